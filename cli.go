@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"novelai-backend/internal/config"
+	"novelai-backend/internal/database"
+	"novelai-backend/internal/service"
+
+	"gorm.io/gorm/logger"
+)
+
+// runCommand 执行命令行子命令
+func runCommand(cfg *config.Config, name string, args []string) error {
+	db, err := database.Open(cfg.DatabasePath, logger.Silent)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	stylePresetService := service.NewStylePresetService(db)
+	if err := stylePresetService.EnsureStylePresetRevisions(); err != nil {
+		return err
+	}
+
+	switch name {
+	case "export-presets":
+		return exportPresets(stylePresetService, args)
+	case "import-presets":
+		return importPresets(stylePresetService, args)
+	case "create-api-key":
+		return createAPIKey(service.NewUserService(db), args)
+	default:
+		return fmt.Errorf("unknown command %q, available commands: export-presets, import-presets, create-api-key", name)
+	}
+}
+
+// exportPresets 导出画风预设：export-presets [-format json|yaml] [-o file]
+func exportPresets(stylePresetService *service.StylePresetService, args []string) error {
+	fs := flag.NewFlagSet("export-presets", flag.ExitOnError)
+	format := fs.String("format", "", "bundle format: json or yaml (default: by output file extension, json)")
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Parse(args)
+
+	if *format == "" {
+		*format = bundleFormatOf(*output)
+	}
+
+	bundle, err := stylePresetService.ExportStylePresets()
+	if err != nil {
+		return err
+	}
+	data, err := service.MarshalStylePresetBundle(bundle, *format)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d style presets to %s\n", len(bundle.Presets), *output)
+	return nil
+}
+
+// importPresets 导入画风预设：import-presets [-strategy skip|overwrite|rename] [-dry-run] [-format json|yaml] file
+// file 为 - 时从标准输入读取，导入报告以 JSON 输出到标准输出
+func importPresets(stylePresetService *service.StylePresetService, args []string) error {
+	fs := flag.NewFlagSet("import-presets", flag.ExitOnError)
+	strategy := fs.String("strategy", service.ImportStrategySkip, "conflict strategy: skip, overwrite or rename")
+	dryRun := fs.Bool("dry-run", false, "print the import report without writing")
+	format := fs.String("format", "", "bundle format: json or yaml (default: by file extension, json)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import-presets [-strategy skip|overwrite|rename] [-dry-run] [-format json|yaml] file")
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = bundleFormatOf(path)
+	}
+
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	bundle, err := service.ParseStylePresetBundle(data, *format)
+	if err != nil {
+		return err
+	}
+	report, err := stylePresetService.ImportStylePresets(bundle, service.StylePresetImportOptions{
+		Strategy: *strategy,
+		DryRun:   *dryRun,
+	})
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	if !report.Valid {
+		return fmt.Errorf("style preset bundle contains invalid presets, nothing was imported")
+	}
+	return nil
+}
+
+// createAPIKey 创建 API 密钥：create-api-key -user name [-scopes generate,keys] [-name label] [-expires 720h]
+// 用户不存在时自动创建，明文密钥输出到标准输出
+func createAPIKey(userService *service.UserService, args []string) error {
+	fs := flag.NewFlagSet("create-api-key", flag.ExitOnError)
+	userName := fs.String("user", "", "user name, created if it does not exist")
+	scopes := fs.String("scopes", service.ScopeGenerate, "comma-separated scopes: "+strings.Join(service.AllScopes, ", "))
+	keyName := fs.String("name", "", "key label")
+	expires := fs.Duration("expires", 0, "key lifetime, e.g. 720h (default: never expires)")
+	fs.Parse(args)
+
+	if *userName == "" {
+		return fmt.Errorf("usage: create-api-key -user name [-scopes generate,keys] [-name label] [-expires 720h]")
+	}
+
+	user, err := userService.FindUserByName(*userName)
+	if errors.Is(err, service.ErrUserNotFound) {
+		user, err = userService.CreateUser(&service.UserInput{Name: *userName})
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Created user %s (id %d)\n", user.Name, user.ID)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	input := &service.APIKeyInput{Name: *keyName}
+	for _, scope := range strings.Split(*scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			input.Scopes = append(input.Scopes, scope)
+		}
+	}
+	if *expires > 0 {
+		expiresAt := time.Now().Add(*expires)
+		input.ExpiresAt = &expiresAt
+	}
+
+	key, plaintext, err := userService.CreateAPIKey(user.ID, input, service.AllScopes)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Created API key %d for user %s with scopes %s\n", key.ID, user.Name, strings.Join(key.Scopes, ","))
+	fmt.Println(plaintext)
+	return nil
+}
+
+// bundleFormatOf 根据文件扩展名判断导出包格式
+func bundleFormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return service.BundleFormatYAML
+	default:
+		return service.BundleFormatJSON
+	}
+}
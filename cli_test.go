@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"novelai-backend/internal/config"
+	"novelai-backend/internal/database"
+	"novelai-backend/internal/model"
+	"novelai-backend/internal/service"
+
+	"gorm.io/gorm/logger"
+)
+
+// captureStdout 执行 fn 并返回其写入标准输出的内容
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	runErr := fn()
+	w.Close()
+	return <-output, runErr
+}
+
+func TestExportImportPresetsCommands(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{DatabasePath: filepath.Join(dir, "test.db")}
+	db, err := database.Open(cfg.DatabasePath, logger.Silent)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if _, err := service.NewStylePresetService(db).CreateStylePreset(&service.StylePresetInput{
+		Name:               "Watercolor",
+		StylePresetContent: model.StylePresetContent{PrefixPrompt: "watercolor"},
+	}); err != nil {
+		t.Fatalf("create preset: %v", err)
+	}
+
+	// 按扩展名导出为 YAML
+	bundlePath := filepath.Join(dir, "presets.yaml")
+	if err := runCommand(cfg, "export-presets", []string{"-o", bundlePath}); err != nil {
+		t.Fatalf("export-presets: %v", err)
+	}
+	data, err := os.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := service.ParseStylePresetBundle(data, service.BundleFormatYAML)
+	if err != nil || len(bundle.Presets) != 1 || bundle.Presets[0].PrefixPrompt != "watercolor" {
+		t.Fatalf("bundle = %+v, err = %v", bundle, err)
+	}
+
+	importPresets := func(args ...string) (*service.StylePresetImportReport, error) {
+		t.Helper()
+		output, err := captureStdout(t, func() error {
+			return runCommand(cfg, "import-presets", args)
+		})
+		var report service.StylePresetImportReport
+		if jsonErr := json.Unmarshal([]byte(output), &report); jsonErr != nil {
+			t.Fatalf("invalid report %q: %v", output, jsonErr)
+		}
+		return &report, err
+	}
+	countPresets := func() int {
+		presets, err := service.NewStylePresetService(db).ListStylePresets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(presets)
+	}
+
+	// 试运行只输出报告
+	report, err := importPresets("-strategy", "rename", "-dry-run", bundlePath)
+	if err != nil || !report.DryRun || report.Created != 1 || report.Items[0].NewName != "Watercolor (2)" {
+		t.Fatalf("dry run report = %+v, err = %v", report, err)
+	}
+	if n := countPresets(); n != 1 {
+		t.Errorf("dry run wrote presets: %d", n)
+	}
+
+	report, err = importPresets("-strategy", "rename", bundlePath)
+	if err != nil || report.Created != 1 {
+		t.Fatalf("report = %+v, err = %v", report, err)
+	}
+	if n := countPresets(); n != 2 {
+		t.Errorf("presets = %d, want 2", n)
+	}
+
+	// 含不合法预设时返回错误且不写入
+	invalidPath := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalidPath, []byte(`{"version": 1, "presets": [{"name": "New"}, {"name": "Bad", "prefix_prompt": "{unclosed"}]}`), 0644)
+	if report, err := importPresets(invalidPath); err == nil || report.Valid {
+		t.Errorf("invalid bundle: report = %+v, err = %v", report, err)
+	}
+	if n := countPresets(); n != 2 {
+		t.Errorf("invalid bundle wrote presets: %d", n)
+	}
+
+	if err := runCommand(cfg, "import-presets", nil); err == nil {
+		t.Error("import-presets without file should fail")
+	}
+	if err := runCommand(cfg, "unknown", nil); err == nil {
+		t.Error("unknown command should fail")
+	}
+}
@@ -3,25 +3,128 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	NovelAIAPIKey   string
-	DatabasePath    string
-	ImagesDir       string
-	Environment     string
-	PrivilegeKey    string
-	TurnstileSecret string
+	NovelAIAPIKey  string
+	NovelAIBaseURL string
+	NovelAITimeout time.Duration
+	DatabasePath   string
+	ImagesDir      string
+	Environment    string
+	AdminKey       string // 管理接口密钥，为空时禁用管理接口
+
+	// 异步生成任务
+	JobWorkers   int
+	JobQueueSize int
+
+	// 限流（令牌桶：桶容量为 Burst，每隔 Interval 补充一个令牌）
+	RateLimitGlobalInterval  time.Duration
+	RateLimitGlobalBurst     int
+	RateLimitIPInterval      time.Duration
+	RateLimitIPBurst         int
+	RateLimitPolicies        string        // 单独配置的路由策略，如 "stream=ip:30s/2;rerun=ip:1m"
+	TurnstileInterval        time.Duration // Turnstile 验证有效期
+	RateLimitStore           string        // 限流状态存储：memory、sqlite 或 redis
+	RateLimitCleanupInterval time.Duration // 清理过期限流记录的间隔
+	RedisURL                 string        // RateLimitStore 为 redis 时的连接地址
+	RedisKeyPrefix           string
+
+	// 人机验证
+	CaptchaProvider      string // turnstile、hcaptcha、recaptcha、local 或 disabled
+	CaptchaSecret        string
+	CaptchaVerifyURL     string   // 为空时使用提供方默认地址
+	CaptchaHostnames     []string // 允许的 hostname，为空时不检查
+	CaptchaAction        string   // 要求的 action，为空时不检查
+	CaptchaMinScore      float64  // reCAPTCHA v3 最低分数
+	CaptchaTimeout       time.Duration
+	CaptchaSessionSecret string // 验证会话 cookie 的签名密钥，为空时使用随机密钥
+	CaptchaCookieSecure  bool   // 会话 cookie 总是带 Secure 属性，反向代理终止 TLS 时开启
+	CaptchaLocalSuffix   bool   // local 模式下接受 "密钥.任意后缀" 形式的 token，不从环境变量读取，仅供测试
+
+	// Anlas 配额（0 表示不限制）：匿名请求按客户端，携带 API 密钥的请求按用户和密钥
+	AnlasQuotaIPDaily     int
+	AnlasQuotaIPMonthly   int
+	AnlasQuotaUserDaily   int
+	AnlasQuotaUserMonthly int
+	AnlasQuotaKeyDaily    int
+	AnlasQuotaKeyMonthly  int
+	AnlasQuotaTimezone    string // 按该时区划分日和月，如 UTC、Asia/Shanghai
+
+	// 客户端 IP 解析
+	TrustedProxies     []string // 可信代理的 IP 或 CIDR，只有来自可信代理的请求才读取转发头
+	TrustedProxyHeader string   // 可信代理设置的转发头：X-Forwarded-For、Forwarded 或 X-Real-IP
+	ClientIPv6Prefix   int      // IPv6 客户端按该前缀长度合并限流
+
+	// 默认生成参数（请求未指定时使用）
+	DefaultModel         string
+	DefaultSampler       string
+	DefaultScale         float64
+	DefaultNoiseSchedule string
+	DefaultSMEA          bool
+	DefaultSMEADyn       bool
+	DefaultCFGRescale    float64
+	DefaultDecrisper     bool
+	DefaultVarietyBoost  bool
 }
 
 func New() *Config {
 	cfg := &Config{
-		NovelAIAPIKey:   getEnv("NOVELAI_API_KEY", ""),
-		DatabasePath:    getEnv("DATABASE_PATH", "./data/novelai.db"),
-		ImagesDir:       getEnv("IMAGES_DIR", "./data/images"),
-		Environment:     getEnv("ENVIRONMENT", "development"),
-		PrivilegeKey:    getEnv("PRIVILEGE_KEY", ""),
-		TurnstileSecret: getEnv("TURNSTILE_SECRET", ""),
+		NovelAIAPIKey:  getEnv("NOVELAI_API_KEY", ""),
+		NovelAIBaseURL: getEnv("NOVELAI_BASE_URL", "https://image.novelai.net"),
+		NovelAITimeout: time.Duration(getEnvInt("NOVELAI_TIMEOUT", 120)) * time.Second,
+		DatabasePath:   getEnv("DATABASE_PATH", "./data/novelai.db"),
+		ImagesDir:      getEnv("IMAGES_DIR", "./data/images"),
+		Environment:    getEnv("ENVIRONMENT", "development"),
+		AdminKey:       getEnv("ADMIN_KEY", ""),
+		JobWorkers:     getEnvInt("JOB_WORKERS", 2),
+		JobQueueSize:   getEnvInt("JOB_QUEUE_SIZE", 100),
+
+		RateLimitGlobalInterval:  time.Duration(getEnvInt("RATE_LIMIT_GLOBAL_INTERVAL", 8)) * time.Second,
+		RateLimitGlobalBurst:     getEnvInt("RATE_LIMIT_GLOBAL_BURST", 1),
+		RateLimitIPInterval:      time.Duration(getEnvInt("RATE_LIMIT_IP_INTERVAL", 15)) * time.Second,
+		RateLimitIPBurst:         getEnvInt("RATE_LIMIT_IP_BURST", 1),
+		RateLimitPolicies:        getEnv("RATE_LIMIT_POLICIES", ""),
+		TurnstileInterval:        time.Duration(getEnvInt("TURNSTILE_INTERVAL", 120)) * time.Second,
+		RateLimitStore:           getEnv("RATE_LIMIT_STORE", "memory"),
+		RateLimitCleanupInterval: time.Duration(getEnvInt("RATE_LIMIT_CLEANUP_INTERVAL", 3600)) * time.Second,
+		RedisURL:                 getEnv("REDIS_URL", "redis://localhost:6379/0"),
+		RedisKeyPrefix:           getEnv("REDIS_KEY_PREFIX", "novelai:"),
+
+		CaptchaProvider:      getEnv("CAPTCHA_PROVIDER", "turnstile"),
+		CaptchaSecret:        getEnv("CAPTCHA_SECRET", getEnv("TURNSTILE_SECRET", "")),
+		CaptchaVerifyURL:     getEnv("CAPTCHA_VERIFY_URL", ""),
+		CaptchaHostnames:     getEnvList("CAPTCHA_HOSTNAMES"),
+		CaptchaAction:        getEnv("CAPTCHA_ACTION", ""),
+		CaptchaMinScore:      getEnvFloat("CAPTCHA_MIN_SCORE", 0.5),
+		CaptchaTimeout:       time.Duration(getEnvInt("CAPTCHA_TIMEOUT", 10)) * time.Second,
+		CaptchaSessionSecret: getEnv("CAPTCHA_SESSION_SECRET", ""),
+		CaptchaCookieSecure:  getEnvBool("CAPTCHA_COOKIE_SECURE", false),
+
+		AnlasQuotaIPDaily:     getEnvInt("ANLAS_QUOTA_IP_DAILY", 0),
+		AnlasQuotaIPMonthly:   getEnvInt("ANLAS_QUOTA_IP_MONTHLY", 0),
+		AnlasQuotaUserDaily:   getEnvInt("ANLAS_QUOTA_USER_DAILY", 0),
+		AnlasQuotaUserMonthly: getEnvInt("ANLAS_QUOTA_USER_MONTHLY", 0),
+		AnlasQuotaKeyDaily:    getEnvInt("ANLAS_QUOTA_KEY_DAILY", 0),
+		AnlasQuotaKeyMonthly:  getEnvInt("ANLAS_QUOTA_KEY_MONTHLY", 0),
+		AnlasQuotaTimezone:    getEnv("ANLAS_QUOTA_TIMEZONE", "UTC"),
+
+		TrustedProxies:     getEnvList("TRUSTED_PROXIES"),
+		TrustedProxyHeader: getEnv("TRUSTED_PROXY_HEADER", "X-Forwarded-For"),
+		ClientIPv6Prefix:   getEnvInt("CLIENT_IPV6_PREFIX", 64),
+
+		DefaultModel:         getEnv("NOVELAI_DEFAULT_MODEL", "nai-diffusion-4-5-full"),
+		DefaultSampler:       getEnv("NOVELAI_DEFAULT_SAMPLER", "k_euler_ancestral"),
+		DefaultScale:         getEnvFloat("NOVELAI_DEFAULT_SCALE", 5),
+		DefaultNoiseSchedule: getEnv("NOVELAI_DEFAULT_NOISE_SCHEDULE", "karras"),
+		DefaultSMEA:          getEnvBool("NOVELAI_DEFAULT_SMEA", false),
+		DefaultSMEADyn:       getEnvBool("NOVELAI_DEFAULT_SMEA_DYN", false),
+		DefaultCFGRescale:    getEnvFloat("NOVELAI_DEFAULT_CFG_RESCALE", 0),
+		DefaultDecrisper:     getEnvBool("NOVELAI_DEFAULT_DECRISPER", true),
+		DefaultVarietyBoost:  getEnvBool("NOVELAI_DEFAULT_VARIETY_BOOST", false),
 	}
 
 	// 确保目录存在
@@ -38,6 +141,44 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvList 读取逗号分隔的列表，忽略空项
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
 func ensureDir(dir string) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		panic(err)
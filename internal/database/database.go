@@ -12,13 +12,20 @@ import (
 
 // Initialize 初始化数据库连接
 func Initialize(databasePath string) (*gorm.DB, error) {
+	return Open(databasePath, logger.Info)
+}
+
+// Open 以指定的 SQL 日志级别初始化数据库连接，命令行子命令使用 logger.Silent 避免日志混入标准输出
+func Open(databasePath string, logLevel logger.LogLevel) (*gorm.DB, error) {
 	// 配置 GORM
 	config := &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+		Logger: logger.Default.LogMode(logLevel),
+		// 将唯一约束等数据库错误转换为 gorm.ErrDuplicatedKey 等通用错误
+		TranslateError: true,
 	}
 
-	// 连接数据库
-	db, err := gorm.Open(sqlite.Open(databasePath), config)
+	// 连接数据库，后台任务与请求并发写入时等待锁而不是立即失败
+	db, err := gorm.Open(sqlite.Open(databasePath+"?_busy_timeout=5000&_journal_mode=WAL"), config)
 	if err != nil {
 		return nil, err
 	}
@@ -37,5 +44,14 @@ func autoMigrate(db *gorm.DB) error {
 	return db.AutoMigrate(
 		&model.ImageGeneration{},
 		&model.StylePreset{},
+		&model.StylePresetRevision{},
+		&model.GenerationJob{},
+		&model.VibeEncoding{},
+		&model.RateLimitBucket{},
+		&model.TurnstileVerification{},
+		&model.CaptchaToken{},
+		&model.User{},
+		&model.APIKey{},
+		&model.AnlasUsage{},
 	)
 }
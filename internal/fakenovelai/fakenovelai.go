@@ -0,0 +1,325 @@
+// Package fakenovelai 提供一个本地的 NovelAI 图像 API 替身，用于测试和离线开发
+package fakenovelai
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Response 预设的一次响应，Status 为 0 时按正常流程返回图像
+type Response struct {
+	Status int           // HTTP 状态码
+	Body   string        // 非 200 时的响应体
+	Delay  time.Duration // 响应前等待的时间
+}
+
+// RateLimited 返回 NovelAI 并发限制时的 429 响应
+func RateLimited() Response {
+	return Error(http.StatusTooManyRequests, "Concurrent generation is locked")
+}
+
+// Error 返回 NovelAI 格式的错误响应
+func Error(status int, message string) Response {
+	body, _ := json.Marshal(map[string]any{
+		"statusCode": status,
+		"message":    message,
+	})
+	return Response{Status: status, Body: string(body)}
+}
+
+// Slow 返回延迟指定时间后的正常响应
+func Slow(delay time.Duration) Response {
+	return Response{Delay: delay}
+}
+
+// Request 记录收到的请求
+type Request struct {
+	Path          string
+	Authorization string
+	Payload       map[string]any
+}
+
+// Server NovelAI API 替身
+type Server struct {
+	*httptest.Server
+
+	// APIKey 不为空时校验 Authorization 头
+	APIKey string
+
+	mu        sync.Mutex
+	responses []Response
+	requests  []Request
+}
+
+// New 启动替身服务，调用方负责 Close
+func New() *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Enqueue 追加预设响应，按顺序用于后续请求，用完后恢复正常响应
+func (s *Server) Enqueue(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, responses...)
+}
+
+// Requests 返回已收到的请求
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// nextResponse 取出下一个预设响应
+func (s *Server) nextResponse() Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.responses) == 0 {
+		return Response{}
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	return resp
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{
+		Path:          r.URL.Path,
+		Authorization: r.Header.Get("Authorization"),
+		Payload:       payload,
+	})
+	s.mu.Unlock()
+
+	resp := s.nextResponse()
+	if resp.Delay > 0 {
+		select {
+		case <-time.After(resp.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if resp.Status != 0 && resp.Status != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.Status)
+		io.WriteString(w, resp.Body)
+		return
+	}
+
+	if s.APIKey != "" && r.Header.Get("Authorization") != "Bearer "+s.APIKey {
+		writeError(w, http.StatusUnauthorized, "Invalid accessToken.")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/ai/generate-image":
+		s.handleGenerateImage(w, payload)
+	case "/ai/generate-image-stream":
+		s.handleGenerateImageStream(w, payload)
+	case "/ai/encode-vibe":
+		s.handleEncodeVibe(w, payload)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleGenerateImage 返回包含 n_samples 张请求尺寸 PNG 的 ZIP，第 i 张的种子为 seed+i
+func (s *Server) handleGenerateImage(w http.ResponseWriter, payload map[string]any) {
+	params, _ := payload["parameters"].(map[string]any)
+	width := intParam(params, "width", 832)
+	height := intParam(params, "height", 1216)
+	if width <= 0 || height <= 0 || width%64 != 0 || height%64 != 0 {
+		writeError(w, http.StatusBadRequest, "width and height must be multiples of 64")
+		return
+	}
+
+	seed := int64(intParam(params, "seed", 0))
+	files := make(map[string][]byte)
+	for i := 0; i < intParam(params, "n_samples", 1); i++ {
+		pngData, err := PNG(width, height, seed+int64(i))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		files[fmt.Sprintf("image_%d.png", i)] = pngData
+	}
+
+	archive, err := Zip(files)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-zip-compressed")
+	w.Write(archive)
+}
+
+// StreamPreviewSteps 流式生成时推送中间预览的步骤
+var StreamPreviewSteps = []int{0, 9, 18}
+
+// handleGenerateImageStream 以 SSE 推送 JPEG 中间预览和最终 PNG（不支持 msgpack）
+func (s *Server) handleGenerateImageStream(w http.ResponseWriter, payload map[string]any) {
+	params, _ := payload["parameters"].(map[string]any)
+	if params["stream"] != "sse" {
+		writeError(w, http.StatusBadRequest, "only stream=sse is supported")
+		return
+	}
+	width := intParam(params, "width", 832)
+	height := intParam(params, "height", 1216)
+	seed := int64(intParam(params, "seed", 0))
+
+	pngData, err := PNG(width, height, seed)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	decoded, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var preview bytes.Buffer
+	if err := jpeg.Encode(&preview, decoded, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	writeEvent := func(event map[string]any) {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event["event_type"], data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	for _, step := range StreamPreviewSteps {
+		writeEvent(map[string]any{
+			"event_type": "intermediate",
+			"samp_ix":    0,
+			"step_ix":    step,
+			"gen_id":     "fake",
+			"sigma":      1.0 / float64(step+1),
+			"image":      base64.StdEncoding.EncodeToString(preview.Bytes()),
+		})
+	}
+	writeEvent(map[string]any{
+		"event_type": "final",
+		"samp_ix":    0,
+		"gen_id":     "fake",
+		"image":      base64.StdEncoding.EncodeToString(pngData),
+	})
+}
+
+// handleEncodeVibe 返回由图像、模型和信息提取度决定的伪编码
+func (s *Server) handleEncodeVibe(w http.ResponseWriter, payload map[string]any) {
+	imageData, _ := payload["image"].(string)
+	model, _ := payload["model"].(string)
+	if imageData == "" || model == "" {
+		writeError(w, http.StatusBadRequest, "image and model are required")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(VibeEncoding(imageData, model, payload["information_extracted"]))
+}
+
+// VibeEncoding 返回替身服务对给定参数的编码结果
+func VibeEncoding(imageData, model string, informationExtracted any) []byte {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%v", imageData, model, informationExtracted)))
+	return sum[:]
+}
+
+// PNG 生成指定尺寸的纯色 PNG，颜色由 seed 决定
+func PNG(width, height int, seed int64) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	c := color.RGBA{R: uint8(seed), G: uint8(seed >> 8), B: uint8(seed >> 16), A: 255}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode png: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Zip 将文件按名称顺序打包为 ZIP
+func Zip(files map[string][]byte) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// intParam 读取 JSON 数字参数
+func intParam(params map[string]any, key string, defaultValue int) int {
+	if v, ok := params[key].(float64); ok {
+		return int(v)
+	}
+	return defaultValue
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(map[string]any{
+		"statusCode": status,
+		"message":    message,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -1,10 +1,20 @@
 package handler
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"time"
 
+	"novelai-backend/internal/middleware"
+	"novelai-backend/internal/model"
 	"novelai-backend/internal/service"
 
 	"github.com/gin-gonic/gin"
@@ -13,16 +23,22 @@ import (
 // ImageHandler 图像处理器
 type ImageHandler struct {
 	novelaiService     *service.NovelAIService
+	generationService  *service.GenerationService
+	jobService         *service.JobService
 	imageService       *service.ImageService
 	stylePresetService *service.StylePresetService
+	quotaService       *service.QuotaService
 }
 
 // NewImageHandler 创建图像处理器实例
-func NewImageHandler(novelaiService *service.NovelAIService, imageService *service.ImageService, stylePresetService *service.StylePresetService) *ImageHandler {
+func NewImageHandler(novelaiService *service.NovelAIService, generationService *service.GenerationService, jobService *service.JobService, imageService *service.ImageService, stylePresetService *service.StylePresetService, quotaService *service.QuotaService) *ImageHandler {
 	return &ImageHandler{
 		novelaiService:     novelaiService,
+		generationService:  generationService,
+		jobService:         jobService,
 		imageService:       imageService,
 		stylePresetService: stylePresetService,
+		quotaService:       quotaService,
 	}
 }
 
@@ -34,15 +50,94 @@ type GenerateImageRequest struct {
 	Steps          int    `json:"steps"`           // 默认 28
 	Width          int    `json:"width"`           // 默认 832
 	Height         int    `json:"height"`          // 默认 1216
-	StylePresetID  *uint  `json:"style_preset_id"` // 预设画风 ID，可为空
+	NSamples       int    `json:"n_samples"`       // 生成数量，默认 1，最多 4
+	StylePresetID  *uint  `json:"style_preset_id"` // 预设画风 ID，可为空；与 style_presets 不能同时指定
+	Async          bool   `json:"async"`           // 为 true 时加入任务队列并立即返回任务 ID
+
+	// 按顺序叠加的画风预设
+	StylePresets []StylePresetLayerRequest `json:"style_presets"`
+
+	// 画风预设模板变量，如 {"style": "watercolor"}，由叠加的所有预设共享
+	PresetVariables map[string]string `json:"preset_variables"`
+
+	// 采样参数，未指定时使用服务端默认值
+	Model         string   `json:"model"`
+	Sampler       string   `json:"sampler"`
+	Scale         *float64 `json:"scale"`
+	NoiseSchedule string   `json:"noise_schedule"`
+	SMEA          *bool    `json:"sm"`
+	SMEADyn       *bool    `json:"sm_dyn"`
+	CFGRescale    *float64 `json:"cfg_rescale"`
+	Decrisper     *bool    `json:"decrisper"`
+	VarietyBoost  *bool    `json:"variety_boost"`
+	QualityToggle *bool    `json:"quality_toggle"` // 默认 false
+	UCPreset      *int     `json:"uc_preset"`      // 默认 0
+
+	// V4 多角色提示词
+	Characters []model.CharacterPrompt `json:"characters"`
+
+	// img2img / 局部重绘参数
+	Action             string   `json:"action" binding:"omitempty,oneof=generate img2img infill"` // 默认 generate
+	Image              string   `json:"image"`                                                    // 源图像 base64，可带 data URL 前缀
+	SourceGenerationID *uint    `json:"source_generation_id"`                                     // 使用历史生成的图像作为源图像
+	Strength           *float64 `json:"strength"`                                                 // 默认 0.7
+	Noise              *float64 `json:"noise"`                                                    // 默认 0
+	Mask               string   `json:"mask"`                                                     // 局部重绘蒙版 base64，白色为重绘区域
+	MaskGenerationID   *uint    `json:"mask_generation_id"`                                       // 使用历史局部重绘的蒙版
+	AddOriginalImage   *bool    `json:"add_original_image"`                                       // 未重绘区域覆盖为原图，默认 true
+
+	// 风格参考（vibe transfer）
+	References []ReferenceImageRequest `json:"references"`
+
+	// 重新生成时使用记录中的叠加预设及其修订版本，为 nil 时按请求解析预设的当前版本
+	resolvedPresets []resolvedStylePreset
+}
+
+// StylePresetLayerRequest 叠加的画风预设
+type StylePresetLayerRequest struct {
+	ID      uint     `json:"id"`
+	Weight  *float64 `json:"weight"`  // 预设文本的权重，默认 1
+	Enabled *bool    `json:"enabled"` // 为 false 时跳过（仍保存在生成记录中），默认 true
+}
+
+// resolvedStylePreset 解析后的叠加画风预设，跳过的预设 revision 为 nil
+type resolvedStylePreset struct {
+	applied  model.AppliedStylePreset
+	revision *model.StylePresetRevision
 }
 
-// GenerateImageResponse 生成图像响应
+// ReferenceImageRequest 风格参考图像参数，image 与 generation_id 二选一
+type ReferenceImageRequest struct {
+	Image                string   `json:"image"`                 // 参考图像 base64，可带 data URL 前缀
+	GenerationID         *uint    `json:"generation_id"`         // 使用历史生成的图像作为参考
+	Strength             *float64 `json:"strength"`              // 默认 0.6
+	InformationExtracted *float64 `json:"information_extracted"` // 默认 1
+}
+
+// GenerateImageResponse 生成图像响应，ID、ImageURL 和 Seed 为批次中的第一张图像
 type GenerateImageResponse struct {
+	ID       uint             `json:"id"`
+	ImageURL string           `json:"image_url"`
+	Seed     int64            `json:"seed"`
+	BatchID  string           `json:"batch_id"`
+	Images   []GeneratedImage `json:"images"`
+	Message  string           `json:"message"`
+}
+
+// GeneratedImage 批次中的单张图像
+type GeneratedImage struct {
 	ID       uint   `json:"id"`
 	ImageURL string `json:"image_url"`
 	Seed     int64  `json:"seed"`
-	Message  string `json:"message"`
+}
+
+// EnqueueImageResponse 异步生成图像响应
+type EnqueueImageResponse struct {
+	JobID         uint   `json:"job_id"`
+	Status        string `json:"status"`
+	QueuePosition int64  `json:"queue_position"`
+	StatusURL     string `json:"status_url"`
+	Message       string `json:"message"`
 }
 
 // GenerateImage 生成图像
@@ -53,117 +148,784 @@ func (h *ImageHandler) GenerateImage(c *gin.Context) {
 		return
 	}
 
-	// 设置默认值
-	if req.Steps <= 0 {
-		req.Steps = 28
-	}
-	if req.Width <= 0 {
-		req.Width = 832
+	task, err := h.buildGenerationTask(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	if req.Height <= 0 {
-		req.Height = 1216
+
+	h.runGeneration(c, task, req.Async || c.Query("async") == "true")
+}
+
+// runGeneration 执行生成任务并写入响应，async 为 true 时加入任务队列
+func (h *ImageHandler) runGeneration(c *gin.Context, task *service.GenerationTask, async bool) {
+	task.UserID = currentUserID(c)
+	if !h.reserveQuota(c, task) {
+		return
 	}
-	if req.NegativePrompt == "" {
-		req.NegativePrompt = "bad anatomy, bad hands, text, error, missing fingers, extra digit, fewer digits, cropped, worst quality, low quality, normal quality, jpeg artifacts, signature, watermark, username, blurry"
+	if async {
+		h.enqueueGeneration(c, task)
+		return
 	}
 
-	// 应用画风预设
-	finalPrompt := req.Prompt
-	finalNegativePrompt := req.NegativePrompt
-
-	if req.StylePresetID != nil && *req.StylePresetID > 0 {
-		preset, err := h.stylePresetService.GetStylePresetByID(*req.StylePresetID)
-		if err == nil {
-			// 应用前缀和后缀
-			if preset.PrefixPrompt != "" {
-				finalPrompt = preset.PrefixPrompt + finalPrompt
+	generations, err := h.generationService.Run(task, nil)
+	if err != nil {
+		var genErr *service.GenerationError
+		if errors.As(err, &genErr) {
+			response := gin.H{
+				"error":   "Failed to generate image",
+				"details": err.Error(),
 			}
-			if preset.SuffixPrompt != "" {
-				finalPrompt = finalPrompt + preset.SuffixPrompt
+			if genErr.Generation != nil {
+				response["id"] = genErr.Generation.ID
 			}
-			if preset.PrefixNegativePrompt != "" {
-				finalNegativePrompt = preset.PrefixNegativePrompt + finalNegativePrompt
+			c.JSON(http.StatusInternalServerError, response)
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to save image",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, newGenerateImageResponse(generations))
+}
+
+// RerunImageRequest 重新生成请求
+type RerunImageRequest struct {
+	Seed  *int64 `json:"seed"` // 默认使用原记录的种子，-1 表示随机
+	Async bool   `json:"async"`
+}
+
+// RerunImage 使用历史生成记录的参数和当时的画风预设修订版本重新生成一张图像
+func (h *ImageHandler) RerunImage(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	// 请求体可以为空
+	var body RerunImageRequest
+	if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	generation, err := h.imageService.GetImageGeneration(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	req, err := h.rerunRequest(generation)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Seed != nil {
+		req.Seed = *body.Seed
+	}
+
+	task, err := h.buildGenerationTask(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// 还原的请求显式指定了全部参数，参数来源沿用原记录
+	maps.Copy(task.ParamSources, generation.ParamSources)
+
+	h.runGeneration(c, task, body.Async || c.Query("async") == "true")
+}
+
+// rerunRequest 根据生成记录还原生成请求，所有参数显式指定，画风预设使用记录中的修订版本
+func (h *ImageHandler) rerunRequest(generation *model.ImageGeneration) (*GenerateImageRequest, error) {
+	req := &GenerateImageRequest{
+		Prompt:          generation.Prompt,
+		NegativePrompt:  generation.NegativePrompt,
+		Seed:            generation.Seed,
+		Steps:           generation.Steps,
+		Width:           generation.Width,
+		Height:          generation.Height,
+		NSamples:        1,
+		PresetVariables: generation.PresetVariables,
+		Model:           generation.Model,
+		Sampler:         generation.Sampler,
+		Scale:           &generation.Scale,
+		NoiseSchedule:   generation.NoiseSchedule,
+		SMEA:            &generation.SMEA,
+		SMEADyn:         &generation.SMEADyn,
+		CFGRescale:      &generation.CFGRescale,
+		Decrisper:       &generation.Decrisper,
+		VarietyBoost:    &generation.VarietyBoost,
+		QualityToggle:   &generation.QualityToggle,
+		UCPreset:        &generation.UCPreset,
+		Characters:      generation.Characters,
+	}
+
+	switch {
+	case len(generation.StylePresets) > 0:
+		req.resolvedPresets = make([]resolvedStylePreset, 0, len(generation.StylePresets))
+		for _, applied := range generation.StylePresets {
+			resolved := resolvedStylePreset{applied: applied}
+			if applied.Enabled {
+				revision, err := h.stylePresetService.GetRevision(applied.RevisionID)
+				if err != nil {
+					return nil, fmt.Errorf("style preset revision %d not found", applied.RevisionID)
+				}
+				resolved.revision = revision
 			}
-			if preset.SuffixNegativePrompt != "" {
-				finalNegativePrompt = finalNegativePrompt + preset.SuffixNegativePrompt
+			req.resolvedPresets = append(req.resolvedPresets, resolved)
+		}
+	case generation.StylePresetID != nil:
+		if generation.StylePresetRevisionID == nil {
+			return nil, fmt.Errorf("generation %d has no style preset revision recorded and cannot be rerun", generation.ID)
+		}
+		revision, err := h.stylePresetService.GetRevision(*generation.StylePresetRevisionID)
+		if err != nil {
+			return nil, fmt.Errorf("style preset revision %d not found", *generation.StylePresetRevisionID)
+		}
+		req.resolvedPresets = []resolvedStylePreset{{
+			applied:  model.AppliedStylePreset{StylePresetID: revision.StylePresetID, RevisionID: revision.ID, Weight: 1, Enabled: true},
+			revision: revision,
+		}}
+	}
+
+	if generation.Action == service.ActionImg2Img || generation.Action == service.ActionInfill {
+		req.Action = generation.Action
+		req.Strength = &generation.Strength
+		req.Noise = &generation.Noise
+		if generation.SourceGenerationID != nil {
+			req.SourceGenerationID = generation.SourceGenerationID
+		} else {
+			data, err := h.imageService.ReadInputImage(generation.SourceFilePath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read source image: %w", err)
 			}
+			req.Image = base64.StdEncoding.EncodeToString(data)
+		}
+	}
+	if generation.Action == service.ActionInfill {
+		data, err := h.imageService.ReadInputImage(generation.MaskFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mask: %w", err)
 		}
+		req.Mask = base64.StdEncoding.EncodeToString(data)
+		req.AddOriginalImage = &generation.AddOriginalImage
 	}
 
-	// 记录开始时间
-	startTime := time.Now()
+	// 直接上传的参考图像只保存了哈希，无法还原
+	for _, ref := range generation.References {
+		if ref.GenerationID == nil {
+			return nil, fmt.Errorf("generation %d uses an uploaded reference image that is not stored and cannot be rerun", generation.ID)
+		}
+		req.References = append(req.References, ReferenceImageRequest{
+			GenerationID:         ref.GenerationID,
+			Strength:             &ref.Strength,
+			InformationExtracted: &ref.InformationExtracted,
+		})
+	}
+
+	return req, nil
+}
 
-	// 调用 NovelAI API
-	novelaiReq := &service.GenerationRequest{
-		Prompt:         finalPrompt,
-		NegativePrompt: finalNegativePrompt,
-		Seed:           req.Seed,
-		Steps:          req.Steps,
-		Width:          req.Width,
-		Height:         req.Height,
+// newGenerateImageResponse 根据批次的生成记录构建响应
+func newGenerateImageResponse(generations []*model.ImageGeneration) *GenerateImageResponse {
+	// 构建图像 URL
+	images := make([]GeneratedImage, len(generations))
+	for i, generation := range generations {
+		images[i] = GeneratedImage{
+			ID:       generation.ID,
+			ImageURL: "/files/" + generation.FilePath,
+			Seed:     generation.Seed,
+		}
 	}
 
-	imageData, originalPayload, err := h.novelaiService.GenerateImage(novelaiReq)
+	return &GenerateImageResponse{
+		ID:       images[0].ID,
+		ImageURL: images[0].ImageURL,
+		Seed:     images[0].Seed,
+		BatchID:  generations[0].BatchID,
+		Images:   images,
+		Message:  "Image generated successfully",
+	}
+}
+
+// StreamGenerateImage 流式生成图像，以 SSE 推送中间预览和最终结果
+// 请求参数与 GenerateImage 相同（不支持 async），只支持生成一张图像
+func (h *ImageHandler) StreamGenerateImage(c *gin.Context) {
+	var req GenerateImageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.NSamples > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "streaming generation supports only one sample"})
+		return
+	}
+
+	task, err := h.buildGenerationTask(&req)
 	if err != nil {
-		// 保存失败记录 - 使用用户原始输入，不包含预设文本
-		generation, _ := h.imageService.SaveFailedGeneration(
-			req.Prompt,
-			req.NegativePrompt,
-			req.Seed,
-			req.Steps,
-			req.Width,
-			req.Height,
-			req.StylePresetID,
-			originalPayload,
-			err.Error(),
-		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	task.Stream = true
+	task.UserID = currentUserID(c)
+	if !h.reserveQuota(c, task) {
+		return
+	}
 
-		c.JSON(http.StatusInternalServerError, gin.H{
+	// 客户端断开后继续生成并保存结果，只是不再推送
+	stream := newSSEJobStream(c)
+	send := func(eventType string, data any) {
+		stream.Send(&service.JobEvent{Type: eventType, Data: data, Time: time.Now()})
+	}
+
+	generations, err := h.generationService.Run(task, send)
+	if err != nil {
+		data := gin.H{
 			"error":   "Failed to generate image",
 			"details": err.Error(),
-			"id":      generation.ID,
+		}
+		var genErr *service.GenerationError
+		if !errors.As(err, &genErr) {
+			data["error"] = "Failed to save image"
+		} else if genErr.Generation != nil {
+			data["id"] = genErr.Generation.ID
+		}
+		send(service.JobEventFailed, data)
+		return
+	}
+
+	send(service.JobEventCompleted, newGenerateImageResponse(generations))
+}
+
+// EstimateGenerationResponse Anlas 消耗估算响应
+type EstimateGenerationResponse struct {
+	Anlas  int                   `json:"anlas"`  // 本次请求预计消耗的 Anlas
+	Quotas []service.QuotaStatus `json:"quotas"` // 当前客户端的配额使用情况
+}
+
+// EstimateGeneration 估算生成请求消耗的 Anlas，参数与生成接口相同，不调用 NovelAI
+func (h *ImageHandler) EstimateGeneration(c *gin.Context) {
+	var req GenerateImageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, err := h.buildGenerationTask(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	quotas, err := h.quotaService.Status(quotaSubject(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get quota",
+			"details": err.Error(),
 		})
 		return
 	}
 
-	// 计算生成时间
-	generationTime := int(time.Since(startTime).Milliseconds())
-
-	// 保存成功记录
-	generation, err := h.imageService.SaveImageGeneration(
-		req.Prompt,
-		req.NegativePrompt,
-		novelaiReq.Seed, // 使用实际的种子值（可能是随机生成的）
-		req.Steps,
-		req.Width,
-		req.Height,
-		req.StylePresetID,
-		originalPayload,
-		imageData,
-	)
+	c.JSON(http.StatusOK, EstimateGenerationResponse{
+		Anlas:  service.EstimateAnlasCost(&task.Request),
+		Quotas: quotas,
+	})
+}
+
+// 配额错误消息中的周期和统计对象名称
+var (
+	quotaPeriodNames  = map[string]string{service.QuotaPeriodDay: "Daily", service.QuotaPeriodMonth: "Monthly"}
+	quotaSubjectNames = map[string]string{service.QuotaSubjectIP: "this client", service.QuotaSubjectUser: "this user", service.QuotaSubjectKey: "this API key"}
+)
+
+// reserveQuota 估算任务消耗的 Anlas 并预留配额，超出配额或预留失败时写入错误响应并返回 false
+func (h *ImageHandler) reserveQuota(c *gin.Context, task *service.GenerationTask) bool {
+	cost := service.EstimateAnlasCost(&task.Request)
+	usage, err := h.quotaService.Reserve(quotaSubject(c), cost)
+	var exceeded *service.QuotaExceededError
+	if errors.As(err, &exceeded) {
+		retryAfter := time.Until(exceeded.Status.ResetAt)
+		c.Header("Retry-After", strconv.FormatInt(int64(retryAfter.Seconds())+1, 10))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": fmt.Sprintf("%s Anlas quota for %s exceeded: %d of %d used, this request costs %d.",
+				quotaPeriodNames[exceeded.Status.Period], quotaSubjectNames[exceeded.Status.Subject],
+				exceeded.Status.Used, *exceeded.Status.Limit, cost),
+			"code":           "QUOTA_EXCEEDED",
+			"quota":          exceeded.Status,
+			"cost":           cost,
+			"retry_after_ms": retryAfter.Milliseconds(),
+		})
+		return false
+	}
+	if errors.Is(err, service.ErrQuotaConflict) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Too many concurrent requests for this quota, please retry",
+			"code":  "QUOTA_BUSY",
+		})
+		return false
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to save image",
+			"error":   "Failed to check quota",
 			"details": err.Error(),
 		})
+		return false
+	}
+	task.AnlasUsageID = &usage.ID
+	return true
+}
+
+// releaseQuota 任务未执行时退还预留的配额
+func (h *ImageHandler) releaseQuota(task *service.GenerationTask) {
+	if task.AnlasUsageID == nil {
 		return
 	}
+	if err := h.quotaService.Release(*task.AnlasUsageID); err != nil {
+		log.Printf("Failed to release anlas usage %d: %v", *task.AnlasUsageID, err)
+	}
+}
 
-	// 更新生成时间
-	generation.GenerationTime = generationTime
-	h.imageService.UpdateGenerationTime(generation.ID, generationTime)
+// currentUserID 返回当前 API 密钥所属的用户 ID，匿名请求返回 nil
+func currentUserID(c *gin.Context) *uint {
+	if key := middleware.CurrentAPIKey(c); key != nil {
+		return &key.UserID
+	}
+	return nil
+}
 
-	// 构建图像 URL
-	imageURL := "/files/" + generation.FilePath
+// enqueueGeneration 将生成任务加入队列
+func (h *ImageHandler) enqueueGeneration(c *gin.Context, task *service.GenerationTask) {
+	job, err := h.jobService.Enqueue(task)
+	if err != nil {
+		h.releaseQuota(task)
+		if errors.Is(err, service.ErrJobQueueFull) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Generation queue is full, please try again later",
+				"code":  "QUEUE_FULL",
+			})
+			return
+		}
 
-	c.JSON(http.StatusOK, GenerateImageResponse{
-		ID:       generation.ID,
-		ImageURL: imageURL,
-		Seed:     generation.Seed,
-		Message:  "Image generated successfully",
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to enqueue generation",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	position, _ := h.jobService.QueuePosition(job)
+
+	c.JSON(http.StatusAccepted, EnqueueImageResponse{
+		JobID:         job.ID,
+		Status:        job.Status,
+		QueuePosition: position,
+		StatusURL:     "/api/jobs/" + strconv.FormatUint(uint64(job.ID), 10),
+		Message:       "Generation job queued",
 	})
 }
 
+// defaultNegativePrompt 请求未指定负面提示词时使用的默认值
+const defaultNegativePrompt = "bad anatomy, bad hands, text, error, missing fingers, extra digit, fewer digits, cropped, worst quality, low quality, normal quality, jpeg artifacts, signature, watermark, username, blurry"
+
+// buildGenerationTask 设置默认值并应用画风预设，构建并校验生成任务
+// 生成参数的优先级：请求中显式指定 > img2img 源图像尺寸 > 画风预设 > 服务端默认值
+func (h *ImageHandler) buildGenerationTask(req *GenerateImageRequest) (*service.GenerationTask, error) {
+	// 叠加的画风预设及其固定的生成参数
+	presets, err := h.resolveStylePresets(req)
+	if err != nil {
+		return nil, err
+	}
+	var layers []service.StylePresetLayer
+	for _, preset := range presets {
+		if preset.revision != nil {
+			layers = append(layers, service.StylePresetLayer{Content: &preset.revision.StylePresetContent, Weight: preset.applied.Weight})
+		}
+	}
+	pinned := service.MergeStylePresetParameters(layers)
+	sources := map[string]string{}
+
+	// img2img / 局部重绘源图像，未指定尺寸时使用源图像尺寸
+	var source *sourceImage
+	if req.Action == service.ActionImg2Img || req.Action == service.ActionInfill {
+		var err error
+		if source, err = h.resolveSourceImage(req); err != nil {
+			return nil, err
+		}
+		if (req.Width > 0 && req.Width != source.width) || (req.Height > 0 && req.Height != source.height) {
+			return nil, fmt.Errorf("source image size %dx%d does not match %dx%d", source.width, source.height, req.Width, req.Height)
+		}
+		if source.width%64 != 0 || source.height%64 != 0 {
+			return nil, fmt.Errorf("source image size %dx%d must be a multiple of 64", source.width, source.height)
+		}
+	}
+
+	// 局部重绘蒙版
+	var mask *maskImage
+	if req.Action == service.ActionInfill {
+		var err error
+		if mask, err = h.resolveMask(req, source); err != nil {
+			return nil, err
+		}
+	}
+
+	// 风格参考图像
+	references, err := h.resolveReferences(req.References)
+	if err != nil {
+		return nil, err
+	}
+
+	// 步数和尺寸，img2img 的尺寸由源图像决定，不使用预设的值
+	steps := pickParam(sources, "steps", nonZero(req.Steps), pinned.Steps, service.DefaultSteps)
+	var width, height int
+	if source != nil {
+		// 请求中指定的尺寸已确认与源图像一致
+		width, height = source.width, source.height
+		sizeSource := service.ParamSourceSourceImage
+		if req.Width > 0 || req.Height > 0 {
+			sizeSource = service.ParamSourceRequest
+		}
+		sources["width"], sources["height"] = sizeSource, sizeSource
+	} else {
+		width = pickParam(sources, "width", nonZero(req.Width), pinned.Width, service.DefaultWidth)
+		height = pickParam(sources, "height", nonZero(req.Height), pinned.Height, service.DefaultHeight)
+	}
+	if req.NSamples <= 0 {
+		req.NSamples = 1
+	}
+
+	// 负面提示词，预设为 replace 模式时只使用预设的负面提示词
+	negativePrompt := req.NegativePrompt
+	switch {
+	case pinned.NegativePromptMode == service.NegativePromptModeReplace:
+		negativePrompt = ""
+		sources["negative_prompt"] = service.ParamSourcePreset
+	case negativePrompt != "":
+		sources["negative_prompt"] = service.ParamSourceRequest
+	default:
+		negativePrompt = defaultNegativePrompt
+		sources["negative_prompt"] = service.ParamSourceDefault
+	}
+
+	// 应用画风预设
+	finalPrompt := req.Prompt
+	finalNegativePrompt := negativePrompt
+	if len(layers) > 0 {
+		result, err := service.ComposeStylePresets(layers, req.Prompt, negativePrompt, req.PresetVariables)
+		if err != nil {
+			return nil, err
+		}
+		finalPrompt = result.Prompt
+		finalNegativePrompt = result.NegativePrompt
+	}
+
+	task := &service.GenerationTask{
+		Prompt:         req.Prompt,
+		NegativePrompt: negativePrompt,
+		StylePresetID:  req.StylePresetID,
+		ParamSources:   sources,
+		Request: service.GenerationRequest{
+			Prompt:         finalPrompt,
+			NegativePrompt: finalNegativePrompt,
+			Seed:           req.Seed,
+			Steps:          steps,
+			Width:          width,
+			Height:         height,
+			NSamples:       req.NSamples,
+			Characters:     req.Characters,
+			References:     references,
+		},
+	}
+	h.applySamplingParameters(req, pinned, &task.Request, sources)
+
+	if len(presets) > 0 {
+		task.StylePresets = make([]model.AppliedStylePreset, len(presets))
+		for i, preset := range presets {
+			task.StylePresets[i] = preset.applied
+		}
+	}
+	for _, preset := range presets {
+		if preset.revision != nil {
+			task.StylePresetID = &preset.revision.StylePresetID
+			task.StylePresetRevisionID = &preset.revision.ID
+			task.PresetVariables = req.PresetVariables
+			break
+		}
+	}
+
+	if source != nil {
+		task.Request.Action = req.Action
+		task.Request.Image = source.data
+		task.Request.Strength = valueOr(req.Strength, service.DefaultImg2ImgStrength)
+		task.Request.Noise = valueOr(req.Noise, 0)
+		task.SourceGenerationID = source.generationID
+		task.SourceFilePath = source.filePath
+	}
+	if mask != nil {
+		task.Request.Mask = mask.data
+		task.Request.AddOriginalImage = valueOr(req.AddOriginalImage, true)
+		task.MaskFilePath = mask.filePath
+	}
+
+	if err := service.ValidateGenerationRequest(&task.Request); err != nil {
+		return nil, err
+	}
+
+	return task, nil
+}
+
+// resolveStylePresets 解析叠加的画风预设
+// style_preset_id 指定的单个预设不存在或已禁用时忽略，style_presets 中启用的预设不存在或已禁用时返回错误
+func (h *ImageHandler) resolveStylePresets(req *GenerateImageRequest) ([]resolvedStylePreset, error) {
+	if req.resolvedPresets != nil {
+		return req.resolvedPresets, nil
+	}
+
+	if req.StylePresetID != nil && *req.StylePresetID > 0 {
+		if len(req.StylePresets) > 0 {
+			return nil, fmt.Errorf("style_preset_id and style_presets cannot be used together")
+		}
+		revision, err := h.stylePresetService.CurrentRevision(*req.StylePresetID)
+		if err != nil {
+			return nil, nil
+		}
+		return []resolvedStylePreset{{
+			applied:  model.AppliedStylePreset{StylePresetID: revision.StylePresetID, RevisionID: revision.ID, Weight: 1, Enabled: true},
+			revision: revision,
+		}}, nil
+	}
+
+	if len(req.StylePresets) > service.MaxStackedStylePresets {
+		return nil, fmt.Errorf("at most %d style presets can be stacked", service.MaxStackedStylePresets)
+	}
+	presets := make([]resolvedStylePreset, 0, len(req.StylePresets))
+	seen := map[uint]bool{}
+	for _, layer := range req.StylePresets {
+		if layer.ID == 0 {
+			return nil, fmt.Errorf("style preset id is required")
+		}
+		if seen[layer.ID] {
+			return nil, fmt.Errorf("style preset %d is listed more than once", layer.ID)
+		}
+		seen[layer.ID] = true
+
+		applied := model.AppliedStylePreset{
+			StylePresetID: layer.ID,
+			Weight:        valueOr(layer.Weight, 1),
+			Enabled:       valueOr(layer.Enabled, true),
+		}
+		if err := service.ValidateStylePresetWeight(applied.Weight); err != nil {
+			return nil, err
+		}
+
+		resolved := resolvedStylePreset{applied: applied}
+		if applied.Enabled {
+			revision, err := h.stylePresetService.CurrentRevision(layer.ID)
+			if err != nil {
+				return nil, fmt.Errorf("style preset %d not found", layer.ID)
+			}
+			resolved.applied.RevisionID = revision.ID
+			resolved.revision = revision
+		}
+		presets = append(presets, resolved)
+	}
+	return presets, nil
+}
+
+// sourceImage img2img 源图像
+type sourceImage struct {
+	data          []byte // PNG 数据
+	width, height int
+	generationID  *uint  // 来自历史生成时的记录 ID
+	filePath      string // 来自历史生成时的文件相对路径
+}
+
+// resolveSourceImage 读取上传的或历史生成的源图像
+func (h *ImageHandler) resolveSourceImage(req *GenerateImageRequest) (*sourceImage, error) {
+	source := &sourceImage{}
+
+	var raw []byte
+	switch {
+	case req.SourceGenerationID != nil:
+		generation, err := h.imageService.GetImageGeneration(*req.SourceGenerationID)
+		if err != nil || generation.Status != model.StatusSuccess {
+			return nil, fmt.Errorf("source generation %d not found", *req.SourceGenerationID)
+		}
+		if raw, err = h.imageService.ReadImageFile(generation); err != nil {
+			return nil, fmt.Errorf("failed to read source generation %d: %w", generation.ID, err)
+		}
+		source.generationID = &generation.ID
+		source.filePath = generation.FilePath
+	case req.Image != "":
+		var err error
+		if raw, err = service.DecodeBase64Image(req.Image); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("img2img requires image or source_generation_id")
+	}
+
+	var err error
+	source.data, source.width, source.height, err = service.NormalizeSourceImage(raw)
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// resolveReferences 读取上传的或历史生成的风格参考图像
+func (h *ImageHandler) resolveReferences(refs []ReferenceImageRequest) ([]service.ReferenceImage, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	if len(refs) > service.MaxReferences {
+		return nil, fmt.Errorf("too many reference images, maximum %d", service.MaxReferences)
+	}
+
+	references := make([]service.ReferenceImage, 0, len(refs))
+	for i, ref := range refs {
+		var raw []byte
+		var generationID *uint
+		switch {
+		case ref.GenerationID != nil:
+			generation, err := h.imageService.GetImageGeneration(*ref.GenerationID)
+			if err != nil || generation.Status != model.StatusSuccess {
+				return nil, fmt.Errorf("reference generation %d not found", *ref.GenerationID)
+			}
+			if raw, err = h.imageService.ReadImageFile(generation); err != nil {
+				return nil, fmt.Errorf("failed to read reference generation %d: %w", generation.ID, err)
+			}
+			generationID = &generation.ID
+		case ref.Image != "":
+			var err error
+			if raw, err = service.DecodeBase64Image(ref.Image); err != nil {
+				return nil, fmt.Errorf("reference %d: %w", i+1, err)
+			}
+		default:
+			return nil, fmt.Errorf("reference %d requires image or generation_id", i+1)
+		}
+
+		data, _, _, err := service.NormalizeSourceImage(raw)
+		if err != nil {
+			return nil, fmt.Errorf("reference %d: %w", i+1, err)
+		}
+		references = append(references, service.ReferenceImage{
+			Image:                data,
+			GenerationID:         generationID,
+			Strength:             valueOr(ref.Strength, service.DefaultReferenceStrength),
+			InformationExtracted: valueOr(ref.InformationExtracted, service.DefaultReferenceInformationExtract),
+		})
+	}
+	return references, nil
+}
+
+// maskImage 局部重绘蒙版
+type maskImage struct {
+	data     []byte // 处理后的 PNG 数据
+	filePath string // 来自历史生成时的文件相对路径
+}
+
+// resolveMask 读取上传的或历史局部重绘的蒙版，并按源图像尺寸处理
+func (h *ImageHandler) resolveMask(req *GenerateImageRequest, source *sourceImage) (*maskImage, error) {
+	mask := &maskImage{}
+
+	var raw []byte
+	switch {
+	case req.MaskGenerationID != nil:
+		generation, err := h.imageService.GetImageGeneration(*req.MaskGenerationID)
+		if err != nil || generation.MaskFilePath == "" {
+			return nil, fmt.Errorf("mask generation %d not found", *req.MaskGenerationID)
+		}
+		if raw, err = h.imageService.ReadInputImage(generation.MaskFilePath); err != nil {
+			return nil, fmt.Errorf("failed to read mask of generation %d: %w", generation.ID, err)
+		}
+		mask.filePath = generation.MaskFilePath
+	case req.Mask != "":
+		var err error
+		if raw, err = service.DecodeBase64Image(req.Mask); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("infill requires mask or mask_generation_id")
+	}
+
+	var err error
+	if mask.data, err = service.PrepareInpaintMask(raw, source.width, source.height); err != nil {
+		return nil, err
+	}
+	if mask.filePath != "" && !bytes.Equal(mask.data, raw) {
+		// 历史蒙版与当前尺寸不一致而被重新处理时，按上传蒙版保存
+		mask.filePath = ""
+	}
+	return mask, nil
+}
+
+// applySamplingParameters 确定采样参数并记录来源：请求中指定的值优先，其次为画风预设固定的值，最后为服务端默认值
+func (h *ImageHandler) applySamplingParameters(req *GenerateImageRequest, preset *model.StylePresetContent, out *service.GenerationRequest, sources map[string]string) {
+	defaults := h.novelaiService.Defaults()
+
+	out.Model = pickParam(sources, "model", nonZero(req.Model), preset.Model, defaults.Model)
+	out.Sampler = pickParam(sources, "sampler", nonZero(req.Sampler), preset.Sampler, defaults.Sampler)
+	out.Scale = pickParam(sources, "scale", req.Scale, preset.Scale, defaults.Scale)
+	out.QualityToggle = pickParam(sources, "quality_toggle", req.QualityToggle, preset.QualityToggle, service.DefaultQualityToggle)
+	out.UCPreset = pickParam(sources, "uc_preset", req.UCPreset, preset.UCPreset, service.DefaultUCPreset)
+
+	out.NoiseSchedule = stringOr(req.NoiseSchedule, defaults.NoiseSchedule)
+	out.CFGRescale = valueOr(req.CFGRescale, defaults.CFGRescale)
+	out.Decrisper = valueOr(req.Decrisper, defaults.Decrisper)
+	out.VarietyBoost = valueOr(req.VarietyBoost, defaults.VarietyBoost)
+
+	// 默认 SMEA 只对支持的模型生效，显式指定时交给校验报错
+	smeaSupported := service.ModelSupportsSMEA(out.Model)
+	out.SMEA = valueOr(req.SMEA, defaults.SMEA && smeaSupported)
+	out.SMEADyn = valueOr(req.SMEADyn, defaults.SMEADyn && smeaSupported)
+}
+
+// pickParam 按 请求 > 画风预设 > 默认值 的优先级选取参数，并将来源记录到 sources
+func pickParam[T any](sources map[string]string, name string, request, preset *T, defaultValue T) T {
+	switch {
+	case request != nil:
+		sources[name] = service.ParamSourceRequest
+		return *request
+	case preset != nil:
+		sources[name] = service.ParamSourcePreset
+		return *preset
+	default:
+		sources[name] = service.ParamSourceDefault
+		return defaultValue
+	}
+}
+
+// nonZero 零值返回 nil，用于以零值表示未指定的请求字段
+func nonZero[T comparable](value T) *T {
+	var zero T
+	if value == zero {
+		return nil
+	}
+	return &value
+}
+
+// stringOr 返回非空字符串，否则返回默认值
+func stringOr(value, defaultValue string) string {
+	if value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// valueOr 返回指针指向的值，指针为 nil 时返回默认值
+func valueOr[T any](value *T, defaultValue T) T {
+	if value != nil {
+		return *value
+	}
+	return defaultValue
+}
+
 // GetImage 获取图像信息
 func (h *ImageHandler) GetImage(c *gin.Context) {
 	idStr := c.Param("id")
@@ -179,30 +941,209 @@ func (h *ImageHandler) GetImage(c *gin.Context) {
 		return
 	}
 
+	c.JSON(http.StatusOK, buildImageResponse(generation))
+}
+
+// buildImageResponse 构建单个图像的响应数据
+func buildImageResponse(generation *model.ImageGeneration) gin.H {
 	// 构建图像 URL
 	imageURL := "/files/" + generation.FilePath
 
-	c.JSON(http.StatusOK, gin.H{
-		"id":              generation.ID,
-		"prompt":          generation.Prompt,
-		"negative_prompt": generation.NegativePrompt,
-		"seed":            generation.Seed,
-		"steps":           generation.Steps,
-		"width":           generation.Width,
-		"height":          generation.Height,
-		"style_preset_id": generation.StylePresetID,
-		"image_url":       imageURL,
-		"status":          generation.Status,
-		"error_message":   generation.ErrorMessage,
-		"generation_time": generation.GenerationTime,
-		"created_at":      generation.CreatedAt,
-	})
+	response := gin.H{
+		"id":                       generation.ID,
+		"user_id":                  generation.UserID,
+		"prompt":                   generation.Prompt,
+		"negative_prompt":          generation.NegativePrompt,
+		"seed":                     generation.Seed,
+		"batch_id":                 generation.BatchID,
+		"batch_index":              generation.BatchIndex,
+		"steps":                    generation.Steps,
+		"width":                    generation.Width,
+		"height":                   generation.Height,
+		"model":                    generation.Model,
+		"sampler":                  generation.Sampler,
+		"scale":                    generation.Scale,
+		"noise_schedule":           generation.NoiseSchedule,
+		"sm":                       generation.SMEA,
+		"sm_dyn":                   generation.SMEADyn,
+		"cfg_rescale":              generation.CFGRescale,
+		"decrisper":                generation.Decrisper,
+		"variety_boost":            generation.VarietyBoost,
+		"quality_toggle":           generation.QualityToggle,
+		"uc_preset":                generation.UCPreset,
+		"param_sources":            generation.ParamSources,
+		"characters":               generation.Characters,
+		"references":               generation.References,
+		"action":                   generation.Action,
+		"style_preset_id":          generation.StylePresetID,
+		"style_preset_revision_id": generation.StylePresetRevisionID,
+		"style_presets":            generation.StylePresets,
+		"preset_variables":         generation.PresetVariables,
+		"image_url":                imageURL,
+		"status":                   generation.Status,
+		"error_message":            generation.ErrorMessage,
+		"generation_time":          generation.GenerationTime,
+		"created_at":               generation.CreatedAt,
+	}
+
+	if generation.Action == service.ActionImg2Img || generation.Action == service.ActionInfill {
+		response["source_generation_id"] = generation.SourceGenerationID
+		response["source_image_url"] = fileURL(generation.SourceFilePath)
+		response["strength"] = generation.Strength
+		response["noise"] = generation.Noise
+	}
+	if generation.Action == service.ActionInfill {
+		response["mask_image_url"] = fileURL(generation.MaskFilePath)
+		response["add_original_image"] = generation.AddOriginalImage
+	}
+
+	return response
+}
+
+// fileURL 构建图像目录下文件的访问 URL，路径为空时返回空字符串
+func fileURL(relativePath string) string {
+	if relativePath == "" {
+		return ""
+	}
+	return "/files/" + filepath.ToSlash(relativePath)
 }
 
 // ListImagesRequest 列出图像请求
 type ListImagesRequest struct {
-	Page  int `form:"page" binding:"min=1"`
-	Limit int `form:"limit" binding:"min=1,max=100"`
+	Page   int    `form:"page" binding:"omitempty,min=1"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=100"`
+	Cursor string `form:"cursor"` // 游标分页，设置后忽略 page
+
+	// 过滤条件
+	Status        string `form:"status" binding:"omitempty,oneof=pending success failed"`
+	StylePresetID *uint  `form:"style_preset_id"`
+	BatchID       string `form:"batch_id"`
+	CreatedFrom   string `form:"created_from"` // RFC3339 或 YYYY-MM-DD（包含）
+	CreatedTo     string `form:"created_to"`   // RFC3339 或 YYYY-MM-DD（日期格式时包含当天）
+	Width         int    `form:"width" binding:"omitempty,min=1"`
+	Height        int    `form:"height" binding:"omitempty,min=1"`
+	MinWidth      int    `form:"min_width" binding:"omitempty,min=1"`
+	MaxWidth      int    `form:"max_width" binding:"omitempty,min=1"`
+	MinHeight     int    `form:"min_height" binding:"omitempty,min=1"`
+	MaxHeight     int    `form:"max_height" binding:"omitempty,min=1"`
+	Seed          *int64 `form:"seed"`
+
+	// 排序
+	Sort  string `form:"sort" binding:"omitempty,oneof=created_at id seed generation_time"`
+	Order string `form:"order" binding:"omitempty,oneof=asc desc"`
+}
+
+// ListImages 分页列出图像
+func (h *ImageHandler) ListImages(c *gin.Context) {
+	var req ListImagesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 设置默认值
+	if req.Page <= 0 {
+		req.Page = 1
+	}
+	if req.Limit <= 0 {
+		req.Limit = 20
+	}
+
+	filter := &service.ImageListFilter{
+		Status:        req.Status,
+		StylePresetID: req.StylePresetID,
+		BatchID:       req.BatchID,
+		Width:         req.Width,
+		Height:        req.Height,
+		MinWidth:      req.MinWidth,
+		MaxWidth:      req.MaxWidth,
+		MinHeight:     req.MinHeight,
+		MaxHeight:     req.MaxHeight,
+		Seed:          req.Seed,
+		SortBy:        req.Sort,
+		SortDesc:      req.Order != "asc",
+		Limit:         req.Limit,
+		Offset:        (req.Page - 1) * req.Limit,
+	}
+
+	if req.CreatedFrom != "" {
+		t, _, err := parseDateParam(req.CreatedFrom)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid created_from"})
+			return
+		}
+		filter.CreatedFrom = &t
+	}
+	if req.CreatedTo != "" {
+		t, dateOnly, err := parseDateParam(req.CreatedTo)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid created_to"})
+			return
+		}
+		if dateOnly {
+			// 只有日期时包含当天
+			t = t.AddDate(0, 0, 1)
+		}
+		filter.CreatedTo = &t
+	}
+
+	if req.Cursor != "" {
+		cursor, err := service.DecodeImageListCursor(req.Cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// 游标只能用于生成它的排序字段
+		sortBy := req.Sort
+		if sortBy == "" {
+			sortBy = service.ImageSortCreatedAt
+		}
+		if cursor.SortBy != sortBy {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cursor does not match sort field " + sortBy})
+			return
+		}
+		filter.Cursor = cursor
+	}
+
+	result, err := h.imageService.ListImageGenerations(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to list images",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	images := make([]gin.H, len(result.Generations))
+	for i := range result.Generations {
+		images[i] = buildImageResponse(&result.Generations[i])
+	}
+
+	response := gin.H{
+		"images":      images,
+		"total":       result.Total,
+		"limit":       req.Limit,
+		"next_cursor": result.NextCursor,
+		"has_more":    result.NextCursor != "",
+	}
+	if req.Cursor == "" {
+		response["page"] = req.Page
+		response["total_pages"] = (result.Total + int64(req.Limit) - 1) / int64(req.Limit)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// parseDateParam 解析日期参数，支持 RFC3339 和 YYYY-MM-DD，返回值表示是否只有日期
+func parseDateParam(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
 }
 
 // GetImagesByIDsRequest 根据 IDs 批量获取图像请求
@@ -236,23 +1177,8 @@ func (h *ImageHandler) GetImagesByIDs(c *gin.Context) {
 
 	// 构建响应数据
 	images := make([]gin.H, len(generations))
-	for i, generation := range generations {
-		imageURL := "/files/" + generation.FilePath
-		images[i] = gin.H{
-			"id":              generation.ID,
-			"prompt":          generation.Prompt,
-			"negative_prompt": generation.NegativePrompt,
-			"seed":            generation.Seed,
-			"steps":           generation.Steps,
-			"width":           generation.Width,
-			"height":          generation.Height,
-			"style_preset_id": generation.StylePresetID,
-			"image_url":       imageURL,
-			"status":          generation.Status,
-			"error_message":   generation.ErrorMessage,
-			"generation_time": generation.GenerationTime,
-			"created_at":      generation.CreatedAt,
-		}
+	for i := range generations {
+		images[i] = buildImageResponse(&generations[i])
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"novelai-backend/internal/model"
+	"novelai-backend/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// JobHandler 异步生成任务处理器
+type JobHandler struct {
+	jobService   *service.JobService
+	imageService *service.ImageService
+}
+
+// NewJobHandler 创建异步生成任务处理器实例
+func NewJobHandler(jobService *service.JobService, imageService *service.ImageService) *JobHandler {
+	return &JobHandler{
+		jobService:   jobService,
+		imageService: imageService,
+	}
+}
+
+// GetJob 获取任务状态
+func (h *JobHandler) GetJob(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+
+	job, err := h.jobService.GetJob(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, h.buildJobResponse(job))
+}
+
+// jobStreamHeartbeat 事件流心跳间隔
+const jobStreamHeartbeat = 15 * time.Second
+
+// StreamJobEvents 推送任务进度事件
+// 默认使用 SSE，请求携带 WebSocket 升级头时改用 WebSocket
+func (h *JobHandler) StreamJobEvents(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+
+	if _, err := h.jobService.GetJob(uint(id)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	// 先订阅再读取当前状态，避免遗漏两者之间发生的事件
+	events, cancel := h.jobService.Subscribe(uint(id))
+	defer cancel()
+
+	job, err := h.jobService.GetJob(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	var stream jobEventStream
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		wsStream, err := newWebSocketJobStream(c)
+		if err != nil {
+			// 升级失败时 upgrader 已写入错误响应
+			return
+		}
+		stream = wsStream
+	} else {
+		stream = newSSEJobStream(c)
+	}
+	defer stream.Close()
+
+	// 发送当前状态
+	snapshot := h.snapshotEvent(job)
+	if err := stream.Send(snapshot); err != nil || snapshot.IsTerminal() {
+		return
+	}
+
+	heartbeat := time.NewTicker(jobStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-stream.Done():
+			return
+		case <-heartbeat.C:
+			if err := stream.Ping(); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				// 订阅已关闭，终止事件可能因缓冲已满被丢弃，补发最终状态
+				if job, err := h.jobService.GetJob(uint(id)); err == nil {
+					if final := h.snapshotEvent(job); final.IsTerminal() {
+						stream.Send(final)
+					}
+				}
+				return
+			}
+
+			if event.IsTerminal() {
+				if job, err := h.jobService.GetJob(uint(id)); err == nil {
+					event.Data = h.buildJobResponse(job)
+				}
+			}
+			if err := stream.Send(&event); err != nil || event.IsTerminal() {
+				return
+			}
+		}
+	}
+}
+
+// snapshotEvent 根据任务当前状态构建事件
+func (h *JobHandler) snapshotEvent(job *model.GenerationJob) *service.JobEvent {
+	event := &service.JobEvent{
+		JobID: job.ID,
+		Time:  time.Now(),
+	}
+
+	switch job.Status {
+	case model.StatusPending:
+		position, _ := h.jobService.QueuePosition(job)
+		event.Type = service.JobEventQueued
+		event.Data = gin.H{"queue_position": position}
+	case model.StatusRunning:
+		event.Type = service.JobEventStarted
+		event.Data = gin.H{"attempts": job.Attempts}
+	case model.StatusSuccess:
+		event.Type = service.JobEventCompleted
+		event.Data = h.buildJobResponse(job)
+	default:
+		event.Type = service.JobEventFailed
+		event.Data = h.buildJobResponse(job)
+	}
+
+	return event
+}
+
+// buildJobResponse 构建任务响应数据，任务完成时附带生成结果
+func (h *JobHandler) buildJobResponse(job *model.GenerationJob) gin.H {
+	response := gin.H{
+		"id":            job.ID,
+		"status":        job.Status,
+		"generation_id": job.GenerationID,
+		"batch_id":      job.BatchID,
+		"error_message": job.ErrorMessage,
+		"attempts":      job.Attempts,
+		"created_at":    job.CreatedAt,
+		"started_at":    job.StartedAt,
+		"finished_at":   job.FinishedAt,
+	}
+
+	if job.Status == model.StatusPending {
+		position, _ := h.jobService.QueuePosition(job)
+		response["queue_position"] = position
+	}
+
+	if job.GenerationID != nil {
+		if generation, err := h.imageService.GetImageGeneration(*job.GenerationID); err == nil {
+			response["generation"] = buildImageResponse(generation)
+		}
+	}
+	if job.BatchID != "" {
+		if generations, err := h.imageService.GetImageGenerationsByBatch(job.BatchID); err == nil {
+			images := make([]gin.H, len(generations))
+			for i := range generations {
+				images[i] = buildImageResponse(&generations[i])
+			}
+			response["generations"] = images
+		}
+	}
+
+	return response
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"novelai-backend/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// jobEventStream 任务事件推送通道
+type jobEventStream interface {
+	Send(event *service.JobEvent) error
+	Ping() error
+	Done() <-chan struct{}
+	Close()
+}
+
+// sseJobStream 基于 Server-Sent Events 的事件推送
+type sseJobStream struct {
+	c *gin.Context
+}
+
+func newSSEJobStream(c *gin.Context) *sseJobStream {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // 禁用 nginx 缓冲
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	return &sseJobStream{c: c}
+}
+
+func (s *sseJobStream) Send(event *service.JobEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.c.Writer, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+		return err
+	}
+	s.c.Writer.Flush()
+	return nil
+}
+
+func (s *sseJobStream) Ping() error {
+	if _, err := fmt.Fprint(s.c.Writer, ": ping\n\n"); err != nil {
+		return err
+	}
+	s.c.Writer.Flush()
+	return nil
+}
+
+func (s *sseJobStream) Done() <-chan struct{} {
+	return s.c.Request.Context().Done()
+}
+
+func (s *sseJobStream) Close() {}
+
+// webSocketUpgrader 与 CORS 配置保持一致，允许任意来源
+var webSocketUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// webSocketJobStream 基于 WebSocket 的事件推送，每个事件为一条 JSON 文本消息
+type webSocketJobStream struct {
+	conn *websocket.Conn
+	done chan struct{}
+}
+
+func newWebSocketJobStream(c *gin.Context) (*webSocketJobStream, error) {
+	conn, err := webSocketUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &webSocketJobStream{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+
+	// 读取并丢弃客户端消息，用于感知连接关闭
+	go func() {
+		defer close(s.done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *webSocketJobStream) Send(event *service.JobEvent) error {
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return s.conn.WriteJSON(event)
+}
+
+func (s *webSocketJobStream) Ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+}
+
+func (s *webSocketJobStream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *webSocketJobStream) Close() {
+	s.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	s.conn.Close()
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+
+	"novelai-backend/internal/middleware"
+	"novelai-backend/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QuotaHandler Anlas 配额处理器
+type QuotaHandler struct {
+	quotaService *service.QuotaService
+}
+
+// NewQuotaHandler 创建配额处理器
+func NewQuotaHandler(quotaService *service.QuotaService) *QuotaHandler {
+	return &QuotaHandler{
+		quotaService: quotaService,
+	}
+}
+
+// GetQuota 获取当前客户端的配额使用情况
+// 匿名请求返回客户端的配额，携带 API 密钥的请求返回所属用户和该密钥的配额
+func (h *QuotaHandler) GetQuota(c *gin.Context) {
+	quotas, err := h.quotaService.Status(quotaSubject(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get quota",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"quotas": quotas,
+	})
+}
+
+// quotaSubject 返回当前请求的配额统计对象
+func quotaSubject(c *gin.Context) service.QuotaSubject {
+	return service.QuotaSubject{
+		APIKey:    middleware.CurrentAPIKey(c),
+		ClientKey: middleware.ClientBucket(c),
+	}
+}
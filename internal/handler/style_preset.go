@@ -1,8 +1,13 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"novelai-backend/internal/model"
 	"novelai-backend/internal/service"
 
 	"github.com/gin-gonic/gin"
@@ -34,3 +39,411 @@ func (h *StylePresetHandler) GetStylePresets(c *gin.Context) {
 		"presets": presets,
 	})
 }
+
+// PreviewStylePresetRequest 预览画风预设请求
+type PreviewStylePresetRequest struct {
+	Prompt         string            `json:"prompt"`
+	NegativePrompt string            `json:"negative_prompt"`
+	Variables      map[string]string `json:"variables"`
+}
+
+// PreviewStylePreset 返回应用画风预设后的最终提示词，不调用 NovelAI
+func (h *StylePresetHandler) PreviewStylePreset(c *gin.Context) {
+	id, ok := parseStylePresetID(c)
+	if !ok {
+		return
+	}
+
+	var req PreviewStylePresetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	preset, err := h.stylePresetService.GetStylePresetByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Style preset not found"})
+		return
+	}
+
+	result, err := h.stylePresetService.ApplyStylePreset(&preset.StylePresetContent, req.Prompt, req.NegativePrompt, req.Variables)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// StylePresetRequest 创建或更新画风预设请求
+type StylePresetRequest struct {
+	Name                   string `json:"name" binding:"required"`
+	Description            string `json:"description"`
+	PrefixPrompt           string `json:"prefix_prompt"`
+	SuffixPrompt           string `json:"suffix_prompt"`
+	PrefixNegativePrompt   string `json:"prefix_negative_prompt"`
+	SuffixNegativePrompt   string `json:"suffix_negative_prompt"`
+	PromptTemplate         string `json:"prompt_template"`                                              // 设置后代替前缀和后缀，必须包含 ${prompt}
+	NegativePromptTemplate string `json:"negative_prompt_template"`                                     // 设置后代替负面前缀和后缀，必须包含 ${negative}
+	NegativePromptMode     string `json:"negative_prompt_mode" binding:"omitempty,oneof=merge replace"` // 默认 merge
+	Enabled                *bool  `json:"enabled"`                                                      // 创建时默认 true，更新时不指定则保持不变
+	SortOrder              *int   `json:"sort_order"`                                                   // 创建时默认排在最后，更新时不指定则保持不变
+
+	// 预设固定的生成参数，不指定表示使用请求值或默认值
+	Model         *string  `json:"model"`
+	Sampler       *string  `json:"sampler"`
+	Scale         *float64 `json:"scale"`
+	Steps         *int     `json:"steps"`
+	Width         *int     `json:"width"`
+	Height        *int     `json:"height"`
+	QualityToggle *bool    `json:"quality_toggle"`
+	UCPreset      *int     `json:"uc_preset"`
+}
+
+// toInput 转换为服务层参数
+func (r *StylePresetRequest) toInput() *service.StylePresetInput {
+	return &service.StylePresetInput{
+		Name:        r.Name,
+		Description: r.Description,
+		StylePresetContent: model.StylePresetContent{
+			PrefixPrompt:           r.PrefixPrompt,
+			SuffixPrompt:           r.SuffixPrompt,
+			PrefixNegativePrompt:   r.PrefixNegativePrompt,
+			SuffixNegativePrompt:   r.SuffixNegativePrompt,
+			PromptTemplate:         r.PromptTemplate,
+			NegativePromptTemplate: r.NegativePromptTemplate,
+			NegativePromptMode:     r.NegativePromptMode,
+			Model:                  r.Model,
+			Sampler:                r.Sampler,
+			Scale:                  r.Scale,
+			Steps:                  r.Steps,
+			Width:                  r.Width,
+			Height:                 r.Height,
+			QualityToggle:          r.QualityToggle,
+			UCPreset:               r.UCPreset,
+		},
+		Enabled:   r.Enabled,
+		SortOrder: r.SortOrder,
+	}
+}
+
+// ListAllStylePresets 获取全部画风预设（包括已禁用的）
+func (h *StylePresetHandler) ListAllStylePresets(c *gin.Context) {
+	presets, err := h.stylePresetService.ListStylePresets()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get style presets",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"presets": presets,
+	})
+}
+
+// CreateStylePreset 创建画风预设
+func (h *StylePresetHandler) CreateStylePreset(c *gin.Context) {
+	var req StylePresetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input := req.toInput()
+	if err := input.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	preset, err := h.stylePresetService.CreateStylePreset(input)
+	if err != nil {
+		respondStylePresetError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, preset)
+}
+
+// UpdateStylePreset 更新画风预设
+func (h *StylePresetHandler) UpdateStylePreset(c *gin.Context) {
+	id, ok := parseStylePresetID(c)
+	if !ok {
+		return
+	}
+
+	var req StylePresetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input := req.toInput()
+	if err := input.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	preset, err := h.stylePresetService.UpdateStylePreset(id, input)
+	if err != nil {
+		respondStylePresetError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, preset)
+}
+
+// DeleteStylePreset 删除画风预设
+func (h *StylePresetHandler) DeleteStylePreset(c *gin.Context) {
+	id, ok := parseStylePresetID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.stylePresetService.DeleteStylePreset(id); err != nil {
+		respondStylePresetError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Style preset deleted"})
+}
+
+// EnableStylePreset 启用画风预设
+func (h *StylePresetHandler) EnableStylePreset(c *gin.Context) {
+	h.setStylePresetEnabled(c, true)
+}
+
+// DisableStylePreset 禁用画风预设
+func (h *StylePresetHandler) DisableStylePreset(c *gin.Context) {
+	h.setStylePresetEnabled(c, false)
+}
+
+func (h *StylePresetHandler) setStylePresetEnabled(c *gin.Context, enabled bool) {
+	id, ok := parseStylePresetID(c)
+	if !ok {
+		return
+	}
+
+	preset, err := h.stylePresetService.SetStylePresetEnabled(id, enabled)
+	if err != nil {
+		respondStylePresetError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, preset)
+}
+
+// ReorderStylePresetsRequest 画风预设排序请求
+type ReorderStylePresetsRequest struct {
+	IDs []uint `json:"ids" binding:"required"`
+}
+
+// ReorderStylePresets 按给定的 ID 顺序排列画风预设
+func (h *StylePresetHandler) ReorderStylePresets(c *gin.Context) {
+	var req ReorderStylePresetsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	presets, err := h.stylePresetService.ReorderStylePresets(req.IDs)
+	if err != nil {
+		respondStylePresetError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"presets": presets,
+	})
+}
+
+// ListStylePresetRevisions 获取画风预设的全部修订版本（新版本在前），预设已删除时仍可查询
+func (h *StylePresetHandler) ListStylePresetRevisions(c *gin.Context) {
+	id, ok := parseStylePresetID(c)
+	if !ok {
+		return
+	}
+
+	revisions, err := h.stylePresetService.ListRevisions(id)
+	if err != nil {
+		respondStylePresetError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"revisions": revisions,
+	})
+}
+
+// DiffStylePresetRevisionsRequest 修订版本比较请求
+type DiffStylePresetRevisionsRequest struct {
+	From int `form:"from" binding:"omitempty,min=1"` // 默认为 to 的上一个版本
+	To   int `form:"to" binding:"omitempty,min=1"`   // 默认为最新版本
+}
+
+// DiffStylePresetRevisions 比较画风预设的两个修订版本
+func (h *StylePresetHandler) DiffStylePresetRevisions(c *gin.Context) {
+	id, ok := parseStylePresetID(c)
+	if !ok {
+		return
+	}
+
+	var req DiffStylePresetRevisionsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.To == 0 {
+		revisions, err := h.stylePresetService.ListRevisions(id)
+		if err != nil {
+			respondStylePresetError(c, err)
+			return
+		}
+		req.To = revisions[0].Revision
+	}
+	if req.From == 0 {
+		req.From = max(req.To-1, 1)
+	}
+
+	diff, err := h.stylePresetService.DiffRevisions(id, req.From, req.To)
+	if err != nil {
+		respondStylePresetError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, diff)
+}
+
+// ExportStylePresets 导出全部画风预设，format=yaml 时导出 YAML，默认 JSON
+func (h *StylePresetHandler) ExportStylePresets(c *gin.Context) {
+	format := c.DefaultQuery("format", service.BundleFormatJSON)
+
+	bundle, err := h.stylePresetService.ExportStylePresets()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to export style presets",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	data, err := service.MarshalStylePresetBundle(bundle, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contentType := "application/json"
+	if format == service.BundleFormatYAML {
+		contentType = "application/yaml"
+	}
+	c.Header("Content-Disposition", `attachment; filename="style-presets.`+format+`"`)
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// ImportStylePresetsRequest 导入画风预设的查询参数，请求体为导出包
+type ImportStylePresetsRequest struct {
+	Strategy string `form:"strategy" binding:"omitempty,oneof=skip overwrite rename"` // 默认 skip
+	DryRun   bool   `form:"dry_run"`                                                  // 只返回导入报告，不写入
+	Format   string `form:"format" binding:"omitempty,oneof=json yaml"`               // 默认按 Content-Type 判断
+}
+
+// ImportStylePresets 导入画风预设导出包
+func (h *StylePresetHandler) ImportStylePresets(c *gin.Context) {
+	var req ImportStylePresetsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Format == "" {
+		req.Format = service.BundleFormatJSON
+		if strings.Contains(c.ContentType(), "yaml") {
+			req.Format = service.BundleFormatYAML
+		}
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, service.MaxStylePresetBundleSize)
+	data, err := c.GetRawData()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("Style preset bundle is too large, maximum %d bytes", service.MaxStylePresetBundleSize),
+			"code":  "BUNDLE_TOO_LARGE",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bundle, err := service.ParseStylePresetBundle(data, req.Format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+			"code":  "INVALID_BUNDLE",
+		})
+		return
+	}
+
+	report, err := h.stylePresetService.ImportStylePresets(bundle, service.StylePresetImportOptions{
+		Strategy: req.Strategy,
+		DryRun:   req.DryRun,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to import style presets",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// 试运行时无论是否合法都返回报告
+	if !report.Valid && !report.DryRun {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "Style preset bundle contains invalid presets",
+			"code":   "INVALID_BUNDLE",
+			"report": report,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// parseStylePresetID 解析路径中的画风预设 ID，失败时写入 400 响应
+func parseStylePresetID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid style preset ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// respondStylePresetError 将画风预设服务的错误转换为响应
+func respondStylePresetError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrStylePresetNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Style preset not found"})
+	case errors.Is(err, service.ErrStylePresetRevisionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Style preset revision not found"})
+	case errors.Is(err, service.ErrStylePresetNameExists):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Style preset name already exists",
+			"code":  "DUPLICATE_NAME",
+		})
+	case errors.Is(err, service.ErrStylePresetRevisionConflict):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Style preset was modified by another request, please retry",
+			"code":  "REVISION_CONFLICT",
+		})
+	case errors.Is(err, service.ErrInvalidStylePresetIDs):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to save style preset",
+			"details": err.Error(),
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"novelai-backend/internal/middleware"
+	"novelai-backend/internal/model"
+	"novelai-backend/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UserHandler 用户和 API 密钥处理器
+type UserHandler struct {
+	userService *service.UserService
+}
+
+// NewUserHandler 创建用户处理器
+func NewUserHandler(userService *service.UserService) *UserHandler {
+	return &UserHandler{
+		userService: userService,
+	}
+}
+
+// CreateUserRequest 创建用户请求
+type CreateUserRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// APIKeyRequest 创建 API 密钥请求
+type APIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`     // 不指定时为 ["generate"]
+	ExpiresAt *time.Time `json:"expires_at"` // RFC 3339，不指定表示不过期
+}
+
+// toInput 转换为服务层参数
+func (r *APIKeyRequest) toInput() *service.APIKeyInput {
+	scopes := r.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{service.ScopeGenerate}
+	}
+	return &service.APIKeyInput{
+		Name:      r.Name,
+		Scopes:    scopes,
+		ExpiresAt: r.ExpiresAt,
+	}
+}
+
+// CreateAPIKeyResponse 创建 API 密钥响应，明文密钥只在此返回一次
+type CreateAPIKeyResponse struct {
+	APIKey *model.APIKey `json:"api_key"`
+	Key    string        `json:"key"`
+}
+
+// ListUsers 获取全部用户
+func (h *UserHandler) ListUsers(c *gin.Context) {
+	users, err := h.userService.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get users",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users": users,
+	})
+}
+
+// CreateUser 创建用户
+func (h *UserHandler) CreateUser(c *gin.Context) {
+	var req CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input := &service.UserInput{Name: req.Name}
+	if err := input.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.userService.CreateUser(input)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, user)
+}
+
+// EnableUser 启用用户
+func (h *UserHandler) EnableUser(c *gin.Context) {
+	h.setUserDisabled(c, false)
+}
+
+// DisableUser 禁用用户，该用户的所有密钥随即失效
+func (h *UserHandler) DisableUser(c *gin.Context) {
+	h.setUserDisabled(c, true)
+}
+
+// setUserDisabled 启用或禁用用户
+func (h *UserHandler) setUserDisabled(c *gin.Context, disabled bool) {
+	id, ok := parseUserID(c, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	user, err := h.userService.SetUserDisabled(id, disabled)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// ListUserAPIKeys 获取用户的全部 API 密钥
+func (h *UserHandler) ListUserAPIKeys(c *gin.Context) {
+	id, ok := parseUserID(c, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+	if _, err := h.userService.GetUser(id); err != nil {
+		respondUserError(c, err)
+		return
+	}
+	h.listAPIKeys(c, id)
+}
+
+// CreateUserAPIKey 为用户创建 API 密钥，可授予任意权限范围
+func (h *UserHandler) CreateUserAPIKey(c *gin.Context) {
+	id, ok := parseUserID(c, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+	h.createAPIKey(c, id, service.AllScopes)
+}
+
+// RevokeUserAPIKey 撤销用户的 API 密钥
+func (h *UserHandler) RevokeUserAPIKey(c *gin.Context) {
+	id, ok := parseUserID(c, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+	keyID, ok := parseUserID(c, "keyId", "Invalid API key ID")
+	if !ok {
+		return
+	}
+	h.revokeAPIKey(c, id, keyID)
+}
+
+// ListOwnAPIKeys 获取当前用户的全部 API 密钥
+func (h *UserHandler) ListOwnAPIKeys(c *gin.Context) {
+	h.listAPIKeys(c, middleware.CurrentAPIKey(c).UserID)
+}
+
+// CreateOwnAPIKey 为当前用户创建 API 密钥，权限范围不能超过当前密钥
+func (h *UserHandler) CreateOwnAPIKey(c *gin.Context) {
+	current := middleware.CurrentAPIKey(c)
+	h.createAPIKey(c, current.UserID, current.Scopes)
+}
+
+// RevokeOwnAPIKey 撤销当前用户的 API 密钥
+func (h *UserHandler) RevokeOwnAPIKey(c *gin.Context) {
+	keyID, ok := parseUserID(c, "id", "Invalid API key ID")
+	if !ok {
+		return
+	}
+	h.revokeAPIKey(c, middleware.CurrentAPIKey(c).UserID, keyID)
+}
+
+// listAPIKeys 返回用户的全部 API 密钥
+func (h *UserHandler) listAPIKeys(c *gin.Context, userID uint) {
+	keys, err := h.userService.ListAPIKeys(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get API keys",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"keys": keys,
+	})
+}
+
+// createAPIKey 创建 API 密钥，allowed 为可授予的权限范围
+func (h *UserHandler) createAPIKey(c *gin.Context, userID uint, allowed []string) {
+	var req APIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input := req.toInput()
+	if err := input.Validate(allowed, time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, plaintext, err := h.userService.CreateAPIKey(userID, input, allowed)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreateAPIKeyResponse{
+		APIKey: key,
+		Key:    plaintext,
+	})
+}
+
+// revokeAPIKey 撤销用户的 API 密钥
+func (h *UserHandler) revokeAPIKey(c *gin.Context, userID, keyID uint) {
+	key, err := h.userService.RevokeAPIKey(userID, keyID)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, key)
+}
+
+// parseUserID 解析路径中的用户或密钥 ID，无效时写入 400 响应
+func parseUserID(c *gin.Context, param, message string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param(param), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// respondUserError 将用户服务的错误转换为响应
+func respondUserError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, service.ErrAPIKeyNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+	case errors.Is(err, service.ErrUserNameExists):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "User name already exists",
+			"code":  "DUPLICATE_NAME",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to save user",
+			"details": err.Error(),
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuthMiddleware 管理接口鉴权，要求 X-Admin-Key 与配置的管理密钥一致
+// 未配置管理密钥时管理接口不可用
+func AdminAuthMiddleware(adminKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminKey == "" {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Admin API is disabled.",
+				"code":  "ADMIN_DISABLED",
+			})
+			c.Abort()
+			return
+		}
+
+		key := c.GetHeader("X-Admin-Key")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid admin key.",
+				"code":  "INVALID_ADMIN_KEY",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"novelai-backend/internal/model"
+	"novelai-backend/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上下文中保存当前 API 密钥的键
+const apiKeyContextKey = "api_key"
+
+// APIKeyAuthMiddleware 解析 Authorization: Bearer <API 密钥>
+// 未携带时作为匿名请求继续处理，携带了无效密钥时返回 401
+func APIKeyAuthMiddleware(userService *service.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if header == "" {
+			c.Next()
+			return
+		}
+
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Authorization header must be \"Bearer <api key>\".",
+				"code":  "INVALID_API_KEY",
+			})
+			c.Abort()
+			return
+		}
+
+		key, err := userService.Authenticate(strings.TrimSpace(token))
+		if errors.Is(err, service.ErrInvalidAPIKey) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid, expired or revoked API key.",
+				"code":  "INVALID_API_KEY",
+			})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to verify API key",
+				"details": err.Error(),
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set(apiKeyContextKey, key)
+		c.Next()
+	}
+}
+
+// RequireScope 要求请求携带具有指定权限范围的 API 密钥
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := CurrentAPIKey(c)
+		if key == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "API key required.",
+				"code":  "API_KEY_REQUIRED",
+			})
+			c.Abort()
+			return
+		}
+		if !service.HasScope(key, scope) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "API key does not have the \"" + scope + "\" scope.",
+				"code":  "INSUFFICIENT_SCOPE",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentAPIKey 返回当前请求的 API 密钥（预加载了用户），匿名请求返回 nil
+func CurrentAPIKey(c *gin.Context) *model.APIKey {
+	if key, ok := c.Get(apiKeyContextKey); ok {
+		return key.(*model.APIKey)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上下文中保存客户端地址的键
+const (
+	clientIPKey     = "client_ip"
+	clientBucketKey = "client_ip_bucket"
+)
+
+// 可信代理设置的转发头
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded" // RFC 7239
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// ClientIPResolver 解析客户端真实 IP
+//
+// 只有直连地址属于可信代理时才读取转发头，且只读取配置的一个转发头：代理通常只追加自己使用的头，
+// 其他转发头由客户端原样传入，不可信。转发链从右向左遍历，跳过可信代理，第一个不可信的地址即为客户端。
+type ClientIPResolver struct {
+	trustedProxies []netip.Prefix
+	header         string
+	ipv6Prefix     int
+}
+
+// NewClientIPResolver 创建解析器，trustedProxies 为可信代理的 IP 或 CIDR，header 为可信代理设置的转发头
+// （HeaderXForwardedFor、HeaderForwarded 或 HeaderXRealIP），
+// ipv6Prefix 为 IPv6 客户端限流时合并的前缀长度（如 64 表示同一 /64 网段视为同一客户端）
+func NewClientIPResolver(trustedProxies []string, header string, ipv6Prefix int) (*ClientIPResolver, error) {
+	if ipv6Prefix < 1 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length %d", ipv6Prefix)
+	}
+	resolver := &ClientIPResolver{ipv6Prefix: ipv6Prefix}
+	for _, supported := range []string{HeaderXForwardedFor, HeaderForwarded, HeaderXRealIP} {
+		if strings.EqualFold(strings.TrimSpace(header), supported) {
+			resolver.header = supported
+		}
+	}
+	if resolver.header == "" {
+		return nil, fmt.Errorf("invalid trusted proxy header %q, supported headers: %s, %s, %s",
+			header, HeaderXForwardedFor, HeaderForwarded, HeaderXRealIP)
+	}
+
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			addr = addr.Unmap()
+			resolver.trustedProxies = append(resolver.trustedProxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		resolver.trustedProxies = append(resolver.trustedProxies, prefix.Masked())
+	}
+	return resolver, nil
+}
+
+// Resolve 返回客户端 IP
+func (r *ClientIPResolver) Resolve(req *http.Request) netip.Addr {
+	remote, ok := parseNode(req.RemoteAddr)
+	if !ok || !r.trusted(remote) {
+		return remote
+	}
+
+	var hops []string
+	switch r.header {
+	case HeaderForwarded:
+		hops = parseForwarded(req.Header.Values(HeaderForwarded))
+	case HeaderXForwardedFor:
+		for _, value := range req.Header.Values(HeaderXForwardedFor) {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	case HeaderXRealIP:
+		if xri := req.Header.Get(HeaderXRealIP); xri != "" {
+			hops = []string{xri}
+		}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseNode(hops[i])
+		if !ok {
+			// 无法识别的地址（如 unknown 或混淆标识）由上一个可信代理报告，以该代理作为客户端
+			break
+		}
+		client = addr
+		if !r.trusted(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// Header 返回读取的转发头
+func (r *ClientIPResolver) Header() string {
+	return r.header
+}
+
+// Bucket 返回限流时使用的客户端标识，IPv6 地址按前缀合并
+func (r *ClientIPResolver) Bucket(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	if addr.Is4() || r.ipv6Prefix == 128 {
+		return addr.String()
+	}
+	prefix, _ := addr.WithZone("").Prefix(r.ipv6Prefix)
+	return prefix.String()
+}
+
+// trusted 判断地址是否属于可信代理
+func (r *ClientIPResolver) trusted(addr netip.Addr) bool {
+	for _, prefix := range r.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIPMiddleware 解析客户端 IP 并保存到上下文，供限流等中间件使用
+func ClientIPMiddleware(resolver *ClientIPResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addr := resolver.Resolve(c.Request)
+		if addr.IsValid() {
+			c.Set(clientIPKey, addr.String())
+			c.Set(clientBucketKey, resolver.Bucket(addr))
+		}
+		c.Next()
+	}
+}
+
+// getClientIP 获取客户端真实IP，未经过 ClientIPMiddleware 时使用直连地址
+func getClientIP(c *gin.Context) string {
+	if ip := c.GetString(clientIPKey); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// ClientBucket 获取限流和配额使用的客户端标识（IPv6 按前缀合并）
+func ClientBucket(c *gin.Context) string {
+	if bucket := c.GetString(clientBucketKey); bucket != "" {
+		return bucket
+	}
+	return getClientIP(c)
+}
+
+// parseForwarded 按出现顺序返回 Forwarded 头中各节点的 for 参数
+func parseForwarded(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseNode 解析转发头中的节点地址，支持 "1.2.3.4"、"1.2.3.4:80"、"2001:db8::1" 和 "[2001:db8::1]:80"
+func parseNode(node string) (netip.Addr, bool) {
+	node = strings.TrimSpace(node)
+	if addr, err := netip.ParseAddr(node); err == nil {
+		return addr.Unmap(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if strings.HasPrefix(node, "[") && strings.HasSuffix(node, "]") {
+		if addr, err := netip.ParseAddr(node[1 : len(node)-1]); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "2001:db8:ffff::1"}
+
+	tests := []struct {
+		name    string
+		header  string // 可信代理设置的转发头
+		remote  string
+		headers map[string]string
+		want    string
+		bucket  string
+	}{
+		{"direct", HeaderXForwardedFor, "203.0.113.5:1234", nil, "203.0.113.5", "203.0.113.5"},
+		{"untrusted remote ignores headers", HeaderXForwardedFor, "203.0.113.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.5", "203.0.113.5"},
+		{"trusted proxy", HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1", "198.51.100.1"},
+		{"right to left", HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1", "198.51.100.1"},
+		{"all trusted", HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3", "10.0.0.3"},
+		{"unknown hop", HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, unknown"}, "10.0.0.1", "10.0.0.1"},
+		{"spoofed unknown before client", HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "unknown, 198.51.100.1"}, "198.51.100.1", "198.51.100.1"},
+		{"spoofed forwarded behind xff proxy", HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{
+			"Forwarded":       "for=1.2.3.4",
+			"X-Forwarded-For": "198.51.100.1",
+		}, "198.51.100.1", "198.51.100.1"},
+		{"spoofed forwarded unknown behind xff proxy", HeaderXForwardedFor, "10.0.0.1:1234", map[string]string{
+			"Forwarded":       "for=unknown",
+			"X-Forwarded-For": "198.51.100.1",
+		}, "198.51.100.1", "198.51.100.1"},
+		{"x-real-ip", HeaderXRealIP, "10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1", "198.51.100.1"},
+		{"spoofed xff behind x-real-ip proxy", HeaderXRealIP, "10.0.0.1:1234", map[string]string{
+			"X-Forwarded-For": "1.2.3.4",
+			"X-Real-IP":       "198.51.100.1",
+		}, "198.51.100.1", "198.51.100.1"},
+		{"x-real-ip missing", HeaderXRealIP, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "10.0.0.1", "10.0.0.1"},
+		{"forwarded", HeaderForwarded, "10.0.0.1:1234", map[string]string{
+			"Forwarded":       `for=192.0.2.60;proto=http;by=203.0.113.43, for="198.51.100.1:8080"`,
+			"X-Forwarded-For": "1.1.1.1",
+		}, "198.51.100.1", "198.51.100.1"},
+		{"forwarded ipv6", HeaderForwarded, "[2001:db8:ffff::1]:443", map[string]string{"Forwarded": `For="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17", "2001:db8:cafe::/64"},
+		{"ipv4-mapped", HeaderXForwardedFor, "[::ffff:203.0.113.5]:1234", nil, "203.0.113.5", "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := NewClientIPResolver(trusted, tt.header, 64)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			addr := resolver.Resolve(req)
+			if addr.String() != tt.want {
+				t.Errorf("Resolve() = %s, want %s", addr, tt.want)
+			}
+			if bucket := resolver.Bucket(addr); bucket != tt.bucket {
+				t.Errorf("Bucket() = %s, want %s", bucket, tt.bucket)
+			}
+		})
+	}
+
+	if _, err := NewClientIPResolver([]string{"not-an-ip"}, HeaderXForwardedFor, 64); err == nil {
+		t.Errorf("expected error for invalid trusted proxy")
+	}
+	if _, err := NewClientIPResolver(trusted, "X-Client-IP", 64); err == nil {
+		t.Errorf("expected error for unsupported header")
+	}
+	if resolver, err := NewClientIPResolver(trusted, "x-real-ip", 64); err != nil || resolver.Header() != HeaderXRealIP {
+		t.Errorf("header should be canonicalized: %v", err)
+	}
+}
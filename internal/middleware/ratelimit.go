@@ -1,11 +1,11 @@
 package middleware
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
-	"net/url"
-	"strings"
+	"strconv"
 	"time"
 
 	"novelai-backend/internal/service"
@@ -13,44 +13,56 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// RateLimitMiddleware 限流中间件（包含Turnstile验证）
-func RateLimitMiddleware(rateLimitService *service.RateLimitService, turnstileSecret string) gin.HandlerFunc {
+// RateLimitMiddleware 限流中间件（包含人机验证），policy 为路由使用的限流策略
+func RateLimitMiddleware(rateLimitService *service.RateLimitService, policy string, captcha *service.CaptchaService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 获取客户端IP
+		// 获取客户端IP，限流和验证状态按客户端标识（IPv6 按前缀合并）记录
 		clientIP := getClientIP(c)
-
-		// 检查特权密钥
-		privilegeKey := c.GetHeader("X-Privilege-Key")
-		if rateLimitService.CheckPrivilegeKey(privilegeKey) {
-			// 特权用户跳过所有限制
-			rateLimitService.UpdateGlobalRequest()
-			rateLimitService.UpdateIPRequest(clientIP)
+		clientKey := ClientBucket(c)
+		ctx := c.Request.Context()
+
+		// 具有 generate 权限的 API 密钥（由 APIKeyAuthMiddleware 解析）
+		if service.HasScope(CurrentAPIKey(c), service.ScopeGenerate) {
+			// 跳过限流和人机验证
+			decision, err := rateLimitService.ConsumePrivileged(ctx, policy, clientKey)
+			if err != nil {
+				abortRateLimitUnavailable(c, err)
+				return
+			}
+			setRateLimitHeaders(c, decision)
 			c.Next()
 			return
 		}
 
-		// 检查全局限流
-		if !rateLimitService.CheckGlobalRateLimit() {
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error": "Global rate limit exceeded. Please wait 10 seconds between requests.",
-				"code":  "GLOBAL_RATE_LIMIT",
-			})
-			c.Abort()
+		// 检查全局和IP限流
+		decision, err := rateLimitService.Check(ctx, policy, clientKey)
+		if err != nil {
+			abortRateLimitUnavailable(c, err)
 			return
 		}
-
-		// 检查IP限流
-		if !rateLimitService.CheckIPRateLimit(clientIP) {
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error": "IP rate limit exceeded. Please wait 30 seconds between requests.",
-				"code":  "IP_RATE_LIMIT",
-			})
-			c.Abort()
+		setRateLimitHeaders(c, decision)
+		if !decision.Allowed {
+			abortRateLimited(c, decision)
 			return
 		}
 
-		// 检查是否需要Turnstile验证
-		if rateLimitService.CheckTurnstileRequired(clientIP) {
+		// 检查是否需要人机验证（请求头和错误码沿用 Turnstile 的命名）
+		// 验证状态绑定客户端标识和签名的会话 cookie，没有有效会话时需要重新验证
+		required := captcha.Enabled()
+		sessionID := ""
+		if required {
+			if cookie, err := c.Cookie(service.CaptchaSessionCookie); err == nil {
+				sessionID, _ = captcha.ParseSession(cookie, clientKey)
+			}
+			if sessionID != "" {
+				required, err = rateLimitService.CheckTurnstileRequired(ctx, captcha.VerificationKey(clientKey, sessionID))
+				if err != nil {
+					abortRateLimitUnavailable(c, err)
+					return
+				}
+			}
+		}
+		if required {
 			// 检查是否提供了Turnstile token
 			turnstileToken := c.GetHeader("X-Turnstile-Token")
 			if turnstileToken == "" {
@@ -58,18 +70,49 @@ func RateLimitMiddleware(rateLimitService *service.RateLimitService, turnstileSe
 			}
 
 			if turnstileToken != "" {
-				// 验证Turnstile token
-				if verifyTurnstileToken(turnstileToken, clientIP, turnstileSecret) {
-					// 验证成功，更新验证时间
-					rateLimitService.UpdateTurnstileVerification(clientIP)
-				} else {
+				// 验证token，每个 token 只能使用一次
+				err := captcha.Verify(ctx, turnstileToken, clientIP)
+				if errors.Is(err, service.ErrCaptchaReplayed) {
 					c.JSON(http.StatusUnauthorized, gin.H{
-						"error": "Invalid Turnstile token.",
-						"code":  "INVALID_TURNSTILE",
+						"error": "Turnstile token has already been used.",
+						"code":  "TURNSTILE_REPLAYED",
 					})
 					c.Abort()
 					return
 				}
+				if errors.Is(err, service.ErrCaptchaRejected) {
+					c.JSON(http.StatusUnauthorized, gin.H{
+						"error":   "Invalid Turnstile token.",
+						"details": err.Error(),
+						"code":    "INVALID_TURNSTILE",
+					})
+					c.Abort()
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusBadGateway, gin.H{
+						"error":   "Captcha verification unavailable",
+						"details": err.Error(),
+						"code":    "CAPTCHA_UNAVAILABLE",
+					})
+					c.Abort()
+					return
+				}
+
+				// 验证成功，没有有效会话时签发新会话，并更新验证时间
+				if sessionID == "" {
+					var cookie string
+					sessionID, cookie, err = captcha.NewSession(clientKey)
+					if err != nil {
+						abortRateLimitUnavailable(c, err)
+						return
+					}
+					http.SetCookie(c.Writer, captcha.SessionCookie(cookie, c.Request.TLS != nil))
+				}
+				if err := rateLimitService.UpdateTurnstileVerification(ctx, captcha.VerificationKey(clientKey, sessionID)); err != nil {
+					abortRateLimitUnavailable(c, err)
+					return
+				}
 			} else {
 				// 没有提供token，要求验证
 				c.JSON(http.StatusUnauthorized, gin.H{
@@ -81,80 +124,59 @@ func RateLimitMiddleware(rateLimitService *service.RateLimitService, turnstileSe
 			}
 		}
 
-		// 更新请求时间
-		rateLimitService.UpdateGlobalRequest()
-		rateLimitService.UpdateIPRequest(clientIP)
+		// 消耗令牌（Turnstile 验证期间可能已被并发请求用完）
+		decision, err = rateLimitService.Consume(ctx, policy, clientKey)
+		if err != nil {
+			abortRateLimitUnavailable(c, err)
+			return
+		}
+		setRateLimitHeaders(c, decision)
+		if !decision.Allowed {
+			abortRateLimited(c, decision)
+			return
+		}
 
 		c.Next()
 	}
 }
 
-// getClientIP 获取客户端真实IP
-func getClientIP(c *gin.Context) string {
-	// 优先从 X-Forwarded-For 获取
-	if xff := c.GetHeader("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
-	}
+// setRateLimitHeaders 设置 RateLimit-Limit / RateLimit-Remaining / RateLimit-Reset 响应头（Reset 单位为秒）
+func setRateLimitHeaders(c *gin.Context, decision *service.RateLimitDecision) {
+	c.Header("RateLimit-Limit", strconv.Itoa(decision.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+}
 
-	// 从 X-Real-IP 获取
-	if xri := c.GetHeader("X-Real-IP"); xri != "" {
-		return xri
+// abortRateLimited 返回 429 和 Retry-After，错误信息来自实际的限流配置
+func abortRateLimited(c *gin.Context, decision *service.RateLimitDecision) {
+	c.Header("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
+	if decision.Scope == service.RateLimitScopeGlobal {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":          fmt.Sprintf("Global rate limit exceeded. Allowed: %s.", decision.Rule.Describe()),
+			"code":           "GLOBAL_RATE_LIMIT",
+			"retry_after_ms": decision.RetryAfter.Milliseconds(),
+		})
+	} else {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":          fmt.Sprintf("IP rate limit exceeded. Allowed: %s.", decision.Rule.Describe()),
+			"code":           "IP_RATE_LIMIT",
+			"retry_after_ms": decision.RetryAfter.Milliseconds(),
+		})
 	}
-
-	// 从 RemoteAddr 获取
-	ip := c.ClientIP()
-	return ip
+	c.Abort()
 }
 
-// TurnstileResponse Turnstile API响应结构
-type TurnstileResponse struct {
-	Success     bool     `json:"success"`
-	ErrorCodes  []string `json:"error-codes,omitempty"`
-	ChallengeTS string   `json:"challenge_ts,omitempty"`
-	Hostname    string   `json:"hostname,omitempty"`
+// ceilSeconds 向上取整的秒数
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
 }
 
-// verifyTurnstileToken 验证Turnstile token
-func verifyTurnstileToken(token, clientIP, secret string) bool {
-	if secret == "" {
-		// 如果没有配置secret，跳过验证
-		return true
-	}
-
-	// 准备请求数据
-	data := url.Values{}
-	data.Set("secret", secret)
-	data.Set("response", token)
-	data.Set("remoteip", clientIP)
-
-	// 创建HTTP请求
-	req, err := http.NewRequest("POST", "https://challenges.cloudflare.com/turnstile/v0/siteverify",
-		bytes.NewBufferString(data.Encode()))
-	if err != nil {
-		return false
-	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// 发送请求
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return false
-	}
-	defer resp.Body.Close()
-
-	// 解析响应
-	var turnstileResp TurnstileResponse
-	if err := json.NewDecoder(resp.Body).Decode(&turnstileResp); err != nil {
-		return false
-	}
-
-	return turnstileResp.Success
+// abortRateLimitUnavailable 限流状态存储不可用时拒绝请求，避免绕过限流，错误只记录在日志中
+func abortRateLimitUnavailable(c *gin.Context, err error) {
+	log.Printf("Rate limit store unavailable: %v", err)
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": "Rate limiter unavailable",
+		"code":  "RATE_LIMIT_UNAVAILABLE",
+	})
+	c.Abort()
 }
@@ -0,0 +1,9 @@
+package model
+
+// CharacterPrompt V4 多角色提示词
+type CharacterPrompt struct {
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negative_prompt"`
+	// 角色位置，5x5 网格坐标：列 A-E（从左到右）+ 行 1-5（从上到下），如 "C3" 为中心；为空表示由模型决定
+	Position string `json:"position,omitempty"`
+}
@@ -10,6 +10,9 @@ type ImageGeneration struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
+	// 发起生成的用户，匿名请求为空
+	UserID *uint `json:"user_id" gorm:"index"`
+
 	// 用户输入参数
 	Prompt         string `json:"prompt" gorm:"type:text;not null"`
 	NegativePrompt string `json:"negative_prompt" gorm:"type:text"`
@@ -18,8 +21,50 @@ type ImageGeneration struct {
 	Width          int    `json:"width" gorm:"default:832"`
 	Height         int    `json:"height" gorm:"default:1216"`
 
-	// 预设画风 ID（预留字段）
-	StylePresetID *uint `json:"style_preset_id" gorm:"index"`
+	// 同一次请求生成的多张图像共享 BatchID，BatchIndex 为在本批次中的序号（从 0 开始）
+	BatchID    string `json:"batch_id" gorm:"index"`
+	BatchIndex int    `json:"batch_index"`
+
+	// 采样参数
+	Model         string  `json:"model"`
+	Sampler       string  `json:"sampler"`
+	Scale         float64 `json:"scale"`
+	NoiseSchedule string  `json:"noise_schedule"`
+	SMEA          bool    `json:"sm"`
+	SMEADyn       bool    `json:"sm_dyn"`
+	CFGRescale    float64 `json:"cfg_rescale"`
+	Decrisper     bool    `json:"decrisper"`
+	VarietyBoost  bool    `json:"variety_boost"`
+	QualityToggle bool    `json:"quality_toggle"`
+	UCPreset      int     `json:"uc_preset"`
+
+	// 参数来源，如 {"model": "preset", "steps": "request"}，取值为 request、preset、source_image 或 default
+	ParamSources map[string]string `json:"param_sources" gorm:"serializer:json;type:text"`
+
+	// V4 多角色提示词
+	Characters []CharacterPrompt `json:"characters" gorm:"serializer:json;type:text"`
+
+	// 风格参考（vibe transfer）
+	References []VibeReference `json:"references" gorm:"serializer:json;type:text"`
+
+	// 生成类型：generate、img2img 或 infill
+	Action string `json:"action" gorm:"default:'generate'"`
+
+	// img2img / 局部重绘参数
+	SourceGenerationID *uint   `json:"source_generation_id" gorm:"index"` // 源图像来自历史生成时的记录 ID
+	SourceFilePath     string  `json:"source_file_path"`                  // 源图像相对路径
+	MaskFilePath       string  `json:"mask_file_path"`                    // 局部重绘蒙版相对路径
+	Strength           float64 `json:"strength"`
+	Noise              float64 `json:"noise"`
+	AddOriginalImage   bool    `json:"add_original_image"`
+
+	// 预设画风 ID 及生成时使用的修订版本和模板变量，叠加多个预设时为第一个启用的预设
+	StylePresetID         *uint             `json:"style_preset_id" gorm:"index"`
+	StylePresetRevisionID *uint             `json:"style_preset_revision_id" gorm:"index"`
+	PresetVariables       map[string]string `json:"preset_variables" gorm:"serializer:json;type:text"`
+
+	// 按顺序叠加的全部画风预设
+	StylePresets []AppliedStylePreset `json:"style_presets" gorm:"serializer:json;type:text"`
 
 	// 原始请求 payload（JSON 格式存储）
 	OriginalPayload string `json:"original_payload" gorm:"type:text"`
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"time"
+)
+
+// 生成状态
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+)
+
+// GenerationJob 异步图像生成任务
+type GenerationJob struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// 任务状态
+	Status string `json:"status" gorm:"default:'pending';index"` // pending, running, success, failed
+
+	// 任务参数（JSON 格式存储的 service.GenerationTask）
+	Payload string `json:"-" gorm:"type:text;not null"`
+
+	// 预留的 Anlas 配额记录，任务失败时退还（与任务参数分开保存，参数无法解析时也能退还）
+	AnlasUsageID *uint `json:"-"`
+
+	// 执行结果
+	GenerationID *uint  `json:"generation_id" gorm:"index"` // 批次中的第一张图像
+	BatchID      string `json:"batch_id"`
+	ErrorMessage string `json:"error_message" gorm:"type:text"`
+	Attempts     int    `json:"attempts"` // 执行次数（进程重启后恢复执行会增加）
+
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+// TableName 指定表名
+func (GenerationJob) TableName() string {
+	return "generation_jobs"
+}
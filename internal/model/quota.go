@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+)
+
+// AnlasUsage 一次生成请求预留的 Anlas，用于按日、按月统计配额
+// 生成失败时删除该记录，即退还预留的 Anlas
+type AnlasUsage struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at" gorm:"not null;index"` // UTC
+
+	UserID    *uint  `json:"user_id" gorm:"index"`    // API 密钥所属用户，匿名请求为空
+	APIKeyID  *uint  `json:"api_key_id" gorm:"index"` // 匿名请求为空
+	ClientKey string `json:"client_key" gorm:"index"` // 客户端标识（IPv6 按前缀合并）
+
+	Anlas int `json:"anlas" gorm:"not null"`
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"time"
+)
+
+// RateLimitBucket 限流令牌桶状态（SQLite 存储）
+type RateLimitBucket struct {
+	Key        string    `gorm:"primaryKey"`
+	Tokens     float64   `gorm:"not null"`
+	RefilledAt time.Time `gorm:"not null;index"` // 上次补充令牌的时间
+}
+
+// TurnstileVerification 客户端最近一次通过 Turnstile 验证的时间（SQLite 存储）
+type TurnstileVerification struct {
+	IP         string    `gorm:"primaryKey"`
+	VerifiedAt time.Time `gorm:"not null;index"`
+}
+
+// CaptchaToken 已使用的人机验证 token（SHA-256），用于防止重放（SQLite 存储）
+type CaptchaToken struct {
+	Hash      string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
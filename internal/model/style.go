@@ -4,7 +4,7 @@ import (
 	"time"
 )
 
-// StylePreset 画风预设（预留）
+// StylePreset 画风预设
 type StylePreset struct {
 	ID        uint      `json:"id" gorm:"primaryKey"`
 	CreatedAt time.Time `json:"created_at"`
@@ -13,16 +13,70 @@ type StylePreset struct {
 	Name        string `json:"name" gorm:"not null;uniqueIndex"`
 	Description string `json:"description" gorm:"type:text"`
 
-	PrefixPrompt         string `json:"prefix_prompt" gorm:"type:text"`
-	SuffixPrompt         string `json:"suffix_prompt" gorm:"type:text"`
-	PrefixNegativePrompt string `json:"prefix_negative_prompt" gorm:"type:text"`
-	SuffixNegativePrompt string `json:"suffix_negative_prompt" gorm:"type:text"`
+	StylePresetContent
+
+	// 当前修订版本，内容每次修改都会生成新的修订版本
+	RevisionID *uint `json:"revision_id"`
+	Revision   int   `json:"revision"`
 
 	// 是否启用
 	Enabled bool `json:"enabled" gorm:"default:true"`
+
+	// 排序，数值小的在前
+	SortOrder int `json:"sort_order" gorm:"default:0;index"`
 }
 
 // TableName 指定表名
 func (StylePreset) TableName() string {
 	return "style_presets"
 }
+
+// StylePresetContent 画风预设中影响生成结果的内容
+type StylePresetContent struct {
+	PrefixPrompt         string `json:"prefix_prompt" gorm:"type:text"`
+	SuffixPrompt         string `json:"suffix_prompt" gorm:"type:text"`
+	PrefixNegativePrompt string `json:"prefix_negative_prompt" gorm:"type:text"`
+	SuffixNegativePrompt string `json:"suffix_negative_prompt" gorm:"type:text"`
+
+	// 提示词模板，设置后代替前缀和后缀，例如 "masterpiece, ${prompt}, ${style:watercolor}"
+	PromptTemplate         string `json:"prompt_template" gorm:"type:text"`
+	NegativePromptTemplate string `json:"negative_prompt_template" gorm:"type:text"`
+
+	// 负面提示词模式：merge（默认）在用户负面提示词基础上应用预设，replace 忽略用户输入和默认负面提示词
+	NegativePromptMode string `json:"negative_prompt_mode"`
+
+	// 预设固定的生成参数，为空表示不指定；请求中显式指定的值优先
+	Model         *string  `json:"model"`
+	Sampler       *string  `json:"sampler"`
+	Scale         *float64 `json:"scale"`
+	Steps         *int     `json:"steps"`
+	Width         *int     `json:"width"`
+	Height        *int     `json:"height"`
+	QualityToggle *bool    `json:"quality_toggle"`
+	UCPreset      *int     `json:"uc_preset"`
+}
+
+// StylePresetRevision 画风预设的修订版本，创建后不再修改；删除预设时保留
+type StylePresetRevision struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+
+	StylePresetID uint   `json:"style_preset_id" gorm:"not null;uniqueIndex:idx_style_preset_revisions_key"`
+	Revision      int    `json:"revision" gorm:"not null;uniqueIndex:idx_style_preset_revisions_key"` // 从 1 开始
+	Name          string `json:"name"`                                                                // 修订时的预设名称
+
+	StylePresetContent
+}
+
+// TableName 指定表名
+func (StylePresetRevision) TableName() string {
+	return "style_preset_revisions"
+}
+
+// AppliedStylePreset 生成时叠加的画风预设，按叠加顺序保存在生成记录中
+type AppliedStylePreset struct {
+	StylePresetID uint    `json:"style_preset_id"`
+	RevisionID    uint    `json:"revision_id,omitempty"` // 实际使用的修订版本，跳过的预设为空
+	Weight        float64 `json:"weight"`
+	Enabled       bool    `json:"enabled"`
+}
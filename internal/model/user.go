@@ -0,0 +1,33 @@
+package model
+
+import (
+	"time"
+)
+
+// User 用户，通过 API 密钥访问生成接口
+type User struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Name     string `json:"name" gorm:"not null;uniqueIndex"`
+	Disabled bool   `json:"disabled" gorm:"not null;default:false"` // 禁用后该用户的所有密钥失效
+}
+
+// APIKey 用户的 API 密钥，只保存 SHA-256 哈希，明文仅在创建时返回一次
+type APIKey struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+
+	UserID uint  `json:"user_id" gorm:"not null;index"`
+	User   *User `json:"-"`
+
+	Name    string   `json:"name"`
+	Prefix  string   `json:"prefix" gorm:"not null"`        // 密钥开头的若干字符，用于识别
+	KeyHash string   `json:"-" gorm:"not null;uniqueIndex"` // 密钥的 SHA-256（十六进制）
+	Scopes  []string `json:"scopes" gorm:"serializer:json;type:text"`
+
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // 为空表示不过期
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
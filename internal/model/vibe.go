@@ -0,0 +1,35 @@
+package model
+
+import (
+	"time"
+)
+
+// VibeReference 生成记录中的风格参考（vibe transfer）信息
+type VibeReference struct {
+	ImageHash            string  `json:"image_hash"`              // 参考图像 SHA-256
+	GenerationID         *uint   `json:"generation_id,omitempty"` // 参考图像来自历史生成时的记录 ID
+	Strength             float64 `json:"strength"`
+	InformationExtracted float64 `json:"information_extracted"`
+}
+
+// VibeEncoding NovelAI encode-vibe 结果缓存，相同图像、模型和信息提取度只编码一次
+type VibeEncoding struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	ImageHash            string  `json:"image_hash" gorm:"not null;uniqueIndex:idx_vibe_encodings_key"`
+	Model                string  `json:"model" gorm:"not null;uniqueIndex:idx_vibe_encodings_key"`
+	InformationExtracted float64 `json:"information_extracted" gorm:"not null;uniqueIndex:idx_vibe_encodings_key"`
+
+	// 编码结果（base64）
+	Encoding string `json:"-" gorm:"type:text;not null"`
+
+	// 缓存命中次数
+	HitCount int `json:"hit_count"`
+}
+
+// TableName 指定表名
+func (VibeEncoding) TableName() string {
+	return "vibe_encodings"
+}
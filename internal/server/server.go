@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"novelai-backend/internal/config"
+	"novelai-backend/internal/handler"
+	"novelai-backend/internal/middleware"
+	"novelai-backend/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// Server 组装后的服务，包含路由和需要后台运行的服务
+type Server struct {
+	Engine           *gin.Engine
+	jobService       *service.JobService
+	rateLimitService *service.RateLimitService
+	cleanupInterval  time.Duration
+}
+
+// New 初始化服务、处理器并注册路由
+func New(cfg *config.Config, db *gorm.DB) (*Server, error) {
+	// 初始化服务
+	novelaiService := service.NewNovelAIService(cfg.NovelAIAPIKey, cfg.NovelAIBaseURL, cfg.NovelAITimeout, service.GenerationDefaults{
+		Model:         cfg.DefaultModel,
+		Sampler:       cfg.DefaultSampler,
+		Scale:         cfg.DefaultScale,
+		NoiseSchedule: cfg.DefaultNoiseSchedule,
+		SMEA:          cfg.DefaultSMEA,
+		SMEADyn:       cfg.DefaultSMEADyn,
+		CFGRescale:    cfg.DefaultCFGRescale,
+		Decrisper:     cfg.DefaultDecrisper,
+		VarietyBoost:  cfg.DefaultVarietyBoost,
+	})
+	if err := novelaiService.ValidateDefaults(); err != nil {
+		return nil, err
+	}
+	imageService := service.NewImageService(db, cfg.ImagesDir)
+	rateLimitStore, err := newRateLimitStore(cfg, db)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitService, err := newRateLimitService(cfg, rateLimitStore)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitCleanupInterval <= 0 {
+		return nil, fmt.Errorf("rate limit cleanup interval must be positive")
+	}
+	stylePresetService := service.NewStylePresetService(db)
+	if err := stylePresetService.EnsureStylePresetRevisions(); err != nil {
+		return nil, err
+	}
+	vibeService := service.NewVibeService(db, novelaiService)
+	quotaService, err := newQuotaService(cfg, db)
+	if err != nil {
+		return nil, err
+	}
+	generationService := service.NewGenerationService(novelaiService, imageService, vibeService, quotaService)
+	jobService := service.NewJobService(db, generationService, cfg.JobWorkers, cfg.JobQueueSize)
+	userService := service.NewUserService(db)
+
+	// 初始化处理器
+	imageHandler := handler.NewImageHandler(novelaiService, generationService, jobService, imageService, stylePresetService, quotaService)
+	jobHandler := handler.NewJobHandler(jobService, imageService)
+	stylePresetHandler := handler.NewStylePresetHandler(stylePresetService)
+	userHandler := handler.NewUserHandler(userService)
+	quotaHandler := handler.NewQuotaHandler(quotaService)
+
+	captchaVerifier, err := service.NewCaptchaVerifier(service.CaptchaConfig{
+		Provider:         cfg.CaptchaProvider,
+		Secret:           cfg.CaptchaSecret,
+		VerifyURL:        cfg.CaptchaVerifyURL,
+		AllowedHostnames: cfg.CaptchaHostnames,
+		Action:           cfg.CaptchaAction,
+		MinScore:         cfg.CaptchaMinScore,
+		Timeout:          cfg.CaptchaTimeout,
+		LocalTokenSuffix: cfg.CaptchaLocalSuffix,
+	})
+	if err != nil {
+		return nil, err
+	}
+	captchaService, err := service.NewCaptchaService(captchaVerifier, rateLimitStore, cfg.CaptchaSessionSecret, cfg.CaptchaCookieSecure)
+	if err != nil {
+		return nil, err
+	}
+	clientIPResolver, err := middleware.NewClientIPResolver(cfg.TrustedProxies, cfg.TrustedProxyHeader, cfg.ClientIPv6Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建路由
+	r := gin.Default()
+	// gin 默认信任所有代理，与限流使用相同的可信代理配置，使日志中的客户端地址一致
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	// gin 只支持 X-Forwarded-For 和 X-Real-IP，同样只读取配置的转发头
+	r.RemoteIPHeaders = nil
+	if header := clientIPResolver.Header(); header != middleware.HeaderForwarded {
+		r.RemoteIPHeaders = []string{header}
+	}
+	r.Use(middleware.ClientIPMiddleware(clientIPResolver))
+
+	// 添加 CORS 中间件
+	r.Use(func(c *gin.Context) {
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Admin-Key")
+		c.Header("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After")
+
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+			return
+		}
+
+		c.Next()
+	})
+
+	// API 路由，携带 Authorization: Bearer <API 密钥> 时识别用户
+	api := r.Group("/api", middleware.APIKeyAuthMiddleware(userService))
+	{
+		// 应用限流中间件到生成图像接口
+		api.POST("/generate",
+			middleware.RateLimitMiddleware(rateLimitService, service.RateLimitPolicyGenerate, captchaService),
+			imageHandler.GenerateImage)
+		api.POST("/generate/stream",
+			middleware.RateLimitMiddleware(rateLimitService, service.RateLimitPolicyStream, captchaService),
+			imageHandler.StreamGenerateImage)
+		api.POST("/images/:id/rerun",
+			middleware.RateLimitMiddleware(rateLimitService, service.RateLimitPolicyRerun, captchaService),
+			imageHandler.RerunImage)
+
+		// Anlas 消耗估算和配额，不调用 NovelAI
+		api.POST("/generate/estimate", imageHandler.EstimateGeneration)
+		api.GET("/quota", quotaHandler.GetQuota)
+
+		// 其他接口不需要严格限流
+		api.GET("/images", imageHandler.ListImages)
+		api.GET("/images/:id", imageHandler.GetImage)
+		api.POST("/images/batch", imageHandler.GetImagesByIDs)
+
+		// 异步生成任务
+		api.GET("/jobs/:id", jobHandler.GetJob)
+		api.GET("/jobs/:id/events", jobHandler.StreamJobEvents)
+
+		// 画风预设接口
+		api.GET("/style-presets", stylePresetHandler.GetStylePresets)
+		api.POST("/style-presets/:id/preview", stylePresetHandler.PreviewStylePreset)
+
+		// 预设导入导出用于实例间迁移，需要管理员密钥
+		api.GET("/style-presets/export",
+			middleware.AdminAuthMiddleware(cfg.AdminKey),
+			stylePresetHandler.ExportStylePresets)
+		api.POST("/style-presets/import",
+			middleware.AdminAuthMiddleware(cfg.AdminKey),
+			stylePresetHandler.ImportStylePresets)
+
+		// 用户管理自己的 API 密钥，需要 keys 权限
+		keys := api.Group("/keys", middleware.RequireScope(service.ScopeKeys))
+		keys.GET("", userHandler.ListOwnAPIKeys)
+		keys.POST("", userHandler.CreateOwnAPIKey)
+		keys.DELETE("/:id", userHandler.RevokeOwnAPIKey)
+	}
+
+	// 管理接口，需要 X-Admin-Key
+	admin := r.Group("/api/admin", middleware.AdminAuthMiddleware(cfg.AdminKey))
+	{
+		admin.GET("/style-presets", stylePresetHandler.ListAllStylePresets)
+		admin.POST("/style-presets", stylePresetHandler.CreateStylePreset)
+		admin.PUT("/style-presets/order", stylePresetHandler.ReorderStylePresets)
+		admin.PUT("/style-presets/:id", stylePresetHandler.UpdateStylePreset)
+		admin.DELETE("/style-presets/:id", stylePresetHandler.DeleteStylePreset)
+		admin.POST("/style-presets/:id/enable", stylePresetHandler.EnableStylePreset)
+		admin.POST("/style-presets/:id/disable", stylePresetHandler.DisableStylePreset)
+		admin.GET("/style-presets/:id/revisions", stylePresetHandler.ListStylePresetRevisions)
+		admin.GET("/style-presets/:id/revisions/diff", stylePresetHandler.DiffStylePresetRevisions)
+
+		admin.GET("/users", userHandler.ListUsers)
+		admin.POST("/users", userHandler.CreateUser)
+		admin.POST("/users/:id/enable", userHandler.EnableUser)
+		admin.POST("/users/:id/disable", userHandler.DisableUser)
+		admin.GET("/users/:id/keys", userHandler.ListUserAPIKeys)
+		admin.POST("/users/:id/keys", userHandler.CreateUserAPIKey)
+		admin.DELETE("/users/:id/keys/:keyId", userHandler.RevokeUserAPIKey)
+	}
+
+	// 静态文件服务
+	r.Static("/files", cfg.ImagesDir)
+
+	return &Server{
+		Engine:           r,
+		jobService:       jobService,
+		rateLimitService: rateLimitService,
+		cleanupInterval:  cfg.RateLimitCleanupInterval,
+	}, nil
+}
+
+// newRateLimitService 根据配置创建限流服务，未单独配置策略的路由共享默认令牌桶
+func newRateLimitService(cfg *config.Config, store service.RateLimitStore) (*service.RateLimitService, error) {
+	defaults := service.RateLimitPolicy{
+		Name:   service.RateLimitPolicyDefault,
+		Global: service.RateLimitRule{Interval: cfg.RateLimitGlobalInterval, Burst: cfg.RateLimitGlobalBurst},
+		IP:     service.RateLimitRule{Interval: cfg.RateLimitIPInterval, Burst: cfg.RateLimitIPBurst},
+	}
+	policies, err := service.ParseRateLimitPolicies(cfg.RateLimitPolicies, defaults)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitConfig := service.RateLimitConfig{
+		Default:           defaults,
+		Policies:          policies,
+		TurnstileInterval: cfg.TurnstileInterval,
+	}
+	if err := rateLimitConfig.Validate(); err != nil {
+		return nil, err
+	}
+	return service.NewRateLimitService(rateLimitConfig, store), nil
+}
+
+// newQuotaService 根据配置创建 Anlas 配额服务
+func newQuotaService(cfg *config.Config, db *gorm.DB) (*service.QuotaService, error) {
+	location, err := time.LoadLocation(cfg.AnlasQuotaTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid anlas quota time zone: %w", err)
+	}
+	quotaConfig := service.QuotaConfig{
+		IP:       service.AnlasQuota{Daily: cfg.AnlasQuotaIPDaily, Monthly: cfg.AnlasQuotaIPMonthly},
+		User:     service.AnlasQuota{Daily: cfg.AnlasQuotaUserDaily, Monthly: cfg.AnlasQuotaUserMonthly},
+		Key:      service.AnlasQuota{Daily: cfg.AnlasQuotaKeyDaily, Monthly: cfg.AnlasQuotaKeyMonthly},
+		Location: location,
+	}
+	if err := quotaConfig.Validate(); err != nil {
+		return nil, err
+	}
+	return service.NewQuotaService(db, quotaConfig), nil
+}
+
+// newRateLimitStore 创建限流状态存储，sqlite 和 redis 存储在重启后保留状态并可供多个实例共享
+func newRateLimitStore(cfg *config.Config, db *gorm.DB) (service.RateLimitStore, error) {
+	switch cfg.RateLimitStore {
+	case "", service.RateLimitStoreMemory:
+		return service.NewMemoryRateLimitStore(), nil
+	case service.RateLimitStoreSQLite:
+		return service.NewSQLiteRateLimitStore(db), nil
+	case service.RateLimitStoreRedis:
+		options, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		client := redis.NewClient(options)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := client.Ping(ctx).Err(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to connect to redis: %w", err)
+		}
+		return service.NewRedisRateLimitStore(client, cfg.RedisKeyPrefix), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", cfg.RateLimitStore)
+	}
+}
+
+// Start 启动后台服务（恢复未完成的任务并启动 worker，定期清理过期的限流记录），ctx 取消后停止清理
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.jobService.Start(); err != nil {
+		return err
+	}
+	go s.rateLimitService.RunCleanup(ctx, s.cleanupInterval)
+	return nil
+}
@@ -0,0 +1,1886 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"novelai-backend/internal/config"
+	"novelai-backend/internal/database"
+	"novelai-backend/internal/fakenovelai"
+	"novelai-backend/internal/model"
+	"novelai-backend/internal/service"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/logger"
+)
+
+const testAdminKey = "test-admin-key"
+
+// testEnv 端到端测试环境：真实路由 + SQLite + NovelAI 替身
+type testEnv struct {
+	t       *testing.T
+	cfg     *config.Config
+	novelai *fakenovelai.Server
+	server  *httptest.Server
+	client  *http.Client // 保存 cookie，与浏览器一样携带人机验证会话
+	apiKey  string       // 测试用户具有全部权限范围的 API 密钥
+}
+
+// newTestEnv 创建测试环境，configure 可在创建服务前修改配置
+func newTestEnv(t *testing.T, configure ...func(*config.Config)) *testEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	novelai := fakenovelai.New()
+	novelai.APIKey = "test-api-key"
+	t.Cleanup(novelai.Close)
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		NovelAIAPIKey:  "test-api-key",
+		NovelAIBaseURL: novelai.URL,
+		NovelAITimeout: 2 * time.Second,
+		DatabasePath:   filepath.Join(dir, "test.db"),
+		ImagesDir:      filepath.Join(dir, "images"),
+		Environment:    "test",
+		AdminKey:       testAdminKey,
+		JobWorkers:     1,
+		JobQueueSize:   10,
+
+		RateLimitGlobalInterval:  8 * time.Second,
+		RateLimitGlobalBurst:     1,
+		RateLimitIPInterval:      15 * time.Second,
+		RateLimitIPBurst:         1,
+		TurnstileInterval:        2 * time.Minute,
+		RateLimitCleanupInterval: time.Hour,
+		TrustedProxyHeader:       "X-Forwarded-For",
+		ClientIPv6Prefix:         64,
+		CaptchaProvider:          "local",
+		CaptchaSecret:            "token",
+		CaptchaLocalSuffix:       true,
+
+		DefaultModel:         "nai-diffusion-4-5-full",
+		DefaultSampler:       "k_euler_ancestral",
+		DefaultScale:         5,
+		DefaultNoiseSchedule: "karras",
+		DefaultDecrisper:     true,
+	}
+	for _, fn := range configure {
+		fn(cfg)
+	}
+
+	db, err := database.Initialize(cfg.DatabasePath)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+
+	userService := service.NewUserService(db)
+	user, err := userService.CreateUser(&service.UserInput{Name: "tester"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	_, apiKey, err := userService.CreateAPIKey(user.ID, &service.APIKeyInput{Scopes: service.AllScopes}, service.AllScopes)
+	if err != nil {
+		t.Fatalf("failed to create api key: %v", err)
+	}
+
+	srv, err := New(cfg, db)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := srv.Start(t.Context()); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	ts := httptest.NewServer(srv.Engine)
+	t.Cleanup(ts.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("failed to create cookie jar: %v", err)
+	}
+
+	return &testEnv{t: t, cfg: cfg, novelai: novelai, server: ts, client: &http.Client{Jar: jar}, apiKey: apiKey}
+}
+
+// do 发送请求并解析 JSON 响应
+func (e *testEnv) do(method, path string, body any, headers map[string]string) (int, map[string]any) {
+	e.t.Helper()
+	status, _, result := e.doWithHeaders(method, path, body, headers)
+	return status, result
+}
+
+// doWithHeaders 发送请求，返回状态码、响应头和解析后的 JSON 响应
+func (e *testEnv) doWithHeaders(method, path string, body any, headers map[string]string) (int, http.Header, map[string]any) {
+	e.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			e.t.Fatalf("failed to marshal body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, e.server.URL+path, reader)
+	if err != nil {
+		e.t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		e.t.Fatalf("failed to decode response of %s %s: %v", method, path, err)
+	}
+	return resp.StatusCode, resp.Header, result
+}
+
+// bearer 返回携带 API 密钥的请求头
+func bearer(key string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + key}
+}
+
+// generate 以测试用户身份调用生成接口
+func (e *testEnv) generate(body map[string]any) (int, map[string]any) {
+	e.t.Helper()
+	return e.do("POST", "/api/generate", body, bearer(e.apiKey))
+}
+
+// admin 以管理员身份调用管理接口
+func (e *testEnv) admin(method, path string, body any) (int, map[string]any) {
+	e.t.Helper()
+	return e.do(method, "/api/admin"+path, body, map[string]string{"X-Admin-Key": testAdminKey})
+}
+
+// waitJob 等待任务结束
+func (e *testEnv) waitJob(id float64) map[string]any {
+	e.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		_, job := e.do("GET", "/api/jobs/"+formatID(id), nil, nil)
+		if job["status"] == "success" || job["status"] == "failed" {
+			return job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	e.t.Fatalf("job %v did not finish in time", id)
+	return nil
+}
+
+func formatID(id float64) string {
+	data, _ := json.Marshal(id)
+	return string(data)
+}
+
+func TestGenerateImage(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, resp := env.generate(map[string]any{
+		"prompt": "1girl, solo",
+		"seed":   12345,
+		"width":  512,
+		"height": 768,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("generate status = %d, body = %v", status, resp)
+	}
+	if resp["seed"] != float64(12345) {
+		t.Errorf("seed = %v, want 12345", resp["seed"])
+	}
+
+	// NovelAI 收到的请求
+	requests := env.novelai.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("novelai requests = %d, want 1", len(requests))
+	}
+	if requests[0].Authorization != "Bearer test-api-key" {
+		t.Errorf("authorization = %q", requests[0].Authorization)
+	}
+	if requests[0].Payload["input"] != "1girl, solo" {
+		t.Errorf("input = %v", requests[0].Payload["input"])
+	}
+
+	// 图像信息
+	status, image := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("get image status = %d", status)
+	}
+	if image["status"] != "success" || image["prompt"] != "1girl, solo" {
+		t.Errorf("unexpected image: %v", image)
+	}
+	if image["image_url"] != resp["image_url"] {
+		t.Errorf("image_url = %v, want %v", image["image_url"], resp["image_url"])
+	}
+
+	// 图像文件
+	fileResp, err := http.Get(env.server.URL + resp["image_url"].(string))
+	if err != nil {
+		t.Fatalf("failed to get image file: %v", err)
+	}
+	defer fileResp.Body.Close()
+	cfg, err := png.DecodeConfig(fileResp.Body)
+	if err != nil {
+		t.Fatalf("image file is not a png: %v", err)
+	}
+	if cfg.Width != 512 || cfg.Height != 768 {
+		t.Errorf("image size = %dx%d, want 512x768", cfg.Width, cfg.Height)
+	}
+}
+
+func TestGenerateImageRandomSeed(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, resp := env.generate(map[string]any{"prompt": "landscape", "seed": -1})
+	if status != http.StatusOK {
+		t.Fatalf("generate status = %d, body = %v", status, resp)
+	}
+
+	sent := env.novelai.Requests()[0].Payload["parameters"].(map[string]any)["seed"]
+	if resp["seed"] == float64(-1) || resp["seed"] != sent {
+		t.Errorf("seed = %v, want seed sent to NovelAI (%v)", resp["seed"], sent)
+	}
+}
+
+func TestGenerateImageNovelAIErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		response fakenovelai.Response
+		details  string
+	}{
+		{"server error", fakenovelai.Error(http.StatusInternalServerError, "boom"), "API error 500"},
+		{"rate limited", fakenovelai.RateLimited(), "API error 429"},
+		{"bad request", fakenovelai.Error(http.StatusBadRequest, "invalid"), "API error 400"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.novelai.Enqueue(tt.response)
+
+			status, resp := env.generate(map[string]any{"prompt": "test"})
+			if status != http.StatusInternalServerError {
+				t.Fatalf("status = %d, want 500", status)
+			}
+			if !strings.Contains(resp["details"].(string), tt.details) {
+				t.Errorf("details = %v, want %q", resp["details"], tt.details)
+			}
+
+			// 失败记录
+			_, image := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+			if image["status"] != "failed" || image["error_message"] == "" {
+				t.Errorf("unexpected failed record: %v", image)
+			}
+		})
+	}
+}
+
+func TestGenerateImageTimeout(t *testing.T) {
+	env := newTestEnv(t)
+	env.novelai.Enqueue(fakenovelai.Slow(5 * time.Second))
+
+	status, resp := env.generate(map[string]any{"prompt": "test"})
+	if status != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", status)
+	}
+	if !strings.Contains(resp["details"].(string), "failed to send request") {
+		t.Errorf("details = %v", resp["details"])
+	}
+}
+
+func TestGenerateImageRequiresTurnstile(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, resp := env.do("POST", "/api/generate", map[string]any{"prompt": "test"}, nil)
+	if status != http.StatusUnauthorized || resp["code"] != "TURNSTILE_REQUIRED" {
+		t.Errorf("status = %d, body = %v", status, resp)
+	}
+	status, resp = env.do("POST", "/api/generate", map[string]any{"prompt": "test"}, map[string]string{"X-Turnstile-Token": "wrong"})
+	if status != http.StatusUnauthorized || resp["code"] != "INVALID_TURNSTILE" {
+		t.Errorf("status = %d, body = %v", status, resp)
+	}
+	if len(env.novelai.Requests()) != 0 {
+		t.Errorf("novelai should not be called")
+	}
+}
+
+func TestCaptchaReplayProtection(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.RateLimitGlobalBurst = 10
+		cfg.RateLimitIPBurst = 10
+		cfg.TrustedProxies = []string{"127.0.0.1", "::1"}
+	})
+	generate := func(headers map[string]string) (int, map[string]any) {
+		return env.do("POST", "/api/generate", map[string]any{"prompt": "test"}, headers)
+	}
+
+	if status, resp := generate(map[string]string{"X-Turnstile-Token": "token.1", "X-Forwarded-For": "203.0.113.5"}); status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	// 会话 cookie 有效期间无需再次验证
+	if status, resp := generate(map[string]string{"X-Forwarded-For": "203.0.113.5"}); status != http.StatusOK {
+		t.Fatalf("verified session: status = %d, body = %v", status, resp)
+	}
+
+	// 其他 IP 复制同一 token 和 cookie 不能通过验证
+	status, resp := generate(map[string]string{"X-Turnstile-Token": "token.1", "X-Forwarded-For": "198.51.100.7"})
+	if status != http.StatusUnauthorized || resp["code"] != "TURNSTILE_REPLAYED" {
+		t.Fatalf("replayed token: status = %d, body = %v", status, resp)
+	}
+	status, resp = generate(map[string]string{"X-Forwarded-For": "198.51.100.7"})
+	if status != http.StatusUnauthorized || resp["code"] != "TURNSTILE_REQUIRED" {
+		t.Fatalf("cookie from another IP: status = %d, body = %v", status, resp)
+	}
+
+	// 没有会话 cookie 时同一 IP 也不能重复使用 token
+	env.client.Jar, _ = cookiejar.New(nil)
+	status, resp = generate(map[string]string{"X-Turnstile-Token": "token.1", "X-Forwarded-For": "203.0.113.5"})
+	if status != http.StatusUnauthorized || resp["code"] != "TURNSTILE_REPLAYED" {
+		t.Fatalf("replayed token without session: status = %d, body = %v", status, resp)
+	}
+}
+
+func TestCaptchaSessionCookie(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		env := newTestEnv(t, func(cfg *config.Config) {
+			cfg.CaptchaCookieSecure = secure
+		})
+		status, header, resp := env.doWithHeaders("POST", "/api/generate", map[string]any{"prompt": "test"}, map[string]string{"X-Turnstile-Token": "token"})
+		if status != http.StatusOK {
+			t.Fatalf("status = %d, body = %v", status, resp)
+		}
+		cookies := (&http.Response{Header: header}).Cookies()
+		if len(cookies) != 1 || cookies[0].Name != "captcha_session" {
+			t.Fatalf("cookies = %v", cookies)
+		}
+		// 由反向代理终止 TLS 时通过配置开启 Secure
+		if cookie := cookies[0]; cookie.Secure != secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+			t.Errorf("secure = %v: cookie = %+v", secure, cookie)
+		}
+	}
+}
+
+func TestGenerateImageCaptchaDisabled(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.CaptchaProvider = "disabled"
+	})
+
+	status, resp := env.do("POST", "/api/generate", map[string]any{"prompt": "test"}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	if _, image := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil); image["user_id"] != nil {
+		t.Errorf("anonymous generation user_id = %v, want nil", image["user_id"])
+	}
+}
+
+func TestGenerateImageRateLimitBurst(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.RateLimitGlobalBurst = 10
+		cfg.RateLimitIPBurst = 2
+		cfg.RateLimitPolicies = "rerun=ip:1m/1"
+	})
+	headers := map[string]string{"X-Turnstile-Token": "token"}
+
+	for i := 0; i < 2; i++ {
+		if status, resp := env.do("POST", "/api/generate", map[string]any{"prompt": "test"}, headers); status != http.StatusOK {
+			t.Fatalf("request %d: status = %d, body = %v", i, status, resp)
+		}
+	}
+
+	status, resp := env.do("POST", "/api/generate", map[string]any{"prompt": "test"}, headers)
+	if status != http.StatusTooManyRequests || resp["code"] != "IP_RATE_LIMIT" {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	if msg, _ := resp["error"].(string); !strings.Contains(msg, "up to 2 requests at once, then 1 every 15s") {
+		t.Errorf("error = %q, want the configured limit", msg)
+	}
+
+	// 单独配置的策略使用独立的令牌桶，消息同样来自配置
+	status, resp = env.do("POST", "/api/images/999/rerun", nil, headers)
+	if status != http.StatusNotFound {
+		t.Fatalf("rerun: status = %d, body = %v", status, resp)
+	}
+	status, resp = env.do("POST", "/api/images/999/rerun", nil, headers)
+	if msg, _ := resp["error"].(string); status != http.StatusTooManyRequests || !strings.Contains(msg, "1 request every 1m0s") {
+		t.Errorf("rerun: status = %d, body = %v", status, resp)
+	}
+	if len(env.novelai.Requests()) != 2 {
+		t.Errorf("novelai requests = %d, want 2", len(env.novelai.Requests()))
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.RateLimitGlobalBurst = 10
+		cfg.RateLimitIPBurst = 2
+	})
+	headers := map[string]string{"X-Turnstile-Token": "token"}
+
+	status, header, resp := env.doWithHeaders("POST", "/api/generate", map[string]any{"prompt": "test"}, headers)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	if header.Get("RateLimit-Limit") != "2" || header.Get("RateLimit-Remaining") != "1" || header.Get("RateLimit-Reset") != "15" {
+		t.Errorf("headers = %v", header)
+	}
+	if header.Get("Retry-After") != "" {
+		t.Errorf("Retry-After should only be set when limited")
+	}
+
+	env.doWithHeaders("POST", "/api/generate", map[string]any{"prompt": "test"}, headers)
+	status, header, resp = env.doWithHeaders("POST", "/api/generate", map[string]any{"prompt": "test"}, headers)
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	if header.Get("RateLimit-Remaining") != "0" || header.Get("Retry-After") == "" {
+		t.Errorf("headers = %v", header)
+	}
+	retryAfter, _ := resp["retry_after_ms"].(float64)
+	if retryAfter <= 0 || retryAfter > 15000 {
+		t.Errorf("retry_after_ms = %v", resp["retry_after_ms"])
+	}
+}
+
+func TestRateLimitBehindTrustedProxy(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.RateLimitGlobalBurst = 10
+		cfg.TrustedProxies = []string{"127.0.0.1", "::1"}
+	})
+	// 不同客户端的人机验证会话互不通用，每次使用新的 token
+	tokens := 0
+	generate := func(headers map[string]string) (int, map[string]any) {
+		tokens++
+		headers["X-Turnstile-Token"] = fmt.Sprintf("token.%d", tokens)
+		return env.do("POST", "/api/generate", map[string]any{"prompt": "test"}, headers)
+	}
+
+	// 经可信代理转发时按转发头中的客户端限流
+	if status, resp := generate(map[string]string{"X-Forwarded-For": "203.0.113.5"}); status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	if status, resp := generate(map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.5"}); status != http.StatusTooManyRequests {
+		t.Fatalf("spoofed left-most entry should not bypass the limit: status = %d, body = %v", status, resp)
+	}
+	if status, resp := generate(map[string]string{"X-Forwarded-For": "203.0.113.6"}); status != http.StatusOK {
+		t.Fatalf("other clients should not be limited: status = %d, body = %v", status, resp)
+	}
+	// 代理只设置 X-Forwarded-For 时，客户端自行添加的 Forwarded 头被忽略
+	if status, resp := generate(map[string]string{"X-Forwarded-For": "203.0.113.6", "Forwarded": "for=192.0.2.1"}); status != http.StatusTooManyRequests {
+		t.Fatalf("spoofed Forwarded header should be ignored: status = %d, body = %v", status, resp)
+	}
+
+	// 同一 /64 网段的 IPv6 客户端共享令牌桶
+	if status, resp := generate(map[string]string{"X-Forwarded-For": "2001:db8::1"}); status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	if status, resp := generate(map[string]string{"X-Forwarded-For": "2001:db8::2"}); status != http.StatusTooManyRequests {
+		t.Fatalf("same /64 should share the limit: status = %d, body = %v", status, resp)
+	}
+}
+
+func TestRateLimitCleanup(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.RateLimitStore = "sqlite"
+		cfg.RateLimitCleanupInterval = 10 * time.Millisecond
+	})
+	db, err := database.Open(env.cfg.DatabasePath, logger.Silent)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	// 后台任务定期删除过期的令牌桶、验证记录和已使用的 token
+	old := time.Now().Add(-48 * time.Hour)
+	db.Create(&model.RateLimitBucket{Key: "ip:stale", Tokens: 1, RefilledAt: old})
+	db.Create(&model.TurnstileVerification{IP: "stale", VerifiedAt: old})
+	db.Create(&model.CaptchaToken{Hash: "stale", ExpiresAt: old})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var buckets, verifications, tokens int64
+		db.Model(&model.RateLimitBucket{}).Count(&buckets)
+		db.Model(&model.TurnstileVerification{}).Count(&verifications)
+		db.Model(&model.CaptchaToken{}).Count(&tokens)
+		if buckets+verifications+tokens == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stale records not cleaned up: %d buckets, %d verifications, %d tokens", buckets, verifications, tokens)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRateLimitStoreUnavailable(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.RateLimitStore = "redis"
+		cfg.RedisURL = "redis://" + redisServer.Addr()
+	})
+	redisServer.Close()
+
+	// 存储错误只记录在日志中，不返回给客户端
+	status, resp := env.do("POST", "/api/generate", map[string]any{"prompt": "test"}, map[string]string{"X-Turnstile-Token": "token"})
+	if status != http.StatusServiceUnavailable || resp["code"] != "RATE_LIMIT_UNAVAILABLE" {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	if _, ok := resp["details"]; ok {
+		t.Errorf("store error should not be exposed: %v", resp)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, user := env.admin("POST", "/users", map[string]any{"name": "alice"})
+	if status != http.StatusCreated {
+		t.Fatalf("create user status = %d, body = %v", status, user)
+	}
+	if status, resp := env.admin("POST", "/users", map[string]any{"name": "alice"}); status != http.StatusConflict || resp["code"] != "DUPLICATE_NAME" {
+		t.Errorf("duplicate user: status = %d, body = %v", status, resp)
+	}
+	userID := formatID(user["id"].(float64))
+
+	status, created := env.admin("POST", "/users/"+userID+"/keys", map[string]any{"name": "laptop"})
+	if status != http.StatusCreated {
+		t.Fatalf("create key status = %d, body = %v", status, created)
+	}
+	key, _ := created["key"].(string)
+	record := created["api_key"].(map[string]any)
+	if !strings.HasPrefix(key, "nai_") || !strings.HasPrefix(key, record["prefix"].(string)) || record["key_hash"] != nil {
+		t.Fatalf("created = %v", created)
+	}
+	if scopes := record["scopes"].([]any); len(scopes) != 1 || scopes[0] != "generate" {
+		t.Errorf("default scopes = %v", scopes)
+	}
+	if status, resp := env.admin("POST", "/users/"+userID+"/keys", map[string]any{"scopes": []string{"admin"}}); status != http.StatusBadRequest {
+		t.Errorf("unknown scope: status = %d, body = %v", status, resp)
+	}
+	if status, resp := env.admin("POST", "/users/"+userID+"/keys", map[string]any{
+		"expires_at": time.Now().Add(-time.Hour).Format(time.RFC3339),
+	}); status != http.StatusBadRequest {
+		t.Errorf("expired key: status = %d, body = %v", status, resp)
+	}
+
+	// generate 权限跳过人机验证，生成记录归属密钥所属用户
+	status, resp := env.do("POST", "/api/generate", map[string]any{"prompt": "test"}, bearer(key))
+	if status != http.StatusOK {
+		t.Fatalf("generate status = %d, body = %v", status, resp)
+	}
+	_, image := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+	if image["user_id"] != user["id"] {
+		t.Errorf("user_id = %v, want %v", image["user_id"], user["id"])
+	}
+
+	// 没有 keys 权限不能管理密钥
+	if status, resp := env.do("GET", "/api/keys", nil, bearer(key)); status != http.StatusForbidden || resp["code"] != "INSUFFICIENT_SCOPE" {
+		t.Errorf("keys without scope: status = %d, body = %v", status, resp)
+	}
+	if status, resp := env.do("GET", "/api/keys", nil, nil); status != http.StatusUnauthorized || resp["code"] != "API_KEY_REQUIRED" {
+		t.Errorf("keys without api key: status = %d, body = %v", status, resp)
+	}
+	if status, resp := env.do("GET", "/api/images", nil, bearer("nai_invalid")); status != http.StatusUnauthorized || resp["code"] != "INVALID_API_KEY" {
+		t.Errorf("invalid key: status = %d, body = %v", status, resp)
+	}
+
+	// 禁用用户后其密钥失效
+	env.admin("POST", "/users/"+userID+"/disable", nil)
+	if status, resp := env.do("POST", "/api/generate", map[string]any{"prompt": "test"}, bearer(key)); status != http.StatusUnauthorized || resp["code"] != "INVALID_API_KEY" {
+		t.Errorf("disabled user: status = %d, body = %v", status, resp)
+	}
+	env.admin("POST", "/users/"+userID+"/enable", nil)
+	if status, resp := env.do("GET", "/api/images", nil, bearer(key)); status != http.StatusOK {
+		t.Errorf("enabled user: status = %d, body = %v", status, resp)
+	}
+
+	// 自助创建的密钥不能超出当前密钥的权限范围
+	status, own := env.do("POST", "/api/keys", map[string]any{"name": "ci", "scopes": []string{"generate"}}, bearer(env.apiKey))
+	if status != http.StatusCreated {
+		t.Fatalf("create own key status = %d, body = %v", status, own)
+	}
+	ownKey := own["key"].(string)
+	if status, resp := env.do("POST", "/api/keys", map[string]any{"scopes": []string{"keys"}}, bearer(ownKey)); status != http.StatusForbidden {
+		t.Errorf("escalation: status = %d, body = %v", status, resp)
+	}
+	_, list := env.do("GET", "/api/keys", nil, bearer(env.apiKey))
+	if keys := list["keys"].([]any); len(keys) != 2 {
+		t.Errorf("keys = %v", keys)
+	}
+
+	// 只能撤销自己的密钥，撤销后立即失效
+	if status, _ := env.do("DELETE", "/api/keys/"+formatID(record["id"].(float64)), nil, bearer(env.apiKey)); status != http.StatusNotFound {
+		t.Errorf("revoke other user's key: status = %d, want 404", status)
+	}
+	status, revoked := env.do("DELETE", "/api/keys/"+formatID(own["api_key"].(map[string]any)["id"].(float64)), nil, bearer(env.apiKey))
+	if status != http.StatusOK || revoked["revoked_at"] == nil {
+		t.Fatalf("revoke status = %d, body = %v", status, revoked)
+	}
+	if status, resp := env.do("GET", "/api/images", nil, bearer(ownKey)); status != http.StatusUnauthorized || resp["code"] != "INVALID_API_KEY" {
+		t.Errorf("revoked key: status = %d, body = %v", status, resp)
+	}
+	status, _ = env.admin("DELETE", "/users/"+userID+"/keys/"+formatID(record["id"].(float64)), nil)
+	if status != http.StatusOK {
+		t.Errorf("admin revoke status = %d", status)
+	}
+	_, list = env.admin("GET", "/users/"+userID+"/keys", nil)
+	if keys := list["keys"].([]any); len(keys) != 1 || keys[0].(map[string]any)["revoked_at"] == nil {
+		t.Errorf("keys = %v", keys)
+	}
+}
+
+func TestAnlasQuota(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.AnlasQuotaUserDaily = 45
+		cfg.AnlasQuotaIPDaily = 10
+		cfg.CaptchaProvider = "disabled"
+		cfg.RateLimitGlobalBurst = 10
+		cfg.RateLimitIPBurst = 10
+	})
+	// 832x1216、28 步每张消耗 20 Anlas
+	body := map[string]any{"prompt": "test"}
+
+	status, estimate := env.do("POST", "/api/generate/estimate", map[string]any{"prompt": "test", "n_samples": 2}, bearer(env.apiKey))
+	if status != http.StatusOK || estimate["anlas"] != float64(40) {
+		t.Fatalf("estimate status = %d, body = %v", status, estimate)
+	}
+
+	// NovelAI 调用失败时退还配额
+	env.novelai.Enqueue(fakenovelai.Error(http.StatusInternalServerError, "boom"))
+	if status, _ := env.generate(body); status != http.StatusInternalServerError {
+		t.Fatalf("failed generation status = %d", status)
+	}
+	for i := 0; i < 2; i++ {
+		if status, resp := env.generate(body); status != http.StatusOK {
+			t.Fatalf("request %d: status = %d, body = %v", i, status, resp)
+		}
+	}
+
+	status, header, resp := env.doWithHeaders("POST", "/api/generate", body, bearer(env.apiKey))
+	if status != http.StatusTooManyRequests || resp["code"] != "QUOTA_EXCEEDED" || resp["cost"] != float64(20) {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	if msg, _ := resp["error"].(string); !strings.Contains(msg, "Daily Anlas quota for this user exceeded: 40 of 45 used") {
+		t.Errorf("error = %q", msg)
+	}
+	if header.Get("Retry-After") == "" {
+		t.Errorf("Retry-After should be set")
+	}
+	if len(env.novelai.Requests()) != 3 {
+		t.Errorf("novelai requests = %d, want 3", len(env.novelai.Requests()))
+	}
+
+	_, quota := env.do("GET", "/api/quota", nil, bearer(env.apiKey))
+	quotas := quota["quotas"].([]any)
+	if len(quotas) != 4 {
+		t.Fatalf("quotas = %v", quotas)
+	}
+	daily := quotas[0].(map[string]any)
+	if daily["subject"] != "user" || daily["period"] != "day" || daily["used"] != float64(40) ||
+		daily["limit"] != float64(45) || daily["remaining"] != float64(5) {
+		t.Errorf("user daily quota = %v", daily)
+	}
+	if monthly := quotas[1].(map[string]any); monthly["used"] != float64(40) || monthly["limit"] != nil {
+		t.Errorf("user monthly quota = %v", monthly)
+	}
+
+	// 匿名请求按客户端统计
+	status, resp = env.do("POST", "/api/generate", body, nil)
+	if status != http.StatusTooManyRequests || resp["code"] != "QUOTA_EXCEEDED" {
+		t.Errorf("anonymous: status = %d, body = %v", status, resp)
+	}
+	_, quota = env.do("GET", "/api/quota", nil, nil)
+	if quotas := quota["quotas"].([]any); len(quotas) != 2 || quotas[0].(map[string]any)["subject"] != "ip" {
+		t.Errorf("anonymous quotas = %v", quotas)
+	}
+}
+
+func TestGetImagesByIDs(t *testing.T) {
+	env := newTestEnv(t)
+
+	var ids []float64
+	for i := 0; i < 3; i++ {
+		_, resp := env.generate(map[string]any{"prompt": "test", "seed": i + 1})
+		ids = append(ids, resp["id"].(float64))
+	}
+
+	status, resp := env.do("POST", "/api/images/batch", map[string]any{"ids": ids[:2]}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	images := resp["images"].([]any)
+	if len(images) != 2 {
+		t.Fatalf("images = %d, want 2", len(images))
+	}
+	for _, img := range images {
+		id := img.(map[string]any)["id"].(float64)
+		if id != ids[0] && id != ids[1] {
+			t.Errorf("unexpected id %v", id)
+		}
+	}
+
+	status, _ = env.do("POST", "/api/images/batch", map[string]any{"ids": []uint{}}, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("empty ids status = %d, want 400", status)
+	}
+}
+
+func TestGetImageNotFound(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, _ := env.do("GET", "/api/images/999", nil, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", status)
+	}
+}
+
+// seedImages 直接写入生成记录，返回按写入顺序排列的 ID
+func seedImages(t *testing.T, env *testEnv, images []model.ImageGeneration) []float64 {
+	t.Helper()
+	db, err := database.Open(env.cfg.DatabasePath, logger.Silent)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	ids := make([]float64, len(images))
+	for i := range images {
+		images[i].FilePath = fmt.Sprintf("seed/%d.png", i)
+		images[i].FileName = fmt.Sprintf("%d.png", i)
+		if err := db.Create(&images[i]).Error; err != nil {
+			t.Fatalf("failed to create image: %v", err)
+		}
+		ids[i] = float64(images[i].ID)
+	}
+	return ids
+}
+
+// listImageIDs 列出图像，返回响应中的 ID 和完整响应
+func (e *testEnv) listImageIDs(query string) (int, []float64, map[string]any) {
+	e.t.Helper()
+	status, resp := e.do("GET", "/api/images?"+query, nil, nil)
+	var ids []float64
+	if list, ok := resp["images"].([]any); ok {
+		for _, image := range list {
+			ids = append(ids, image.(map[string]any)["id"].(float64))
+		}
+	}
+	return status, ids, resp
+}
+
+func TestListImagesFilters(t *testing.T) {
+	env := newTestEnv(t)
+
+	presetID := uint(7)
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	ids := seedImages(t, env, []model.ImageGeneration{
+		{CreatedAt: base, Prompt: "a", Seed: 1, Width: 832, Height: 1216, Status: "success", BatchID: "batch-a", StylePresetID: &presetID},
+		{CreatedAt: base.AddDate(0, 0, 1), Prompt: "b", Seed: 2, Width: 1024, Height: 1024, Status: "success", BatchID: "batch-a", StylePresetID: &presetID},
+		{CreatedAt: base.AddDate(0, 0, 2), Prompt: "c", Seed: 3, Width: 1216, Height: 832, Status: "failed"},
+		{CreatedAt: base.AddDate(0, 0, 3), Prompt: "d", Seed: 4, Width: 640, Height: 640, Status: "success"},
+		{CreatedAt: base.AddDate(0, 0, 4), Prompt: "e", Seed: 5, Width: 1024, Height: 1024, Status: "pending"},
+	})
+	rfc3339 := func(t time.Time) string { return url.QueryEscape(t.Format(time.RFC3339)) }
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int // ids 的下标，按创建时间升序
+	}{
+		{"no filter", "", []int{0, 1, 2, 3, 4}},
+		{"status", "status=success", []int{0, 1, 3}},
+		{"style preset", "style_preset_id=7", []int{0, 1}},
+		{"batch", "batch_id=batch-a", []int{0, 1}},
+		{"exact size", "width=1024&height=1024", []int{1, 4}},
+		{"min width", "min_width=1000", []int{1, 2, 4}},
+		{"max width", "max_width=832", []int{0, 3}},
+		{"height range", "min_height=700&max_height=1100", []int{1, 2, 4}},
+		{"seed", "seed=3", []int{2}},
+		{"date range includes end day", "created_from=2024-03-02&created_to=2024-03-03", []int{1, 2}},
+		{"time range excludes end", "created_from=" + rfc3339(base.AddDate(0, 0, 1)) + "&created_to=" + rfc3339(base.AddDate(0, 0, 3)), []int{1, 2}},
+		// 与服务器时区不同的偏移量按实际时刻比较
+		{"time range with offsets", "created_from=" + rfc3339(base.AddDate(0, 0, 1).In(time.FixedZone("", 9*3600))) +
+			"&created_to=" + rfc3339(base.AddDate(0, 0, 3).In(time.FixedZone("", -5*3600))), []int{1, 2}},
+		{"combined", "status=success&min_width=1000", []int{1}},
+		{"no match", "seed=99", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, got, resp := env.listImageIDs(tt.query + "&order=asc")
+			if status != http.StatusOK {
+				t.Fatalf("status = %d, body = %v", status, resp)
+			}
+			var want []float64
+			for _, i := range tt.want {
+				want = append(want, ids[i])
+			}
+			if !reflect.DeepEqual(got, want) || resp["total"] != float64(len(want)) {
+				t.Errorf("ids = %v, total = %v, want %v", got, resp["total"], want)
+			}
+		})
+	}
+
+	// 默认按创建时间倒序
+	if _, got, _ := env.listImageIDs("status=success"); !reflect.DeepEqual(got, []float64{ids[3], ids[1], ids[0]}) {
+		t.Errorf("default order ids = %v", got)
+	}
+
+	for _, query := range []string{"status=unknown", "created_from=yesterday", "created_to=2024-13-01", "limit=101", "sort=prompt", "cursor=invalid"} {
+		if status, _, resp := env.listImageIDs(query); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, body = %v, want 400", query, status, resp)
+		}
+	}
+}
+
+func TestListImagesCursor(t *testing.T) {
+	env := newTestEnv(t)
+
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ids := seedImages(t, env, []model.ImageGeneration{
+		{CreatedAt: base, Prompt: "a", Seed: 30, Width: 832, Status: "success"},
+		{CreatedAt: base.Add(time.Hour), Prompt: "b", Seed: 10, Width: 1024, Status: "success"},
+		{CreatedAt: base.Add(2 * time.Hour), Prompt: "c", Seed: 10, Width: 1024, Status: "failed"},
+		{CreatedAt: base.Add(3 * time.Hour), Prompt: "d", Seed: 20, Width: 640, Status: "success"},
+		{CreatedAt: base.Add(4 * time.Hour), Prompt: "e", Seed: 10, Width: 1216, Status: "success"},
+	})
+
+	// pages 依次读取全部页，返回每页的 ID
+	pages := func(query string) [][]float64 {
+		t.Helper()
+		var result [][]float64
+		cursor := ""
+		for len(result) < 10 {
+			status, got, resp := env.listImageIDs(query + "&cursor=" + cursor)
+			if status != http.StatusOK {
+				t.Fatalf("%s: status = %d, body = %v", query, status, resp)
+			}
+			if cursor != "" {
+				if _, ok := resp["page"]; ok {
+					t.Errorf("%s: cursor response should not include page", query)
+				}
+			}
+			result = append(result, got)
+			next, _ := resp["next_cursor"].(string)
+			if resp["has_more"] != (next != "") {
+				t.Errorf("%s: has_more = %v, next_cursor = %q", query, resp["has_more"], next)
+			}
+			if next == "" {
+				break
+			}
+			cursor = url.QueryEscape(next)
+		}
+		return result
+	}
+	page := func(indexes ...int) []float64 {
+		var result []float64
+		for _, i := range indexes {
+			result = append(result, ids[i])
+		}
+		return result
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  [][]float64
+	}{
+		{"created at desc", "limit=2", [][]float64{page(4, 3), page(2, 1), page(0)}},
+		{"created at asc", "limit=2&order=asc", [][]float64{page(0, 1), page(2, 3), page(4)}},
+		{"id", "limit=3&sort=id&order=asc", [][]float64{page(0, 1, 2), page(3, 4)}},
+		// 排序值相同的记录按 ID 排序，翻页时不会重复或遗漏
+		{"ties across boundary asc", "limit=2&sort=seed&order=asc", [][]float64{page(1, 2), page(4, 3), page(0)}},
+		{"ties across boundary desc", "limit=2&sort=seed", [][]float64{page(0, 3), page(4, 2), page(1)}},
+		{"with filter", "limit=2&status=success", [][]float64{page(4, 3), page(1, 0)}},
+		{"exact page size", "limit=5", [][]float64{page(4, 3, 2, 1, 0)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pages(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 游标必须与排序字段一致
+	_, _, resp := env.listImageIDs("limit=2")
+	if status, _, resp := env.listImageIDs("limit=2&sort=seed&cursor=" + url.QueryEscape(resp["next_cursor"].(string))); status != http.StatusBadRequest {
+		t.Errorf("mismatched cursor: status = %d, body = %v, want 400", status, resp)
+	}
+}
+
+func TestAsyncGenerationEvents(t *testing.T) {
+	env := newTestEnv(t)
+	env.novelai.Enqueue(fakenovelai.Slow(300 * time.Millisecond))
+
+	status, resp := env.generate(map[string]any{"prompt": "test", "async": true})
+	if status != http.StatusAccepted {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	jobID := resp["job_id"].(float64)
+
+	eventsResp, err := http.Get(env.server.URL + "/api/jobs/" + formatID(jobID) + "/events")
+	if err != nil {
+		t.Fatalf("failed to open event stream: %v", err)
+	}
+	defer eventsResp.Body.Close()
+
+	var events []string
+	scanner := bufio.NewScanner(eventsResp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, name)
+		}
+	}
+
+	if len(events) == 0 || events[len(events)-1] != "completed" {
+		t.Fatalf("events = %v, want to end with completed", events)
+	}
+	for _, want := range []string{"novelai_response", "file_saved"} {
+		found := false
+		for _, e := range events {
+			found = found || e == want
+		}
+		if !found {
+			t.Errorf("events = %v, missing %s", events, want)
+		}
+	}
+
+	job := env.waitJob(jobID)
+	if job["status"] != "success" || job["generation"] == nil {
+		t.Errorf("unexpected job: %v", job)
+	}
+}
+
+func TestGenerateImageSamplingParameters(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, resp := env.generate(map[string]any{
+		"prompt":         "test",
+		"model":          "nai-diffusion-3",
+		"sampler":        "k_dpmpp_2m",
+		"scale":          6.5,
+		"noise_schedule": "native",
+		"sm":             true,
+		"sm_dyn":         true,
+		"cfg_rescale":    0.2,
+		"variety_boost":  true,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+
+	payload := env.novelai.Requests()[0].Payload
+	params := payload["parameters"].(map[string]any)
+	if payload["model"] != "nai-diffusion-3" || params["sampler"] != "k_dpmpp_2m" ||
+		params["scale"] != 6.5 || params["noise_schedule"] != "native" ||
+		params["sm"] != true || params["sm_dyn"] != true || params["cfg_rescale"] != 0.2 ||
+		params["skip_cfg_above_sigma"] == nil || params["dynamic_thresholding"] != true {
+		t.Errorf("unexpected payload: %v", payload)
+	}
+
+	_, image := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+	if image["model"] != "nai-diffusion-3" || image["sampler"] != "k_dpmpp_2m" || image["scale"] != 6.5 || image["sm"] != true {
+		t.Errorf("parameters not persisted: %v", image)
+	}
+}
+
+func TestGenerateImageDefaultParameters(t *testing.T) {
+	env := newTestEnv(t)
+
+	if status, resp := env.generate(map[string]any{"prompt": "test"}); status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+
+	payload := env.novelai.Requests()[0].Payload
+	params := payload["parameters"].(map[string]any)
+	if payload["model"] != env.cfg.DefaultModel || params["sampler"] != env.cfg.DefaultSampler ||
+		params["scale"] != env.cfg.DefaultScale || params["noise_schedule"] != env.cfg.DefaultNoiseSchedule {
+		t.Errorf("defaults not applied: %v", payload)
+	}
+}
+
+func TestGenerateImageInvalidParameters(t *testing.T) {
+	tests := []struct {
+		name string
+		body map[string]any
+	}{
+		{"unknown model", map[string]any{"model": "nai-diffusion-9"}},
+		{"sampler not allowed", map[string]any{"model": "nai-diffusion-4-5-full", "sampler": "ddim_v3"}},
+		{"native schedule on v4", map[string]any{"noise_schedule": "native"}},
+		{"smea on v4", map[string]any{"sm": true}},
+		{"scale out of range", map[string]any{"scale": 11}},
+		{"cfg rescale out of range", map[string]any{"cfg_rescale": 1.5}},
+	}
+
+	env := newTestEnv(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.body["prompt"] = "test"
+			status, resp := env.generate(tt.body)
+			if status != http.StatusBadRequest {
+				t.Errorf("status = %d, body = %v", status, resp)
+			}
+		})
+	}
+	if len(env.novelai.Requests()) != 0 {
+		t.Errorf("novelai should not be called")
+	}
+}
+
+func TestImg2Img(t *testing.T) {
+	env := newTestEnv(t)
+
+	source, err := fakenovelai.PNG(512, 512, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 上传源图像
+	status, resp := env.generate(map[string]any{
+		"prompt":   "test",
+		"action":   "img2img",
+		"image":    "data:image/png;base64," + base64.StdEncoding.EncodeToString(source),
+		"strength": 0.5,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+
+	payload := env.novelai.Requests()[0].Payload
+	params := payload["parameters"].(map[string]any)
+	if payload["action"] != "img2img" || params["image"] == "" || params["strength"] != 0.5 ||
+		params["width"] != float64(512) || params["height"] != float64(512) {
+		t.Errorf("unexpected payload: action=%v strength=%v size=%vx%v", payload["action"], params["strength"], params["width"], params["height"])
+	}
+
+	firstID := resp["id"].(float64)
+	_, image := env.do("GET", "/api/images/"+formatID(firstID), nil, nil)
+	if image["action"] != "img2img" || image["source_image_url"] == "" || image["source_generation_id"] != nil {
+		t.Errorf("unexpected image: %v", image)
+	}
+	sourceResp, err := http.Get(env.server.URL + image["source_image_url"].(string))
+	if err != nil || sourceResp.StatusCode != http.StatusOK {
+		t.Fatalf("source image not served: %v", err)
+	}
+	sourceResp.Body.Close()
+
+	// 使用历史生成作为源图像
+	status, resp = env.generate(map[string]any{
+		"prompt":               "test",
+		"action":               "img2img",
+		"source_generation_id": firstID,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	_, image = env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+	if image["source_generation_id"] != firstID || image["strength"] != 0.7 {
+		t.Errorf("unexpected image: %v", image)
+	}
+
+	// 尺寸不一致
+	status, _ = env.generate(map[string]any{
+		"prompt":               "test",
+		"action":               "img2img",
+		"source_generation_id": firstID,
+		"width":                832,
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("size mismatch status = %d, want 400", status)
+	}
+
+	// 缺少源图像
+	status, _ = env.generate(map[string]any{"prompt": "test", "action": "img2img"})
+	if status != http.StatusBadRequest {
+		t.Errorf("missing source status = %d, want 400", status)
+	}
+}
+
+func TestInfill(t *testing.T) {
+	env := newTestEnv(t)
+
+	source, err := fakenovelai.PNG(512, 512, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1/8 尺寸的蒙版
+	maskImg := image.NewGray(image.Rect(0, 0, 64, 64))
+	maskImg.SetGray(3, 3, color.Gray{Y: 255})
+	var maskBuf bytes.Buffer
+	if err := png.Encode(&maskBuf, maskImg); err != nil {
+		t.Fatal(err)
+	}
+
+	status, resp := env.generate(map[string]any{
+		"prompt": "test",
+		"action": "infill",
+		"image":  base64.StdEncoding.EncodeToString(source),
+		"mask":   base64.StdEncoding.EncodeToString(maskBuf.Bytes()),
+	})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+
+	payload := env.novelai.Requests()[0].Payload
+	params := payload["parameters"].(map[string]any)
+	if payload["action"] != "infill" || payload["model"] != "nai-diffusion-4-5-full-inpainting" ||
+		params["mask"] == "" || params["image"] == "" || params["add_original_image"] != true {
+		t.Errorf("unexpected payload: action=%v model=%v", payload["action"], payload["model"])
+	}
+	sentMask, _ := base64.StdEncoding.DecodeString(params["mask"].(string))
+	if cfg, err := png.DecodeConfig(bytes.NewReader(sentMask)); err != nil || cfg.Width != 512 || cfg.Height != 512 {
+		t.Errorf("mask should be upscaled to 512x512: %v %v", cfg, err)
+	}
+
+	firstID := resp["id"].(float64)
+	_, record := env.do("GET", "/api/images/"+formatID(firstID), nil, nil)
+	if record["action"] != "infill" || record["mask_image_url"] == "" || record["source_image_url"] == "" {
+		t.Errorf("unexpected image: %v", record)
+	}
+	if filepath.Dir(record["mask_image_url"].(string)) != filepath.Dir(record["image_url"].(string)) {
+		t.Errorf("mask should be stored next to the result: %v", record)
+	}
+
+	// 复用历史蒙版和源图像
+	status, resp = env.generate(map[string]any{
+		"prompt":               "test",
+		"action":               "infill",
+		"source_generation_id": firstID,
+		"mask_generation_id":   firstID,
+		"add_original_image":   false,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	_, second := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+	if second["mask_image_url"] != record["mask_image_url"] || second["add_original_image"] != false {
+		t.Errorf("mask from history not linked: %v", second)
+	}
+
+	// 蒙版尺寸不一致
+	wrongMask := image.NewGray(image.Rect(0, 0, 100, 100))
+	wrongMask.SetGray(3, 3, color.Gray{Y: 255})
+	maskBuf.Reset()
+	if err := png.Encode(&maskBuf, wrongMask); err != nil {
+		t.Fatal(err)
+	}
+	status, resp = env.generate(map[string]any{
+		"prompt": "test",
+		"action": "infill",
+		"image":  base64.StdEncoding.EncodeToString(source),
+		"mask":   base64.StdEncoding.EncodeToString(maskBuf.Bytes()),
+	})
+	if status != http.StatusBadRequest || !strings.Contains(fmt.Sprint(resp), "mask size 100x100 must match image size 512x512") {
+		t.Errorf("mask size mismatch: status = %d, body = %v", status, resp)
+	}
+
+	// 缺少蒙版
+	status, _ = env.generate(map[string]any{
+		"prompt": "test",
+		"action": "infill",
+		"image":  base64.StdEncoding.EncodeToString(source),
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("missing mask status = %d, want 400", status)
+	}
+}
+
+func TestGenerateImageCharacters(t *testing.T) {
+	env := newTestEnv(t)
+
+	characters := []map[string]any{
+		{"prompt": "girl, red hair", "negative_prompt": "lowres", "position": "B2"},
+		{"prompt": "boy, black hair"},
+	}
+	status, resp := env.generate(map[string]any{"prompt": "2people", "characters": characters})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+
+	params := env.novelai.Requests()[0].Payload["parameters"].(map[string]any)
+	if params["use_coords"] != true {
+		t.Errorf("use_coords = %v, want true", params["use_coords"])
+	}
+	prompts := params["characterPrompts"].([]any)
+	if len(prompts) != 2 {
+		t.Fatalf("characterPrompts = %v", prompts)
+	}
+	first := prompts[0].(map[string]any)
+	center := first["center"].(map[string]any)
+	if first["prompt"] != "girl, red hair" || first["uc"] != "lowres" || center["x"] != 0.3 || center["y"] != 0.3 {
+		t.Errorf("unexpected character prompt: %v", first)
+	}
+	positive := params["v4_prompt"].(map[string]any)["caption"].(map[string]any)["char_captions"].([]any)
+	negative := params["v4_negative_prompt"].(map[string]any)["caption"].(map[string]any)["char_captions"].([]any)
+	if len(positive) != 2 || positive[1].(map[string]any)["char_caption"] != "boy, black hair" ||
+		len(negative) != 2 || negative[0].(map[string]any)["char_caption"] != "lowres" {
+		t.Errorf("unexpected char_captions: %v / %v", positive, negative)
+	}
+
+	_, record := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+	stored := record["characters"].([]any)
+	if len(stored) != 2 || stored[0].(map[string]any)["position"] != "B2" {
+		t.Errorf("characters not persisted: %v", record["characters"])
+	}
+
+	// 校验
+	for _, body := range []map[string]any{
+		{"prompt": "x", "characters": []map[string]any{{"prompt": "a", "position": "F9"}}},
+		{"prompt": "x", "characters": []map[string]any{{"prompt": ""}}},
+		{"prompt": "x", "model": "nai-diffusion-3", "characters": []map[string]any{{"prompt": "a"}}},
+	} {
+		if status, resp := env.generate(body); status != http.StatusBadRequest {
+			t.Errorf("status = %d, body = %v, want 400", status, resp)
+		}
+	}
+}
+
+func TestGenerateImageVibeTransfer(t *testing.T) {
+	env := newTestEnv(t)
+
+	reference, err := fakenovelai.PNG(64, 64, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedReference := base64.StdEncoding.EncodeToString(reference)
+	body := map[string]any{
+		"prompt":     "test",
+		"references": []map[string]any{{"image": encodedReference, "strength": 0.4}},
+	}
+
+	// V4 模型先编码，相同图像和参数第二次命中缓存
+	for i := 0; i < 2; i++ {
+		if status, resp := env.generate(body); status != http.StatusOK {
+			t.Fatalf("status = %d, body = %v", status, resp)
+		}
+	}
+
+	var encodes, generates []fakenovelai.Request
+	for _, req := range env.novelai.Requests() {
+		switch req.Path {
+		case "/ai/encode-vibe":
+			encodes = append(encodes, req)
+		case "/ai/generate-image":
+			generates = append(generates, req)
+		}
+	}
+	if len(encodes) != 1 || len(generates) != 2 {
+		t.Fatalf("encode-vibe calls = %d, generate calls = %d, want 1 and 2", len(encodes), len(generates))
+	}
+	if encodes[0].Payload["model"] != "nai-diffusion-4-5-full" || encodes[0].Payload["information_extracted"] != 1.0 {
+		t.Errorf("unexpected encode payload: %v", encodes[0].Payload)
+	}
+
+	want := base64.StdEncoding.EncodeToString(fakenovelai.VibeEncoding(encodes[0].Payload["image"].(string), "nai-diffusion-4-5-full", 1.0))
+	for _, req := range generates {
+		params := req.Payload["parameters"].(map[string]any)
+		images := params["reference_image_multiple"].([]any)
+		strengths := params["reference_strength_multiple"].([]any)
+		if len(images) != 1 || images[0] != want || strengths[0] != 0.4 ||
+			params["normalize_reference_strength_multiple"] != true {
+			t.Errorf("unexpected reference parameters: %v %v", images, strengths)
+		}
+	}
+
+	// V3 模型直接发送图像
+	body["model"] = "nai-diffusion-3"
+	status, resp := env.generate(body)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	requests := env.novelai.Requests()
+	last := requests[len(requests)-1]
+	images := last.Payload["parameters"].(map[string]any)["reference_image_multiple"].([]any)
+	if len(requests) != 4 || last.Path != "/ai/generate-image" || len(images) != 1 || images[0] != encodedReference {
+		t.Errorf("v3 reference not sent as image: %d requests, %v", len(requests), last.Path)
+	}
+
+	_, record := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+	stored := record["references"].([]any)
+	if len(stored) != 1 || stored[0].(map[string]any)["image_hash"] == "" || stored[0].(map[string]any)["strength"] != 0.4 {
+		t.Errorf("references not persisted: %v", record["references"])
+	}
+
+	// 校验
+	for _, refs := range []map[string]any{
+		{"image": encodedReference, "strength": 1.5},
+		{"image": encodedReference, "information_extracted": 0},
+		{},
+	} {
+		if status, resp := env.generate(map[string]any{"prompt": "x", "references": []map[string]any{refs}}); status != http.StatusBadRequest {
+			t.Errorf("status = %d, body = %v, want 400", status, resp)
+		}
+	}
+}
+
+func TestGenerateImageMultipleSamples(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, resp := env.generate(map[string]any{"prompt": "test", "seed": 100, "n_samples": 3})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	if n := env.novelai.Requests()[0].Payload["parameters"].(map[string]any)["n_samples"]; n != float64(3) {
+		t.Errorf("n_samples = %v, want 3", n)
+	}
+
+	images := resp["images"].([]any)
+	if len(images) != 3 || resp["batch_id"] == "" {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+	for i, item := range images {
+		image := item.(map[string]any)
+		if image["seed"] != float64(100+i) {
+			t.Errorf("image %d seed = %v, want %d", i, image["seed"], 100+i)
+		}
+		_, record := env.do("GET", "/api/images/"+formatID(image["id"].(float64)), nil, nil)
+		if record["batch_id"] != resp["batch_id"] || record["batch_index"] != float64(i) || record["seed"] != float64(100+i) {
+			t.Errorf("unexpected record %d: %v", i, record)
+		}
+	}
+
+	_, list := env.do("GET", "/api/images?batch_id="+resp["batch_id"].(string), nil, nil)
+	if list["total"] != float64(3) {
+		t.Errorf("batch list total = %v, want 3", list["total"])
+	}
+
+	// 异步任务返回整个批次
+	status, resp = env.generate(map[string]any{"prompt": "test", "n_samples": 2, "async": true})
+	if status != http.StatusAccepted {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	job := env.waitJob(resp["job_id"].(float64))
+	if generations, _ := job["generations"].([]any); job["status"] != "success" || len(generations) != 2 {
+		t.Errorf("unexpected job: %v", job)
+	}
+
+	if status, _ := env.generate(map[string]any{"prompt": "test", "n_samples": 5}); status != http.StatusBadRequest {
+		t.Errorf("n_samples 5 status = %d, want 400", status)
+	}
+}
+
+func TestStreamGenerateImage(t *testing.T) {
+	env := newTestEnv(t)
+
+	data, _ := json.Marshal(map[string]any{"prompt": "test", "seed": 42, "width": 512, "height": 512})
+	req, _ := http.NewRequest("POST", env.server.URL+"/api/generate/stream", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+env.apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, content type = %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	var names []string
+	var previews int
+	var completed map[string]any
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			names = append(names, name)
+			continue
+		}
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event map[string]any
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			t.Fatalf("invalid event: %v", err)
+		}
+		switch event["type"] {
+		case "preview":
+			previews++
+			image, _ := event["data"].(map[string]any)["image"].(string)
+			if !strings.HasPrefix(image, "data:image/jpeg;base64,") {
+				t.Errorf("unexpected preview image prefix: %.40s", image)
+			}
+		case "completed":
+			completed = event["data"].(map[string]any)
+		}
+	}
+
+	if previews != len(fakenovelai.StreamPreviewSteps) {
+		t.Errorf("previews = %d, want %d (events %v)", previews, len(fakenovelai.StreamPreviewSteps), names)
+	}
+	if completed == nil || completed["seed"] != float64(42) {
+		t.Fatalf("events = %v, completed = %v", names, completed)
+	}
+
+	sent := env.novelai.Requests()[0]
+	if sent.Path != "/ai/generate-image-stream" || sent.Payload["parameters"].(map[string]any)["stream"] != "sse" {
+		t.Errorf("unexpected request: %s %v", sent.Path, sent.Payload["parameters"].(map[string]any)["stream"])
+	}
+
+	_, image := env.do("GET", "/api/images/"+formatID(completed["id"].(float64)), nil, nil)
+	if image["status"] != "success" || image["width"] != float64(512) {
+		t.Errorf("unexpected image: %v", image)
+	}
+	fileResp, err := http.Get(env.server.URL + completed["image_url"].(string))
+	if err != nil || fileResp.StatusCode != http.StatusOK {
+		t.Fatalf("final image not served: %v", err)
+	}
+	fileResp.Body.Close()
+
+	if status, _ := env.do("POST", "/api/generate/stream", map[string]any{"prompt": "test", "n_samples": 2},
+		bearer(env.apiKey)); status != http.StatusBadRequest {
+		t.Errorf("n_samples 2 status = %d, want 400", status)
+	}
+}
+
+func TestStylePresetManagement(t *testing.T) {
+	env := newTestEnv(t)
+
+	// 鉴权
+	if status, _ := env.do("GET", "/api/admin/style-presets", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("missing admin key status = %d, want 401", status)
+	}
+
+	status, first := env.admin("POST", "/style-presets", map[string]any{
+		"name":          "Watercolor",
+		"prefix_prompt": "{{watercolor}}, ",
+	})
+	if status != http.StatusCreated || first["enabled"] != true || first["sort_order"] != float64(0) {
+		t.Fatalf("status = %d, body = %v", status, first)
+	}
+	status, second := env.admin("POST", "/style-presets", map[string]any{"name": "Sketch", "enabled": false})
+	if status != http.StatusCreated || second["enabled"] != false || second["sort_order"] != float64(1) {
+		t.Fatalf("status = %d, body = %v", status, second)
+	}
+	firstID, secondID := first["id"].(float64), second["id"].(float64)
+
+	// 名称重复和提示词校验
+	if status, resp := env.admin("POST", "/style-presets", map[string]any{"name": " Watercolor "}); status != http.StatusConflict || resp["code"] != "DUPLICATE_NAME" {
+		t.Errorf("duplicate name status = %d, body = %v", status, resp)
+	}
+	if status, _ := env.admin("POST", "/style-presets", map[string]any{"name": "Broken", "suffix_prompt": ", {masterpiece"}); status != http.StatusBadRequest {
+		t.Errorf("unbalanced prompt status = %d, want 400", status)
+	}
+	if status, _ := env.admin("PUT", "/style-presets/"+formatID(secondID), map[string]any{"name": "Watercolor"}); status != http.StatusConflict {
+		t.Errorf("rename to duplicate status = %d, want 409", status)
+	}
+
+	// 禁用的预设不出现在公开列表中
+	_, public := env.do("GET", "/api/style-presets", nil, nil)
+	if presets := public["presets"].([]any); len(presets) != 1 {
+		t.Errorf("public presets = %v, want 1", presets)
+	}
+	if status, resp := env.admin("POST", "/style-presets/"+formatID(secondID)+"/enable", nil); status != http.StatusOK || resp["enabled"] != true {
+		t.Errorf("enable status = %d, body = %v", status, resp)
+	}
+
+	// 排序
+	status, resp := env.admin("PUT", "/style-presets/order", map[string]any{"ids": []float64{secondID, firstID}})
+	if status != http.StatusOK {
+		t.Fatalf("reorder status = %d, body = %v", status, resp)
+	}
+	_, public = env.do("GET", "/api/style-presets", nil, nil)
+	presets := public["presets"].([]any)
+	if len(presets) != 2 || presets[0].(map[string]any)["id"] != secondID {
+		t.Errorf("presets not reordered: %v", presets)
+	}
+	if status, _ := env.admin("PUT", "/style-presets/order", map[string]any{"ids": []float64{firstID, firstID}}); status != http.StatusBadRequest {
+		t.Errorf("duplicated ids status = %d, want 400", status)
+	}
+
+	// 更新后用于生成
+	status, resp = env.admin("PUT", "/style-presets/"+formatID(firstID), map[string]any{
+		"name":          "Watercolor",
+		"prefix_prompt": "watercolor, ",
+	})
+	if status != http.StatusOK || resp["prefix_prompt"] != "watercolor, " || resp["sort_order"] != float64(1) {
+		t.Errorf("update status = %d, body = %v", status, resp)
+	}
+	if status, resp := env.generate(map[string]any{"prompt": "cat", "style_preset_id": firstID}); status != http.StatusOK {
+		t.Fatalf("generate status = %d, body = %v", status, resp)
+	}
+	if input := env.novelai.Requests()[0].Payload["input"]; input != "watercolor, cat" {
+		t.Errorf("input = %v, want preset applied", input)
+	}
+
+	// 删除
+	if status, _ := env.admin("DELETE", "/style-presets/"+formatID(firstID), nil); status != http.StatusOK {
+		t.Errorf("delete status = %d, want 200", status)
+	}
+	if status, _ := env.admin("DELETE", "/style-presets/"+formatID(firstID), nil); status != http.StatusNotFound {
+		t.Errorf("second delete status = %d, want 404", status)
+	}
+}
+
+func TestStylePresetTemplate(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, preset := env.admin("POST", "/style-presets", map[string]any{
+		"name":                     "Template",
+		"prompt_template":          "masterpiece, ${prompt}, ${medium:watercolor}",
+		"negative_prompt_template": "${negative}, lowres",
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("status = %d, body = %v", status, preset)
+	}
+	id := formatID(preset["id"].(float64))
+
+	if status, _ := env.admin("POST", "/style-presets", map[string]any{"name": "Bad", "prompt_template": "${prompt"}); status != http.StatusBadRequest {
+		t.Errorf("invalid template status = %d, want 400", status)
+	}
+
+	status, preview := env.do("POST", "/api/style-presets/"+id+"/preview", map[string]any{
+		"prompt":          "1girl, ",
+		"negative_prompt": "blurry",
+	}, nil)
+	if status != http.StatusOK || preview["prompt"] != "masterpiece, 1girl, watercolor" || preview["negative_prompt"] != "blurry, lowres" {
+		t.Errorf("status = %d, preview = %v", status, preview)
+	}
+	if vars := preview["variables"].([]any); len(vars) != 1 || vars[0].(map[string]any)["name"] != "medium" {
+		t.Errorf("variables = %v", preview["variables"])
+	}
+	if status, _ := env.do("POST", "/api/style-presets/"+id+"/preview", map[string]any{
+		"prompt": "cat", "variables": map[string]string{"unknown": "x"},
+	}, nil); status != http.StatusBadRequest {
+		t.Errorf("unknown variable status = %d, want 400", status)
+	}
+
+	status, resp := env.generate(map[string]any{
+		"prompt":           "cat",
+		"style_preset_id":  preset["id"],
+		"preset_variables": map[string]string{"medium": "oil painting"},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	if input := env.novelai.Requests()[0].Payload["input"]; input != "masterpiece, cat, oil painting" {
+		t.Errorf("input = %v", input)
+	}
+	_, record := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+	if record["prompt"] != "cat" {
+		t.Errorf("record prompt = %v, want user input", record["prompt"])
+	}
+}
+
+func TestStylePresetParameters(t *testing.T) {
+	env := newTestEnv(t)
+
+	if status, _ := env.admin("POST", "/style-presets", map[string]any{"name": "Bad", "width": 1024}); status != http.StatusBadRequest {
+		t.Errorf("width without height status = %d, want 400", status)
+	}
+	if status, _ := env.admin("POST", "/style-presets", map[string]any{
+		"name": "Bad", "model": "nai-diffusion-3", "uc_preset": 4,
+	}); status != http.StatusBadRequest {
+		t.Errorf("invalid uc_preset status = %d, want 400", status)
+	}
+
+	status, preset := env.admin("POST", "/style-presets", map[string]any{
+		"name":                   "Pinned",
+		"suffix_negative_prompt": "lowres",
+		"negative_prompt_mode":   "replace",
+		"model":                  "nai-diffusion-3",
+		"sampler":                "k_dpmpp_2m",
+		"steps":                  40,
+		"width":                  1024,
+		"height":                 1024,
+		"quality_toggle":         true,
+		"uc_preset":              2,
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("status = %d, body = %v", status, preset)
+	}
+
+	// 请求中显式指定的 steps 优先于预设
+	status, resp := env.generate(map[string]any{
+		"prompt":          "cat",
+		"negative_prompt": "blurry",
+		"steps":           20,
+		"style_preset_id": preset["id"],
+	})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+
+	req := env.novelai.Requests()[0]
+	params := req.Payload["parameters"].(map[string]any)
+	if req.Payload["model"] != "nai-diffusion-3" || params["sampler"] != "k_dpmpp_2m" {
+		t.Errorf("model = %v, sampler = %v", req.Payload["model"], params["sampler"])
+	}
+	if params["steps"] != float64(20) || params["width"] != float64(1024) || params["height"] != float64(1024) {
+		t.Errorf("steps = %v, size = %vx%v", params["steps"], params["width"], params["height"])
+	}
+	if params["qualityToggle"] != true || params["ucPreset"] != float64(2) {
+		t.Errorf("qualityToggle = %v, ucPreset = %v", params["qualityToggle"], params["ucPreset"])
+	}
+	if params["negative_prompt"] != "lowres" {
+		t.Errorf("negative_prompt = %v, want preset negative only", params["negative_prompt"])
+	}
+
+	_, record := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+	sources, _ := record["param_sources"].(map[string]any)
+	want := map[string]string{
+		"model":           "preset",
+		"steps":           "request",
+		"width":           "preset",
+		"scale":           "default",
+		"uc_preset":       "preset",
+		"negative_prompt": "preset",
+	}
+	for name, source := range want {
+		if sources[name] != source {
+			t.Errorf("param_sources[%s] = %v, want %s", name, sources[name], source)
+		}
+	}
+	if record["quality_toggle"] != true || record["uc_preset"] != float64(2) {
+		t.Errorf("record quality_toggle = %v, uc_preset = %v", record["quality_toggle"], record["uc_preset"])
+	}
+}
+
+func TestStylePresetRevisionsAndRerun(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, preset := env.admin("POST", "/style-presets", map[string]any{
+		"name":          "Versioned",
+		"prefix_prompt": "watercolor",
+	})
+	if status != http.StatusCreated || preset["revision"] != float64(1) {
+		t.Fatalf("status = %d, body = %v", status, preset)
+	}
+	id := formatID(preset["id"].(float64))
+
+	status, resp := env.generate(map[string]any{"prompt": "cat", "seed": 42, "style_preset_id": preset["id"]})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+	imageID := formatID(resp["id"].(float64))
+
+	status, updated := env.admin("PUT", "/style-presets/"+id, map[string]any{
+		"name":          "Versioned",
+		"prefix_prompt": "oil painting",
+	})
+	if status != http.StatusOK || updated["revision"] != float64(2) {
+		t.Fatalf("status = %d, body = %v", status, updated)
+	}
+	// 只修改启用状态不生成新版本
+	if _, disabled := env.admin("POST", "/style-presets/"+id+"/disable", nil); disabled["revision"] != float64(2) {
+		t.Errorf("revision after disable = %v, want 2", disabled["revision"])
+	}
+
+	_, revisions := env.admin("GET", "/style-presets/"+id+"/revisions", nil)
+	if list := revisions["revisions"].([]any); len(list) != 2 {
+		t.Fatalf("revisions = %v", revisions)
+	}
+
+	status, diff := env.admin("GET", "/style-presets/"+id+"/revisions/diff", nil)
+	if status != http.StatusOK {
+		t.Fatalf("diff status = %d, body = %v", status, diff)
+	}
+	changes := diff["changes"].([]any)
+	if len(changes) != 1 || changes[0].(map[string]any)["field"] != "prefix_prompt" ||
+		changes[0].(map[string]any)["from"] != "watercolor" || changes[0].(map[string]any)["to"] != "oil painting" {
+		t.Errorf("changes = %v", changes)
+	}
+
+	// 重新生成使用原记录的修订版本，即使预设已修改并禁用
+	status, rerun := env.do("POST", "/api/images/"+imageID+"/rerun", nil, bearer(env.apiKey))
+	if status != http.StatusOK {
+		t.Fatalf("rerun status = %d, body = %v", status, rerun)
+	}
+	requests := env.novelai.Requests()
+	if input := requests[len(requests)-1].Payload["input"]; input != "watercolor, cat" {
+		t.Errorf("rerun input = %v, want original revision", input)
+	}
+	if params := requests[len(requests)-1].Payload["parameters"].(map[string]any); params["seed"] != float64(42) {
+		t.Errorf("rerun seed = %v, want 42", params["seed"])
+	}
+
+	_, original := env.do("GET", "/api/images/"+imageID, nil, nil)
+	_, record := env.do("GET", "/api/images/"+formatID(rerun["id"].(float64)), nil, nil)
+	if record["style_preset_revision_id"] != original["style_preset_revision_id"] || record["style_preset_revision_id"] == nil {
+		t.Errorf("revision id = %v, want %v", record["style_preset_revision_id"], original["style_preset_revision_id"])
+	}
+	// 参数来源沿用原记录，而不是全部标记为 request
+	if sources, _ := record["param_sources"].(map[string]any); sources["steps"] != "default" || !reflect.DeepEqual(sources, original["param_sources"]) {
+		t.Errorf("param_sources = %v, want %v", record["param_sources"], original["param_sources"])
+	}
+
+	if status, _ := env.do("POST", "/api/images/999/rerun", nil, bearer(env.apiKey)); status != http.StatusNotFound {
+		t.Errorf("missing image rerun status = %d, want 404", status)
+	}
+}
+
+func TestStylePresetExportImport(t *testing.T) {
+	env := newTestEnv(t)
+	adminHeaders := map[string]string{"X-Admin-Key": testAdminKey}
+
+	if status, _ := env.admin("POST", "/style-presets", map[string]any{
+		"name": "Watercolor", "prefix_prompt": "watercolor", "steps": 30,
+	}); status != http.StatusCreated {
+		t.Fatalf("create status = %d", status)
+	}
+
+	if status, _ := env.do("GET", "/api/style-presets/export", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("export without admin key status = %d, want 401", status)
+	}
+	status, bundle := env.do("GET", "/api/style-presets/export", nil, adminHeaders)
+	if status != http.StatusOK || len(bundle["presets"].([]any)) != 1 {
+		t.Fatalf("status = %d, bundle = %v", status, bundle)
+	}
+
+	// 试运行不写入
+	status, report := env.do("POST", "/api/style-presets/import?strategy=rename&dry_run=true", bundle, adminHeaders)
+	if status != http.StatusOK || report["created"] != float64(1) {
+		t.Fatalf("status = %d, report = %v", status, report)
+	}
+	if item := report["items"].([]any)[0].(map[string]any); item["action"] != "rename" || item["new_name"] != "Watercolor (2)" {
+		t.Errorf("item = %v", item)
+	}
+	if _, list := env.admin("GET", "/style-presets", nil); len(list["presets"].([]any)) != 1 {
+		t.Errorf("dry run wrote presets: %v", list)
+	}
+
+	// 重命名生成的名称不与导出包中的其他预设冲突
+	status, report = env.do("POST", "/api/style-presets/import?strategy=rename&dry_run=true", map[string]any{
+		"version": 1,
+		"presets": []map[string]any{{"name": "Watercolor"}, {"name": "Watercolor (2)"}},
+	}, adminHeaders)
+	if status != http.StatusOK || report["valid"] != true || report["created"] != float64(2) {
+		t.Fatalf("status = %d, report = %v", status, report)
+	}
+	items := report["items"].([]any)
+	if item := items[0].(map[string]any); item["new_name"] != "Watercolor (3)" {
+		t.Errorf("renamed item = %v", item)
+	}
+	if item := items[1].(map[string]any); item["action"] != "create" || item["error"] != nil {
+		t.Errorf("literal item = %v", item)
+	}
+
+	// 请求体大小有上限
+	oversized := strings.Repeat(" ", service.MaxStylePresetBundleSize+1)
+	req, _ := http.NewRequest("POST", env.server.URL+"/api/style-presets/import", strings.NewReader(oversized))
+	req.Header.Set("X-Admin-Key", testAdminKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized bundle status = %d, want 413", resp.StatusCode)
+	}
+
+	status, report = env.do("POST", "/api/style-presets/import", bundle, adminHeaders)
+	if status != http.StatusOK || report["skipped"] != float64(1) {
+		t.Errorf("skip status = %d, report = %v", status, report)
+	}
+
+	// YAML 导出包，覆盖已有预设
+	yamlBundle := "version: 1\npresets:\n  - name: Watercolor\n    prefix_prompt: oil painting\n"
+	req, _ = http.NewRequest("POST", env.server.URL+"/api/style-presets/import?strategy=overwrite", strings.NewReader(yamlBundle))
+	req.Header.Set("Content-Type", "application/yaml")
+	req.Header.Set("X-Admin-Key", testAdminKey)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("yaml import status = %d", resp.StatusCode)
+	}
+	_, list := env.admin("GET", "/style-presets", nil)
+	preset := list["presets"].([]any)[0].(map[string]any)
+	if preset["prefix_prompt"] != "oil painting" || preset["revision"] != float64(2) {
+		t.Errorf("overwritten preset = %v", preset)
+	}
+
+	// 含不合法预设时整体不导入
+	status, report = env.do("POST", "/api/style-presets/import", map[string]any{
+		"version": 1,
+		"presets": []map[string]any{{"name": "New"}, {"name": "Bad", "prefix_prompt": "{unclosed"}},
+	}, adminHeaders)
+	if status != http.StatusBadRequest || report["code"] != "INVALID_BUNDLE" {
+		t.Errorf("invalid bundle status = %d, body = %v", status, report)
+	}
+	if _, list := env.admin("GET", "/style-presets", nil); len(list["presets"].([]any)) != 1 {
+		t.Errorf("invalid bundle wrote presets: %v", list)
+	}
+}
+
+func TestStackedStylePresets(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, first := env.admin("POST", "/style-presets", map[string]any{"name": "Watercolor", "prefix_prompt": "watercolor, masterpiece", "steps": 30})
+	_, second := env.admin("POST", "/style-presets", map[string]any{"name": "Lighting", "suffix_prompt": "masterpiece, soft lighting", "steps": 40})
+	_, skipped := env.admin("POST", "/style-presets", map[string]any{"name": "Skipped", "prefix_prompt": "sketch"})
+
+	status, resp := env.generate(map[string]any{
+		"prompt": "1girl",
+		"style_presets": []map[string]any{
+			{"id": first["id"]},
+			{"id": second["id"], "weight": 1.5},
+			{"id": skipped["id"], "enabled": false},
+		},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, resp)
+	}
+
+	payload := env.novelai.Requests()[0].Payload
+	if input := payload["input"]; input != "watercolor, masterpiece, 1girl, 1.5::soft lighting::" {
+		t.Errorf("input = %v", input)
+	}
+	// 后面的预设覆盖前面预设固定的参数
+	if steps := payload["parameters"].(map[string]any)["steps"]; steps != float64(40) {
+		t.Errorf("steps = %v, want 40", steps)
+	}
+
+	_, record := env.do("GET", "/api/images/"+formatID(resp["id"].(float64)), nil, nil)
+	applied := record["style_presets"].([]any)
+	if len(applied) != 3 || record["style_preset_id"] != first["id"] {
+		t.Fatalf("style_presets = %v, style_preset_id = %v", applied, record["style_preset_id"])
+	}
+	if last := applied[2].(map[string]any); last["enabled"] != false || last["revision_id"] != nil {
+		t.Errorf("skipped preset = %v", last)
+	}
+	if middle := applied[1].(map[string]any); middle["weight"] != 1.5 || middle["revision_id"] == nil {
+		t.Errorf("weighted preset = %v", middle)
+	}
+
+	if status, _ := env.generate(map[string]any{
+		"prompt":          "1girl",
+		"style_preset_id": first["id"],
+		"style_presets":   []map[string]any{{"id": second["id"]}},
+	}); status != http.StatusBadRequest {
+		t.Errorf("both fields status = %d, want 400", status)
+	}
+	if status, _ := env.generate(map[string]any{
+		"prompt":        "1girl",
+		"style_presets": []map[string]any{{"id": 999}},
+	}); status != http.StatusBadRequest {
+		t.Errorf("missing preset status = %d, want 400", status)
+	}
+}
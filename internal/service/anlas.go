@@ -0,0 +1,42 @@
+package service
+
+import (
+	"math"
+)
+
+// Anlas 消耗估算参数，与 NovelAI 网页端的计算方式一致
+const (
+	anlasPixelFactor     = 2.951823174884865e-6 // 每像素的固定消耗
+	anlasPixelStepFactor = 5.753298233447344e-7 // 每像素每步的消耗
+	anlasMinPixels       = 64 * 64 * 16         // 低于该像素数按该像素数计算
+	anlasSMEAFactor      = 1.2                  // 开启 SMEA 时的倍率
+	anlasSMEADynFactor   = 1.4                  // 同时开启 SMEA DYN 时的倍率
+	anlasMinPerSample    = 2                    // 每张图像的最低消耗
+)
+
+// EstimateAnlasCost 估算一次生成请求消耗的 Anlas
+//
+// 按分辨率和步数计算每张图像的消耗，SMEA 只对支持的模型（V3）计入倍率，img2img 按重绘强度折算，
+// 最后乘以生成数量。不考虑 Opus 订阅的免费生成，结果为上限。
+func EstimateAnlasCost(req *GenerationRequest) int {
+	pixels := float64(max(req.Width*req.Height, anlasMinPixels))
+	steps := req.Steps
+	if steps <= 0 {
+		steps = DefaultSteps
+	}
+	cost := anlasPixelFactor*pixels + anlasPixelStepFactor*pixels*float64(steps)
+
+	if spec, ok := novelAIModels[req.Model]; ok && spec.SupportsSMEA && req.SMEA {
+		if req.SMEADyn {
+			cost *= anlasSMEADynFactor
+		} else {
+			cost *= anlasSMEAFactor
+		}
+	}
+	if req.Action == ActionImg2Img && req.Strength > 0 {
+		cost *= req.Strength
+	}
+
+	perSample := max(int(math.Ceil(cost)), anlasMinPerSample)
+	return perSample * max(req.NSamples, 1)
+}
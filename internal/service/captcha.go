@@ -0,0 +1,316 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 人机验证服务提供方
+const (
+	CaptchaProviderTurnstile = "turnstile"
+	CaptchaProviderHCaptcha  = "hcaptcha"
+	CaptchaProviderRecaptcha = "recaptcha" // reCAPTCHA v3
+	CaptchaProviderLocal     = "local"     // 本地验证，token 与密钥一致即通过，用于开发和测试
+	CaptchaProviderDisabled  = "disabled"  // 不要求人机验证
+)
+
+// 各提供方默认的 siteverify 地址
+const (
+	TurnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	HCaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+	RecaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+)
+
+// ErrCaptchaRejected token 未通过验证
+var ErrCaptchaRejected = errors.New("captcha verification failed")
+
+// CaptchaVerifier 人机验证
+type CaptchaVerifier interface {
+	// Provider 返回提供方名称
+	Provider() string
+	// Verify 验证客户端提交的 token，未通过时返回包装了 ErrCaptchaRejected 的错误，
+	// 其他错误表示验证服务不可用
+	Verify(ctx context.Context, token, remoteIP string) error
+}
+
+// CaptchaConfig 人机验证配置
+type CaptchaConfig struct {
+	Provider         string
+	Secret           string
+	VerifyURL        string        // 为空时使用提供方默认地址，可指向本地替身
+	AllowedHostnames []string      // 非空时要求验证结果的 hostname 在列表中
+	Action           string        // 非空时要求验证结果的 action 一致（Turnstile、reCAPTCHA）
+	MinScore         float64       // reCAPTCHA v3 的最低分数
+	Timeout          time.Duration // 调用 siteverify 的超时时间
+	LocalTokenSuffix bool          // local 模式下允许 "密钥.任意后缀" 形式的 token，仅用于测试
+}
+
+// NewCaptchaVerifier 根据配置创建人机验证
+func NewCaptchaVerifier(cfg CaptchaConfig) (CaptchaVerifier, error) {
+	switch cfg.Provider {
+	case CaptchaProviderDisabled:
+		return DisabledCaptchaVerifier{}, nil
+	case CaptchaProviderLocal:
+		if cfg.Secret == "" {
+			return nil, fmt.Errorf("captcha secret is required for provider %s", cfg.Provider)
+		}
+		return &LocalCaptchaVerifier{token: cfg.Secret, allowSuffix: cfg.LocalTokenSuffix}, nil
+	case CaptchaProviderTurnstile, CaptchaProviderHCaptcha, CaptchaProviderRecaptcha:
+	default:
+		return nil, fmt.Errorf("unknown captcha provider %q", cfg.Provider)
+	}
+
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("captcha secret is required for provider %s, use provider %s to turn off captcha", cfg.Provider, CaptchaProviderDisabled)
+	}
+	if cfg.Provider == CaptchaProviderRecaptcha && (cfg.MinScore < 0 || cfg.MinScore > 1) {
+		return nil, fmt.Errorf("reCAPTCHA min score must be between 0 and 1")
+	}
+	if cfg.VerifyURL == "" {
+		cfg.VerifyURL = map[string]string{
+			CaptchaProviderTurnstile: TurnstileVerifyURL,
+			CaptchaProviderHCaptcha:  HCaptchaVerifyURL,
+			CaptchaProviderRecaptcha: RecaptchaVerifyURL,
+		}[cfg.Provider]
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return &SiteVerifyCaptchaVerifier{
+		config: cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+// SiteVerifyResponse siteverify 接口响应，Turnstile、hCaptcha 和 reCAPTCHA 使用相同的格式
+type SiteVerifyResponse struct {
+	Success     bool     `json:"success"`
+	ErrorCodes  []string `json:"error-codes,omitempty"`
+	ChallengeTS string   `json:"challenge_ts,omitempty"`
+	Hostname    string   `json:"hostname,omitempty"`
+	Action      string   `json:"action,omitempty"`
+	Score       *float64 `json:"score,omitempty"` // 仅 reCAPTCHA v3
+}
+
+// SiteVerifyCaptchaVerifier 通过提供方的 siteverify 接口验证 token
+type SiteVerifyCaptchaVerifier struct {
+	config CaptchaConfig
+	client *http.Client
+}
+
+// Provider 返回提供方名称
+func (v *SiteVerifyCaptchaVerifier) Provider() string {
+	return v.config.Provider
+}
+
+// Verify 调用 siteverify 并检查 hostname、action 和分数
+func (v *SiteVerifyCaptchaVerifier) Verify(ctx context.Context, token, remoteIP string) error {
+	data := url.Values{}
+	data.Set("secret", v.config.Secret)
+	data.Set("response", token)
+	if remoteIP != "" {
+		data.Set("remoteip", remoteIP)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.config.VerifyURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s siteverify: %w", v.config.Provider, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s siteverify returned status %d", v.config.Provider, resp.StatusCode)
+	}
+
+	var result SiteVerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode %s siteverify response: %w", v.config.Provider, err)
+	}
+	return v.check(&result)
+}
+
+// check 检查 siteverify 结果
+func (v *SiteVerifyCaptchaVerifier) check(result *SiteVerifyResponse) error {
+	if !result.Success {
+		return fmt.Errorf("%w: %s", ErrCaptchaRejected, strings.Join(result.ErrorCodes, ", "))
+	}
+	if len(v.config.AllowedHostnames) > 0 && !slices.Contains(v.config.AllowedHostnames, result.Hostname) {
+		return fmt.Errorf("%w: unexpected hostname %q", ErrCaptchaRejected, result.Hostname)
+	}
+	if v.config.Action != "" && v.config.Provider != CaptchaProviderHCaptcha && result.Action != v.config.Action {
+		return fmt.Errorf("%w: unexpected action %q", ErrCaptchaRejected, result.Action)
+	}
+	if v.config.Provider == CaptchaProviderRecaptcha {
+		if result.Score == nil {
+			return fmt.Errorf("%w: missing score", ErrCaptchaRejected)
+		}
+		if *result.Score < v.config.MinScore {
+			return fmt.Errorf("%w: score %g is below %g", ErrCaptchaRejected, *result.Score, v.config.MinScore)
+		}
+	}
+	return nil
+}
+
+// LocalCaptchaVerifier 本地验证，不访问外部服务
+// token 与密钥一致时通过；allowSuffix 时 "密钥.任意后缀" 也通过，供测试生成不同的单次 token
+type LocalCaptchaVerifier struct {
+	token       string
+	allowSuffix bool
+}
+
+// Provider 返回提供方名称
+func (v *LocalCaptchaVerifier) Provider() string {
+	return CaptchaProviderLocal
+}
+
+// Verify 以常量时间比较 token 中的密钥部分
+func (v *LocalCaptchaVerifier) Verify(ctx context.Context, token, remoteIP string) error {
+	secret := token
+	if v.allowSuffix && len(token) > len(v.token) && token[len(v.token)] == '.' {
+		secret = token[:len(v.token)]
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(v.token)) != 1 {
+		return fmt.Errorf("%w: token mismatch", ErrCaptchaRejected)
+	}
+	return nil
+}
+
+// DisabledCaptchaVerifier 不要求人机验证
+type DisabledCaptchaVerifier struct{}
+
+// Provider 返回提供方名称
+func (DisabledCaptchaVerifier) Provider() string {
+	return CaptchaProviderDisabled
+}
+
+// Verify 总是通过
+func (DisabledCaptchaVerifier) Verify(ctx context.Context, token, remoteIP string) error {
+	return nil
+}
+
+// CaptchaTokenTTL 已使用 token 的记录时长，覆盖各提供方 token 的有效期
+const CaptchaTokenTTL = 10 * time.Minute
+
+// CaptchaSessionCookie 人机验证会话 cookie 名称
+const CaptchaSessionCookie = "captcha_session"
+
+// ErrCaptchaReplayed token 已被使用过
+var ErrCaptchaReplayed = errors.New("captcha token has already been used")
+
+// CaptchaService 人机验证：单次使用的 token 和绑定客户端的验证会话
+//
+// 验证通过后签发会话 cookie，cookie 以 HMAC 绑定客户端标识，验证状态按客户端标识和会话记录，
+// 其他客户端复制 cookie 或 token 都不能跳过验证。
+type CaptchaService struct {
+	verifier     CaptchaVerifier
+	store        RateLimitStore
+	sessionKey   []byte
+	secureCookie bool
+	now          func() time.Time
+}
+
+// NewCaptchaService 创建人机验证服务，已使用的 token 记录在 store 中
+// sessionSecret 为会话签名密钥，为空时使用随机密钥（重启后会话失效，多个实例间不能共享会话）；
+// secureCookie 为 true 时会话 cookie 总是带 Secure 属性，用于由反向代理终止 TLS 的部署
+func NewCaptchaService(verifier CaptchaVerifier, store RateLimitStore, sessionSecret string, secureCookie bool) (*CaptchaService, error) {
+	key := []byte(sessionSecret)
+	if sessionSecret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &CaptchaService{
+		verifier:     verifier,
+		store:        store,
+		sessionKey:   key,
+		secureCookie: secureCookie,
+		now:          time.Now,
+	}, nil
+}
+
+// Enabled 是否要求人机验证
+func (s *CaptchaService) Enabled() bool {
+	return s.verifier.Provider() != CaptchaProviderDisabled
+}
+
+// Verify 验证 token，同一 token 只能使用一次
+// 先由提供方验证，通过后才记录 token，未通过验证的 token 不占用存储；并发提交同一 token 时只有一个请求通过
+func (s *CaptchaService) Verify(ctx context.Context, token, remoteIP string) error {
+	if err := s.verifier.Verify(ctx, token, remoteIP); err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(token))
+	first, err := s.store.MarkCaptchaToken(ctx, hex.EncodeToString(sum[:]), CaptchaTokenTTL, s.now())
+	if err != nil {
+		return fmt.Errorf("rate limit store unavailable: %w", err)
+	}
+	if !first {
+		return ErrCaptchaReplayed
+	}
+	return nil
+}
+
+// NewSession 为客户端签发新的会话，返回会话 ID 和 cookie 值
+func (s *CaptchaService) NewSession(clientKey string) (string, string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	sessionID := hex.EncodeToString(id)
+	return sessionID, sessionID + "." + s.sign(sessionID, clientKey), nil
+}
+
+// SessionCookie 返回写入会话的 cookie，tls 表示当前请求是否直接经 HTTPS 到达
+func (s *CaptchaService) SessionCookie(value string, tls bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     CaptchaSessionCookie,
+		Value:    value,
+		Path:     "/",
+		Secure:   s.secureCookie || tls,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ParseSession 校验 cookie 签名及绑定的客户端，返回会话 ID
+func (s *CaptchaService) ParseSession(cookie, clientKey string) (string, bool) {
+	sessionID, signature, ok := strings.Cut(cookie, ".")
+	if !ok || sessionID == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.sign(sessionID, clientKey))) {
+		return "", false
+	}
+	return sessionID, true
+}
+
+// VerificationKey 验证状态的存储键，由客户端标识和会话组成
+func (s *CaptchaService) VerificationKey(clientKey, sessionID string) string {
+	return clientKey + "#" + sessionID
+}
+
+// sign 计算会话签名
+func (s *CaptchaService) sign(sessionID, clientKey string) string {
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte(sessionID + "|" + clientKey))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
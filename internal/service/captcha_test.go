@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSiteVerifyCaptchaVerifier(t *testing.T) {
+	var response map[string]any
+	var form map[string]string
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = map[string]string{"secret": r.PostForm.Get("secret"), "response": r.PostForm.Get("response"), "remoteip": r.PostForm.Get("remoteip")}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer stub.Close()
+
+	turnstile, err := NewCaptchaVerifier(CaptchaConfig{
+		Provider:         CaptchaProviderTurnstile,
+		Secret:           "secret",
+		VerifyURL:        stub.URL,
+		AllowedHostnames: []string{"example.com"},
+		Action:           "generate",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	recaptcha, err := NewCaptchaVerifier(CaptchaConfig{
+		Provider:  CaptchaProviderRecaptcha,
+		Secret:    "secret",
+		VerifyURL: stub.URL,
+		MinScore:  0.5,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		verifier CaptchaVerifier
+		response map[string]any
+		rejected bool
+	}{
+		{"turnstile success", turnstile, map[string]any{"success": true, "hostname": "example.com", "action": "generate"}, false},
+		{"turnstile failure", turnstile, map[string]any{"success": false, "error-codes": []string{"invalid-input-response"}}, true},
+		{"turnstile hostname", turnstile, map[string]any{"success": true, "hostname": "evil.com", "action": "generate"}, true},
+		{"turnstile action", turnstile, map[string]any{"success": true, "hostname": "example.com", "action": "login"}, true},
+		{"recaptcha score", recaptcha, map[string]any{"success": true, "score": 0.9}, false},
+		{"recaptcha low score", recaptcha, map[string]any{"success": true, "score": 0.1}, true},
+		{"recaptcha missing score", recaptcha, map[string]any{"success": true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response = tt.response
+			err := tt.verifier.Verify(context.Background(), "user-token", "203.0.113.5")
+			if tt.rejected != errors.Is(err, ErrCaptchaRejected) || (!tt.rejected && err != nil) {
+				t.Fatalf("Verify() = %v, rejected = %v", err, tt.rejected)
+			}
+			if form["secret"] != "secret" || form["response"] != "user-token" || form["remoteip"] != "203.0.113.5" {
+				t.Errorf("siteverify form = %v", form)
+			}
+		})
+	}
+
+	// 验证服务不可用不应被当作验证失败
+	stub.Close()
+	if err := turnstile.Verify(context.Background(), "user-token", ""); err == nil || errors.Is(err, ErrCaptchaRejected) {
+		t.Errorf("Verify() with unavailable siteverify = %v", err)
+	}
+
+	if _, err := NewCaptchaVerifier(CaptchaConfig{Provider: CaptchaProviderTurnstile}); err == nil {
+		t.Errorf("expected error for missing secret")
+	}
+}
+
+func TestCaptchaServiceVerify(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	svc, err := NewCaptchaService(&LocalCaptchaVerifier{token: "secret"}, store, "", false)
+	if err != nil {
+		t.Fatalf("failed to create captcha service: %v", err)
+	}
+	ctx := context.Background()
+
+	// 未通过验证的 token 不记录
+	if err := svc.Verify(ctx, "wrong", ""); !errors.Is(err, ErrCaptchaRejected) {
+		t.Errorf("Verify(wrong) = %v", err)
+	}
+	if len(store.captchaTokens) != 0 {
+		t.Errorf("rejected token should not be recorded: %v", store.captchaTokens)
+	}
+
+	if err := svc.Verify(ctx, "secret", ""); err != nil {
+		t.Fatalf("Verify(secret) = %v", err)
+	}
+	if err := svc.Verify(ctx, "secret", ""); !errors.Is(err, ErrCaptchaReplayed) {
+		t.Errorf("replayed Verify = %v", err)
+	}
+}
+
+func TestLocalCaptchaVerifier(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowSuffix bool
+		token       string
+		rejected    bool
+	}{
+		{"secret", false, "secret", false},
+		{"wrong secret", false, "secreT", true},
+		{"prefix of secret", false, "secre", true},
+		{"suffix not allowed", false, "secret.1", true},
+		{"suffix allowed", true, "secret.1", false},
+		{"suffix without separator", true, "secret1", true},
+		{"suffix with wrong secret", true, "secreT.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := NewCaptchaVerifier(CaptchaConfig{Provider: CaptchaProviderLocal, Secret: "secret", LocalTokenSuffix: tt.allowSuffix})
+			if err != nil {
+				t.Fatalf("failed to create verifier: %v", err)
+			}
+			err = verifier.Verify(context.Background(), tt.token, "")
+			if (err != nil) != tt.rejected || (err != nil && !errors.Is(err, ErrCaptchaRejected)) {
+				t.Errorf("Verify(%q) = %v, rejected = %v", tt.token, err, tt.rejected)
+			}
+		})
+	}
+}
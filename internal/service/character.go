@@ -0,0 +1,107 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"novelai-backend/internal/model"
+)
+
+// MaxCharacters 单次生成最多支持的角色数
+const MaxCharacters = 6
+
+// CharacterCenter 角色在画面中的位置（0-1）
+type CharacterCenter struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// defaultCharacterCenter 未指定位置时使用画面中心
+var defaultCharacterCenter = CharacterCenter{X: 0.5, Y: 0.5}
+
+// NovelAICharacterPrompt NovelAI characterPrompts 参数
+type NovelAICharacterPrompt struct {
+	Prompt  string          `json:"prompt"`
+	UC      string          `json:"uc"`
+	Center  CharacterCenter `json:"center"`
+	Enabled bool            `json:"enabled"`
+}
+
+// V4CharCaption V4 提示词中的角色描述
+type V4CharCaption struct {
+	CharCaption string            `json:"char_caption"`
+	Centers     []CharacterCenter `json:"centers"`
+}
+
+// ParseCharacterPosition 解析 5x5 网格坐标（如 "C3"），返回网格中心位置
+func ParseCharacterPosition(position string) (CharacterCenter, error) {
+	position = strings.ToUpper(strings.TrimSpace(position))
+	if len(position) != 2 || position[0] < 'A' || position[0] > 'E' || position[1] < '1' || position[1] > '5' {
+		return CharacterCenter{}, fmt.Errorf("invalid character position %q, expected A1-E5", position)
+	}
+
+	// 网格中心依次为 0.1、0.3、0.5、0.7、0.9
+	return CharacterCenter{
+		X: float64(1+2*int(position[0]-'A')) / 10,
+		Y: float64(1+2*int(position[1]-'1')) / 10,
+	}, nil
+}
+
+// validateCharacters 校验多角色提示词
+func validateCharacters(characters []model.CharacterPrompt, spec novelAIModelSpec) error {
+	if len(characters) == 0 {
+		return nil
+	}
+	if spec.Version < 4 {
+		return fmt.Errorf("character prompts require a V4 model")
+	}
+	if len(characters) > MaxCharacters {
+		return fmt.Errorf("too many characters, maximum %d", MaxCharacters)
+	}
+	for i, character := range characters {
+		if strings.TrimSpace(character.Prompt) == "" {
+			return fmt.Errorf("character %d prompt is required", i+1)
+		}
+		if character.Position != "" {
+			if _, err := ParseCharacterPosition(character.Position); err != nil {
+				return fmt.Errorf("character %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// buildCharacterParameters 将多角色提示词转换为 NovelAI 参数
+// 返回 characterPrompts、正向和负向 char_captions，以及是否使用坐标
+func buildCharacterParameters(characters []model.CharacterPrompt) ([]NovelAICharacterPrompt, []V4CharCaption, []V4CharCaption, bool) {
+	prompts := make([]NovelAICharacterPrompt, 0, len(characters))
+	captions := make([]V4CharCaption, 0, len(characters))
+	negativeCaptions := make([]V4CharCaption, 0, len(characters))
+	useCoords := false
+
+	for _, character := range characters {
+		center := defaultCharacterCenter
+		if character.Position != "" {
+			// 已在校验阶段确认格式正确
+			center, _ = ParseCharacterPosition(character.Position)
+			useCoords = true
+		}
+
+		prompts = append(prompts, NovelAICharacterPrompt{
+			Prompt:  character.Prompt,
+			UC:      character.NegativePrompt,
+			Center:  center,
+			Enabled: true,
+		})
+		captions = append(captions, V4CharCaption{
+			CharCaption: character.Prompt,
+			Centers:     []CharacterCenter{center},
+		})
+		negativeCaptions = append(negativeCaptions, V4CharCaption{
+			CharCaption: character.NegativePrompt,
+			Centers:     []CharacterCenter{center},
+		})
+	}
+
+	return prompts, captions, negativeCaptions, useCoords
+}
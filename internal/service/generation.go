@@ -0,0 +1,282 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"novelai-backend/internal/model"
+)
+
+// 生成参数来源，保存在生成记录的 param_sources 中
+const (
+	ParamSourceRequest     = "request"      // 请求中显式指定
+	ParamSourcePreset      = "preset"       // 画风预设固定的值
+	ParamSourceSourceImage = "source_image" // img2img 源图像尺寸
+	ParamSourceDefault     = "default"      // 服务端默认值
+)
+
+// GenerationTask 一次图像生成的完整参数，可序列化后作为异步任务持久化
+type GenerationTask struct {
+	// 用户原始输入，保存到生成记录中（不包含预设文本）
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negative_prompt"`
+	StylePresetID  *uint  `json:"style_preset_id"`
+
+	// 发起生成的用户（API 密钥所属用户），匿名请求为空
+	UserID *uint `json:"user_id,omitempty"`
+
+	// 预留的 Anlas 配额记录，生成失败时退还
+	AnlasUsageID *uint `json:"anlas_usage_id,omitempty"`
+
+	// 实际应用的画风预设修订版本和模板变量
+	StylePresetRevisionID *uint                      `json:"style_preset_revision_id,omitempty"`
+	PresetVariables       map[string]string          `json:"preset_variables,omitempty"`
+	StylePresets          []model.AppliedStylePreset `json:"style_presets,omitempty"`
+
+	// 各生成参数的来源（ParamSource*）
+	ParamSources map[string]string `json:"param_sources,omitempty"`
+
+	// 源图像 / 蒙版来自历史生成时的记录 ID 和文件路径，为空表示上传的图像
+	SourceGenerationID *uint  `json:"source_generation_id,omitempty"`
+	SourceFilePath     string `json:"source_file_path,omitempty"`
+	MaskFilePath       string `json:"mask_file_path,omitempty"`
+
+	// 发送给 NovelAI 的请求（已应用预设和默认值）
+	Request GenerationRequest `json:"request"`
+
+	// 使用 NovelAI 流式接口，中间预览以 preview 事件交给 progress
+	Stream bool `json:"stream,omitempty"`
+}
+
+// GenerationError NovelAI 生成失败，Generation 为已保存的失败记录（保存失败时为 nil）
+type GenerationError struct {
+	Generation *model.ImageGeneration
+	Err        error
+}
+
+func (e *GenerationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *GenerationError) Unwrap() error {
+	return e.Err
+}
+
+// GenerationService 图像生成流程服务，串联 NovelAI 调用和结果保存
+type GenerationService struct {
+	novelaiService *NovelAIService
+	imageService   *ImageService
+	vibeService    *VibeService
+	quotaService   *QuotaService
+}
+
+// NewGenerationService 创建图像生成流程服务实例
+func NewGenerationService(novelaiService *NovelAIService, imageService *ImageService, vibeService *VibeService, quotaService *QuotaService) *GenerationService {
+	return &GenerationService{
+		novelaiService: novelaiService,
+		imageService:   imageService,
+		vibeService:    vibeService,
+		quotaService:   quotaService,
+	}
+}
+
+// Run 执行生成任务并保存结果，返回按批次序号排列的生成记录，progress 可为 nil
+// NovelAI 调用失败时保存失败记录并返回 *GenerationError，其他错误表示结果保存失败；
+// NovelAI 调用失败或未执行（包括 panic）时退还预留的配额，NovelAI 返回图像后已消耗 Anlas，保存失败也不退还
+func (s *GenerationService) Run(task *GenerationTask, progress ProgressFunc) (generations []*model.ImageGeneration, err error) {
+	if progress == nil {
+		progress = func(string, any) {}
+	}
+	charged := false
+	if task.AnlasUsageID != nil {
+		defer func() {
+			if !charged {
+				s.releaseQuota(*task.AnlasUsageID)
+			}
+		}()
+	}
+
+	// 记录开始时间
+	startTime := time.Now()
+
+	req := task.Request
+	batchID := newBatchID()
+	var images [][]byte
+	var originalPayload string
+	err = s.vibeService.EncodeReferences(&req)
+	if err == nil {
+		if task.Stream {
+			images, originalPayload, err = s.novelaiService.GenerateImageStream(&req, func(preview *StreamPreview) {
+				progress(JobEventPreview, map[string]any{
+					"sample_index": preview.SampleIndex,
+					"step":         preview.Step,
+					"sigma":        preview.Sigma,
+					"image":        "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(preview.Image),
+				})
+			})
+		} else {
+			images, originalPayload, err = s.novelaiService.GenerateImage(&req)
+		}
+	}
+	if err != nil {
+		// 保存失败记录 - 使用用户原始输入，不包含预设文本
+		generation := task.newGeneration(&req, originalPayload)
+		generation.BatchID = batchID
+		s.attachInputImages(task, &req, generation)
+		generation, _ = s.imageService.SaveFailedGeneration(generation, err.Error())
+		return nil, &GenerationError{Generation: generation, Err: err}
+	}
+	charged = true
+
+	// 计算生成时间
+	generationTime := int(time.Since(startTime).Milliseconds())
+	progress(JobEventNovelAIResponse, map[string]any{
+		"generation_time": generationTime,
+		"seed":            req.Seed,
+		"batch_id":        batchID,
+		"n_samples":       len(images),
+	})
+
+	// 输入图像只保存一次，同批次的记录共用
+	first := task.newGeneration(&req, originalPayload)
+	if err := s.attachInputImages(task, &req, first); err != nil {
+		return nil, fmt.Errorf("failed to save input image: %w", err)
+	}
+
+	// 每张图像保存为一条成功记录，种子为 req.Seed+序号（req.Seed 可能是随机生成的）
+	generations = make([]*model.ImageGeneration, 0, len(images))
+	for i, imageData := range images {
+		generation := task.newGeneration(&req, originalPayload)
+		generation.Seed = req.Seed + int64(i)
+		generation.BatchID = batchID
+		generation.BatchIndex = i
+		generation.SourceFilePath = first.SourceFilePath
+		generation.MaskFilePath = first.MaskFilePath
+
+		generation, err = s.imageService.SaveImageGeneration(generation, imageData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save image: %w", err)
+		}
+		progress(JobEventFileSaved, map[string]any{
+			"generation_id": generation.ID,
+			"batch_index":   generation.BatchIndex,
+			"file_path":     generation.FilePath,
+			"file_size":     generation.FileSize,
+		})
+
+		// 更新生成时间
+		generation.GenerationTime = generationTime
+		s.imageService.UpdateGenerationTime(generation.ID, generationTime)
+		generations = append(generations, generation)
+	}
+
+	return generations, nil
+}
+
+// releaseQuota 退还预留的配额，失败时只记录日志
+func (s *GenerationService) releaseQuota(usageID uint) {
+	if err := s.quotaService.Release(usageID); err != nil {
+		log.Printf("Failed to release anlas usage %d: %v", usageID, err)
+	}
+}
+
+// attachInputImages 记录生成使用的源图像和蒙版，上传的图像保存到图像目录
+func (s *GenerationService) attachInputImages(task *GenerationTask, req *GenerationRequest, generation *model.ImageGeneration) error {
+	if req.Action != ActionImg2Img && req.Action != ActionInfill {
+		return nil
+	}
+
+	generation.SourceFilePath = task.SourceFilePath
+	if generation.SourceFilePath == "" {
+		path, err := s.imageService.SaveInputImage(req.Image, req.Seed, "source")
+		if err != nil {
+			return err
+		}
+		generation.SourceFilePath = path
+	}
+
+	if req.Action != ActionInfill {
+		return nil
+	}
+
+	generation.MaskFilePath = task.MaskFilePath
+	if generation.MaskFilePath == "" {
+		path, err := s.imageService.SaveInputImage(req.Mask, req.Seed, "mask")
+		if err != nil {
+			return err
+		}
+		generation.MaskFilePath = path
+	}
+	return nil
+}
+
+// newGeneration 根据任务和实际发送的请求构建生成记录（不含文件信息）
+func (t *GenerationTask) newGeneration(req *GenerationRequest, originalPayload string) *model.ImageGeneration {
+	generation := &model.ImageGeneration{
+		UserID:                t.UserID,
+		Prompt:                t.Prompt,
+		NegativePrompt:        t.NegativePrompt,
+		Seed:                  req.Seed,
+		Steps:                 req.Steps,
+		Width:                 req.Width,
+		Height:                req.Height,
+		Model:                 req.Model,
+		Sampler:               req.Sampler,
+		Scale:                 req.Scale,
+		NoiseSchedule:         req.NoiseSchedule,
+		SMEA:                  req.SMEA,
+		SMEADyn:               req.SMEADyn,
+		CFGRescale:            req.CFGRescale,
+		Decrisper:             req.Decrisper,
+		VarietyBoost:          req.VarietyBoost,
+		QualityToggle:         req.QualityToggle,
+		UCPreset:              req.UCPreset,
+		ParamSources:          t.ParamSources,
+		Characters:            req.Characters,
+		References:            referenceRecords(req.References),
+		StylePresetID:         t.StylePresetID,
+		StylePresetRevisionID: t.StylePresetRevisionID,
+		PresetVariables:       t.PresetVariables,
+		StylePresets:          t.StylePresets,
+		OriginalPayload:       originalPayload,
+	}
+
+	generation.Action = ActionGenerate
+	if req.Action == ActionImg2Img || req.Action == ActionInfill {
+		generation.Action = req.Action
+		generation.SourceGenerationID = t.SourceGenerationID
+		generation.Strength = req.Strength
+		generation.Noise = req.Noise
+		generation.AddOriginalImage = req.AddOriginalImage
+	}
+
+	return generation
+}
+
+// referenceRecords 生成记录中保存的风格参考信息（仅图像哈希，不含图像数据）
+func referenceRecords(references []ReferenceImage) []model.VibeReference {
+	if len(references) == 0 {
+		return nil
+	}
+	records := make([]model.VibeReference, 0, len(references))
+	for i := range references {
+		records = append(records, model.VibeReference{
+			ImageHash:            references[i].Hash(),
+			GenerationID:         references[i].GenerationID,
+			Strength:             references[i].Strength,
+			InformationExtracted: references[i].InformationExtracted,
+		})
+	}
+	return records
+}
+
+// newBatchID 生成批次 ID
+func newBatchID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
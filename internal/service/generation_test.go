@@ -0,0 +1,66 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"novelai-backend/internal/database"
+	"novelai-backend/internal/fakenovelai"
+	"novelai-backend/internal/model"
+
+	"gorm.io/gorm/logger"
+)
+
+func TestGenerationRunReleasesQuota(t *testing.T) {
+	dir := t.TempDir()
+	db, err := database.Open(filepath.Join(dir, "test.db"), logger.Silent)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	novelai := fakenovelai.New()
+	t.Cleanup(novelai.Close)
+
+	// 图像目录是一个文件，NovelAI 返回图像后保存失败
+	imagesDir := filepath.Join(dir, "images")
+	if err := os.WriteFile(imagesDir, nil, 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	novelaiService := NewNovelAIService("test-api-key", novelai.URL, 2*time.Second, GenerationDefaults{})
+	quota := NewQuotaService(db, QuotaConfig{Location: time.UTC})
+	generations := NewGenerationService(novelaiService, NewImageService(db, imagesDir), NewVibeService(db, novelaiService), quota)
+
+	run := func() (*uint, error) {
+		t.Helper()
+		usage, err := quota.Reserve(QuotaSubject{ClientKey: "1.1.1.1"}, 20)
+		if err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		task := &GenerationTask{Prompt: "x", AnlasUsageID: &usage.ID, Request: GenerationRequest{
+			Prompt: "x", Model: ModelV45Full, Sampler: "k_euler_ancestral", NoiseSchedule: "karras", Scale: 5, Steps: 28, Width: 64, Height: 64,
+		}}
+		_, err = generations.Run(task, nil)
+		return &usage.ID, err
+	}
+	released := func(usageID *uint) bool {
+		var count int64
+		db.Model(&model.AnlasUsage{}).Where("id = ?", *usageID).Count(&count)
+		return count == 0
+	}
+
+	// NovelAI 调用失败时退还
+	novelai.Enqueue(fakenovelai.Error(500, "internal error"))
+	usageID, err := run()
+	var genErr *GenerationError
+	if !errors.As(err, &genErr) || !released(usageID) {
+		t.Errorf("novelai failure: err = %v, released = %v, want released", err, released(usageID))
+	}
+
+	// NovelAI 已返回图像，保存失败时不退还
+	usageID, err = run()
+	if err == nil || errors.As(err, &genErr) || released(usageID) {
+		t.Errorf("save failure: err = %v, released = %v, want kept", err, released(usageID))
+	}
+}
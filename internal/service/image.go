@@ -1,9 +1,12 @@
 package service
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"novelai-backend/internal/model"
@@ -25,24 +28,67 @@ func NewImageService(db *gorm.DB, imagesDir string) *ImageService {
 	}
 }
 
-// SaveImageGeneration 保存图像生成记录
-func (s *ImageService) SaveImageGeneration(
-	prompt, negativePrompt string,
-	seed int64,
-	steps, width, height int,
-	stylePresetID *uint,
-	originalPayload string,
-	imageData []byte,
-) (*model.ImageGeneration, error) {
+// SaveImageGeneration 保存图像文件并创建成功的生成记录
+// generation 需填好生成参数，文件信息和状态由本方法设置
+func (s *ImageService) SaveImageGeneration(generation *model.ImageGeneration, imageData []byte) (*model.ImageGeneration, error) {
 	// 生成文件名
 	timestamp := time.Now().Format("20060102_150405")
-	fileName := fmt.Sprintf("novelai_%s_%d.png", timestamp, seed)
+	fileName := fmt.Sprintf("novelai_%s_%d.png", timestamp, generation.Seed)
 
+	fullPath, relativePath, err := s.writeImageFile(fileName, imageData)
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建数据库记录
+	generation.FilePath = relativePath
+	generation.FileName = fileName
+	generation.FileSize = int64(len(imageData))
+	generation.Status = model.StatusSuccess
+
+	// 保存到数据库
+	if err := s.db.Create(generation).Error; err != nil {
+		// 如果数据库保存失败，删除已保存的文件
+		os.Remove(fullPath)
+		return nil, fmt.Errorf("failed to save to database: %w", err)
+	}
+
+	return generation, nil
+}
+
+// SaveInputImage 保存生成使用的输入图像（如 img2img 源图像），返回相对路径
+// 文件与生成结果放在同一年月目录下，文件名以 kind 结尾
+func (s *ImageService) SaveInputImage(imageData []byte, seed int64, kind string) (string, error) {
+	timestamp := time.Now().Format("20060102_150405")
+	fileName := fmt.Sprintf("novelai_%s_%d_%s.png", timestamp, seed, kind)
+
+	_, relativePath, err := s.writeImageFile(fileName, imageData)
+	if err != nil {
+		return "", err
+	}
+	return relativePath, nil
+}
+
+// ReadImageFile 读取生成记录对应的图像文件
+func (s *ImageService) ReadImageFile(generation *model.ImageGeneration) ([]byte, error) {
+	if generation.FilePath == "" {
+		return nil, fmt.Errorf("generation %d has no image file", generation.ID)
+	}
+	return os.ReadFile(s.GetImageFilePath(generation))
+}
+
+// ReadInputImage 读取图像目录下的输入图像（源图像、蒙版等）
+func (s *ImageService) ReadInputImage(relativePath string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.imagesDir, relativePath))
+}
+
+// writeImageFile 将图像写入当前年月目录，返回完整路径和相对路径
+func (s *ImageService) writeImageFile(fileName string, imageData []byte) (string, string, error) {
 	// 创建年月目录
 	yearMonth := time.Now().Format("2006/01")
 	dirPath := filepath.Join(s.imagesDir, yearMonth)
 	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create directory: %w", err)
+		return "", "", fmt.Errorf("failed to create directory: %w", err)
 	}
 
 	// 完整文件路径
@@ -51,56 +97,16 @@ func (s *ImageService) SaveImageGeneration(
 
 	// 保存文件
 	if err := os.WriteFile(fullPath, imageData, 0644); err != nil {
-		return nil, fmt.Errorf("failed to save image file: %w", err)
-	}
-
-	// 创建数据库记录
-	generation := &model.ImageGeneration{
-		Prompt:          prompt,
-		NegativePrompt:  negativePrompt,
-		Seed:            seed,
-		Steps:           steps,
-		Width:           width,
-		Height:          height,
-		StylePresetID:   stylePresetID,
-		OriginalPayload: originalPayload,
-		FilePath:        relativePath,
-		FileName:        fileName,
-		FileSize:        int64(len(imageData)),
-		Status:          "success",
-	}
-
-	// 保存到数据库
-	if err := s.db.Create(generation).Error; err != nil {
-		// 如果数据库保存失败，删除已保存的文件
-		os.Remove(fullPath)
-		return nil, fmt.Errorf("failed to save to database: %w", err)
+		return "", "", fmt.Errorf("failed to save image file: %w", err)
 	}
 
-	return generation, nil
+	return fullPath, relativePath, nil
 }
 
 // SaveFailedGeneration 保存失败的生成记录
-func (s *ImageService) SaveFailedGeneration(
-	prompt, negativePrompt string,
-	seed int64,
-	steps, width, height int,
-	stylePresetID *uint,
-	originalPayload string,
-	errorMessage string,
-) (*model.ImageGeneration, error) {
-	generation := &model.ImageGeneration{
-		Prompt:          prompt,
-		NegativePrompt:  negativePrompt,
-		Seed:            seed,
-		Steps:           steps,
-		Width:           width,
-		Height:          height,
-		StylePresetID:   stylePresetID,
-		OriginalPayload: originalPayload,
-		Status:          "failed",
-		ErrorMessage:    errorMessage,
-	}
+func (s *ImageService) SaveFailedGeneration(generation *model.ImageGeneration, errorMessage string) (*model.ImageGeneration, error) {
+	generation.Status = model.StatusFailed
+	generation.ErrorMessage = errorMessage
 
 	if err := s.db.Create(generation).Error; err != nil {
 		return nil, fmt.Errorf("failed to save failed generation: %w", err)
@@ -118,25 +124,231 @@ func (s *ImageService) GetImageGeneration(id uint) (*model.ImageGeneration, erro
 	return &generation, nil
 }
 
-// ListImageGenerations 列出图像生成记录
-func (s *ImageService) ListImageGenerations(limit, offset int) ([]model.ImageGeneration, int64, error) {
-	var generations []model.ImageGeneration
+// 图像列表支持的排序字段
+const (
+	ImageSortCreatedAt      = "created_at"
+	ImageSortID             = "id"
+	ImageSortSeed           = "seed"
+	ImageSortGenerationTime = "generation_time"
+)
+
+// ImageListFilter 图像列表查询条件
+type ImageListFilter struct {
+	Status        string
+	StylePresetID *uint
+	BatchID       string
+	CreatedFrom   *time.Time // 包含
+	CreatedTo     *time.Time // 不包含
+	Width         int
+	Height        int
+	MinWidth      int
+	MaxWidth      int
+	MinHeight     int
+	MaxHeight     int
+	Seed          *int64
+
+	SortBy   string // 默认 created_at
+	SortDesc bool
+
+	Limit  int
+	Offset int              // 页码分页使用
+	Cursor *ImageListCursor // 游标分页使用，设置后忽略 Offset
+}
+
+// ImageListCursor 游标分页位置，记录上一页最后一条记录的排序值和 ID
+type ImageListCursor struct {
+	SortBy string `json:"s"`
+	Value  string `json:"v"`
+	ID     uint   `json:"id"`
+}
+
+// ImageListResult 图像列表查询结果
+type ImageListResult struct {
+	Generations []model.ImageGeneration
+	Total       int64
+	NextCursor  string // 没有更多数据时为空
+}
+
+// EncodeImageListCursor 将游标编码为字符串
+func EncodeImageListCursor(cursor *ImageListCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeImageListCursor 解析游标字符串
+func DecodeImageListCursor(value string) (*ImageListCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	var cursor ImageListCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if cursor.ID == 0 {
+		return nil, fmt.Errorf("invalid cursor: missing id")
+	}
+
+	return &cursor, nil
+}
+
+// ListImageGenerations 按条件列出图像生成记录
+func (s *ImageService) ListImageGenerations(filter *ImageListFilter) (*ImageListResult, error) {
+	sortBy := filter.SortBy
+	if sortBy == "" {
+		sortBy = ImageSortCreatedAt
+	}
+	if !isImageSortField(sortBy) {
+		return nil, fmt.Errorf("unsupported sort field: %s", sortBy)
+	}
+
+	query := applyImageListFilter(s.db.Model(&model.ImageGeneration{}), filter)
+
+	// 获取总数（不受分页影响）
 	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, err
+	}
 
-	// 获取总数
-	if err := s.db.Model(&model.ImageGeneration{}).Count(&total).Error; err != nil {
-		return nil, 0, err
+	direction := "ASC"
+	if filter.SortDesc {
+		direction = "DESC"
+	}
+	query = query.Order(sortBy + " " + direction)
+	if sortBy != ImageSortID {
+		query = query.Order("id " + direction)
 	}
 
-	// 获取分页数据
-	if err := s.db.Order("created_at DESC").
-		Limit(limit).
-		Offset(offset).
-		Find(&generations).Error; err != nil {
-		return nil, 0, err
+	if filter.Cursor != nil {
+		if filter.Cursor.SortBy != sortBy {
+			return nil, fmt.Errorf("cursor does not match sort field %s", sortBy)
+		}
+		cond, args, err := imageCursorCondition(filter.Cursor, filter.SortDesc)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where(cond, args...)
+	} else if filter.Offset > 0 {
+		query = query.Offset(filter.Offset)
+	}
+
+	// 多取一条用于判断是否还有下一页
+	var generations []model.ImageGeneration
+	if err := query.Limit(filter.Limit + 1).Find(&generations).Error; err != nil {
+		return nil, err
+	}
+
+	result := &ImageListResult{Total: total}
+	if len(generations) > filter.Limit {
+		generations = generations[:filter.Limit]
+		last := generations[len(generations)-1]
+		result.NextCursor = EncodeImageListCursor(&ImageListCursor{
+			SortBy: sortBy,
+			Value:  imageSortValue(&last, sortBy),
+			ID:     last.ID,
+		})
+	}
+	result.Generations = generations
+
+	return result, nil
+}
+
+// applyImageListFilter 将过滤条件应用到查询上
+func applyImageListFilter(query *gorm.DB, filter *ImageListFilter) *gorm.DB {
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.StylePresetID != nil {
+		query = query.Where("style_preset_id = ?", *filter.StylePresetID)
+	}
+	if filter.BatchID != "" {
+		query = query.Where("batch_id = ?", filter.BatchID)
+	}
+	// created_at 以服务器本地时区写入并按字符串比较，时间范围须转换到同一时区
+	if filter.CreatedFrom != nil {
+		query = query.Where("created_at >= ?", filter.CreatedFrom.In(time.Local))
+	}
+	if filter.CreatedTo != nil {
+		query = query.Where("created_at < ?", filter.CreatedTo.In(time.Local))
+	}
+	if filter.Width > 0 {
+		query = query.Where("width = ?", filter.Width)
+	}
+	if filter.Height > 0 {
+		query = query.Where("height = ?", filter.Height)
+	}
+	if filter.MinWidth > 0 {
+		query = query.Where("width >= ?", filter.MinWidth)
+	}
+	if filter.MaxWidth > 0 {
+		query = query.Where("width <= ?", filter.MaxWidth)
+	}
+	if filter.MinHeight > 0 {
+		query = query.Where("height >= ?", filter.MinHeight)
+	}
+	if filter.MaxHeight > 0 {
+		query = query.Where("height <= ?", filter.MaxHeight)
+	}
+	if filter.Seed != nil {
+		query = query.Where("seed = ?", *filter.Seed)
+	}
+	return query
+}
+
+// imageCursorCondition 构建游标分页的 keyset 条件
+func imageCursorCondition(cursor *ImageListCursor, desc bool) (string, []any, error) {
+	op := ">"
+	if desc {
+		op = "<"
+	}
+
+	if cursor.SortBy == ImageSortID {
+		return "id " + op + " ?", []any{cursor.ID}, nil
 	}
 
-	return generations, total, nil
+	var value any
+	switch cursor.SortBy {
+	case ImageSortCreatedAt:
+		t, err := time.Parse(time.RFC3339Nano, cursor.Value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid cursor: %w", err)
+		}
+		value = t
+	default:
+		n, err := strconv.ParseInt(cursor.Value, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid cursor: %w", err)
+		}
+		value = n
+	}
+
+	col := cursor.SortBy
+	cond := fmt.Sprintf("(%s %s ?) OR (%s = ? AND id %s ?)", col, op, col, op)
+	return cond, []any{value, value, cursor.ID}, nil
+}
+
+// imageSortValue 获取记录在指定排序字段上的值
+func imageSortValue(generation *model.ImageGeneration, sortBy string) string {
+	switch sortBy {
+	case ImageSortCreatedAt:
+		return generation.CreatedAt.Format(time.RFC3339Nano)
+	case ImageSortSeed:
+		return strconv.FormatInt(generation.Seed, 10)
+	case ImageSortGenerationTime:
+		return strconv.Itoa(generation.GenerationTime)
+	default:
+		return ""
+	}
+}
+
+// isImageSortField 检查是否为支持的排序字段
+func isImageSortField(field string) bool {
+	switch field {
+	case ImageSortCreatedAt, ImageSortID, ImageSortSeed, ImageSortGenerationTime:
+		return true
+	}
+	return false
 }
 
 // GetImageFilePath 获取图像文件的完整路径
@@ -163,3 +375,16 @@ func (s *ImageService) GetImageGenerationsByIDs(ids []uint) ([]model.ImageGenera
 
 	return generations, nil
 }
+
+// GetImageGenerationsByBatch 获取同一批次的生成记录，按批次序号排列
+func (s *ImageService) GetImageGenerationsByBatch(batchID string) ([]model.ImageGeneration, error) {
+	var generations []model.ImageGeneration
+
+	if err := s.db.Where("batch_id = ?", batchID).
+		Order("batch_index ASC").
+		Find(&generations).Error; err != nil {
+		return nil, err
+	}
+
+	return generations, nil
+}
@@ -0,0 +1,283 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"novelai-backend/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// ErrJobQueueFull 任务队列已满
+var ErrJobQueueFull = errors.New("job queue is full")
+
+// JobService 异步生成任务服务，任务持久化在数据库中，由固定数量的 worker 执行
+type JobService struct {
+	db                *gorm.DB
+	generationService *GenerationService
+	workers           int
+	queue             chan uint
+	events            *jobEventHub
+	startOnce         sync.Once
+}
+
+// NewJobService 创建异步生成任务服务实例
+func NewJobService(db *gorm.DB, generationService *GenerationService, workers, queueSize int) *JobService {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = 100
+	}
+	return &JobService{
+		db:                db,
+		generationService: generationService,
+		workers:           workers,
+		queue:             make(chan uint, queueSize),
+		events:            newJobEventHub(),
+	}
+}
+
+// Start 恢复未完成的任务并启动 worker，只会执行一次
+func (s *JobService) Start() error {
+	var err error
+	s.startOnce.Do(func() {
+		var pendingIDs []uint
+		pendingIDs, err = s.recoverJobs()
+		if err != nil {
+			return
+		}
+
+		for i := 0; i < s.workers; i++ {
+			go s.worker()
+		}
+
+		if len(pendingIDs) > 0 {
+			log.Printf("Resuming %d pending generation jobs", len(pendingIDs))
+			// 恢复的任务可能超过队列容量，在后台逐个放入
+			go func() {
+				for _, id := range pendingIDs {
+					s.queue <- id
+				}
+			}()
+		}
+	})
+	return err
+}
+
+// recoverJobs 将上次进程退出时仍在执行的任务重置为等待状态，并返回所有等待中的任务 ID
+func (s *JobService) recoverJobs() ([]uint, error) {
+	if err := s.db.Model(&model.GenerationJob{}).
+		Where("status = ?", model.StatusRunning).
+		Updates(map[string]any{"status": model.StatusPending, "started_at": nil}).Error; err != nil {
+		return nil, fmt.Errorf("failed to reset running jobs: %w", err)
+	}
+
+	var ids []uint
+	if err := s.db.Model(&model.GenerationJob{}).
+		Where("status = ?", model.StatusPending).
+		Order("id ASC").
+		Pluck("id", &ids).Error; err != nil {
+		return nil, fmt.Errorf("failed to load pending jobs: %w", err)
+	}
+
+	return ids, nil
+}
+
+// Enqueue 持久化生成任务并放入队列
+func (s *JobService) Enqueue(task *GenerationTask) (*model.GenerationJob, error) {
+	if len(s.queue) >= cap(s.queue) {
+		return nil, ErrJobQueueFull
+	}
+
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal task: %w", err)
+	}
+
+	job := &model.GenerationJob{
+		Status:       model.StatusPending,
+		Payload:      string(payload),
+		AnlasUsageID: task.AnlasUsageID,
+	}
+	if err := s.db.Create(job).Error; err != nil {
+		return nil, fmt.Errorf("failed to save job: %w", err)
+	}
+
+	select {
+	case s.queue <- job.ID:
+	default:
+		// 并发入队导致队列已满，撤销任务
+		s.db.Delete(job)
+		return nil, ErrJobQueueFull
+	}
+
+	if position, err := s.QueuePosition(job); err == nil {
+		s.publish(job.ID, JobEventQueued, map[string]any{"queue_position": position})
+	}
+
+	return job, nil
+}
+
+// Subscribe 订阅任务进度事件，终止事件发布后通道会被关闭
+// 订阅不会补发历史事件，调用方应在订阅后读取一次任务当前状态
+func (s *JobService) Subscribe(jobID uint) (<-chan JobEvent, func()) {
+	return s.events.subscribe(jobID)
+}
+
+// publish 发布任务事件
+func (s *JobService) publish(jobID uint, eventType string, data any) {
+	s.events.publish(JobEvent{
+		JobID: jobID,
+		Type:  eventType,
+		Data:  data,
+		Time:  time.Now(),
+	})
+}
+
+// publishQueuePositions 向仍在排队且有订阅者的任务推送最新排队位置
+func (s *JobService) publishQueuePositions() {
+	for _, id := range s.events.subscribedJobIDs() {
+		job, err := s.GetJob(id)
+		if err != nil || job.Status != model.StatusPending {
+			continue
+		}
+		if position, err := s.QueuePosition(job); err == nil {
+			s.publish(id, JobEventQueued, map[string]any{"queue_position": position})
+		}
+	}
+}
+
+// GetJob 获取任务
+func (s *JobService) GetJob(id uint) (*model.GenerationJob, error) {
+	var job model.GenerationJob
+	if err := s.db.First(&job, id).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// QueuePosition 获取等待中任务的排队位置（从 1 开始），非等待状态返回 0
+func (s *JobService) QueuePosition(job *model.GenerationJob) (int64, error) {
+	if job.Status != model.StatusPending {
+		return 0, nil
+	}
+
+	var ahead int64
+	if err := s.db.Model(&model.GenerationJob{}).
+		Where("status = ? AND id < ?", model.StatusPending, job.ID).
+		Count(&ahead).Error; err != nil {
+		return 0, err
+	}
+	return ahead + 1, nil
+}
+
+// worker 从队列中取出任务并执行
+func (s *JobService) worker() {
+	for id := range s.queue {
+		s.process(id)
+	}
+}
+
+// process 执行单个任务并更新任务状态
+func (s *JobService) process(id uint) {
+	// 将任务标记为执行中，状态不是 pending 时说明已被处理
+	now := time.Now()
+	result := s.db.Model(&model.GenerationJob{}).
+		Where("id = ? AND status = ?", id, model.StatusPending).
+		Updates(map[string]any{
+			"status":     model.StatusRunning,
+			"started_at": now,
+			"attempts":   gorm.Expr("attempts + 1"),
+		})
+	if result.Error != nil {
+		log.Printf("Failed to start job %d: %v", id, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	job, err := s.GetJob(id)
+	if err != nil {
+		log.Printf("Failed to load job %d: %v", id, err)
+		return
+	}
+
+	s.publish(id, JobEventStarted, map[string]any{"attempts": job.Attempts})
+	s.publishQueuePositions()
+
+	generations, err := s.runJob(job)
+	s.finishJob(job, generations, err)
+}
+
+// runJob 解析任务参数并执行生成，捕获 panic 避免 worker 退出
+func (s *JobService) runJob(job *model.GenerationJob) (generations []*model.ImageGeneration, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	var task GenerationTask
+	if err := json.Unmarshal([]byte(job.Payload), &task); err != nil {
+		// 未执行生成，退还预留的配额；执行后是否退还由 Run 决定
+		if job.AnlasUsageID != nil {
+			s.generationService.releaseQuota(*job.AnlasUsageID)
+		}
+		return nil, fmt.Errorf("invalid job payload: %w", err)
+	}
+
+	generations, err = s.generationService.Run(&task, func(eventType string, data any) {
+		s.publish(job.ID, eventType, data)
+	})
+	var genErr *GenerationError
+	if errors.As(err, &genErr) && genErr.Generation != nil {
+		return []*model.ImageGeneration{genErr.Generation}, err
+	}
+	return generations, err
+}
+
+// finishJob 记录任务执行结果，generations 为空或第一条为批次的代表记录
+func (s *JobService) finishJob(job *model.GenerationJob, generations []*model.ImageGeneration, runErr error) {
+	updates := map[string]any{
+		"status":      model.StatusSuccess,
+		"finished_at": time.Now(),
+	}
+	var generation *model.ImageGeneration
+	if len(generations) > 0 {
+		generation = generations[0]
+		updates["generation_id"] = generation.ID
+		updates["batch_id"] = generation.BatchID
+	}
+	if runErr != nil {
+		updates["status"] = model.StatusFailed
+		updates["error_message"] = runErr.Error()
+	}
+
+	if err := s.db.Model(&model.GenerationJob{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
+		log.Printf("Failed to update job %d: %v", job.ID, err)
+	}
+
+	data := map[string]any{}
+	if generation != nil {
+		ids := make([]uint, 0, len(generations))
+		for _, g := range generations {
+			ids = append(ids, g.ID)
+		}
+		data["generation_id"] = generation.ID
+		data["generation_ids"] = ids
+		data["batch_id"] = generation.BatchID
+	}
+	if runErr != nil {
+		data["error"] = runErr.Error()
+		s.publish(job.ID, JobEventFailed, data)
+		return
+	}
+	s.publish(job.ID, JobEventCompleted, data)
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// 任务事件类型
+const (
+	JobEventQueued          = "queued"           // 排队中，Data 包含 queue_position
+	JobEventStarted         = "started"          // 开始执行
+	JobEventPreview         = "preview"          // 流式生成的中间预览
+	JobEventNovelAIResponse = "novelai_response" // 收到 NovelAI 响应
+	JobEventFileSaved       = "file_saved"       // 图像文件已保存
+	JobEventCompleted       = "completed"        // 执行成功（终止事件）
+	JobEventFailed          = "failed"           // 执行失败（终止事件）
+)
+
+// jobEventSubscriberBuffer 每个订阅者的事件缓冲数量
+const jobEventSubscriberBuffer = 32
+
+// JobEvent 任务进度事件
+type JobEvent struct {
+	JobID uint      `json:"job_id,omitempty"` // 同步流式生成时为 0
+	Type  string    `json:"type"`
+	Data  any       `json:"data,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// IsTerminal 是否为终止事件
+func (e *JobEvent) IsTerminal() bool {
+	return e.Type == JobEventCompleted || e.Type == JobEventFailed
+}
+
+// ProgressFunc 生成过程中的进度回调
+type ProgressFunc func(eventType string, data any)
+
+// jobEventHub 按任务分发进度事件
+type jobEventHub struct {
+	mu          sync.Mutex
+	subscribers map[uint]map[chan JobEvent]struct{}
+}
+
+func newJobEventHub() *jobEventHub {
+	return &jobEventHub{
+		subscribers: make(map[uint]map[chan JobEvent]struct{}),
+	}
+}
+
+// subscribe 订阅任务事件，返回的取消函数可重复调用
+func (h *jobEventHub) subscribe(jobID uint) (<-chan JobEvent, func()) {
+	ch := make(chan JobEvent, jobEventSubscriberBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[jobID] == nil {
+		h.subscribers[jobID] = make(map[chan JobEvent]struct{})
+	}
+	h.subscribers[jobID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(jobID, ch)
+	}
+	return ch, cancel
+}
+
+// publish 发布事件，订阅者处理不及时时丢弃非终止事件；终止事件发布后关闭订阅
+func (h *jobEventHub) publish(event JobEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[event.JobID] {
+		select {
+		case ch <- event:
+		default:
+		}
+		if event.IsTerminal() {
+			h.remove(event.JobID, ch)
+		}
+	}
+}
+
+// subscribedJobIDs 返回当前有订阅者的任务 ID
+func (h *jobEventHub) subscribedJobIDs() []uint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ids := make([]uint, 0, len(h.subscribers))
+	for id := range h.subscribers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// remove 移除并关闭订阅，调用方需持有锁
+func (h *jobEventHub) remove(jobID uint, ch chan JobEvent) {
+	subs, ok := h.subscribers[jobID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(h.subscribers, jobID)
+	}
+}
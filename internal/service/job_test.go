@@ -0,0 +1,79 @@
+package service
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"novelai-backend/internal/database"
+	"novelai-backend/internal/model"
+
+	"gorm.io/gorm/logger"
+)
+
+func TestJobFailureReleasesQuota(t *testing.T) {
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"), logger.Silent)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	quota := NewQuotaService(db, QuotaConfig{Location: time.UTC})
+	// 未配置 NovelAI 服务，执行生成时 panic
+	jobs := NewJobService(db, NewGenerationService(nil, nil, nil, quota), 1, 10)
+
+	reserve := func() *uint {
+		t.Helper()
+		usage, err := quota.Reserve(QuotaSubject{ClientKey: "1.1.1.1"}, 20)
+		if err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		return &usage.ID
+	}
+	waitFailed := func(id uint) *model.GenerationJob {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			job, err := jobs.GetJob(id)
+			if err != nil {
+				t.Fatalf("get job: %v", err)
+			}
+			if job.Status == model.StatusFailed {
+				return job
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("job %d status = %s, want failed", id, job.Status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	assertReleased := func(usageID *uint) {
+		t.Helper()
+		var count int64
+		db.Model(&model.AnlasUsage{}).Where("id = ?", *usageID).Count(&count)
+		if count != 0 {
+			t.Errorf("anlas usage %d should be released", *usageID)
+		}
+	}
+
+	// 任务参数无法解析（在启动前写入，由恢复流程放入队列）
+	invalid := &model.GenerationJob{Status: model.StatusPending, Payload: "{", AnlasUsageID: reserve()}
+	if err := db.Create(invalid).Error; err != nil {
+		t.Fatalf("create job: %v", err)
+	}
+	if err := jobs.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	waitFailed(invalid.ID)
+	assertReleased(invalid.AnlasUsageID)
+
+	// 执行时 panic
+	task := &GenerationTask{Prompt: "x", AnlasUsageID: reserve(), Request: GenerationRequest{Prompt: "x", Model: ModelV45Full}}
+	job, err := jobs.Enqueue(task)
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if failed := waitFailed(job.ID); !strings.HasPrefix(failed.ErrorMessage, "job panicked") {
+		t.Errorf("error message = %q, want panic", failed.ErrorMessage)
+	}
+	assertReleased(task.AnlasUsageID)
+}
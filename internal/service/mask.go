@@ -0,0 +1,81 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// maskScale NovelAI 在潜空间中使用蒙版，潜空间尺寸为图像的 1/8
+const maskScale = 8
+
+// PrepareInpaintMask 校验蒙版尺寸并转换为 NovelAI 需要的格式
+// 蒙版可以与源图像同尺寸，也可以是 1/8 尺寸（潜空间尺寸，会被放大）；
+// 白色且不透明的像素表示需要重绘的区域。输出为与源图像同尺寸的黑白 PNG，
+// 并按 8x8 网格对齐：网格内只要有需要重绘的像素，整个网格都会被重绘，
+// 避免 NovelAI 缩小蒙版时丢失细小区域
+func PrepareInpaintMask(data []byte, width, height int) ([]byte, error) {
+	img, _, err := decodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mask: %w", err)
+	}
+
+	bounds := img.Bounds()
+	scale := 0
+	switch {
+	case bounds.Dx() == width && bounds.Dy() == height:
+		scale = 1
+	case bounds.Dx()*maskScale == width && bounds.Dy()*maskScale == height:
+		scale = maskScale
+	default:
+		return nil, fmt.Errorf("mask size %dx%d must match image size %dx%d or %dx%d",
+			bounds.Dx(), bounds.Dy(), width, height, width/maskScale, height/maskScale)
+	}
+
+	// 计算每个 8x8 网格是否需要重绘
+	cols, rows := (width+maskScale-1)/maskScale, (height+maskScale-1)/maskScale
+	cells := make([]bool, cols*rows)
+	painted := false
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if !isMaskedPixel(img.At(bounds.Min.X+x, bounds.Min.Y+y)) {
+				continue
+			}
+			// 原图坐标
+			ix, iy := x*scale, y*scale
+			cells[(iy/maskScale)*cols+ix/maskScale] = true
+			painted = true
+		}
+	}
+	if !painted {
+		return nil, fmt.Errorf("mask is empty")
+	}
+
+	out := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if cells[(y/maskScale)*cols+x/maskScale] {
+				out.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return nil, fmt.Errorf("failed to encode mask: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// isMaskedPixel 白色且不透明的像素表示需要重绘
+func isMaskedPixel(c color.Color) bool {
+	r, g, b, a := c.RGBA()
+	if a < 0x8000 {
+		return false
+	}
+	// RGBA 返回预乘后的 16 位值
+	luminance := (299*r + 587*g + 114*b) / 1000
+	return luminance >= 0x8000
+}
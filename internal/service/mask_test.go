@@ -0,0 +1,95 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func encodeTestMask(t *testing.T, width, height int, points ...image.Point) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.Black)
+		}
+	}
+	for _, p := range points {
+		img.Set(p.X, p.Y, color.White)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeTestMask(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func isWhite(img image.Image, x, y int) bool {
+	r, _, _, _ := img.At(x, y).RGBA()
+	return r == 0xffff
+}
+
+func TestPrepareInpaintMaskAlignsToGrid(t *testing.T) {
+	data, err := PrepareInpaintMask(encodeTestMask(t, 64, 64, image.Pt(10, 10)), 64, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := decodeTestMask(t, data)
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 64 {
+		t.Fatalf("mask size = %v", img.Bounds())
+	}
+	// (10,10) 所在的网格为 (8,8)-(15,15)
+	for _, p := range []image.Point{{8, 8}, {15, 15}, {10, 10}} {
+		if !isWhite(img, p.X, p.Y) {
+			t.Errorf("pixel %v should be masked", p)
+		}
+	}
+	for _, p := range []image.Point{{7, 7}, {16, 16}, {0, 0}} {
+		if isWhite(img, p.X, p.Y) {
+			t.Errorf("pixel %v should not be masked", p)
+		}
+	}
+}
+
+func TestPrepareInpaintMaskUpscalesLatentMask(t *testing.T) {
+	data, err := PrepareInpaintMask(encodeTestMask(t, 8, 16, image.Pt(1, 2)), 64, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := decodeTestMask(t, data)
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 128 {
+		t.Fatalf("mask size = %v", img.Bounds())
+	}
+	if !isWhite(img, 8, 16) || !isWhite(img, 15, 23) || isWhite(img, 16, 16) {
+		t.Errorf("latent pixel (1,2) should cover (8,16)-(15,23)")
+	}
+}
+
+func TestPrepareInpaintMaskRejectsInvalidMasks(t *testing.T) {
+	if _, err := PrepareInpaintMask(encodeTestMask(t, 32, 32, image.Pt(1, 1)), 64, 64); err == nil {
+		t.Error("expected size mismatch error")
+	}
+	if _, err := PrepareInpaintMask(encodeTestMask(t, 64, 64), 64, 64); err == nil {
+		t.Error("expected empty mask error")
+	}
+	if _, err := PrepareInpaintMask([]byte("not an image"), 64, 64); err == nil {
+		t.Error("expected decode error")
+	}
+	if _, err := PrepareInpaintMask(encodeTestPNG(t, 1, 1, 30000, 30000), 64, 64); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Errorf("err = %v, want size error before decoding", err)
+	}
+}
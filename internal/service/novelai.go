@@ -3,32 +3,110 @@ package service
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"strings"
 	"time"
+
+	"novelai-backend/internal/model"
+)
+
+const (
+	// DefaultNovelAIBaseURL NovelAI 图像 API 默认地址
+	DefaultNovelAIBaseURL = "https://image.novelai.net"
+
+	novelAIGenerateImagePath = "/ai/generate-image"
 )
 
+// varietyBoostSigma 开启 variety boost 时跳过 CFG 的 sigma 阈值
+const varietyBoostSigma = 19.0
+
+// 生成类型
 const (
-	NovelAIImageURL = "https://image.novelai.net/ai/generate-image"
+	ActionGenerate = "generate"
+	ActionImg2Img  = "img2img"
+	ActionInfill   = "infill"
 )
 
+// img2img / 局部重绘参数范围
+const (
+	DefaultImg2ImgStrength = 0.7
+	MinImg2ImgStrength     = 0.01
+	MaxImg2ImgStrength     = 0.99
+	MaxImg2ImgNoise        = 0.99
+)
+
+// omittedImagePlaceholder 保存到记录中的 payload 用于替代图像数据
+const omittedImagePlaceholder = "<omitted>"
+
 // NovelAIService NovelAI API 服务
 type NovelAIService struct {
-	apiKey string
-	client *http.Client
+	apiKey   string
+	baseURL  string
+	client   *http.Client
+	defaults GenerationDefaults
 }
 
-// NewNovelAIService 创建 NovelAI 服务实例
-func NewNovelAIService(apiKey string) *NovelAIService {
+// GenerationDefaults 请求未指定时使用的采样参数
+type GenerationDefaults struct {
+	Model         string
+	Sampler       string
+	Scale         float64
+	NoiseSchedule string
+	SMEA          bool // 仅对支持 SMEA 的模型生效
+	SMEADyn       bool
+	CFGRescale    float64
+	Decrisper     bool
+	VarietyBoost  bool
+}
+
+// NewNovelAIService 创建 NovelAI 服务实例，baseURL 为空时使用官方地址，timeout 为 0 时默认 2 分钟
+func NewNovelAIService(apiKey, baseURL string, timeout time.Duration, defaults GenerationDefaults) *NovelAIService {
+	if baseURL == "" {
+		baseURL = DefaultNovelAIBaseURL
+	}
+	if timeout <= 0 {
+		timeout = 120 * time.Second // 2分钟超时
+	}
 	return &NovelAIService{
-		apiKey: apiKey,
+		apiKey:  apiKey,
+		baseURL: strings.TrimRight(baseURL, "/"),
 		client: &http.Client{
-			Timeout: 120 * time.Second, // 2分钟超时
+			Timeout: timeout,
 		},
+		defaults: defaults,
+	}
+}
+
+// Defaults 返回默认采样参数
+func (s *NovelAIService) Defaults() GenerationDefaults {
+	return s.defaults
+}
+
+// ValidateDefaults 校验默认采样参数是否为合法组合
+func (s *NovelAIService) ValidateDefaults() error {
+	d := s.defaults
+	req := &GenerationRequest{
+		Model:         d.Model,
+		Sampler:       d.Sampler,
+		Scale:         d.Scale,
+		NoiseSchedule: d.NoiseSchedule,
+		SMEA:          d.SMEA && ModelSupportsSMEA(d.Model),
+		SMEADyn:       d.SMEADyn && ModelSupportsSMEA(d.Model),
+		CFGRescale:    d.CFGRescale,
+		Steps:         DefaultSteps,
+		Width:         DefaultWidth,
+		Height:        DefaultHeight,
+		NSamples:      1,
+	}
+	if err := ValidateGenerationRequest(req); err != nil {
+		return fmt.Errorf("invalid default generation parameters: %w", err)
 	}
+	return nil
 }
 
 // GenerationRequest 生成请求参数
@@ -39,6 +117,37 @@ type GenerationRequest struct {
 	Steps          int    `json:"steps"`
 	Width          int    `json:"width"`
 	Height         int    `json:"height"`
+	NSamples       int    `json:"n_samples"` // 生成数量，1–MaxSamples
+
+	// 采样参数
+	Model         string  `json:"model"`
+	Sampler       string  `json:"sampler"`
+	Scale         float64 `json:"scale"`
+	NoiseSchedule string  `json:"noise_schedule"`
+	SMEA          bool    `json:"sm"`
+	SMEADyn       bool    `json:"sm_dyn"`
+	CFGRescale    float64 `json:"cfg_rescale"`
+	Decrisper     bool    `json:"decrisper"`     // dynamic_thresholding
+	VarietyBoost  bool    `json:"variety_boost"` // skip_cfg_above_sigma
+	QualityToggle bool    `json:"quality_toggle"`
+	UCPreset      int     `json:"uc_preset"`
+
+	// V4 多角色提示词
+	Characters []model.CharacterPrompt `json:"characters,omitempty"`
+
+	// img2img / 局部重绘参数
+	Action           string  `json:"action"`          // generate（默认）、img2img 或 infill
+	Image            []byte  `json:"image,omitempty"` // 源图像（PNG）
+	Mask             []byte  `json:"mask,omitempty"`  // 局部重绘蒙版（PNG，已对齐 8x8 网格）
+	Strength         float64 `json:"strength"`
+	Noise            float64 `json:"noise"`
+	AddOriginalImage bool    `json:"add_original_image"` // 局部重绘时将未重绘区域覆盖为原图
+
+	// 风格参考（vibe transfer）
+	References []ReferenceImage `json:"references,omitempty"`
+
+	// V4+ 模型风格参考的 encode-vibe 编码结果，与 References 一一对应
+	encodedReferences []string
 }
 
 // NovelAIPayload NovelAI API 请求负载
@@ -51,36 +160,45 @@ type NovelAIPayload struct {
 
 // NovelAIParameters NovelAI API 参数
 type NovelAIParameters struct {
-	ParamsVersion                         int      `json:"params_version"`
-	PreferBrownian                        bool     `json:"prefer_brownian"`
-	NegativePrompt                        string   `json:"negative_prompt"`
-	Height                                int      `json:"height"`
-	Width                                 int      `json:"width"`
-	Scale                                 int      `json:"scale"`
-	Seed                                  int64    `json:"seed"`
-	Sampler                               string   `json:"sampler"`
-	NoiseSchedule                         string   `json:"noise_schedule"`
-	Steps                                 int      `json:"steps"`
-	NSamples                              int      `json:"n_samples"`
-	UCPreset                              int      `json:"ucPreset"`
-	QualityToggle                         bool     `json:"qualityToggle"`
-	AddOriginalImage                      bool     `json:"add_original_image"`
-	ControlnetStrength                    int      `json:"controlnet_strength"`
-	DeliberateEulerAncestralBug           bool     `json:"deliberate_euler_ancestral_bug"`
-	DynamicThresholding                   bool     `json:"dynamic_thresholding"`
-	Legacy                                bool     `json:"legacy"`
-	LegacyV3Extend                        bool     `json:"legacy_v3_extend"`
-	SM                                    bool     `json:"sm"`
-	SMDyn                                 bool     `json:"sm_dyn"`
-	UncondScale                           int      `json:"uncond_scale"`
-	SkipCfgAboveSigma                     *float64 `json:"skip_cfg_above_sigma"`
-	UseCoords                             bool     `json:"use_coords"`
-	CharacterPrompts                      []any    `json:"characterPrompts"`
-	ReferenceImageMultiple                []any    `json:"reference_image_multiple"`
-	ReferenceInformationExtractedMultiple []any    `json:"reference_information_extracted_multiple"`
-	ReferenceStrengthMultiple             []any    `json:"reference_strength_multiple"`
-	V4NegativePrompt                      V4Prompt `json:"v4_negative_prompt"`
-	V4Prompt                              V4Prompt `json:"v4_prompt"`
+	ParamsVersion                         int                      `json:"params_version"`
+	Image                                 string                   `json:"image,omitempty"`
+	Mask                                  string                   `json:"mask,omitempty"`
+	InpaintImg2ImgStrength                *float64                 `json:"inpaintImg2ImgStrength,omitempty"`
+	Strength                              *float64                 `json:"strength,omitempty"`
+	Noise                                 *float64                 `json:"noise,omitempty"`
+	ExtraNoiseSeed                        *int64                   `json:"extra_noise_seed,omitempty"`
+	PreferBrownian                        bool                     `json:"prefer_brownian"`
+	NegativePrompt                        string                   `json:"negative_prompt"`
+	Height                                int                      `json:"height"`
+	Width                                 int                      `json:"width"`
+	Scale                                 float64                  `json:"scale"`
+	Seed                                  int64                    `json:"seed"`
+	Sampler                               string                   `json:"sampler"`
+	NoiseSchedule                         string                   `json:"noise_schedule"`
+	Steps                                 int                      `json:"steps"`
+	CFGRescale                            float64                  `json:"cfg_rescale"`
+	NSamples                              int                      `json:"n_samples"`
+	Stream                                string                   `json:"stream,omitempty"`
+	UCPreset                              int                      `json:"ucPreset"`
+	QualityToggle                         bool                     `json:"qualityToggle"`
+	AddOriginalImage                      bool                     `json:"add_original_image"`
+	ControlnetStrength                    int                      `json:"controlnet_strength"`
+	DeliberateEulerAncestralBug           bool                     `json:"deliberate_euler_ancestral_bug"`
+	DynamicThresholding                   bool                     `json:"dynamic_thresholding"`
+	Legacy                                bool                     `json:"legacy"`
+	LegacyV3Extend                        bool                     `json:"legacy_v3_extend"`
+	SM                                    bool                     `json:"sm"`
+	SMDyn                                 bool                     `json:"sm_dyn"`
+	UncondScale                           int                      `json:"uncond_scale"`
+	SkipCfgAboveSigma                     *float64                 `json:"skip_cfg_above_sigma"`
+	UseCoords                             bool                     `json:"use_coords"`
+	CharacterPrompts                      []NovelAICharacterPrompt `json:"characterPrompts"`
+	ReferenceImageMultiple                []any                    `json:"reference_image_multiple"`
+	ReferenceInformationExtractedMultiple []any                    `json:"reference_information_extracted_multiple"`
+	ReferenceStrengthMultiple             []any                    `json:"reference_strength_multiple"`
+	NormalizeReferenceStrengthMultiple    bool                     `json:"normalize_reference_strength_multiple,omitempty"`
+	V4NegativePrompt                      V4Prompt                 `json:"v4_negative_prompt"`
+	V4Prompt                              V4Prompt                 `json:"v4_prompt"`
 }
 
 // V4Prompt V4 提示词格式
@@ -92,136 +210,239 @@ type V4Prompt struct {
 
 // V4Caption V4 标题格式
 type V4Caption struct {
-	BaseCaption  string `json:"base_caption"`
-	CharCaptions []any  `json:"char_captions"`
+	BaseCaption  string          `json:"base_caption"`
+	CharCaptions []V4CharCaption `json:"char_captions"`
+}
+
+// GenerateImage 生成图像，返回的图像数量等于 req.NSamples，第 i 张的种子为 req.Seed+i
+func (s *NovelAIService) GenerateImage(req *GenerationRequest) ([][]byte, string, error) {
+	payload, err := buildPayload(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, recordPayload, err := s.postPayload(novelAIGenerateImagePath, payload)
+	if err != nil {
+		return nil, recordPayload, err
+	}
+	defer resp.Body.Close()
+
+	// 读取响应数据
+	archiveData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, recordPayload, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	// 从 ZIP 文件中提取 PNG 图像，每个样本一张
+	images, err := extractPNGsFromZip(archiveData)
+	if err != nil {
+		return nil, recordPayload, fmt.Errorf("failed to extract image: %w", err)
+	}
+	if len(images) != req.NSamples {
+		return nil, recordPayload, fmt.Errorf("expected %d images, got %d", req.NSamples, len(images))
+	}
+
+	return images, recordPayload, nil
 }
 
-// GenerateImage 生成图像
-func (s *NovelAIService) GenerateImage(req *GenerationRequest) ([]byte, string, error) {
-	// 处理随机种子
+// buildPayload 校验请求并构建 NovelAI 请求负载，随机种子会回写到 req.Seed
+func buildPayload(req *GenerationRequest) (*NovelAIPayload, error) {
+	// 未指定数量时生成一张（兼容旧的任务数据）
+	if req.NSamples == 0 {
+		req.NSamples = 1
+	}
+	if err := ValidateGenerationRequest(req); err != nil {
+		return nil, err
+	}
+
+	// 处理随机种子，并回写实际使用的种子
+	if req.Seed == -1 {
+		req.Seed = rand.Int63n(9999999999)
+	}
 	seed := req.Seed
-	if seed == -1 {
-		seed = rand.Int63n(9999999999)
+
+	// 多角色提示词
+	characterPrompts, charCaptions, negativeCharCaptions, useCoords := buildCharacterParameters(req.Characters)
+
+	// variety boost 通过跳过高 sigma 阶段的 CFG 实现
+	var skipCfgAboveSigma *float64
+	if req.VarietyBoost {
+		sigma := varietyBoostSigma
+		skipCfgAboveSigma = &sigma
 	}
 
-	// 构建请求负载，使用默认参数
-	payload := NovelAIPayload{
-		Action: "generate",
+	// 构建请求负载
+	payload := &NovelAIPayload{
+		Action: ActionGenerate,
 		Input:  req.Prompt,
-		Model:  "nai-diffusion-4-5-full", // 默认模型
+		Model:  req.Model,
 		Parameters: NovelAIParameters{
 			ParamsVersion:                         3,
 			PreferBrownian:                        true,
 			NegativePrompt:                        req.NegativePrompt,
 			Height:                                req.Height,
 			Width:                                 req.Width,
-			Scale:                                 5, // 默认值
+			Scale:                                 req.Scale,
 			Seed:                                  seed,
-			Sampler:                               "k_euler_ancestral", // 默认值
-			NoiseSchedule:                         "karras",            // 默认值
+			Sampler:                               req.Sampler,
+			NoiseSchedule:                         req.NoiseSchedule,
 			Steps:                                 req.Steps,
-			NSamples:                              1,
-			UCPreset:                              0,
-			QualityToggle:                         false,
+			CFGRescale:                            req.CFGRescale,
+			NSamples:                              req.NSamples,
+			UCPreset:                              req.UCPreset,
+			QualityToggle:                         req.QualityToggle,
 			AddOriginalImage:                      false,
 			ControlnetStrength:                    1,
 			DeliberateEulerAncestralBug:           false,
-			DynamicThresholding:                   true, // 默认 decrisper: true
+			DynamicThresholding:                   req.Decrisper,
 			Legacy:                                false,
 			LegacyV3Extend:                        false,
-			SM:                                    false, // 默认值
-			SMDyn:                                 false, // 默认值
+			SM:                                    req.SMEA,
+			SMDyn:                                 req.SMEADyn,
 			UncondScale:                           1,
-			SkipCfgAboveSigma:                     nil, // 默认 variety_boost: false
-			UseCoords:                             false,
-			CharacterPrompts:                      []any{},
+			SkipCfgAboveSigma:                     skipCfgAboveSigma,
+			UseCoords:                             useCoords,
+			CharacterPrompts:                      characterPrompts,
 			ReferenceImageMultiple:                []any{},
 			ReferenceInformationExtractedMultiple: []any{},
 			ReferenceStrengthMultiple:             []any{},
 			V4NegativePrompt: V4Prompt{
 				Caption: V4Caption{
 					BaseCaption:  req.NegativePrompt,
-					CharCaptions: []any{},
+					CharCaptions: negativeCharCaptions,
 				},
+				UseCoords: useCoords,
 			},
 			V4Prompt: V4Prompt{
 				Caption: V4Caption{
 					BaseCaption:  req.Prompt,
-					CharCaptions: []any{},
+					CharCaptions: charCaptions,
 				},
-				UseCoords: false,
+				UseCoords: useCoords,
 				UseOrder:  true,
 			},
 		},
 	}
 
+	// img2img / 局部重绘附带源图像，额外噪声使用相同的种子
+	if req.Action == ActionImg2Img || req.Action == ActionInfill {
+		payload.Action = req.Action
+		payload.Parameters.Image = base64.StdEncoding.EncodeToString(req.Image)
+		payload.Parameters.Strength = &req.Strength
+		payload.Parameters.Noise = &req.Noise
+		payload.Parameters.ExtraNoiseSeed = &seed
+	}
+
+	// 局部重绘使用对应的 inpainting 模型
+	if req.Action == ActionInfill {
+		inpaintStrength := 1.0
+		payload.Model = InpaintModel(req.Model)
+		payload.Parameters.Mask = base64.StdEncoding.EncodeToString(req.Mask)
+		payload.Parameters.AddOriginalImage = req.AddOriginalImage
+		payload.Parameters.InpaintImg2ImgStrength = &inpaintStrength
+	}
+
+	// 风格参考
+	if len(req.References) > 0 {
+		if err := applyReferenceParameters(&payload.Parameters, req); err != nil {
+			return nil, err
+		}
+	}
+
+	return payload, nil
+}
+
+// postPayload 发送请求负载，返回状态码为 200 的响应和用于保存到记录中的 payload
+// 调用方负责关闭响应体
+func (s *NovelAIService) postPayload(path string, payload *NovelAIPayload) (*http.Response, string, error) {
 	// 序列化请求负载
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to marshal payload: %w", err)
 	}
+	recordPayload := payloadForRecord(*payload)
 
 	// 创建 HTTP 请求
-	req2, err := http.NewRequest("POST", NovelAIImageURL, bytes.NewBuffer(payloadBytes))
+	req, err := http.NewRequest("POST", s.baseURL+path, bytes.NewBuffer(payloadBytes))
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to create request: %w", err)
+		return nil, recordPayload, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// 设置请求头
-	req2.Header.Set("Authorization", "Bearer "+s.apiKey)
-	req2.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
 
 	// 发送请求
-	resp, err := s.client.Do(req2)
+	resp, err := s.client.Do(req)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to send request: %w", err)
+		return nil, recordPayload, fmt.Errorf("failed to send request: %w", err)
 	}
-	defer resp.Body.Close()
 
 	// 检查响应状态
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		body, _ := io.ReadAll(resp.Body)
-		return nil, "", fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+		return nil, recordPayload, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
 	}
 
-	// 读取响应数据
-	archiveData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to read response: %w", err)
-	}
+	return resp, recordPayload, nil
+}
 
-	// 从 ZIP 文件中提取 PNG 图像
-	imageData, err := extractPNGFromZip(archiveData)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to extract image: %w", err)
+// payloadForRecord 序列化用于保存到记录中的 payload，图像数据替换为占位符
+func payloadForRecord(payload NovelAIPayload) string {
+	if payload.Parameters.Image != "" {
+		payload.Parameters.Image = omittedImagePlaceholder
 	}
-
-	return imageData, string(payloadBytes), nil
+	if payload.Parameters.Mask != "" {
+		payload.Parameters.Mask = omittedImagePlaceholder
+	}
+	if len(payload.Parameters.ReferenceImageMultiple) > 0 {
+		references := make([]any, len(payload.Parameters.ReferenceImageMultiple))
+		for i := range references {
+			references[i] = omittedImagePlaceholder
+		}
+		payload.Parameters.ReferenceImageMultiple = references
+	}
+	data, _ := json.Marshal(payload)
+	return string(data)
 }
 
-// extractPNGFromZip 从 ZIP 文件中提取 PNG 图像
-func extractPNGFromZip(zipData []byte) ([]byte, error) {
+// extractPNGsFromZip 按压缩包中的顺序提取全部 PNG 图像
+func extractPNGsFromZip(zipData []byte) ([][]byte, error) {
 	reader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read zip: %w", err)
 	}
 
+	var images [][]byte
 	for _, file := range reader.File {
-		if file.Name[len(file.Name)-4:] == ".png" {
-			rc, err := file.Open()
-			if err != nil {
-				return nil, fmt.Errorf("failed to open file in zip: %w", err)
-			}
-			defer rc.Close()
-
-			data, err := io.ReadAll(rc)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read file in zip: %w", err)
-			}
-
-			return data, nil
+		if !strings.HasSuffix(file.Name, ".png") {
+			continue
 		}
+		data, err := readZipFile(file)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, data)
 	}
 
-	return nil, fmt.Errorf("no PNG file found in zip")
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no PNG file found in zip")
+	}
+	return images, nil
+}
+
+// readZipFile 读取压缩包中的单个文件
+func readZipFile(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file in zip: %w", err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file in zip: %w", err)
+	}
+	return data, nil
 }
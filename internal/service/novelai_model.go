@@ -0,0 +1,221 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// NovelAI 模型
+const (
+	ModelV3             = "nai-diffusion-3"
+	ModelFurryV3        = "nai-diffusion-furry-3"
+	ModelV4Curated      = "nai-diffusion-4-curated-preview"
+	ModelV4Full         = "nai-diffusion-4-full"
+	ModelV45Curated     = "nai-diffusion-4-5-curated"
+	ModelV45Full        = "nai-diffusion-4-5-full"
+	DefaultNovelAIModel = ModelV45Full
+)
+
+// 参数取值范围
+const (
+	MinScale      = 0.0
+	MaxScale      = 10.0
+	MinCFGRescale = 0.0
+	MaxCFGRescale = 1.0
+	MaxSamples    = 4
+	MinSteps      = 1
+	MaxSteps      = 50
+	MaxImageSide  = 2048 // 宽高上限，且必须为 64 的倍数
+)
+
+// 未指定时使用的生成参数
+const (
+	DefaultSteps  = 28
+	DefaultWidth  = 832
+	DefaultHeight = 1216
+
+	DefaultQualityToggle = false
+	DefaultUCPreset      = 0
+)
+
+// novelAIModelSpec 模型支持的参数
+type novelAIModelSpec struct {
+	Version        int // 主版本：3 或 4（4.5 与 4 使用相同的参数格式）
+	Samplers       []string
+	NoiseSchedules []string
+	SupportsSMEA   bool
+	UCPresets      int    // 支持的 UC 预设数量，ucPreset 取值为 0 到 UCPresets-1
+	InpaintModel   string // 局部重绘使用的模型
+}
+
+var (
+	v3Samplers = []string{
+		"k_euler", "k_euler_ancestral", "k_dpmpp_2s_ancestral",
+		"k_dpmpp_2m_sde", "k_dpmpp_2m", "k_dpmpp_sde", "ddim_v3",
+	}
+	v4Samplers = []string{
+		"k_euler", "k_euler_ancestral", "k_dpmpp_2s_ancestral",
+		"k_dpmpp_2m_sde", "k_dpmpp_2m", "k_dpmpp_sde",
+	}
+	v3NoiseSchedules = []string{"native", "karras", "exponential", "polyexponential"}
+	v4NoiseSchedules = []string{"karras", "exponential", "polyexponential"}
+)
+
+// novelAIModels 支持的模型及其参数白名单
+var novelAIModels = map[string]novelAIModelSpec{
+	ModelV3: {
+		Version: 3, Samplers: v3Samplers, NoiseSchedules: v3NoiseSchedules, SupportsSMEA: true, UCPresets: 4,
+		InpaintModel: "nai-diffusion-3-inpainting",
+	},
+	ModelFurryV3: {
+		Version: 3, Samplers: v3Samplers, NoiseSchedules: v3NoiseSchedules, SupportsSMEA: true, UCPresets: 3,
+		InpaintModel: "nai-diffusion-furry-3-inpainting",
+	},
+	ModelV4Curated: {
+		Version: 4, Samplers: v4Samplers, NoiseSchedules: v4NoiseSchedules, UCPresets: 4,
+		InpaintModel: "nai-diffusion-4-curated-inpainting",
+	},
+	ModelV4Full: {
+		Version: 4, Samplers: v4Samplers, NoiseSchedules: v4NoiseSchedules, UCPresets: 4,
+		InpaintModel: "nai-diffusion-4-full-inpainting",
+	},
+	ModelV45Curated: {
+		Version: 4, Samplers: v4Samplers, NoiseSchedules: v4NoiseSchedules, UCPresets: 5,
+		InpaintModel: "nai-diffusion-4-5-curated-inpainting",
+	},
+	ModelV45Full: {
+		Version: 4, Samplers: v4Samplers, NoiseSchedules: v4NoiseSchedules, UCPresets: 5,
+		InpaintModel: "nai-diffusion-4-5-full-inpainting",
+	},
+}
+
+// SupportedModels 返回支持的模型列表
+func SupportedModels() []string {
+	models := make([]string, 0, len(novelAIModels))
+	for name := range novelAIModels {
+		models = append(models, name)
+	}
+	sort.Strings(models)
+	return models
+}
+
+// IsSupportedModel 是否为支持的模型
+func IsSupportedModel(model string) bool {
+	_, ok := novelAIModels[model]
+	return ok
+}
+
+// IsSupportedSampler 是否为任一模型支持的采样器
+func IsSupportedSampler(sampler string) bool {
+	return slices.Contains(v3Samplers, sampler) || slices.Contains(v4Samplers, sampler)
+}
+
+// ValidateUCPreset 校验 UC 预设，model 为空时按所有模型中的最大范围校验
+func ValidateUCPreset(model string, ucPreset int) error {
+	limit := 0
+	if spec, ok := novelAIModels[model]; ok {
+		limit = spec.UCPresets
+	} else {
+		for _, spec := range novelAIModels {
+			limit = max(limit, spec.UCPresets)
+		}
+	}
+	if ucPreset < 0 || ucPreset >= limit {
+		if model == "" {
+			return fmt.Errorf("uc_preset must be between 0 and %d", limit-1)
+		}
+		return fmt.Errorf("uc_preset must be between 0 and %d for model %s", limit-1, model)
+	}
+	return nil
+}
+
+// ValidateImageSize 校验图像尺寸：64 的倍数且不超过 MaxImageSide
+func ValidateImageSize(width, height int) error {
+	if width < 64 || height < 64 || width > MaxImageSide || height > MaxImageSide || width%64 != 0 || height%64 != 0 {
+		return fmt.Errorf("width and height must be multiples of 64 between 64 and %d", MaxImageSide)
+	}
+	return nil
+}
+
+// ModelSupportsSMEA 模型是否支持 SMEA
+func ModelSupportsSMEA(model string) bool {
+	return novelAIModels[model].SupportsSMEA
+}
+
+// ModelUsesEncodedVibes 模型的风格参考是否需要先调用 encode-vibe 编码（V4 及以上）
+func ModelUsesEncodedVibes(model string) bool {
+	return novelAIModels[model].Version >= 4
+}
+
+// InpaintModel 返回模型对应的局部重绘模型
+func InpaintModel(model string) string {
+	return novelAIModels[model].InpaintModel
+}
+
+// ValidateGenerationRequest 按模型白名单校验生成参数
+func ValidateGenerationRequest(req *GenerationRequest) error {
+	spec, ok := novelAIModels[req.Model]
+	if !ok {
+		return fmt.Errorf("unsupported model: %s", req.Model)
+	}
+	if !slices.Contains(spec.Samplers, req.Sampler) {
+		return fmt.Errorf("sampler %s is not supported by model %s", req.Sampler, req.Model)
+	}
+	if !slices.Contains(spec.NoiseSchedules, req.NoiseSchedule) {
+		return fmt.Errorf("noise schedule %s is not supported by model %s", req.NoiseSchedule, req.Model)
+	}
+	if req.Sampler == "ddim_v3" && req.NoiseSchedule != "native" {
+		return fmt.Errorf("sampler ddim_v3 requires noise schedule native")
+	}
+	if (req.SMEA || req.SMEADyn) && !spec.SupportsSMEA {
+		return fmt.Errorf("SMEA is not supported by model %s", req.Model)
+	}
+	if req.SMEADyn && !req.SMEA {
+		return fmt.Errorf("sm_dyn requires sm")
+	}
+	if req.Steps < MinSteps || req.Steps > MaxSteps {
+		return fmt.Errorf("steps must be between %d and %d", MinSteps, MaxSteps)
+	}
+	if err := ValidateImageSize(req.Width, req.Height); err != nil {
+		return err
+	}
+	if err := ValidateUCPreset(req.Model, req.UCPreset); err != nil {
+		return err
+	}
+	if req.NSamples < 1 || req.NSamples > MaxSamples {
+		return fmt.Errorf("n_samples must be between 1 and %d", MaxSamples)
+	}
+	if req.Scale < MinScale || req.Scale > MaxScale {
+		return fmt.Errorf("scale must be between %g and %g", MinScale, MaxScale)
+	}
+	if req.CFGRescale < MinCFGRescale || req.CFGRescale > MaxCFGRescale {
+		return fmt.Errorf("cfg_rescale must be between %g and %g", MinCFGRescale, MaxCFGRescale)
+	}
+	if err := validateCharacters(req.Characters, spec); err != nil {
+		return err
+	}
+	if err := validateReferences(req.References); err != nil {
+		return err
+	}
+
+	switch req.Action {
+	case "", ActionGenerate:
+	case ActionImg2Img, ActionInfill:
+		if len(req.Image) == 0 {
+			return fmt.Errorf("%s requires a source image", req.Action)
+		}
+		if req.Action == ActionInfill && len(req.Mask) == 0 {
+			return fmt.Errorf("infill requires a mask")
+		}
+		if req.Strength < MinImg2ImgStrength || req.Strength > MaxImg2ImgStrength {
+			return fmt.Errorf("strength must be between %g and %g", MinImg2ImgStrength, MaxImg2ImgStrength)
+		}
+		if req.Noise < 0 || req.Noise > MaxImg2ImgNoise {
+			return fmt.Errorf("noise must be between 0 and %g", MaxImg2ImgNoise)
+		}
+	default:
+		return fmt.Errorf("unsupported action: %s", req.Action)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const novelAIGenerateImageStreamPath = "/ai/generate-image-stream"
+
+// NovelAI 流式响应的事件类型
+const (
+	novelAIStreamIntermediate = "intermediate"
+	novelAIStreamFinal        = "final"
+)
+
+// maxStreamEventSize 单个流式事件的最大长度（最终图像以 base64 PNG 发送）
+const maxStreamEventSize = 64 << 20
+
+// StreamPreview 流式生成的中间预览
+type StreamPreview struct {
+	SampleIndex int     `json:"sample_index"`
+	Step        int     `json:"step"`
+	Sigma       float64 `json:"sigma"`
+	Image       []byte  `json:"-"` // JPEG
+}
+
+// novelAIStreamEvent NovelAI 流式响应中的单个事件（stream=sse）
+type novelAIStreamEvent struct {
+	EventType string  `json:"event_type"`
+	SampIx    int     `json:"samp_ix"`
+	StepIx    int     `json:"step_ix"`
+	GenID     string  `json:"gen_id"`
+	Sigma     float64 `json:"sigma"`
+	Image     string  `json:"image"`
+}
+
+// GenerateImageStream 通过 NovelAI 流式接口生成单张图像，每个中间步骤的预览交给 onPreview
+// 返回值与 GenerateImage 相同；只支持 n_samples 为 1，响应格式使用 SSE（不支持 msgpack）
+func (s *NovelAIService) GenerateImageStream(req *GenerationRequest, onPreview func(*StreamPreview)) ([][]byte, string, error) {
+	payload, err := buildPayload(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.NSamples != 1 {
+		return nil, "", fmt.Errorf("streaming generation supports only one sample")
+	}
+	payload.Parameters.Stream = "sse"
+
+	resp, recordPayload, err := s.postPayload(novelAIGenerateImageStreamPath, payload)
+	if err != nil {
+		return nil, recordPayload, err
+	}
+	defer resp.Body.Close()
+
+	var final []byte
+	err = readSSEData(resp.Body, func(data []byte) error {
+		var event novelAIStreamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("invalid stream event: %w", err)
+		}
+		image, err := base64.StdEncoding.DecodeString(event.Image)
+		if err != nil {
+			return fmt.Errorf("invalid stream image: %w", err)
+		}
+
+		switch event.EventType {
+		case novelAIStreamIntermediate:
+			if onPreview != nil {
+				onPreview(&StreamPreview{
+					SampleIndex: event.SampIx,
+					Step:        event.StepIx,
+					Sigma:       event.Sigma,
+					Image:       image,
+				})
+			}
+		case novelAIStreamFinal:
+			final = image
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, recordPayload, fmt.Errorf("failed to read stream: %w", err)
+	}
+	if final == nil {
+		return nil, recordPayload, fmt.Errorf("stream ended without final image")
+	}
+
+	return [][]byte{final}, recordPayload, nil
+}
+
+// readSSEData 逐个读取 SSE 事件的 data 字段，多行 data 以换行连接
+func readSSEData(r io.Reader, handle func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxStreamEventSize)
+
+	var data bytes.Buffer
+	dispatch := func() error {
+		if data.Len() == 0 {
+			return nil
+		}
+		defer data.Reset()
+		return handle(data.Bytes())
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if err := dispatch(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return dispatch()
+}
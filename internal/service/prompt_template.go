@@ -0,0 +1,202 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 模板内置变量，分别为用户输入的提示词和负面提示词
+const (
+	TemplateVarPrompt   = "prompt"
+	TemplateVarNegative = "negative"
+)
+
+// templateVarNamePattern 模板变量名
+var templateVarNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// PromptTemplate 解析后的提示词模板
+//
+// 语法：${name} 插入变量，${name:default} 指定默认值（可包含成对的 {}），$$ 表示字面量 $。
+// 由于 NovelAI 使用 {} 表示强调，占位符必须以 $ 开头，普通的 {} 按原样保留。
+type PromptTemplate struct {
+	parts []templatePart
+}
+
+// templatePart 模板片段：字面量或变量
+type templatePart struct {
+	literal    string
+	variable   string
+	def        string
+	hasDefault bool
+}
+
+// TemplateVariable 模板中声明的变量
+type TemplateVariable struct {
+	Name       string `json:"name"`
+	Default    string `json:"default,omitempty"`
+	HasDefault bool   `json:"has_default"`
+}
+
+// ParsePromptTemplate 解析提示词模板
+func ParsePromptTemplate(src string) (*PromptTemplate, error) {
+	t := &PromptTemplate{}
+	var literal strings.Builder
+
+	for i := 0; i < len(src); {
+		if src[i] != '$' {
+			literal.WriteByte(src[i])
+			i++
+			continue
+		}
+		if strings.HasPrefix(src[i:], "$$") {
+			literal.WriteByte('$')
+			i += 2
+			continue
+		}
+		if !strings.HasPrefix(src[i:], "${") {
+			literal.WriteByte('$')
+			i++
+			continue
+		}
+
+		end := placeholderEnd(src[i+2:])
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder at position %d", i)
+		}
+		body := src[i+2 : i+2+end]
+		part := templatePart{variable: body}
+		if name, def, ok := strings.Cut(body, ":"); ok {
+			part = templatePart{variable: name, def: def, hasDefault: true}
+		}
+		if !templateVarNamePattern.MatchString(part.variable) {
+			return nil, fmt.Errorf("invalid variable name %q", part.variable)
+		}
+		if part.hasDefault && isBuiltinTemplateVar(part.variable) {
+			return nil, fmt.Errorf("variable %s cannot have a default value", part.variable)
+		}
+
+		if literal.Len() > 0 {
+			t.parts = append(t.parts, templatePart{literal: literal.String()})
+			literal.Reset()
+		}
+		t.parts = append(t.parts, part)
+		i += 2 + end + 1
+	}
+	if literal.Len() > 0 {
+		t.parts = append(t.parts, templatePart{literal: literal.String()})
+	}
+
+	// 不同位置的同名变量默认值必须一致
+	defaults := map[string]templatePart{}
+	for _, part := range t.parts {
+		if part.variable == "" {
+			continue
+		}
+		if prev, ok := defaults[part.variable]; ok && (prev.hasDefault != part.hasDefault || prev.def != part.def) {
+			return nil, fmt.Errorf("variable %s has conflicting defaults", part.variable)
+		}
+		defaults[part.variable] = part
+	}
+
+	return t, nil
+}
+
+// Uses 模板是否使用了指定变量
+func (t *PromptTemplate) Uses(name string) bool {
+	for _, part := range t.parts {
+		if part.variable == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Variables 返回模板中声明的自定义变量（不含内置变量），按名称排序
+func (t *PromptTemplate) Variables() []TemplateVariable {
+	seen := map[string]bool{}
+	var variables []TemplateVariable
+	for _, part := range t.parts {
+		if part.variable == "" || isBuiltinTemplateVar(part.variable) || seen[part.variable] {
+			continue
+		}
+		seen[part.variable] = true
+		variables = append(variables, TemplateVariable{
+			Name:       part.variable,
+			Default:    part.def,
+			HasDefault: part.hasDefault,
+		})
+	}
+	sort.Slice(variables, func(i, j int) bool { return variables[i].Name < variables[j].Name })
+	return variables
+}
+
+// Render 使用变量值渲染模板，并规范化逗号分隔；没有默认值的变量必须提供
+func (t *PromptTemplate) Render(values map[string]string) (string, error) {
+	var b strings.Builder
+	for _, part := range t.parts {
+		if part.variable == "" {
+			b.WriteString(part.literal)
+			continue
+		}
+		value, ok := values[part.variable]
+		if !ok {
+			if !part.hasDefault {
+				return "", fmt.Errorf("variable %s is required", part.variable)
+			}
+			value = part.def
+		}
+		b.WriteString(value)
+	}
+	return normalizePrompt(b.String()), nil
+}
+
+// literalText 返回模板中的字面量和默认值，用于括号校验
+func (t *PromptTemplate) literalText() string {
+	var b strings.Builder
+	for _, part := range t.parts {
+		b.WriteString(part.literal)
+		b.WriteString(part.def)
+	}
+	return b.String()
+}
+
+// placeholderEnd 返回占位符结束的 } 的位置，默认值中可以包含成对的 {}
+func placeholderEnd(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// isBuiltinTemplateVar 是否为内置变量
+func isBuiltinTemplateVar(name string) bool {
+	return name == TemplateVarPrompt || name == TemplateVarNegative
+}
+
+// normalizePrompt 规范化逗号分隔的提示词：去掉各段首尾空白和空段，以 ", " 连接
+func normalizePrompt(prompt string) string {
+	segments := strings.Split(prompt, ",")
+	kept := segments[:0]
+	for _, segment := range segments {
+		if segment = strings.TrimSpace(segment); segment != "" {
+			kept = append(kept, segment)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+// joinPrompt 以逗号连接提示词片段，忽略空片段
+func joinPrompt(parts ...string) string {
+	return normalizePrompt(strings.Join(parts, ","))
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"testing"
+
+	"novelai-backend/internal/model"
+)
+
+func TestPromptTemplateRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		values   map[string]string
+		want     string
+	}{
+		{"builtin", "masterpiece, ${prompt}, {best quality}", map[string]string{"prompt": "1girl"}, "masterpiece, 1girl, {best quality}"},
+		{"default", "${prompt}, ${style:watercolor}", map[string]string{"prompt": "cat"}, "cat, watercolor"},
+		{"override", "${prompt}, ${style:watercolor}", map[string]string{"prompt": "cat", "style": "sketch"}, "cat, sketch"},
+		{"empty variable", "${prompt}, ${style:}, masterpiece", map[string]string{"prompt": "cat"}, "cat, masterpiece"},
+		{"normalize commas", " ,${prompt} ,,  extra,", map[string]string{"prompt": "a,  b"}, "a, b, extra"},
+		{"braces in default", "${prompt}, ${style:{{watercolor}}}", map[string]string{"prompt": "cat"}, "cat, {{watercolor}}"},
+		{"literal dollar", "$$5, ${prompt}", map[string]string{"prompt": "cat"}, "$5, cat"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParsePromptTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			got, err := tmpl.Render(tt.values)
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptTemplateErrors(t *testing.T) {
+	for _, template := range []string{
+		"${prompt",
+		"${1style}",
+		"${prompt:default}",
+		"${style:a}, ${style:b}",
+	} {
+		if _, err := ParsePromptTemplate(template); err == nil {
+			t.Errorf("ParsePromptTemplate(%q) succeeded, want error", template)
+		}
+	}
+
+	tmpl, err := ParsePromptTemplate("${prompt}, ${style}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(map[string]string{"prompt": "cat"}); err == nil {
+		t.Error("missing required variable should fail")
+	}
+	if vars := tmpl.Variables(); len(vars) != 1 || vars[0].Name != "style" || vars[0].HasDefault {
+		t.Errorf("Variables() = %v", vars)
+	}
+}
+
+func TestStylePresetInputValidateTemplate(t *testing.T) {
+	for _, in := range []StylePresetInput{
+		{Name: "a", StylePresetContent: model.StylePresetContent{PromptTemplate: "masterpiece"}},
+		{Name: "a", StylePresetContent: model.StylePresetContent{PromptTemplate: "${prompt}, ${negative}"}},
+		{Name: "a", StylePresetContent: model.StylePresetContent{PromptTemplate: "${prompt}, {best quality"}},
+		{Name: "a", StylePresetContent: model.StylePresetContent{NegativePromptTemplate: "lowres"}},
+	} {
+		if err := in.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded, want error", in)
+		}
+	}
+
+	valid := StylePresetInput{Name: "a", StylePresetContent: model.StylePresetContent{
+		PromptTemplate:         "${prompt}, ${style:{watercolor}}",
+		NegativePromptTemplate: "${negative}, lowres",
+	}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
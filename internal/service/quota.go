@@ -0,0 +1,255 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"novelai-backend/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// 配额统计对象
+const (
+	QuotaSubjectIP   = "ip"   // 匿名请求按客户端标识统计
+	QuotaSubjectUser = "user" // 携带 API 密钥的请求按用户统计
+	QuotaSubjectKey  = "key"  // 携带 API 密钥的请求按密钥统计
+)
+
+// 配额周期
+const (
+	QuotaPeriodDay   = "day"
+	QuotaPeriodMonth = "month"
+)
+
+// ErrQuotaExceeded 请求的 Anlas 消耗超出配额
+var ErrQuotaExceeded = errors.New("anlas quota exceeded")
+
+// AnlasQuota 每日和每月的 Anlas 上限，0 表示不限制
+type AnlasQuota struct {
+	Daily   int
+	Monthly int
+}
+
+// QuotaConfig 配额配置
+type QuotaConfig struct {
+	IP       AnlasQuota
+	User     AnlasQuota
+	Key      AnlasQuota
+	Location *time.Location // 按该时区划分日和月
+}
+
+// Validate 校验配额配置
+func (c *QuotaConfig) Validate() error {
+	for _, quota := range []AnlasQuota{c.IP, c.User, c.Key} {
+		if quota.Daily < 0 || quota.Monthly < 0 {
+			return fmt.Errorf("anlas quota must not be negative")
+		}
+	}
+	if c.Location == nil {
+		return fmt.Errorf("anlas quota time zone is required")
+	}
+	return nil
+}
+
+// QuotaSubject 发起请求的客户端，APIKey 为空时为匿名请求
+type QuotaSubject struct {
+	APIKey    *model.APIKey
+	ClientKey string
+}
+
+// QuotaStatus 一个统计对象在一个周期内的配额使用情况
+type QuotaStatus struct {
+	Subject   string    `json:"subject"` // QuotaSubject*
+	Period    string    `json:"period"`  // QuotaPeriod*
+	Limit     *int      `json:"limit"`   // 为空表示不限制
+	Used      int       `json:"used"`
+	Remaining *int      `json:"remaining"` // 为空表示不限制
+	ResetAt   time.Time `json:"reset_at"`  // 周期结束时间
+}
+
+// QuotaExceededError 超出配额的详细信息
+type QuotaExceededError struct {
+	Status QuotaStatus
+	Cost   int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s %s anlas quota exceeded: used %d of %d, this request costs %d",
+		e.Status.Subject, e.Status.Period, e.Status.Used, *e.Status.Limit, e.Cost)
+}
+
+func (e *QuotaExceededError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// QuotaService Anlas 配额服务，使用记录保存在数据库中
+//
+// 检查和预留在同一条 SQL 语句中完成，并发请求（包括共享同一数据库的多个实例）不会同时通过检查。
+type QuotaService struct {
+	db     *gorm.DB
+	config QuotaConfig
+	now    func() time.Time
+}
+
+// NewQuotaService 创建配额服务
+func NewQuotaService(db *gorm.DB, config QuotaConfig) *QuotaService {
+	return &QuotaService{
+		db:     db,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+// quotaCounter 一个统计对象的配额和查询条件
+type quotaCounter struct {
+	subject string
+	quota   AnlasQuota
+	query   string
+	value   any
+}
+
+// counters 返回适用于客户端的统计对象：匿名请求按客户端标识，携带密钥的请求按用户和密钥
+func (s *QuotaService) counters(subject QuotaSubject) []quotaCounter {
+	if subject.APIKey == nil {
+		return []quotaCounter{{QuotaSubjectIP, s.config.IP, "client_key = ? AND api_key_id IS NULL", subject.ClientKey}}
+	}
+	return []quotaCounter{
+		{QuotaSubjectUser, s.config.User, "user_id = ?", subject.APIKey.UserID},
+		{QuotaSubjectKey, s.config.Key, "api_key_id = ?", subject.APIKey.ID},
+	}
+}
+
+// quotaPeriod 配额周期的起止时间
+type quotaPeriod struct {
+	name       string
+	start, end time.Time
+}
+
+// periods 返回当前日和月的起止时间
+func (s *QuotaService) periods(now time.Time) []quotaPeriod {
+	local := now.In(s.config.Location)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, s.config.Location)
+	month := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, s.config.Location)
+	return []quotaPeriod{
+		{QuotaPeriodDay, day, day.AddDate(0, 0, 1)},
+		{QuotaPeriodMonth, month, month.AddDate(0, 1, 0)},
+	}
+}
+
+// status 统计使用情况
+func (s *QuotaService) status(tx *gorm.DB, subject QuotaSubject, now time.Time) ([]QuotaStatus, error) {
+	var statuses []QuotaStatus
+	for _, counter := range s.counters(subject) {
+		for _, period := range s.periods(now) {
+			// 时间统一以 UTC 保存和比较
+			var used int
+			err := tx.Model(&model.AnlasUsage{}).
+				Where(counter.query, counter.value).
+				Where("created_at >= ?", period.start.UTC()).
+				Select("COALESCE(SUM(anlas), 0)").Scan(&used).Error
+			if err != nil {
+				return nil, err
+			}
+
+			status := QuotaStatus{
+				Subject: counter.subject,
+				Period:  period.name,
+				Used:    used,
+				ResetAt: period.end,
+			}
+			limit := counter.quota.Daily
+			if period.name == QuotaPeriodMonth {
+				limit = counter.quota.Monthly
+			}
+			if limit > 0 {
+				remaining := max(limit-used, 0)
+				status.Limit = &limit
+				status.Remaining = &remaining
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+// Status 返回客户端当前的配额使用情况
+func (s *QuotaService) Status(subject QuotaSubject) ([]QuotaStatus, error) {
+	return s.status(s.db, subject, s.now())
+}
+
+// quotaReserveAttempts 预留时因并发退还而重新检查的最大次数
+const quotaReserveAttempts = 3
+
+// ErrQuotaConflict 并发请求过多，多次尝试后仍未能预留配额
+var ErrQuotaConflict = errors.New("anlas quota reservation conflicted with concurrent requests")
+
+// Reserve 检查配额并预留 Anlas，超出任一配额时返回 *QuotaExceededError
+func (s *QuotaService) Reserve(subject QuotaSubject, cost int) (*model.AnlasUsage, error) {
+	for range quotaReserveAttempts {
+		usage, err := s.tryReserve(subject, cost)
+		if usage != nil || err != nil {
+			return usage, err
+		}
+		// 检查后其他请求的记录已被退还，重新尝试
+	}
+	return nil, ErrQuotaConflict
+}
+
+// tryReserve 尝试预留一次，未插入且没有超出的配额（检查期间有记录被退还）时返回 nil, nil
+func (s *QuotaService) tryReserve(subject QuotaSubject, cost int) (*model.AnlasUsage, error) {
+	now := s.now()
+	usage := &model.AnlasUsage{
+		CreatedAt: now.UTC(),
+		ClientKey: subject.ClientKey,
+		Anlas:     cost,
+	}
+	if subject.APIKey != nil {
+		usage.UserID = &subject.APIKey.UserID
+		usage.APIKeyID = &subject.APIKey.ID
+	}
+
+	// 只有所有配额都未超出时才插入记录
+	conditions := []string{"1 = 1"}
+	args := []any{usage.CreatedAt, usage.UserID, usage.APIKeyID, usage.ClientKey, usage.Anlas}
+	for _, counter := range s.counters(subject) {
+		for _, period := range s.periods(now) {
+			limit := counter.quota.Daily
+			if period.name == QuotaPeriodMonth {
+				limit = counter.quota.Monthly
+			}
+			if limit <= 0 {
+				continue
+			}
+			conditions = append(conditions, "(SELECT COALESCE(SUM(anlas), 0) FROM anlas_usages WHERE "+counter.query+" AND created_at >= ?) + ? <= ?")
+			args = append(args, counter.value, period.start.UTC(), cost, limit)
+		}
+	}
+	result := s.db.Raw("INSERT INTO anlas_usages (created_at, user_id, api_key_id, client_key, anlas) SELECT ?, ?, ?, ?, ? WHERE "+
+		strings.Join(conditions, " AND ")+" RETURNING id", args...).Scan(&usage.ID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if usage.ID != 0 {
+		return usage, nil
+	}
+
+	// 未插入时找出超出的配额
+	statuses, err := s.status(s.db, subject, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if status.Limit != nil && status.Used+cost > *status.Limit {
+			return nil, &QuotaExceededError{Status: status, Cost: cost}
+		}
+	}
+	return nil, nil
+}
+
+// Release 删除预留记录，退还 Anlas，重复调用不会出错
+func (s *QuotaService) Release(id uint) error {
+	return s.db.Delete(&model.AnlasUsage{}, id).Error
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"novelai-backend/internal/database"
+	"novelai-backend/internal/model"
+
+	"gorm.io/gorm/logger"
+)
+
+func TestEstimateAnlasCost(t *testing.T) {
+	tests := []struct {
+		name string
+		req  GenerationRequest
+		want int
+	}{
+		{"default size", GenerationRequest{Model: ModelV45Full, Width: 832, Height: 1216, Steps: 28}, 20},
+		{"multiple samples", GenerationRequest{Model: ModelV45Full, Width: 832, Height: 1216, Steps: 28, NSamples: 4}, 80},
+		{"more steps", GenerationRequest{Model: ModelV45Full, Width: 832, Height: 1216, Steps: 50}, 33},
+		{"smea", GenerationRequest{Model: ModelV3, Width: 832, Height: 1216, Steps: 28, SMEA: true}, 24},
+		{"smea dyn", GenerationRequest{Model: ModelV3, Width: 832, Height: 1216, Steps: 28, SMEA: true, SMEADyn: true}, 27},
+		{"smea ignored by v4", GenerationRequest{Model: ModelV4Full, Width: 832, Height: 1216, Steps: 28, SMEA: true}, 20},
+		{"img2img strength", GenerationRequest{Model: ModelV45Full, Width: 832, Height: 1216, Steps: 28, Action: ActionImg2Img, Strength: 0.5}, 10},
+		{"infill ignores strength", GenerationRequest{Model: ModelV45Full, Width: 832, Height: 1216, Steps: 28, Action: ActionInfill, Strength: 0.5}, 20},
+		{"minimum", GenerationRequest{Model: ModelV45Full, Width: 64, Height: 64, Steps: 1}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EstimateAnlasCost(&tt.req); got != tt.want {
+				t.Errorf("cost = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaService(t *testing.T) {
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"), logger.Silent)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	location := time.FixedZone("UTC+8", 8*3600)
+	svc := NewQuotaService(db, QuotaConfig{
+		IP:       AnlasQuota{Daily: 50, Monthly: 80},
+		User:     AnlasQuota{Daily: 30},
+		Location: location,
+	})
+	now := time.Date(2024, 1, 31, 23, 0, 0, 0, location)
+	svc.now = func() time.Time { return now }
+
+	anonymous := QuotaSubject{ClientKey: "1.1.1.1"}
+	if _, err := svc.Reserve(anonymous, 20); err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	usage, err := svc.Reserve(anonymous, 20)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	var exceeded *QuotaExceededError
+	if _, err := svc.Reserve(anonymous, 20); !errors.As(err, &exceeded) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("err = %v, want quota exceeded", err)
+	}
+	if exceeded.Status.Subject != QuotaSubjectIP || exceeded.Status.Period != QuotaPeriodDay || exceeded.Status.Used != 40 {
+		t.Errorf("exceeded = %+v", exceeded.Status)
+	}
+	if !exceeded.Status.ResetAt.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, location)) {
+		t.Errorf("reset at = %v", exceeded.Status.ResetAt)
+	}
+	if _, err := svc.Reserve(QuotaSubject{ClientKey: "2.2.2.2"}, 20); err != nil {
+		t.Errorf("other clients should not be affected: %v", err)
+	}
+
+	// 退还后可以再次使用
+	if err := svc.Release(usage.ID); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, err := svc.Reserve(anonymous, 20); err != nil {
+		t.Fatalf("reserve after release: %v", err)
+	}
+
+	// 按配置的时区进入新的一天和新的月份
+	now = now.Add(2 * time.Hour)
+	statuses, err := svc.Status(anonymous)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	for _, status := range statuses {
+		if status.Used != 0 || *status.Remaining != *status.Limit {
+			t.Errorf("status after reset = %+v", status)
+		}
+	}
+
+	// 携带密钥的请求按用户和密钥统计，不计入客户端配额
+	key := &model.APIKey{ID: 3, UserID: 7}
+	if _, err := svc.Reserve(QuotaSubject{APIKey: key, ClientKey: "1.1.1.1"}, 30); err != nil {
+		t.Fatalf("reserve with key: %v", err)
+	}
+	if _, err := svc.Reserve(QuotaSubject{APIKey: &model.APIKey{ID: 4, UserID: 7}}, 2); !errors.As(err, &exceeded) || exceeded.Status.Subject != QuotaSubjectUser {
+		t.Errorf("err = %v, want user quota exceeded", err)
+	}
+	statuses, _ = svc.Status(QuotaSubject{APIKey: key})
+	if len(statuses) != 4 || statuses[2].Subject != QuotaSubjectKey || statuses[2].Used != 30 || statuses[2].Limit != nil {
+		t.Errorf("statuses = %+v", statuses)
+	}
+	if statuses, _ := svc.Status(anonymous); statuses[0].Used != 0 {
+		t.Errorf("keyed usage should not count against the client: %+v", statuses[0])
+	}
+}
+
+func TestQuotaServiceConcurrentReserve(t *testing.T) {
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"), logger.Silent)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	// 两个服务实例共享同一数据库，模拟多个后端实例
+	config := QuotaConfig{IP: AnlasQuota{Daily: 100}, Location: time.UTC}
+	services := []*QuotaService{NewQuotaService(db, config), NewQuotaService(db, config)}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(svc *QuotaService) {
+			defer wg.Done()
+			if _, err := svc.Reserve(QuotaSubject{ClientKey: "1.1.1.1"}, 20); err == nil {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			} else if !errors.Is(err, ErrQuotaExceeded) {
+				t.Errorf("reserve: %v", err)
+			}
+		}(services[i%2])
+	}
+	wg.Wait()
+
+	if reserved != 5 {
+		t.Errorf("reserved %d requests, want 5", reserved)
+	}
+}
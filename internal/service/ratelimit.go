@@ -1,129 +1,284 @@
 package service
 
 import (
-	"sync"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// IPRecord 记录IP的访问信息
-type IPRecord struct {
-	LastRequest       time.Time
-	TurnstileVerified time.Time
-}
+// 路由使用的限流策略名称，未单独配置的策略使用默认策略并共享令牌桶
+const (
+	RateLimitPolicyDefault  = "default"
+	RateLimitPolicyGenerate = "generate"
+	RateLimitPolicyStream   = "stream"
+	RateLimitPolicyRerun    = "rerun"
+)
 
-// RateLimitService 限流服务
-type RateLimitService struct {
-	mu                sync.RWMutex
-	globalLastRequest time.Time
-	ipRecords         map[string]*IPRecord
-	privilegeKey      string
+// RateLimitPolicyNames 可以单独配置的路由策略
+var RateLimitPolicyNames = []string{RateLimitPolicyGenerate, RateLimitPolicyStream, RateLimitPolicyRerun}
 
-	// 限流配置
-	globalInterval    time.Duration // 全局限流间隔
-	ipInterval        time.Duration // IP限流间隔
-	turnstileInterval time.Duration // Turnstile验证间隔
+// 限流范围
+const (
+	RateLimitScopeGlobal = "global"
+	RateLimitScopeIP     = "ip"
+)
+
+// RateLimitRule 令牌桶规则：桶容量为 Burst，每隔 Interval 补充一个令牌
+type RateLimitRule struct {
+	Interval time.Duration
+	Burst    int
 }
 
-// NewRateLimitService 创建新的限流服务
-func NewRateLimitService(privilegeKey string) *RateLimitService {
-	return &RateLimitService{
-		ipRecords:         make(map[string]*IPRecord),
-		privilegeKey:      privilegeKey,
-		globalInterval:    8 * time.Second,
-		ipInterval:        15 * time.Second,
-		turnstileInterval: 2 * 60 * time.Second, // 2分钟
+// Validate 校验规则
+func (r RateLimitRule) Validate() error {
+	if r.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if r.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
 	}
+	return nil
 }
 
-// CheckGlobalRateLimit 检查全局限流
-func (r *RateLimitService) CheckGlobalRateLimit() bool {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// Describe 规则的文字描述，用于错误信息
+func (r RateLimitRule) Describe() string {
+	if r.Burst == 1 {
+		return fmt.Sprintf("1 request every %s", r.Interval)
+	}
+	return fmt.Sprintf("up to %d requests at once, then 1 every %s", r.Burst, r.Interval)
+}
 
-	now := time.Now()
-	return now.Sub(r.globalLastRequest) >= r.globalInterval
+// RateLimitPolicy 限流策略，包含全局和单 IP 两个令牌桶
+type RateLimitPolicy struct {
+	Name   string
+	Global RateLimitRule
+	IP     RateLimitRule
 }
 
-// CheckIPRateLimit 检查IP限流
-func (r *RateLimitService) CheckIPRateLimit(ip string) bool {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// RateLimitConfig 限流服务配置
+type RateLimitConfig struct {
+	Default           RateLimitPolicy            // 默认策略
+	Policies          map[string]RateLimitPolicy // 单独配置的路由策略，使用独立的令牌桶
+	TurnstileInterval time.Duration              // Turnstile 验证有效期
+}
 
-	record, exists := r.ipRecords[ip]
-	if !exists {
-		return true
+// Validate 校验限流配置
+func (c *RateLimitConfig) Validate() error {
+	policies := []RateLimitPolicy{c.Default}
+	for _, policy := range c.Policies {
+		policies = append(policies, policy)
 	}
-
-	now := time.Now()
-	return now.Sub(record.LastRequest) >= r.ipInterval
+	for _, policy := range policies {
+		if err := policy.Global.Validate(); err != nil {
+			return fmt.Errorf("invalid global rate limit of policy %s: %w", policy.Name, err)
+		}
+		if err := policy.IP.Validate(); err != nil {
+			return fmt.Errorf("invalid IP rate limit of policy %s: %w", policy.Name, err)
+		}
+	}
+	if c.TurnstileInterval <= 0 {
+		return fmt.Errorf("turnstile interval must be positive")
+	}
+	return nil
 }
 
-// CheckTurnstileRequired 检查是否需要Turnstile验证
-func (r *RateLimitService) CheckTurnstileRequired(ip string) bool {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// ParseRateLimitPolicies 解析路由限流策略，格式如 "stream=global:8s/1,ip:30s/2;rerun=ip:1m/1"
+// 每项为 范围:补充间隔/桶容量，未指定的范围使用默认策略的规则，策略名称必须是 RateLimitPolicyNames 之一
+func ParseRateLimitPolicies(spec string, defaults RateLimitPolicy) (map[string]RateLimitPolicy, error) {
+	policies := map[string]RateLimitPolicy{}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rules, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid rate limit policy %q", entry)
+		}
+		if !slices.Contains(RateLimitPolicyNames, name) {
+			return nil, fmt.Errorf("unknown rate limit policy %q, available policies: %s", name, strings.Join(RateLimitPolicyNames, ", "))
+		}
 
-	record, exists := r.ipRecords[ip]
-	if !exists {
-		return true
+		policy := RateLimitPolicy{Name: name, Global: defaults.Global, IP: defaults.IP}
+		for _, rule := range strings.Split(rules, ",") {
+			scope, value, ok := strings.Cut(strings.TrimSpace(rule), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid rate limit rule %q in policy %s", rule, name)
+			}
+			parsed, err := parseRateLimitRule(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rate limit rule %q in policy %s: %w", rule, name, err)
+			}
+			switch scope {
+			case RateLimitScopeGlobal:
+				policy.Global = parsed
+			case RateLimitScopeIP:
+				policy.IP = parsed
+			default:
+				return nil, fmt.Errorf("unknown rate limit scope %q in policy %s", scope, name)
+			}
+		}
+		policies[name] = policy
 	}
+	return policies, nil
+}
 
-	// 如果从未验证过，需要验证
-	if record.TurnstileVerified.IsZero() {
-		return true
+// parseRateLimitRule 解析 "30s/2" 形式的规则，省略桶容量时为 1
+func parseRateLimitRule(value string) (RateLimitRule, error) {
+	interval, burst, hasBurst := strings.Cut(value, "/")
+	rule := RateLimitRule{Burst: 1}
+
+	var err error
+	if rule.Interval, err = time.ParseDuration(interval); err != nil {
+		return rule, err
 	}
+	if hasBurst {
+		if rule.Burst, err = strconv.Atoi(burst); err != nil {
+			return rule, err
+		}
+	}
+	return rule, rule.Validate()
+}
 
-	// 检查是否超过验证间隔时间
-	now := time.Now()
-	return now.Sub(record.TurnstileVerified) >= r.turnstileInterval
+// RateLimitDecision 限流检查结果
+//
+// Limit、Remaining 和 Reset 取自剩余令牌最少的令牌桶，用于 RateLimit-* 响应头。
+type RateLimitDecision struct {
+	Allowed    bool
+	Scope      string        // 未通过时为触发限制的范围
+	Rule       RateLimitRule // 未通过时为触发限制的规则
+	Limit      int           // 桶容量
+	Remaining  int           // 剩余可用令牌数
+	Reset      time.Duration // 令牌桶补满所需的时间
+	RetryAfter time.Duration // 未通过时距离所有桶都有可用令牌的时间
 }
 
-// UpdateGlobalRequest 更新全局请求时间
-func (r *RateLimitService) UpdateGlobalRequest() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// RateLimitService 限流服务
+type RateLimitService struct {
+	store  RateLimitStore
+	config RateLimitConfig
+	now    func() time.Time
+}
+
+// NewRateLimitService 创建新的限流服务，状态保存在 store 中
+func NewRateLimitService(config RateLimitConfig, store RateLimitStore) *RateLimitService {
+	return &RateLimitService{
+		store:  store,
+		config: config,
+		now:    time.Now,
+	}
+}
 
-	r.globalLastRequest = time.Now()
+// Policy 返回路由策略，未单独配置时返回默认策略
+func (r *RateLimitService) Policy(name string) RateLimitPolicy {
+	if policy, ok := r.config.Policies[name]; ok {
+		return policy
+	}
+	return r.config.Default
 }
 
-// UpdateIPRequest 更新IP请求时间
-func (r *RateLimitService) UpdateIPRequest(ip string) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// take 对策略的全局和 IP 令牌桶执行一次取令牌操作
+func (r *RateLimitService) take(ctx context.Context, policyName, ip string, mode RateLimitTakeMode) (*RateLimitDecision, error) {
+	policy := r.Policy(policyName)
+	buckets := []RateLimitBucket{
+		{Key: policy.Name + ":" + RateLimitScopeGlobal, Rule: policy.Global},
+		{Key: policy.Name + ":" + RateLimitScopeIP + ":" + ip, Rule: policy.IP},
+	}
+	result, err := r.store.Take(ctx, buckets, mode, r.now())
+	if err != nil {
+		return nil, fmt.Errorf("rate limit store unavailable: %w", err)
+	}
 
-	if r.ipRecords[ip] == nil {
-		r.ipRecords[ip] = &IPRecord{}
+	decision := &RateLimitDecision{Allowed: result.Allowed, Remaining: -1}
+	for i, bucket := range buckets {
+		tokens := result.Tokens[i]
+		remaining := int(math.Floor(tokens))
+		if decision.Remaining < 0 || remaining < decision.Remaining {
+			decision.Limit = bucket.Rule.Burst
+			decision.Remaining = remaining
+			decision.Reset = refillDuration(bucket.Rule, float64(bucket.Rule.Burst)-tokens)
+		}
+		if !result.Allowed && tokens < 1 {
+			if decision.Scope == "" {
+				decision.Scope = RateLimitScopeGlobal
+				if i > 0 {
+					decision.Scope = RateLimitScopeIP
+				}
+				decision.Rule = bucket.Rule
+			}
+			decision.RetryAfter = max(decision.RetryAfter, refillDuration(bucket.Rule, 1-tokens))
+		}
 	}
-	r.ipRecords[ip].LastRequest = time.Now()
+	return decision, nil
 }
 
-// UpdateTurnstileVerification 更新Turnstile验证时间
-func (r *RateLimitService) UpdateTurnstileVerification(ip string) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// refillDuration 补充指定数量令牌所需的时间
+func refillDuration(rule RateLimitRule, tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(tokens * float64(rule.Interval)))
+}
+
+// Check 检查全局和 IP 限流，不消耗令牌
+func (r *RateLimitService) Check(ctx context.Context, policyName, ip string) (*RateLimitDecision, error) {
+	return r.take(ctx, policyName, ip, RateLimitPeek)
+}
+
+// Consume 两个令牌桶都有可用令牌时各消耗一个
+func (r *RateLimitService) Consume(ctx context.Context, policyName, ip string) (*RateLimitDecision, error) {
+	return r.take(ctx, policyName, ip, RateLimitConsume)
+}
+
+// ConsumePrivileged 具有 generate 权限的 API 密钥不受限流，但同样消耗令牌（不低于 0）
+func (r *RateLimitService) ConsumePrivileged(ctx context.Context, policyName, ip string) (*RateLimitDecision, error) {
+	return r.take(ctx, policyName, ip, RateLimitForce)
+}
 
-	if r.ipRecords[ip] == nil {
-		r.ipRecords[ip] = &IPRecord{}
+// CheckTurnstileRequired 检查是否需要Turnstile验证
+func (r *RateLimitService) CheckTurnstileRequired(ctx context.Context, ip string) (bool, error) {
+	verified, exists, err := r.store.TurnstileVerifiedAt(ctx, ip)
+	if err != nil {
+		return false, fmt.Errorf("rate limit store unavailable: %w", err)
+	}
+	if !exists {
+		return true, nil
 	}
-	r.ipRecords[ip].TurnstileVerified = time.Now()
+
+	// 检查是否超过验证间隔时间
+	return r.now().Sub(verified) >= r.config.TurnstileInterval, nil
 }
 
-// CheckPrivilegeKey 检查特权密钥
-func (r *RateLimitService) CheckPrivilegeKey(key string) bool {
-	return r.privilegeKey != "" && key == r.privilegeKey
+// UpdateTurnstileVerification 更新Turnstile验证时间
+func (r *RateLimitService) UpdateTurnstileVerification(ctx context.Context, ip string) error {
+	return r.store.SetTurnstileVerified(ctx, ip, r.now(), r.config.TurnstileInterval)
 }
 
-// CleanupOldRecords 清理过期记录（可选的后台任务）
-func (r *RateLimitService) CleanupOldRecords() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// CleanupOldRecords 清理过期记录
+func (r *RateLimitService) CleanupOldRecords(ctx context.Context) error {
+	cutoff := r.now().Add(-24 * time.Hour) // 清理24小时前的记录
+	return r.store.Cleanup(ctx, cutoff)
+}
 
-	now := time.Now()
-	cutoff := now.Add(-24 * time.Hour) // 清理24小时前的记录
+// RunCleanup 每隔 interval 清理一次过期记录，ctx 取消后返回
+func (r *RateLimitService) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	for ip, record := range r.ipRecords {
-		if record.LastRequest.Before(cutoff) && record.TurnstileVerified.Before(cutoff) {
-			delete(r.ipRecords, ip)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.CleanupOldRecords(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to clean up rate limit records: %v", err)
+			}
 		}
 	}
 }
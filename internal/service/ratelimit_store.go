@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 限流状态存储类型
+const (
+	RateLimitStoreMemory = "memory"
+	RateLimitStoreSQLite = "sqlite"
+	RateLimitStoreRedis  = "redis"
+)
+
+// RateLimitTakeMode 取令牌的方式
+type RateLimitTakeMode int
+
+const (
+	RateLimitPeek    RateLimitTakeMode = iota // 只检查，不消耗令牌
+	RateLimitConsume                          // 所有桶都有令牌时各消耗一个
+	RateLimitForce                            // 无论是否有令牌都各消耗一个，令牌数不低于 0
+)
+
+// RateLimitBucket 一次取令牌操作涉及的令牌桶
+type RateLimitBucket struct {
+	Key  string
+	Rule RateLimitRule
+}
+
+// RateLimitTakeResult 取令牌的结果
+type RateLimitTakeResult struct {
+	Allowed bool      // 所有桶在操作前都有可用令牌
+	Tokens  []float64 // 操作后各桶剩余的令牌数，与传入的桶顺序一致
+}
+
+// RateLimitStore 限流和 Turnstile 验证状态的存储
+//
+// 多个实例共享同一存储时限流对所有实例生效。Take 对多个桶的补充、检查和消耗必须是原子的，
+// 不存在的桶视为满的。
+type RateLimitStore interface {
+	Take(ctx context.Context, buckets []RateLimitBucket, mode RateLimitTakeMode, now time.Time) (*RateLimitTakeResult, error)
+	// TurnstileVerifiedAt 返回客户端最近一次通过验证的时间，没有记录时返回 false
+	TurnstileVerifiedAt(ctx context.Context, ip string) (time.Time, bool, error)
+	// SetTurnstileVerified 记录验证时间，记录至少保留 ttl
+	SetTurnstileVerified(ctx context.Context, ip string, at time.Time, ttl time.Duration) error
+	// MarkCaptchaToken 记录已使用的人机验证 token（hash），ttl 内再次记录时返回 false
+	MarkCaptchaToken(ctx context.Context, hash string, ttl time.Duration, now time.Time) (bool, error)
+	// Cleanup 清理 before 之前的记录
+	Cleanup(ctx context.Context, before time.Time) error
+}
+
+// refillTokens 按经过的时间补充令牌，refilledAt 为零值时返回满桶
+func refillTokens(tokens float64, refilledAt time.Time, rule RateLimitRule, now time.Time) float64 {
+	if refilledAt.IsZero() {
+		return float64(rule.Burst)
+	}
+	if elapsed := now.Sub(refilledAt); elapsed > 0 {
+		return min(float64(rule.Burst), tokens+float64(elapsed)/float64(rule.Interval))
+	}
+	return tokens
+}
+
+// takeTokens 对已补充的令牌执行取令牌操作，原地更新 tokens
+func takeTokens(tokens []float64, mode RateLimitTakeMode) bool {
+	allowed := true
+	for _, t := range tokens {
+		if t < 1 {
+			allowed = false
+		}
+	}
+	if mode == RateLimitForce || (mode == RateLimitConsume && allowed) {
+		for i := range tokens {
+			tokens[i] = max(tokens[i]-1, 0)
+		}
+	}
+	return allowed
+}
+
+// memoryBucket 内存中的令牌桶
+type memoryBucket struct {
+	tokens     float64
+	refilledAt time.Time
+}
+
+// MemoryRateLimitStore 进程内存储，重启后状态丢失，仅适用于单实例
+type MemoryRateLimitStore struct {
+	mu                sync.Mutex
+	buckets           map[string]*memoryBucket
+	turnstileVerified map[string]time.Time
+	captchaTokens     map[string]time.Time // token hash -> 过期时间
+}
+
+// NewMemoryRateLimitStore 创建内存存储
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets:           make(map[string]*memoryBucket),
+		turnstileVerified: make(map[string]time.Time),
+		captchaTokens:     make(map[string]time.Time),
+	}
+}
+
+// Take 取令牌
+func (s *MemoryRateLimitStore) Take(ctx context.Context, buckets []RateLimitBucket, mode RateLimitTakeMode, now time.Time) (*RateLimitTakeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := make([]float64, len(buckets))
+	for i, bucket := range buckets {
+		var refilledAt time.Time
+		if b := s.buckets[bucket.Key]; b != nil {
+			tokens[i], refilledAt = b.tokens, b.refilledAt
+		}
+		tokens[i] = refillTokens(tokens[i], refilledAt, bucket.Rule, now)
+	}
+	allowed := takeTokens(tokens, mode)
+	for i, bucket := range buckets {
+		b := s.buckets[bucket.Key]
+		if b == nil {
+			b = &memoryBucket{}
+			s.buckets[bucket.Key] = b
+		}
+		b.tokens = tokens[i]
+		if now.After(b.refilledAt) {
+			b.refilledAt = now
+		}
+	}
+	return &RateLimitTakeResult{Allowed: allowed, Tokens: tokens}, nil
+}
+
+// TurnstileVerifiedAt 返回最近一次验证时间
+func (s *MemoryRateLimitStore) TurnstileVerifiedAt(ctx context.Context, ip string) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	verified, ok := s.turnstileVerified[ip]
+	return verified, ok, nil
+}
+
+// SetTurnstileVerified 记录验证时间
+func (s *MemoryRateLimitStore) SetTurnstileVerified(ctx context.Context, ip string, at time.Time, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.turnstileVerified[ip] = at
+	return nil
+}
+
+// MarkCaptchaToken 记录已使用的 token
+func (s *MemoryRateLimitStore) MarkCaptchaToken(ctx context.Context, hash string, ttl time.Duration, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if expires, ok := s.captchaTokens[hash]; ok && now.Before(expires) {
+		return false, nil
+	}
+	s.captchaTokens[hash] = now.Add(ttl)
+	return true, nil
+}
+
+// Cleanup 清理过期记录
+func (s *MemoryRateLimitStore) Cleanup(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, b := range s.buckets {
+		if b.refilledAt.Before(before) {
+			delete(s.buckets, key)
+		}
+	}
+	for ip, verified := range s.turnstileVerified {
+		if verified.Before(before) {
+			delete(s.turnstileVerified, ip)
+		}
+	}
+	for hash, expires := range s.captchaTokens {
+		if expires.Before(before) {
+			delete(s.captchaTokens, hash)
+		}
+	}
+	return nil
+}
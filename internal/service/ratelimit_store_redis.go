@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeTokensScript 在 Redis 中原子地补充、检查并消耗多个令牌桶，逻辑与 refillTokens / takeTokens 一致
+//
+// KEYS 为各桶的键；ARGV[1] 为当前时间（毫秒），ARGV[2] 为 RateLimitTakeMode，
+// 之后每个桶依次为补充间隔（毫秒）和桶容量。桶以 hash 保存 tokens 和 ts，满桶后自动过期。
+var takeTokensScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local mode = tonumber(ARGV[2])
+local tokens, refilled = {}, {}
+local allowed = 1
+for i = 1, #KEYS do
+	local interval = tonumber(ARGV[2 * i + 1])
+	local burst = tonumber(ARGV[2 * i + 2])
+	local state = redis.call('HMGET', KEYS[i], 'tokens', 'ts')
+	local t, ts = burst, now
+	if state[1] then
+		t, ts = tonumber(state[1]), tonumber(state[2])
+		if now > ts then
+			t = math.min(burst, t + (now - ts) / interval)
+			ts = now
+		end
+	end
+	tokens[i], refilled[i] = t, ts
+	if t < 1 then
+		allowed = 0
+	end
+end
+local reply = {allowed}
+for i = 1, #KEYS do
+	local interval = tonumber(ARGV[2 * i + 1])
+	local burst = tonumber(ARGV[2 * i + 2])
+	if mode == 2 or (mode == 1 and allowed == 1) then
+		tokens[i] = math.max(tokens[i] - 1, 0)
+	end
+	redis.call('HSET', KEYS[i], 'tokens', tostring(tokens[i]), 'ts', refilled[i])
+	redis.call('PEXPIRE', KEYS[i], math.ceil((burst - tokens[i]) * interval) + 1000)
+	reply[i + 1] = tostring(tokens[i])
+end
+return reply
+`)
+
+// RedisRateLimitStore 使用 Redis（或兼容 Redis 协议的服务）保存限流状态，可供多个实例共享
+type RedisRateLimitStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisRateLimitStore 创建 Redis 存储，prefix 为所有键的前缀
+func NewRedisRateLimitStore(client redis.UniversalClient, prefix string) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client, prefix: prefix}
+}
+
+// Take 取令牌
+func (s *RedisRateLimitStore) Take(ctx context.Context, buckets []RateLimitBucket, mode RateLimitTakeMode, now time.Time) (*RateLimitTakeResult, error) {
+	keys := make([]string, len(buckets))
+	args := []any{now.UnixMilli(), int(mode)}
+	for i, bucket := range buckets {
+		keys[i] = s.prefix + "ratelimit:" + bucket.Key
+		args = append(args, bucket.Rule.Interval.Milliseconds(), bucket.Rule.Burst)
+	}
+
+	reply, err := takeTokensScript.Run(ctx, s.client, keys, args...).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != len(buckets)+1 {
+		return nil, fmt.Errorf("unexpected rate limit script reply: %v", reply)
+	}
+
+	result := &RateLimitTakeResult{Allowed: reply[0] == int64(1), Tokens: make([]float64, len(buckets))}
+	for i := range buckets {
+		s, _ := reply[i+1].(string)
+		if result.Tokens[i], err = strconv.ParseFloat(s, 64); err != nil {
+			return nil, fmt.Errorf("unexpected rate limit script reply: %v", reply)
+		}
+	}
+	return result, nil
+}
+
+// TurnstileVerifiedAt 返回最近一次验证时间
+func (s *RedisRateLimitStore) TurnstileVerifiedAt(ctx context.Context, ip string) (time.Time, bool, error) {
+	ms, err := s.client.Get(ctx, s.prefix+"turnstile:"+ip).Int64()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.UnixMilli(ms), true, nil
+}
+
+// SetTurnstileVerified 记录验证时间，记录在 ttl 后由 Redis 自动删除
+func (s *RedisRateLimitStore) SetTurnstileVerified(ctx context.Context, ip string, at time.Time, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+"turnstile:"+ip, at.UnixMilli(), ttl).Err()
+}
+
+// MarkCaptchaToken 记录已使用的 token，记录在 ttl 后由 Redis 自动删除
+func (s *RedisRateLimitStore) MarkCaptchaToken(ctx context.Context, hash string, ttl time.Duration, now time.Time) (bool, error) {
+	return s.client.SetNX(ctx, s.prefix+"captcha:"+hash, now.UnixMilli(), ttl).Result()
+}
+
+// Cleanup Redis 中的记录自动过期，无需清理
+func (s *RedisRateLimitStore) Cleanup(ctx context.Context, before time.Time) error {
+	return nil
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"novelai-backend/internal/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SQLiteRateLimitStore 使用应用数据库保存限流状态，重启后保留，可供同一数据库文件上的多个进程共享
+type SQLiteRateLimitStore struct {
+	db *gorm.DB
+}
+
+// NewSQLiteRateLimitStore 创建 SQLite 存储
+func NewSQLiteRateLimitStore(db *gorm.DB) *SQLiteRateLimitStore {
+	return &SQLiteRateLimitStore{db: db}
+}
+
+// Take 取令牌
+func (s *SQLiteRateLimitStore) Take(ctx context.Context, buckets []RateLimitBucket, mode RateLimitTakeMode, now time.Time) (*RateLimitTakeResult, error) {
+	result := &RateLimitTakeResult{Tokens: make([]float64, len(buckets))}
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// 先写入缺失的满桶，使事务一开始就持有写锁，避免并发事务读后写冲突
+		rows := make([]model.RateLimitBucket, len(buckets))
+		for i, bucket := range buckets {
+			rows[i] = model.RateLimitBucket{Key: bucket.Key, Tokens: float64(bucket.Rule.Burst), RefilledAt: now}
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error; err != nil {
+			return err
+		}
+
+		for i, bucket := range buckets {
+			if err := tx.Where("key = ?", bucket.Key).First(&rows[i]).Error; err != nil {
+				return err
+			}
+			result.Tokens[i] = refillTokens(rows[i].Tokens, rows[i].RefilledAt, bucket.Rule, now)
+		}
+		result.Allowed = takeTokens(result.Tokens, mode)
+
+		for i := range rows {
+			updates := map[string]any{"tokens": result.Tokens[i]}
+			if now.After(rows[i].RefilledAt) {
+				updates["refilled_at"] = now
+			}
+			if err := tx.Model(&rows[i]).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// TurnstileVerifiedAt 返回最近一次验证时间
+func (s *SQLiteRateLimitStore) TurnstileVerifiedAt(ctx context.Context, ip string) (time.Time, bool, error) {
+	var verification model.TurnstileVerification
+	err := s.db.WithContext(ctx).Where("ip = ?", ip).First(&verification).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return verification.VerifiedAt, true, nil
+}
+
+// SetTurnstileVerified 记录验证时间，过期记录由 Cleanup 清理
+func (s *SQLiteRateLimitStore) SetTurnstileVerified(ctx context.Context, ip string, at time.Time, ttl time.Duration) error {
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "ip"}},
+		DoUpdates: clause.AssignmentColumns([]string{"verified_at"}),
+	}).Create(&model.TurnstileVerification{IP: ip, VerifiedAt: at}).Error
+}
+
+// MarkCaptchaToken 记录已使用的 token，已过期的记录视为不存在
+func (s *SQLiteRateLimitStore) MarkCaptchaToken(ctx context.Context, hash string, ttl time.Duration, now time.Time) (bool, error) {
+	first := false
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("hash = ? AND expires_at <= ?", hash, now).Delete(&model.CaptchaToken{}).Error; err != nil {
+			return err
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.CaptchaToken{Hash: hash, ExpiresAt: now.Add(ttl)})
+		first = result.RowsAffected == 1
+		return result.Error
+	})
+	return first, err
+}
+
+// Cleanup 清理过期记录
+func (s *SQLiteRateLimitStore) Cleanup(ctx context.Context, before time.Time) error {
+	db := s.db.WithContext(ctx)
+	if err := db.Where("refilled_at < ?", before).Delete(&model.RateLimitBucket{}).Error; err != nil {
+		return err
+	}
+	if err := db.Where("verified_at < ?", before).Delete(&model.TurnstileVerification{}).Error; err != nil {
+		return err
+	}
+	return db.Where("expires_at < ?", before).Delete(&model.CaptchaToken{}).Error
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"novelai-backend/internal/database"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm/logger"
+)
+
+// rateLimitStores 各存储实现的构造函数，sqlite 和 redis 使用临时数据库和 miniredis
+func rateLimitStores(t *testing.T) map[string]func() RateLimitStore {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := database.Open(dbPath, logger.Silent)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	redisServer := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return map[string]func() RateLimitStore{
+		RateLimitStoreMemory: func() RateLimitStore { return NewMemoryRateLimitStore() },
+		RateLimitStoreSQLite: func() RateLimitStore { return NewSQLiteRateLimitStore(db) },
+		RateLimitStoreRedis:  func() RateLimitStore { return NewRedisRateLimitStore(client, "test:") },
+	}
+}
+
+func TestRateLimitTokenBucket(t *testing.T) {
+	for name, newStore := range rateLimitStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Unix(1700000000, 0)
+			svc := NewRateLimitService(RateLimitConfig{
+				Default: RateLimitPolicy{
+					Name:   RateLimitPolicyDefault,
+					Global: RateLimitRule{Interval: time.Second, Burst: 10},
+					IP:     RateLimitRule{Interval: 10 * time.Second, Burst: 2},
+				},
+				TurnstileInterval: time.Minute,
+			}, newStore())
+			svc.now = func() time.Time { return now }
+
+			consume := func(policy, ip string) *RateLimitDecision {
+				t.Helper()
+				d, err := svc.Consume(ctx, policy, ip)
+				if err != nil {
+					t.Fatalf("consume failed: %v", err)
+				}
+				return d
+			}
+
+			for i := 0; i < 2; i++ {
+				if d := consume(RateLimitPolicyGenerate, "1.1.1.1"); !d.Allowed {
+					t.Fatalf("request %d should be allowed within burst", i)
+				}
+			}
+			if d := consume(RateLimitPolicyStream, "1.1.1.1"); d.Allowed || d.Scope != RateLimitScopeIP {
+				t.Fatalf("routes without own policy should share the default bucket, got %+v", d)
+			}
+
+			// 响应头取剩余令牌最少的 IP 桶
+			now = now.Add(4 * time.Second)
+			d, err := svc.Check(ctx, RateLimitPolicyGenerate, "1.1.1.1")
+			if err != nil {
+				t.Fatalf("check failed: %v", err)
+			}
+			if d.Limit != 2 || d.Remaining != 0 || d.RetryAfter != 6*time.Second || d.Reset != 16*time.Second {
+				t.Fatalf("decision = %+v, want limit 2, remaining 0, retry after 6s, reset 16s", d)
+			}
+
+			if d := consume(RateLimitPolicyGenerate, "2.2.2.2"); !d.Allowed {
+				t.Fatalf("other IPs should not be limited")
+			}
+
+			// 补充一个令牌后只允许一次请求
+			now = now.Add(6 * time.Second)
+			if d := consume(RateLimitPolicyGenerate, "1.1.1.1"); !d.Allowed {
+				t.Fatalf("request should be allowed after refill")
+			}
+			if d := consume(RateLimitPolicyGenerate, "1.1.1.1"); d.Allowed {
+				t.Fatalf("request should be limited until next refill")
+			}
+
+			// 特权请求消耗令牌但不会让令牌数为负
+			now = now.Add(time.Hour)
+			for i := 0; i < 5; i++ {
+				if _, err := svc.ConsumePrivileged(ctx, RateLimitPolicyGenerate, "1.1.1.1"); err != nil {
+					t.Fatalf("consume privileged failed: %v", err)
+				}
+			}
+			now = now.Add(10 * time.Second)
+			if d, err := svc.Check(ctx, RateLimitPolicyGenerate, "1.1.1.1"); err != nil || !d.Allowed {
+				t.Fatalf("privileged requests should not push tokens below zero")
+			}
+
+			// 共享同一存储的其他实例看到相同的状态
+			replica := NewRateLimitService(svc.config, svc.store)
+			replica.now = svc.now
+			if d, err := replica.Consume(ctx, RateLimitPolicyGenerate, "1.1.1.1"); err != nil || !d.Allowed {
+				t.Fatalf("replica consume = %+v, %v", d, err)
+			}
+			if d := consume(RateLimitPolicyGenerate, "1.1.1.1"); d.Allowed {
+				t.Fatalf("token consumed by replica should not be available")
+			}
+
+			if required, err := svc.CheckTurnstileRequired(ctx, "1.1.1.1"); err != nil || !required {
+				t.Fatalf("turnstile should be required before verification")
+			}
+			if err := replica.UpdateTurnstileVerification(ctx, "1.1.1.1"); err != nil {
+				t.Fatalf("update turnstile failed: %v", err)
+			}
+			if required, err := svc.CheckTurnstileRequired(ctx, "1.1.1.1"); err != nil || required {
+				t.Fatalf("turnstile verification should be shared")
+			}
+			now = now.Add(time.Minute)
+			if required, err := svc.CheckTurnstileRequired(ctx, "1.1.1.1"); err != nil || !required {
+				t.Fatalf("turnstile verification should expire")
+			}
+
+			// 已使用的 token 在有效期内不能再次使用
+			store := svc.store
+			for i, want := range []bool{true, false} {
+				if first, err := store.MarkCaptchaToken(ctx, "hash", time.Minute, now); err != nil || first != want {
+					t.Fatalf("mark captcha token %d = %v, %v, want %v", i, first, err, want)
+				}
+			}
+			if name != RateLimitStoreRedis { // Redis 中的记录按服务器时间过期
+				if first, err := store.MarkCaptchaToken(ctx, "hash", time.Minute, now.Add(2*time.Minute)); err != nil || !first {
+					t.Fatalf("expired captcha token should be accepted again")
+				}
+			}
+		})
+	}
+}
+
+func TestParseRateLimitPolicies(t *testing.T) {
+	defaults := RateLimitPolicy{
+		Name:   RateLimitPolicyDefault,
+		Global: RateLimitRule{Interval: 8 * time.Second, Burst: 1},
+		IP:     RateLimitRule{Interval: 15 * time.Second, Burst: 1},
+	}
+	policies, err := ParseRateLimitPolicies("stream=ip:30s/2; rerun=global:1m,ip:2m/3", defaults)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stream := policies[RateLimitPolicyStream]
+	if stream.Global != defaults.Global || stream.IP != (RateLimitRule{Interval: 30 * time.Second, Burst: 2}) {
+		t.Errorf("stream policy = %+v", stream)
+	}
+	rerun := policies[RateLimitPolicyRerun]
+	if rerun.Global != (RateLimitRule{Interval: time.Minute, Burst: 1}) || rerun.IP != (RateLimitRule{Interval: 2 * time.Minute, Burst: 3}) {
+		t.Errorf("rerun policy = %+v", rerun)
+	}
+
+	for _, spec := range []string{"stream", "stream=ip", "stream=user:1s", "stream=ip:1s/0", "stream=ip:0s", "steram=ip:30s", "default=ip:30s"} {
+		if _, err := ParseRateLimitPolicies(spec, defaults); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+func TestRateLimitRunCleanup(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Unix(1700000000, 0)
+	svc := NewRateLimitService(RateLimitConfig{
+		Default: RateLimitPolicy{
+			Name:   RateLimitPolicyDefault,
+			Global: RateLimitRule{Interval: time.Second, Burst: 10},
+			IP:     RateLimitRule{Interval: time.Second, Burst: 10},
+		},
+		TurnstileInterval: time.Minute,
+	}, store)
+	var mu sync.Mutex
+	svc.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := svc.Consume(ctx, RateLimitPolicyGenerate, "1.1.1.1"); err != nil {
+		t.Fatalf("consume failed: %v", err)
+	}
+	if _, err := store.MarkCaptchaToken(ctx, "hash", time.Minute, now); err != nil {
+		t.Fatalf("mark token failed: %v", err)
+	}
+	mu.Lock()
+	now = now.Add(25 * time.Hour)
+	mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		svc.RunCleanup(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		store.mu.Lock()
+		remaining := len(store.buckets) + len(store.captchaTokens)
+		store.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d records not cleaned up", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// ctx 取消后停止
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("cleanup did not stop after context was cancelled")
+	}
+}
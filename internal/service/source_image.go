@@ -0,0 +1,66 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	_ "image/jpeg" // 支持 JPEG 源图像
+	"image/png"
+	"strings"
+)
+
+// MaxSourceImageSize 源图像最大字节数
+const MaxSourceImageSize = 16 << 20
+
+// MaxSourceImagePixels 源图像、蒙版和风格参考图像的最大像素数，与最大生成尺寸一致
+const MaxSourceImagePixels = MaxImageSide * MaxImageSide
+
+// DecodeBase64Image 解码 base64 图像，支持 data URL 前缀（data:image/png;base64,...）
+func DecodeBase64Image(value string) ([]byte, error) {
+	if strings.HasPrefix(value, "data:") {
+		if i := strings.Index(value, ","); i >= 0 {
+			value = value[i+1:]
+		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 image: %w", err)
+	}
+	if len(data) > MaxSourceImageSize {
+		return nil, fmt.Errorf("image is too large, maximum %d bytes", MaxSourceImageSize)
+	}
+	return data, nil
+}
+
+// decodeImage 解码图像，先读取头部检查尺寸，避免声明了超大尺寸的小文件在解码时占用大量内存
+func decodeImage(data []byte) (image.Image, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxSourceImagePixels {
+		return nil, "", fmt.Errorf("image size %dx%d exceeds the maximum of %d pixels", config.Width, config.Height, MaxSourceImagePixels)
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// NormalizeSourceImage 解码源图像并统一转换为 PNG，返回 PNG 数据和尺寸
+func NormalizeSourceImage(data []byte) ([]byte, int, int, error) {
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	if format == "png" {
+		return data, bounds.Dx(), bounds.Dy(), nil
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to encode png: %w", err)
+	}
+	return buf.Bytes(), bounds.Dx(), bounds.Dy(), nil
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// encodeTestPNG 编码指定尺寸的 PNG，declaredWidth / declaredHeight 非 0 时改写 IHDR 中声明的尺寸，
+// 模拟数据很小但声明超大尺寸的图像
+func encodeTestPNG(t *testing.T, width, height, declaredWidth, declaredHeight int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if declaredWidth > 0 {
+		// 8 字节签名之后为 IHDR：长度(4) 类型(4) 宽(4) 高(4) ... CRC(4)
+		binary.BigEndian.PutUint32(data[16:20], uint32(declaredWidth))
+		binary.BigEndian.PutUint32(data[20:24], uint32(declaredHeight))
+		binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	}
+	return data
+}
+
+func TestNormalizeSourceImageRejectsOversizedImages(t *testing.T) {
+	data, width, height, err := NormalizeSourceImage(encodeTestPNG(t, 64, 32, 0, 0))
+	if err != nil || width != 64 || height != 32 || len(data) == 0 {
+		t.Fatalf("NormalizeSourceImage() = %d, %d, %v", width, height, err)
+	}
+
+	bomb := encodeTestPNG(t, 1, 1, 30000, 30000)
+	if _, _, _, err := NormalizeSourceImage(bomb); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Errorf("err = %v, want size error", err)
+	}
+}
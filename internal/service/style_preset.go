@@ -1,11 +1,43 @@
 package service
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
 	"novelai-backend/internal/model"
 
 	"gorm.io/gorm"
 )
 
+// 画风预设字段长度限制（按字符计）
+const (
+	MaxStylePresetNameLength        = 100
+	MaxStylePresetDescriptionLength = 1000
+	MaxStylePresetPromptLength      = 2000
+)
+
+// 画风预设负面提示词模式
+const (
+	NegativePromptModeMerge   = "merge"   // 在用户（或默认）负面提示词基础上应用预设
+	NegativePromptModeReplace = "replace" // 只使用预设的负面提示词，忽略用户输入和默认值
+)
+
+// 画风预设错误
+var (
+	ErrStylePresetNotFound   = errors.New("style preset not found")
+	ErrStylePresetNameExists = errors.New("style preset name already exists")
+	ErrInvalidStylePresetIDs = errors.New("style preset ids must not be empty or duplicated")
+
+	ErrStylePresetRevisionNotFound = errors.New("style preset revision not found")
+	ErrStylePresetRevisionConflict = errors.New("style preset was modified concurrently")
+)
+
 // StylePresetService 画风预设服务
 type StylePresetService struct {
 	db *gorm.DB
@@ -21,7 +53,7 @@ func NewStylePresetService(db *gorm.DB) *StylePresetService {
 // GetAllStylePresets 获取所有启用的画风预设
 func (s *StylePresetService) GetAllStylePresets() ([]model.StylePreset, error) {
 	var presets []model.StylePreset
-	err := s.db.Where("enabled = ?", true).Order("created_at ASC").Find(&presets).Error
+	err := s.db.Where("enabled = ?", true).Order("sort_order ASC").Order("id ASC").Find(&presets).Error
 	return presets, err
 }
 
@@ -34,3 +66,510 @@ func (s *StylePresetService) GetStylePresetByID(id uint) (*model.StylePreset, er
 	}
 	return &preset, nil
 }
+
+// ListStylePresets 获取全部画风预设（包括已禁用的），用于管理
+func (s *StylePresetService) ListStylePresets() ([]model.StylePreset, error) {
+	var presets []model.StylePreset
+	err := s.db.Order("sort_order ASC").Order("id ASC").Find(&presets).Error
+	return presets, err
+}
+
+// FindStylePreset 根据ID获取画风预设（包括已禁用的）
+func (s *StylePresetService) FindStylePreset(id uint) (*model.StylePreset, error) {
+	var preset model.StylePreset
+	if err := s.db.First(&preset, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrStylePresetNotFound
+		}
+		return nil, err
+	}
+	return &preset, nil
+}
+
+// StylePresetInput 创建或更新画风预设的参数
+type StylePresetInput struct {
+	Name        string
+	Description string
+	model.StylePresetContent
+	Enabled   *bool // 为 nil 时创建默认启用，更新保持不变
+	SortOrder *int  // 为 nil 时创建排在最后，更新保持不变
+}
+
+// Validate 校验画风预设参数
+func (in *StylePresetInput) Validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if utf8.RuneCountInString(in.Name) > MaxStylePresetNameLength {
+		return fmt.Errorf("name must be at most %d characters", MaxStylePresetNameLength)
+	}
+	if utf8.RuneCountInString(in.Description) > MaxStylePresetDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", MaxStylePresetDescriptionLength)
+	}
+
+	prompts := []struct {
+		field string
+		value string
+	}{
+		{"prefix_prompt", in.PrefixPrompt},
+		{"suffix_prompt", in.SuffixPrompt},
+		{"prefix_negative_prompt", in.PrefixNegativePrompt},
+		{"suffix_negative_prompt", in.SuffixNegativePrompt},
+	}
+	for _, p := range prompts {
+		if utf8.RuneCountInString(p.value) > MaxStylePresetPromptLength {
+			return fmt.Errorf("%s must be at most %d characters", p.field, MaxStylePresetPromptLength)
+		}
+		if err := validatePromptBrackets(p.value); err != nil {
+			return fmt.Errorf("%s: %w", p.field, err)
+		}
+	}
+
+	templates := []struct {
+		field   string
+		value   string
+		builtin string
+		other   string
+	}{
+		{"prompt_template", in.PromptTemplate, TemplateVarPrompt, TemplateVarNegative},
+		{"negative_prompt_template", in.NegativePromptTemplate, TemplateVarNegative, TemplateVarPrompt},
+	}
+	for _, p := range templates {
+		if p.value == "" {
+			continue
+		}
+		if utf8.RuneCountInString(p.value) > MaxStylePresetPromptLength {
+			return fmt.Errorf("%s must be at most %d characters", p.field, MaxStylePresetPromptLength)
+		}
+		tmpl, err := ParsePromptTemplate(p.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.field, err)
+		}
+		if !tmpl.Uses(p.builtin) {
+			return fmt.Errorf("%s must contain ${%s}", p.field, p.builtin)
+		}
+		if tmpl.Uses(p.other) {
+			return fmt.Errorf("%s cannot use ${%s}", p.field, p.other)
+		}
+		if err := validatePromptBrackets(tmpl.literalText()); err != nil {
+			return fmt.Errorf("%s: %w", p.field, err)
+		}
+	}
+
+	switch in.NegativePromptMode {
+	case "":
+		in.NegativePromptMode = NegativePromptModeMerge
+	case NegativePromptModeMerge, NegativePromptModeReplace:
+	default:
+		return fmt.Errorf("negative_prompt_mode must be %s or %s", NegativePromptModeMerge, NegativePromptModeReplace)
+	}
+
+	return in.validateParameters()
+}
+
+// validateParameters 校验预设固定的生成参数，空字符串视为不指定
+func (in *StylePresetInput) validateParameters() error {
+	if in.Model != nil && *in.Model == "" {
+		in.Model = nil
+	}
+	if in.Sampler != nil && *in.Sampler == "" {
+		in.Sampler = nil
+	}
+
+	modelName := ""
+	if in.Model != nil {
+		if !IsSupportedModel(*in.Model) {
+			return fmt.Errorf("unsupported model: %s", *in.Model)
+		}
+		modelName = *in.Model
+	}
+	if in.Sampler != nil {
+		if modelName != "" && !slices.Contains(novelAIModels[modelName].Samplers, *in.Sampler) {
+			return fmt.Errorf("sampler %s is not supported by model %s", *in.Sampler, modelName)
+		}
+		if !IsSupportedSampler(*in.Sampler) {
+			return fmt.Errorf("unsupported sampler: %s", *in.Sampler)
+		}
+	}
+	if in.Scale != nil && (*in.Scale < MinScale || *in.Scale > MaxScale) {
+		return fmt.Errorf("scale must be between %g and %g", MinScale, MaxScale)
+	}
+	if in.Steps != nil && (*in.Steps < MinSteps || *in.Steps > MaxSteps) {
+		return fmt.Errorf("steps must be between %d and %d", MinSteps, MaxSteps)
+	}
+	if (in.Width == nil) != (in.Height == nil) {
+		return fmt.Errorf("width and height must be set together")
+	}
+	if in.Width != nil {
+		if err := ValidateImageSize(*in.Width, *in.Height); err != nil {
+			return err
+		}
+	}
+	if in.UCPreset != nil {
+		if err := ValidateUCPreset(modelName, *in.UCPreset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePromptBrackets 检查提示词中的强调括号 {} [] () 是否成对且正确嵌套
+func validatePromptBrackets(prompt string) error {
+	pairs := map[rune]rune{'}': '{', ']': '[', ')': '('}
+	var stack []rune
+	for _, r := range prompt {
+		switch r {
+		case '{', '[', '(':
+			stack = append(stack, r)
+		case '}', ']', ')':
+			if len(stack) == 0 || stack[len(stack)-1] != pairs[r] {
+				return fmt.Errorf("unbalanced bracket %q", r)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("unclosed bracket %q", stack[len(stack)-1])
+	}
+	return nil
+}
+
+// CreateStylePreset 创建画风预设
+func (s *StylePresetService) CreateStylePreset(in *StylePresetInput) (*model.StylePreset, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	preset := &model.StylePreset{}
+	applyStylePresetInput(preset, in)
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if in.SortOrder == nil {
+			var maxOrder *int
+			if err := tx.Model(&model.StylePreset{}).Select("MAX(sort_order)").Scan(&maxOrder).Error; err != nil {
+				return err
+			}
+			if maxOrder != nil {
+				preset.SortOrder = *maxOrder + 1
+			}
+		}
+
+		// Enabled 的数据库默认值为 true，创建时零值会被默认值覆盖，需要单独更新
+		enabled := preset.Enabled
+		if err := tx.Create(preset).Error; err != nil {
+			return err
+		}
+		if !enabled {
+			if err := tx.Model(preset).Update("enabled", false).Error; err != nil {
+				return err
+			}
+		}
+		return createRevision(tx, preset)
+	})
+	if err != nil {
+		return nil, translateStylePresetError(err)
+	}
+	return preset, nil
+}
+
+// UpdateStylePreset 更新画风预设
+func (s *StylePresetService) UpdateStylePreset(id uint, in *StylePresetInput) (*model.StylePreset, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	preset, err := s.FindStylePreset(id)
+	if err != nil {
+		return nil, err
+	}
+	// 内容有变化时生成新的修订版本，只修改名称、描述、启用状态或排序时不生成
+	changed := preset.RevisionID == nil || !reflect.DeepEqual(preset.StylePresetContent, in.StylePresetContent)
+	applyStylePresetInput(preset, in)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// Save 会写入零值字段（如清空的后缀、禁用状态）；修订版本只由 createRevision 更新，避免覆盖并发请求的结果
+		if err := tx.Omit("revision", "revision_id").Save(preset).Error; err != nil {
+			return err
+		}
+		if changed {
+			return createRevision(tx, preset)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, translateStylePresetError(err)
+	}
+	return preset, nil
+}
+
+// EnsureStylePresetRevisions 为没有修订版本的预设（引入修订版本之前创建的）保存初始修订版本
+func (s *StylePresetService) EnsureStylePresetRevisions() error {
+	var presets []model.StylePreset
+	if err := s.db.Where("revision_id IS NULL").Find(&presets).Error; err != nil {
+		return err
+	}
+	for i := range presets {
+		if err := s.db.Transaction(func(tx *gorm.DB) error {
+			return createRevision(tx, &presets[i])
+		}); err != nil {
+			return fmt.Errorf("failed to create revision for style preset %d: %w", presets[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// createRevision 将预设的当前内容保存为新的修订版本，并更新预设指向该版本
+// 修订版本号以条件更新递增，读取预设后已被其他请求修改时返回 ErrStylePresetRevisionConflict
+func createRevision(tx *gorm.DB, preset *model.StylePreset) error {
+	result := tx.Model(&model.StylePreset{}).
+		Where("id = ? AND revision = ?", preset.ID, preset.Revision).
+		Update("revision", gorm.Expr("revision + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrStylePresetRevisionConflict
+	}
+
+	revision := &model.StylePresetRevision{
+		StylePresetID:      preset.ID,
+		Revision:           preset.Revision + 1,
+		Name:               preset.Name,
+		StylePresetContent: preset.StylePresetContent,
+	}
+	if err := tx.Create(revision).Error; err != nil {
+		return err
+	}
+
+	preset.RevisionID = &revision.ID
+	preset.Revision = revision.Revision
+	return tx.Model(preset).Update("revision_id", revision.ID).Error
+}
+
+// CurrentRevision 返回启用的画风预设的当前修订版本
+func (s *StylePresetService) CurrentRevision(presetID uint) (*model.StylePresetRevision, error) {
+	preset, err := s.GetStylePresetByID(presetID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrStylePresetNotFound
+		}
+		return nil, err
+	}
+	if preset.RevisionID == nil {
+		return nil, ErrStylePresetRevisionNotFound
+	}
+	return s.GetRevision(*preset.RevisionID)
+}
+
+// GetRevision 根据 ID 获取修订版本
+func (s *StylePresetService) GetRevision(id uint) (*model.StylePresetRevision, error) {
+	var revision model.StylePresetRevision
+	if err := s.db.First(&revision, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrStylePresetRevisionNotFound
+		}
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// ListRevisions 获取预设的全部修订版本，新版本在前；预设已删除时仍可查询
+func (s *StylePresetService) ListRevisions(presetID uint) ([]model.StylePresetRevision, error) {
+	var revisions []model.StylePresetRevision
+	if err := s.db.Where("style_preset_id = ?", presetID).Order("revision DESC").Find(&revisions).Error; err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, ErrStylePresetNotFound
+	}
+	return revisions, nil
+}
+
+// getRevisionByNumber 根据预设 ID 和版本号获取修订版本
+func (s *StylePresetService) getRevisionByNumber(presetID uint, number int) (*model.StylePresetRevision, error) {
+	var revision model.StylePresetRevision
+	err := s.db.Where("style_preset_id = ? AND revision = ?", presetID, number).First(&revision).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrStylePresetRevisionNotFound
+		}
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// RevisionChange 两个修订版本之间变化的字段
+type RevisionChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// RevisionDiff 修订版本差异
+type RevisionDiff struct {
+	From    *model.StylePresetRevision `json:"from"`
+	To      *model.StylePresetRevision `json:"to"`
+	Changes []RevisionChange           `json:"changes"`
+}
+
+// DiffRevisions 比较预设的两个修订版本（按版本号），返回名称和内容中变化的字段
+func (s *StylePresetService) DiffRevisions(presetID uint, fromNumber, toNumber int) (*RevisionDiff, error) {
+	from, err := s.getRevisionByNumber(presetID, fromNumber)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.getRevisionByNumber(presetID, toNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	fromFields, err := revisionFields(from)
+	if err != nil {
+		return nil, err
+	}
+	toFields, err := revisionFields(to)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(fromFields))
+	for name := range fromFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	diff := &RevisionDiff{From: from, To: to, Changes: []RevisionChange{}}
+	for _, name := range names {
+		if !reflect.DeepEqual(fromFields[name], toFields[name]) {
+			diff.Changes = append(diff.Changes, RevisionChange{Field: name, From: fromFields[name], To: toFields[name]})
+		}
+	}
+	return diff, nil
+}
+
+// revisionFields 将修订版本的名称和内容按 JSON 字段名展开，用于比较
+func revisionFields(revision *model.StylePresetRevision) (map[string]any, error) {
+	data, err := json.Marshal(struct {
+		Name string `json:"name"`
+		model.StylePresetContent
+	}{revision.Name, revision.StylePresetContent})
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// DeleteStylePreset 删除画风预设，已有生成记录中的预设 ID 和修订版本保持不变
+func (s *StylePresetService) DeleteStylePreset(id uint) error {
+	result := s.db.Delete(&model.StylePreset{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrStylePresetNotFound
+	}
+	return nil
+}
+
+// SetStylePresetEnabled 启用或禁用画风预设
+func (s *StylePresetService) SetStylePresetEnabled(id uint, enabled bool) (*model.StylePreset, error) {
+	result := s.db.Model(&model.StylePreset{}).Where("id = ?", id).Update("enabled", enabled)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrStylePresetNotFound
+	}
+	return s.FindStylePreset(id)
+}
+
+// ReorderStylePresets 按给定的 ID 顺序重新设置排序，未列出的预设排在其后并保持原有顺序
+func (s *StylePresetService) ReorderStylePresets(ids []uint) ([]model.StylePreset, error) {
+	if len(ids) == 0 {
+		return nil, ErrInvalidStylePresetIDs
+	}
+	order := make(map[uint]int, len(ids))
+	for i, id := range ids {
+		if _, ok := order[id]; ok {
+			return nil, ErrInvalidStylePresetIDs
+		}
+		order[id] = i
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var presets []model.StylePreset
+		if err := tx.Order("sort_order ASC").Order("id ASC").Find(&presets).Error; err != nil {
+			return err
+		}
+
+		found := 0
+		for _, preset := range presets {
+			if _, ok := order[preset.ID]; ok {
+				found++
+			}
+		}
+		if found != len(ids) {
+			return ErrStylePresetNotFound
+		}
+
+		next := len(ids)
+		for _, preset := range presets {
+			sortOrder, ok := order[preset.ID]
+			if !ok {
+				sortOrder = next
+				next++
+			}
+			if err := tx.Model(&model.StylePreset{}).Where("id = ?", preset.ID).
+				Update("sort_order", sortOrder).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.ListStylePresets()
+}
+
+// StylePresetResult 应用画风预设后的提示词
+type StylePresetResult struct {
+	Prompt         string             `json:"prompt"`
+	NegativePrompt string             `json:"negative_prompt"`
+	Variables      []TemplateVariable `json:"variables"` // 预设模板声明的自定义变量
+}
+
+// ApplyStylePreset 将画风预设应用到用户输入的提示词
+// 设置了模板时按模板渲染，否则以逗号连接前缀、提示词和后缀；variables 中不能包含模板未声明的变量
+// 负面提示词模式为 replace 时忽略 negativePrompt
+func (s *StylePresetService) ApplyStylePreset(preset *model.StylePresetContent, prompt, negativePrompt string, variables map[string]string) (*StylePresetResult, error) {
+	return ComposeStylePresets([]StylePresetLayer{{Content: preset, Weight: 1}}, prompt, negativePrompt, variables)
+}
+
+// applyStylePresetInput 将参数写入画风预设
+func applyStylePresetInput(preset *model.StylePreset, in *StylePresetInput) {
+	preset.Name = in.Name
+	preset.Description = in.Description
+	preset.StylePresetContent = in.StylePresetContent
+	if in.Enabled != nil {
+		preset.Enabled = *in.Enabled
+	} else if preset.ID == 0 {
+		preset.Enabled = true
+	}
+	if in.SortOrder != nil {
+		preset.SortOrder = *in.SortOrder
+	}
+}
+
+// translateStylePresetError 将唯一约束冲突转换为 ErrStylePresetNameExists
+func translateStylePresetError(err error) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrStylePresetNameExists
+	}
+	return err
+}
@@ -0,0 +1,340 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"novelai-backend/internal/model"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// StylePresetBundleVersion 导出包格式版本
+const StylePresetBundleVersion = 1
+
+// MaxStylePresetBundleSize 导入的导出包最大字节数
+const MaxStylePresetBundleSize = 8 << 20
+
+// 导出包格式
+const (
+	BundleFormatJSON = "json"
+	BundleFormatYAML = "yaml"
+)
+
+// 导入时名称冲突的处理策略
+const (
+	ImportStrategySkip      = "skip"      // 跳过已存在的预设
+	ImportStrategyOverwrite = "overwrite" // 覆盖已存在预设的内容
+	ImportStrategyRename    = "rename"    // 以 "名称 (2)" 等新名称创建
+)
+
+// 导入计划中每个预设的处理方式
+const (
+	ImportActionCreate    = "create"
+	ImportActionOverwrite = "overwrite"
+	ImportActionRename    = "rename"
+	ImportActionSkip      = "skip"
+)
+
+// ErrInvalidStylePresetBundle 导出包格式错误或包含不合法的预设
+var ErrInvalidStylePresetBundle = errors.New("invalid style preset bundle")
+
+// StylePresetBundle 画风预设导出包，用于在不同实例之间迁移预设
+type StylePresetBundle struct {
+	Version    int                     `json:"version" yaml:"version"`
+	ExportedAt time.Time               `json:"exported_at" yaml:"exported_at"`
+	Presets    []StylePresetBundleItem `json:"presets" yaml:"presets"`
+}
+
+// StylePresetBundleItem 导出包中的画风预设，不包含 ID、时间和修订版本等实例相关的字段
+type StylePresetBundleItem struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+
+	PrefixPrompt           string `json:"prefix_prompt,omitempty" yaml:"prefix_prompt,omitempty"`
+	SuffixPrompt           string `json:"suffix_prompt,omitempty" yaml:"suffix_prompt,omitempty"`
+	PrefixNegativePrompt   string `json:"prefix_negative_prompt,omitempty" yaml:"prefix_negative_prompt,omitempty"`
+	SuffixNegativePrompt   string `json:"suffix_negative_prompt,omitempty" yaml:"suffix_negative_prompt,omitempty"`
+	PromptTemplate         string `json:"prompt_template,omitempty" yaml:"prompt_template,omitempty"`
+	NegativePromptTemplate string `json:"negative_prompt_template,omitempty" yaml:"negative_prompt_template,omitempty"`
+	NegativePromptMode     string `json:"negative_prompt_mode,omitempty" yaml:"negative_prompt_mode,omitempty"`
+
+	Model         *string  `json:"model,omitempty" yaml:"model,omitempty"`
+	Sampler       *string  `json:"sampler,omitempty" yaml:"sampler,omitempty"`
+	Scale         *float64 `json:"scale,omitempty" yaml:"scale,omitempty"`
+	Steps         *int     `json:"steps,omitempty" yaml:"steps,omitempty"`
+	Width         *int     `json:"width,omitempty" yaml:"width,omitempty"`
+	Height        *int     `json:"height,omitempty" yaml:"height,omitempty"`
+	QualityToggle *bool    `json:"quality_toggle,omitempty" yaml:"quality_toggle,omitempty"`
+	UCPreset      *int     `json:"uc_preset,omitempty" yaml:"uc_preset,omitempty"`
+
+	Enabled   *bool `json:"enabled,omitempty" yaml:"enabled,omitempty"`       // 不指定时新预设默认启用
+	SortOrder *int  `json:"sort_order,omitempty" yaml:"sort_order,omitempty"` // 不指定时新预设排在最后
+}
+
+// newBundleItem 将画风预设转换为导出包中的预设
+func newBundleItem(preset *model.StylePreset) StylePresetBundleItem {
+	enabled := preset.Enabled
+	sortOrder := preset.SortOrder
+	return StylePresetBundleItem{
+		Name:                   preset.Name,
+		Description:            preset.Description,
+		PrefixPrompt:           preset.PrefixPrompt,
+		SuffixPrompt:           preset.SuffixPrompt,
+		PrefixNegativePrompt:   preset.PrefixNegativePrompt,
+		SuffixNegativePrompt:   preset.SuffixNegativePrompt,
+		PromptTemplate:         preset.PromptTemplate,
+		NegativePromptTemplate: preset.NegativePromptTemplate,
+		NegativePromptMode:     preset.NegativePromptMode,
+		Model:                  preset.Model,
+		Sampler:                preset.Sampler,
+		Scale:                  preset.Scale,
+		Steps:                  preset.Steps,
+		Width:                  preset.Width,
+		Height:                 preset.Height,
+		QualityToggle:          preset.QualityToggle,
+		UCPreset:               preset.UCPreset,
+		Enabled:                &enabled,
+		SortOrder:              &sortOrder,
+	}
+}
+
+// toInput 转换为创建或更新预设的参数
+func (item *StylePresetBundleItem) toInput() *StylePresetInput {
+	return &StylePresetInput{
+		Name:        item.Name,
+		Description: item.Description,
+		StylePresetContent: model.StylePresetContent{
+			PrefixPrompt:           item.PrefixPrompt,
+			SuffixPrompt:           item.SuffixPrompt,
+			PrefixNegativePrompt:   item.PrefixNegativePrompt,
+			SuffixNegativePrompt:   item.SuffixNegativePrompt,
+			PromptTemplate:         item.PromptTemplate,
+			NegativePromptTemplate: item.NegativePromptTemplate,
+			NegativePromptMode:     item.NegativePromptMode,
+			Model:                  item.Model,
+			Sampler:                item.Sampler,
+			Scale:                  item.Scale,
+			Steps:                  item.Steps,
+			Width:                  item.Width,
+			Height:                 item.Height,
+			QualityToggle:          item.QualityToggle,
+			UCPreset:               item.UCPreset,
+		},
+		Enabled:   item.Enabled,
+		SortOrder: item.SortOrder,
+	}
+}
+
+// ExportStylePresets 导出全部画风预设（包括已禁用的），按排序顺序排列
+func (s *StylePresetService) ExportStylePresets() (*StylePresetBundle, error) {
+	presets, err := s.ListStylePresets()
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &StylePresetBundle{
+		Version:    StylePresetBundleVersion,
+		ExportedAt: time.Now().UTC(),
+		Presets:    make([]StylePresetBundleItem, 0, len(presets)),
+	}
+	for i := range presets {
+		bundle.Presets = append(bundle.Presets, newBundleItem(&presets[i]))
+	}
+	return bundle, nil
+}
+
+// MarshalStylePresetBundle 按格式序列化导出包
+func MarshalStylePresetBundle(bundle *StylePresetBundle, format string) ([]byte, error) {
+	switch format {
+	case BundleFormatJSON:
+		return json.MarshalIndent(bundle, "", "  ")
+	case BundleFormatYAML:
+		return yaml.Marshal(bundle)
+	default:
+		return nil, fmt.Errorf("unsupported bundle format: %s", format)
+	}
+}
+
+// ParseStylePresetBundle 按格式解析导出包并检查版本
+func ParseStylePresetBundle(data []byte, format string) (*StylePresetBundle, error) {
+	var bundle StylePresetBundle
+	var err error
+	switch format {
+	case BundleFormatJSON:
+		err = json.Unmarshal(data, &bundle)
+	case BundleFormatYAML:
+		err = yaml.Unmarshal(data, &bundle)
+	default:
+		return nil, fmt.Errorf("unsupported bundle format: %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidStylePresetBundle, err)
+	}
+	if bundle.Version != StylePresetBundleVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidStylePresetBundle, bundle.Version)
+	}
+	return &bundle, nil
+}
+
+// StylePresetImportOptions 导入选项
+type StylePresetImportOptions struct {
+	Strategy string // 名称冲突时的处理策略，默认 skip
+	DryRun   bool   // 只生成导入报告，不写入数据库
+}
+
+// StylePresetImportItem 单个预设的导入结果
+type StylePresetImportItem struct {
+	Name     string `json:"name"`               // 导出包中的名称
+	Action   string `json:"action"`             // create、overwrite、rename 或 skip
+	NewName  string `json:"new_name,omitempty"` // rename 时的新名称
+	PresetID uint   `json:"preset_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// StylePresetImportReport 导入报告
+type StylePresetImportReport struct {
+	DryRun    bool                    `json:"dry_run"`
+	Strategy  string                  `json:"strategy"`
+	Valid     bool                    `json:"valid"` // 为 false 时没有写入任何预设
+	Created   int                     `json:"created"`
+	Overwrote int                     `json:"overwritten"`
+	Skipped   int                     `json:"skipped"`
+	Items     []StylePresetImportItem `json:"items"`
+}
+
+// ImportStylePresets 导入画风预设
+// 先校验全部预设并生成导入计划，存在不合法的预设时不写入任何数据；否则在一个事务中执行
+func (s *StylePresetService) ImportStylePresets(bundle *StylePresetBundle, opts StylePresetImportOptions) (*StylePresetImportReport, error) {
+	if opts.Strategy == "" {
+		opts.Strategy = ImportStrategySkip
+	}
+	switch opts.Strategy {
+	case ImportStrategySkip, ImportStrategyOverwrite, ImportStrategyRename:
+	default:
+		return nil, fmt.Errorf("unsupported import strategy: %s", opts.Strategy)
+	}
+
+	existing, err := s.ListStylePresets()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*model.StylePreset, len(existing))
+	for i := range existing {
+		byName[existing[i].Name] = &existing[i]
+	}
+
+	report := &StylePresetImportReport{
+		DryRun:   opts.DryRun,
+		Strategy: opts.Strategy,
+		Valid:    true,
+		Items:    make([]StylePresetImportItem, len(bundle.Presets)),
+	}
+	inputs := make([]*StylePresetInput, len(bundle.Presets))
+	seen := map[string]bool{}    // 导出包中已处理的原始名称，用于检查重复
+	renamed := map[string]bool{} // 重命名生成的新名称
+
+	// 生成的新名称不能与导出包中任何预设的原始名称冲突
+	bundleNames := make(map[string]bool, len(bundle.Presets))
+	for i := range bundle.Presets {
+		bundleNames[strings.TrimSpace(bundle.Presets[i].Name)] = true
+	}
+
+	for i := range bundle.Presets {
+		item := &report.Items[i]
+		input := bundle.Presets[i].toInput()
+		item.Name = strings.TrimSpace(input.Name)
+
+		if err := input.Validate(); err != nil {
+			item.Error = err.Error()
+			report.Valid = false
+			continue
+		}
+		if seen[input.Name] {
+			item.Error = "duplicate name in bundle"
+			report.Valid = false
+			continue
+		}
+		seen[input.Name] = true
+
+		current, exists := byName[input.Name]
+		switch {
+		case !exists:
+			item.Action = ImportActionCreate
+		case opts.Strategy == ImportStrategySkip:
+			item.Action = ImportActionSkip
+			item.PresetID = current.ID
+		case opts.Strategy == ImportStrategyOverwrite:
+			item.Action = ImportActionOverwrite
+			item.PresetID = current.ID
+		default:
+			item.Action = ImportActionRename
+			input.Name = uniquePresetName(input.Name, func(name string) bool {
+				return byName[name] != nil || bundleNames[name] || renamed[name]
+			})
+			item.NewName = input.Name
+			renamed[input.Name] = true
+			if err := input.Validate(); err != nil {
+				item.Error = err.Error()
+				report.Valid = false
+				continue
+			}
+		}
+		inputs[i] = input
+	}
+
+	if !report.Valid {
+		return report, nil
+	}
+	for _, item := range report.Items {
+		switch item.Action {
+		case ImportActionCreate, ImportActionRename:
+			report.Created++
+		case ImportActionOverwrite:
+			report.Overwrote++
+		case ImportActionSkip:
+			report.Skipped++
+		}
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		txService := &StylePresetService{db: tx}
+		for i := range report.Items {
+			item := &report.Items[i]
+			switch item.Action {
+			case ImportActionCreate, ImportActionRename:
+				preset, err := txService.CreateStylePreset(inputs[i])
+				if err != nil {
+					return fmt.Errorf("failed to import style preset %q: %w", item.Name, err)
+				}
+				item.PresetID = preset.ID
+			case ImportActionOverwrite:
+				if _, err := txService.UpdateStylePreset(item.PresetID, inputs[i]); err != nil {
+					return fmt.Errorf("failed to import style preset %q: %w", item.Name, err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// uniquePresetName 返回 "名称 (2)"、"名称 (3)" 等第一个未被占用的名称
+func uniquePresetName(name string, taken func(string) bool) string {
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)", name, n)
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
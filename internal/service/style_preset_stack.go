@@ -0,0 +1,268 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"novelai-backend/internal/model"
+)
+
+// 叠加画风预设的限制
+const (
+	MaxStackedStylePresets = 8
+	MinStylePresetWeight   = 0.1
+	MaxStylePresetWeight   = 3.0
+)
+
+// promptSentinel 渲染模板时代替 ${prompt} / ${negative}，用于拆分出预设自身的片段
+const promptSentinel = "\x00input\x00"
+
+// StylePresetLayer 叠加中的一层画风预设
+type StylePresetLayer struct {
+	Content *model.StylePresetContent
+	Weight  float64 // 预设文本的权重，1 表示不加权
+}
+
+// ComposeStylePresets 按顺序叠加画风预设
+//
+// 每个预设依次包裹上一步的结果：第二个预设的前缀在第一个预设的前缀之前，后缀在其后。
+// 用户输入保持原样，预设片段中与用户输入或更靠前的预设重复的标签（不区分大小写）被去掉，优先级为用户输入、第一个预设、第二个预设……
+// 标签只在括号和强调语法之外的逗号处拆分，"{a, b}" 这样的分组作为一个标签。
+// 权重不为 1 时，预设自身的片段以 NovelAI 数值强调语法 "w::片段::" 包裹。
+// variables 由所有预设共享，不能包含任何预设都未声明的变量；任一预设的负面提示词模式为 replace 时忽略 negativePrompt。
+func ComposeStylePresets(layers []StylePresetLayer, prompt, negativePrompt string, variables map[string]string) (*StylePresetResult, error) {
+	result := &StylePresetResult{Variables: []TemplateVariable{}}
+	declared := map[string]bool{}
+	for _, layer := range layers {
+		if layer.Content.NegativePromptMode == NegativePromptModeReplace {
+			negativePrompt = ""
+		}
+	}
+
+	compose := func(input string, template func(*model.StylePresetContent) (string, string, string), builtin string) (string, error) {
+		composed := &composedPrompt{core: input}
+		for _, layer := range layers {
+			tmplSrc, prefix, suffix := template(layer.Content)
+			if tmplSrc == "" {
+				composed.wrap(splitTags(prefix), splitTags(suffix), layer.Weight)
+				continue
+			}
+
+			tmpl, err := ParsePromptTemplate(tmplSrc)
+			if err != nil {
+				return "", fmt.Errorf("invalid style preset template: %w", err)
+			}
+			for _, v := range tmpl.Variables() {
+				if !declared[v.Name] {
+					declared[v.Name] = true
+					result.Variables = append(result.Variables, v)
+				}
+			}
+
+			values := make(map[string]string, len(variables)+1)
+			for name, value := range variables {
+				values[name] = value
+			}
+			values[builtin] = promptSentinel
+			rendered, err := tmpl.Render(values)
+			if err != nil {
+				return "", err
+			}
+
+			// ${prompt} 为独立的标签时拆分出前后片段，否则（如 "{${prompt}}"）整体作为新的输入
+			tags := splitTags(rendered)
+			if i := sentinelIndex(tags); i >= 0 {
+				composed.wrap(tags[:i], tags[i+1:], layer.Weight)
+				continue
+			}
+			if layer.Weight != 1 {
+				return "", fmt.Errorf("style preset weight requires ${%s} to be a separate tag in the template", builtin)
+			}
+			composed = &composedPrompt{core: strings.ReplaceAll(rendered, promptSentinel, composed.render())}
+		}
+		return composed.render(), nil
+	}
+
+	var err error
+	result.Prompt, err = compose(prompt, func(c *model.StylePresetContent) (string, string, string) {
+		return c.PromptTemplate, c.PrefixPrompt, c.SuffixPrompt
+	}, TemplateVarPrompt)
+	if err != nil {
+		return nil, err
+	}
+	result.NegativePrompt, err = compose(negativePrompt, func(c *model.StylePresetContent) (string, string, string) {
+		return c.NegativePromptTemplate, c.PrefixNegativePrompt, c.SuffixNegativePrompt
+	}, TemplateVarNegative)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range variables {
+		if !declared[name] {
+			return nil, fmt.Errorf("unknown preset variable: %s", name)
+		}
+	}
+	return result, nil
+}
+
+// MergeStylePresetParameters 合并叠加预设固定的生成参数，后面的预设覆盖前面的；任一预设为 replace 时负面提示词模式为 replace
+func MergeStylePresetParameters(layers []StylePresetLayer) *model.StylePresetContent {
+	merged := &model.StylePresetContent{NegativePromptMode: NegativePromptModeMerge}
+	for _, layer := range layers {
+		c := layer.Content
+		if c.NegativePromptMode == NegativePromptModeReplace {
+			merged.NegativePromptMode = NegativePromptModeReplace
+		}
+		merged.Model = overrideParam(merged.Model, c.Model)
+		merged.Sampler = overrideParam(merged.Sampler, c.Sampler)
+		merged.Scale = overrideParam(merged.Scale, c.Scale)
+		merged.Steps = overrideParam(merged.Steps, c.Steps)
+		merged.Width = overrideParam(merged.Width, c.Width)
+		merged.Height = overrideParam(merged.Height, c.Height)
+		merged.QualityToggle = overrideParam(merged.QualityToggle, c.QualityToggle)
+		merged.UCPreset = overrideParam(merged.UCPreset, c.UCPreset)
+	}
+	return merged
+}
+
+// overrideParam 新值不为 nil 时覆盖旧值
+func overrideParam[T any](current, next *T) *T {
+	if next != nil {
+		return next
+	}
+	return current
+}
+
+// ValidateStylePresetWeight 校验叠加预设的权重
+func ValidateStylePresetWeight(weight float64) error {
+	if weight < MinStylePresetWeight || weight > MaxStylePresetWeight {
+		return fmt.Errorf("style preset weight must be between %g and %g", MinStylePresetWeight, MaxStylePresetWeight)
+	}
+	return nil
+}
+
+// composedPrompt 叠加过程中的提示词：核心输入及由内到外的各层预设片段
+type composedPrompt struct {
+	core   string
+	layers []promptLayer
+}
+
+// promptLayer 一层预设在核心输入前后的片段
+type promptLayer struct {
+	before, after []string
+	weight        float64
+}
+
+// wrap 在当前结果外再包裹一层片段
+func (p *composedPrompt) wrap(before, after []string, weight float64) {
+	p.layers = append(p.layers, promptLayer{before: before, after: after, weight: weight})
+}
+
+// render 去掉预设片段中的重复标签并拼接为最终提示词，核心输入保持原样
+func (p *composedPrompt) render() string {
+	seen := map[string]bool{}
+	for _, tag := range splitTags(p.core) {
+		seen[strings.ToLower(tag)] = true
+	}
+	dedupe := func(tags []string) []string {
+		kept := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			key := strings.ToLower(tag)
+			if !seen[key] {
+				seen[key] = true
+				kept = append(kept, tag)
+			}
+		}
+		return kept
+	}
+
+	befores := make([]string, len(p.layers))
+	afters := make([]string, len(p.layers))
+	for i, layer := range p.layers {
+		befores[i] = weightTags(dedupe(layer.before), layer.weight)
+		afters[i] = weightTags(dedupe(layer.after), layer.weight)
+	}
+
+	parts := make([]string, 0, 2*len(p.layers)+1)
+	for i := len(befores) - 1; i >= 0; i-- {
+		parts = append(parts, befores[i])
+	}
+	parts = append(parts, strings.Trim(p.core, ", \t\r\n"))
+	parts = append(parts, afters...)
+
+	kept := parts[:0]
+	for _, part := range parts {
+		if part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+// weightTags 以逗号连接标签，权重不为 1 时使用 "w::标签::" 包裹
+func weightTags(tags []string, weight float64) string {
+	text := strings.Join(tags, ", ")
+	if text == "" || weight == 1 {
+		return text
+	}
+	return strconv.FormatFloat(weight, 'f', -1, 64) + "::" + text + "::"
+}
+
+// splitTags 按括号和强调语法之外的逗号拆分提示词，去掉首尾空白和空标签
+//
+// "{a, b}"、"[a, b]"、"(a, b)" 和 "1.2::a, b::" 各自作为一个标签。
+func splitTags(prompt string) []string {
+	var tags []string
+	add := func(tag string) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	depth, emphasis, start := 0, 0, 0
+	for i := 0; i < len(prompt); i++ {
+		switch prompt[i] {
+		case '{', '[', '(':
+			depth++
+		case '}', ']', ')':
+			if depth > 0 {
+				depth--
+			}
+		case ':':
+			if i+1 >= len(prompt) || prompt[i+1] != ':' {
+				continue
+			}
+			// 紧跟在数字后的 "::" 开始强调，其余的 "::" 结束强调
+			segment := prompt[start:i]
+			weight := segment[strings.LastIndexAny(segment, "{[(: ")+1:]
+			if _, err := strconv.ParseFloat(weight, 64); err == nil {
+				emphasis++
+			} else if emphasis > 0 {
+				emphasis--
+			}
+			i++
+		case ',':
+			if depth == 0 && emphasis == 0 {
+				add(prompt[start:i])
+				start = i + 1
+			}
+		}
+	}
+	add(prompt[start:])
+	return tags
+}
+
+// sentinelIndex 返回独立出现一次的占位标签位置，不满足时返回 -1
+func sentinelIndex(tags []string) int {
+	index := -1
+	for i, tag := range tags {
+		if strings.Contains(tag, promptSentinel) {
+			if tag != promptSentinel || index >= 0 {
+				return -1
+			}
+			index = i
+		}
+	}
+	return index
+}
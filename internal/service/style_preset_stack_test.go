@@ -0,0 +1,86 @@
+package service
+
+import (
+	"testing"
+
+	"novelai-backend/internal/model"
+)
+
+func TestComposeStylePresets(t *testing.T) {
+	watercolor := &model.StylePresetContent{PrefixPrompt: "watercolor, masterpiece", SuffixNegativePrompt: "lowres"}
+	lighting := &model.StylePresetContent{PromptTemplate: "Masterpiece, ${prompt}, soft lighting, ${mood:calm}", NegativePromptTemplate: "${negative}, lowres, blurry"}
+	emphasis := &model.StylePresetContent{PromptTemplate: "{${prompt}}"}
+
+	tests := []struct {
+		name         string
+		layers       []StylePresetLayer
+		prompt       string
+		wantPrompt   string
+		wantNegative string
+	}{
+		{
+			name:         "single",
+			layers:       []StylePresetLayer{{Content: watercolor, Weight: 1}},
+			prompt:       "1girl",
+			wantPrompt:   "watercolor, masterpiece, 1girl",
+			wantNegative: "bad hands, lowres",
+		},
+		{
+			name:         "stacked with dedupe",
+			layers:       []StylePresetLayer{{Content: watercolor, Weight: 1}, {Content: lighting, Weight: 1}},
+			prompt:       "1girl, watercolor",
+			wantPrompt:   "masterpiece, 1girl, watercolor, soft lighting, calm",
+			wantNegative: "bad hands, lowres, blurry",
+		},
+		{
+			name:         "weighted",
+			layers:       []StylePresetLayer{{Content: lighting, Weight: 1.2}},
+			prompt:       "1girl",
+			wantPrompt:   "1.2::Masterpiece::, 1girl, 1.2::soft lighting, calm::",
+			wantNegative: "bad hands, 1.2::lowres, blurry::",
+		},
+		{
+			name:         "prompt kept as written",
+			layers:       []StylePresetLayer{{Content: watercolor, Weight: 1}},
+			prompt:       "1girl, 1girl,cat ears",
+			wantPrompt:   "watercolor, masterpiece, 1girl, 1girl,cat ears",
+			wantNegative: "bad hands, lowres",
+		},
+		{
+			name:         "bracketed group",
+			layers:       []StylePresetLayer{{Content: &model.StylePresetContent{PrefixPrompt: "{masterpiece, watercolor}, [blue, red], watercolor, Masterpiece", SuffixPrompt: "1.2::soft, lighting::"}, Weight: 1}},
+			prompt:       "{1girl, watercolor}, masterpiece",
+			wantPrompt:   "{masterpiece, watercolor}, [blue, red], watercolor, {1girl, watercolor}, masterpiece, 1.2::soft, lighting::",
+			wantNegative: "bad hands",
+		},
+		{
+			name:         "opaque template",
+			layers:       []StylePresetLayer{{Content: watercolor, Weight: 1}, {Content: emphasis, Weight: 1}},
+			prompt:       "1girl",
+			wantPrompt:   "{watercolor, masterpiece, 1girl}",
+			wantNegative: "bad hands, lowres",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ComposeStylePresets(tt.layers, tt.prompt, "bad hands", nil)
+			if err != nil {
+				t.Fatalf("ComposeStylePresets() error = %v", err)
+			}
+			if result.Prompt != tt.wantPrompt {
+				t.Errorf("prompt = %q, want %q", result.Prompt, tt.wantPrompt)
+			}
+			if result.NegativePrompt != tt.wantNegative {
+				t.Errorf("negative prompt = %q, want %q", result.NegativePrompt, tt.wantNegative)
+			}
+		})
+	}
+
+	if _, err := ComposeStylePresets([]StylePresetLayer{{Content: emphasis, Weight: 2}}, "1girl", "", nil); err == nil {
+		t.Error("expected error for weighted template without separate ${prompt}")
+	}
+	if _, err := ComposeStylePresets([]StylePresetLayer{{Content: watercolor, Weight: 1}}, "1girl", "", map[string]string{"mood": "x"}); err == nil {
+		t.Error("expected error for undeclared variable")
+	}
+}
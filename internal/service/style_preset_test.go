@@ -0,0 +1,41 @@
+package service
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"novelai-backend/internal/database"
+	"novelai-backend/internal/model"
+
+	"gorm.io/gorm/logger"
+)
+
+func TestStylePresetRevisionConflict(t *testing.T) {
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"), logger.Silent)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	svc := NewStylePresetService(db)
+
+	preset, err := svc.CreateStylePreset(&StylePresetInput{Name: "Concurrent", StylePresetContent: model.StylePresetContent{PrefixPrompt: "watercolor"}})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// 模拟并发请求：读取预设后，另一个请求先生成了新版本
+	stale := *preset
+	if _, err := svc.UpdateStylePreset(preset.ID, &StylePresetInput{Name: "Concurrent", StylePresetContent: model.StylePresetContent{PrefixPrompt: "oil painting"}}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	stale.PrefixPrompt = "sketch"
+	if err := createRevision(db, &stale); !errors.Is(err, ErrStylePresetRevisionConflict) {
+		t.Fatalf("stale revision err = %v, want conflict", err)
+	}
+
+	revisions, _ := svc.ListRevisions(preset.ID)
+	current, _ := svc.FindStylePreset(preset.ID)
+	if len(revisions) != 2 || current.Revision != 2 || current.RevisionID == nil || *current.RevisionID != revisions[0].ID {
+		t.Errorf("revisions = %d, current = %+v", len(revisions), current)
+	}
+
+}
@@ -0,0 +1,264 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"novelai-backend/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// API 密钥权限范围
+const (
+	ScopeGenerate = "generate" // 调用生成接口，不受匿名限流和人机验证限制
+	ScopeKeys     = "keys"     // 管理自己的 API 密钥
+)
+
+// AllScopes 全部权限范围
+var AllScopes = []string{ScopeGenerate, ScopeKeys}
+
+// APIKeyPrefix API 密钥的固定前缀
+const APIKeyPrefix = "nai_"
+
+// apiKeyLastUsedInterval 最近使用时间的更新间隔，避免每个请求都写数据库
+const apiKeyLastUsedInterval = time.Minute
+
+// 用户字段长度限制（按字符计）
+const (
+	MaxUserNameLength   = 100
+	MaxAPIKeyNameLength = 100
+)
+
+// 用户和 API 密钥错误
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrUserNameExists = errors.New("user name already exists")
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+)
+
+// UserService 用户和 API 密钥服务
+type UserService struct {
+	db  *gorm.DB
+	now func() time.Time
+}
+
+// NewUserService 创建用户服务
+func NewUserService(db *gorm.DB) *UserService {
+	return &UserService{
+		db:  db,
+		now: time.Now,
+	}
+}
+
+// UserInput 创建用户的参数
+type UserInput struct {
+	Name string
+}
+
+// Validate 校验用户参数
+func (in *UserInput) Validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if utf8.RuneCountInString(in.Name) > MaxUserNameLength {
+		return fmt.Errorf("name must be at most %d characters", MaxUserNameLength)
+	}
+	return nil
+}
+
+// CreateUser 创建用户
+func (s *UserService) CreateUser(input *UserInput) (*model.User, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	user := &model.User{Name: input.Name}
+	if err := s.db.Create(user).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, ErrUserNameExists
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// ListUsers 获取全部用户
+func (s *UserService) ListUsers() ([]model.User, error) {
+	var users []model.User
+	err := s.db.Order("id ASC").Find(&users).Error
+	return users, err
+}
+
+// GetUser 根据ID获取用户
+func (s *UserService) GetUser(id uint) (*model.User, error) {
+	var user model.User
+	if err := s.db.First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// FindUserByName 根据名称获取用户
+func (s *UserService) FindUserByName(name string) (*model.User, error) {
+	var user model.User
+	if err := s.db.Where("name = ?", name).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SetUserDisabled 启用或禁用用户
+func (s *UserService) SetUserDisabled(id uint, disabled bool) (*model.User, error) {
+	user, err := s.GetUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(user).Update("disabled", disabled).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// APIKeyInput 创建 API 密钥的参数
+type APIKeyInput struct {
+	Name      string
+	Scopes    []string
+	ExpiresAt *time.Time // 为空表示不过期
+}
+
+// Validate 校验 API 密钥参数，allowed 为可授予的权限范围
+func (in *APIKeyInput) Validate(allowed []string, now time.Time) error {
+	in.Name = strings.TrimSpace(in.Name)
+	if utf8.RuneCountInString(in.Name) > MaxAPIKeyNameLength {
+		return fmt.Errorf("name must be at most %d characters", MaxAPIKeyNameLength)
+	}
+	if len(in.Scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range in.Scopes {
+		if !slices.Contains(AllScopes, scope) {
+			return fmt.Errorf("unknown scope %q, supported scopes: %s", scope, strings.Join(AllScopes, ", "))
+		}
+		if !slices.Contains(allowed, scope) {
+			return fmt.Errorf("scope %q cannot be granted", scope)
+		}
+	}
+	slices.Sort(in.Scopes)
+	in.Scopes = slices.Compact(in.Scopes)
+	if in.ExpiresAt != nil && !in.ExpiresAt.After(now) {
+		return fmt.Errorf("expires_at must be in the future")
+	}
+	return nil
+}
+
+// CreateAPIKey 为用户创建 API 密钥，返回记录和只出现这一次的明文密钥
+// allowed 为可授予的权限范围，管理员为 AllScopes，用户自助创建时为当前密钥的权限范围
+func (s *UserService) CreateAPIKey(userID uint, input *APIKeyInput, allowed []string) (*model.APIKey, string, error) {
+	if err := input.Validate(allowed, s.now()); err != nil {
+		return nil, "", err
+	}
+	if _, err := s.GetUser(userID); err != nil {
+		return nil, "", err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	plaintext := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	key := &model.APIKey{
+		UserID:    userID,
+		Name:      input.Name,
+		Prefix:    plaintext[:len(APIKeyPrefix)+8],
+		KeyHash:   hashAPIKey(plaintext),
+		Scopes:    input.Scopes,
+		ExpiresAt: input.ExpiresAt,
+	}
+	if err := s.db.Create(key).Error; err != nil {
+		return nil, "", err
+	}
+	return key, plaintext, nil
+}
+
+// ListAPIKeys 获取用户的全部 API 密钥（包括已撤销的）
+func (s *UserService) ListAPIKeys(userID uint) ([]model.APIKey, error) {
+	var keys []model.APIKey
+	err := s.db.Where("user_id = ?", userID).Order("id ASC").Find(&keys).Error
+	return keys, err
+}
+
+// RevokeAPIKey 撤销用户的 API 密钥
+func (s *UserService) RevokeAPIKey(userID, keyID uint) (*model.APIKey, error) {
+	var key model.APIKey
+	if err := s.db.Where("id = ? AND user_id = ?", keyID, userID).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+	if key.RevokedAt == nil {
+		now := s.now()
+		if err := s.db.Model(&key).Update("revoked_at", now).Error; err != nil {
+			return nil, err
+		}
+		key.RevokedAt = &now
+	}
+	return &key, nil
+}
+
+// Authenticate 校验明文密钥，返回预加载了用户的密钥记录，最近使用时间最多每分钟更新一次
+// 密钥不存在、已撤销、已过期或用户被禁用时返回 ErrInvalidAPIKey
+func (s *UserService) Authenticate(plaintext string) (*model.APIKey, error) {
+	if !strings.HasPrefix(plaintext, APIKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	var key model.APIKey
+	err := s.db.Preload("User").Where("key_hash = ?", hashAPIKey(plaintext)).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)) || key.User == nil || key.User.Disabled {
+		return nil, ErrInvalidAPIKey
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyLastUsedInterval {
+		if err := s.db.Model(&key).Update("last_used_at", now).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+// HasScope 判断密钥是否具有指定权限范围
+func HasScope(key *model.APIKey, scope string) bool {
+	return key != nil && slices.Contains(key.Scopes, scope)
+}
+
+// hashAPIKey 计算密钥的 SHA-256，密钥为 256 位随机数，无需慢哈希
+func hashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
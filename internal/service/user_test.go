@@ -0,0 +1,109 @@
+package service
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"novelai-backend/internal/database"
+	"novelai-backend/internal/model"
+
+	"gorm.io/gorm/logger"
+)
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"), logger.Silent)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	svc := NewUserService(db)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	svc.now = func() time.Time { return now }
+
+	user, err := svc.CreateUser(&UserInput{Name: " alice "})
+	if err != nil || user.Name != "alice" {
+		t.Fatalf("create user: %v, %v", user, err)
+	}
+	if _, err := svc.CreateUser(&UserInput{Name: "alice"}); !errors.Is(err, ErrUserNameExists) {
+		t.Errorf("duplicate user err = %v", err)
+	}
+
+	expiresAt := now.Add(time.Hour)
+	key, plaintext, err := svc.CreateAPIKey(user.ID, &APIKeyInput{Scopes: []string{ScopeGenerate, ScopeGenerate}, ExpiresAt: &expiresAt}, AllScopes)
+	if err != nil {
+		t.Fatalf("create key: %v", err)
+	}
+	if len(key.Scopes) != 1 || !strings.HasPrefix(plaintext, key.Prefix) {
+		t.Errorf("key = %+v", key)
+	}
+	var stored model.APIKey
+	db.First(&stored, key.ID)
+	if stored.KeyHash == "" || strings.Contains(stored.KeyHash, plaintext[len(APIKeyPrefix):]) {
+		t.Errorf("key should be stored hashed, got %q", stored.KeyHash)
+	}
+
+	// 权限范围不能超出 allowed
+	if _, _, err := svc.CreateAPIKey(user.ID, &APIKeyInput{Scopes: []string{ScopeKeys}}, []string{ScopeGenerate}); err == nil {
+		t.Errorf("scope outside allowed should be rejected")
+	}
+	if _, _, err := svc.CreateAPIKey(999, &APIKeyInput{Scopes: []string{ScopeGenerate}}, AllScopes); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("missing user err = %v", err)
+	}
+
+	authenticated, err := svc.Authenticate(plaintext)
+	if err != nil || authenticated.User == nil || authenticated.User.ID != user.ID || !HasScope(authenticated, ScopeGenerate) {
+		t.Fatalf("authenticate: %+v, %v", authenticated, err)
+	}
+	db.First(&stored, key.ID)
+	if stored.LastUsedAt == nil || !stored.LastUsedAt.Equal(now) {
+		t.Errorf("last_used_at = %v, want %v", stored.LastUsedAt, now)
+	}
+	// 一分钟内再次使用不更新，超过一分钟后更新
+	usedAt := now
+	now = usedAt.Add(30 * time.Second)
+	svc.Authenticate(plaintext)
+	db.First(&stored, key.ID)
+	if !stored.LastUsedAt.Equal(usedAt) {
+		t.Errorf("last_used_at = %v, want %v", stored.LastUsedAt, usedAt)
+	}
+	now = usedAt.Add(time.Minute)
+	svc.Authenticate(plaintext)
+	db.First(&stored, key.ID)
+	if !stored.LastUsedAt.Equal(now) {
+		t.Errorf("last_used_at = %v, want %v", stored.LastUsedAt, now)
+	}
+	if _, err := svc.Authenticate(plaintext + "x"); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("wrong key err = %v", err)
+	}
+
+	// 过期后失效
+	now = expiresAt
+	if _, err := svc.Authenticate(plaintext); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("expired key err = %v", err)
+	}
+
+	// 撤销和禁用用户后失效
+	_, other, _ := svc.CreateAPIKey(user.ID, &APIKeyInput{Scopes: []string{ScopeGenerate}}, AllScopes)
+	if _, err := svc.SetUserDisabled(user.ID, true); err != nil {
+		t.Fatalf("disable user: %v", err)
+	}
+	if _, err := svc.Authenticate(other); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("disabled user err = %v", err)
+	}
+	svc.SetUserDisabled(user.ID, false)
+	if _, err := svc.Authenticate(other); err != nil {
+		t.Errorf("enabled user err = %v", err)
+	}
+	keys, _ := svc.ListAPIKeys(user.ID)
+	if _, err := svc.RevokeAPIKey(user.ID+1, keys[1].ID); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("revoke other user's key err = %v", err)
+	}
+	if _, err := svc.RevokeAPIKey(user.ID, keys[1].ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := svc.Authenticate(other); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("revoked key err = %v", err)
+	}
+}
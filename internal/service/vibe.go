@@ -0,0 +1,190 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+
+	"novelai-backend/internal/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 风格参考参数
+const (
+	MaxReferences                      = 16
+	DefaultReferenceStrength           = 0.6
+	DefaultReferenceInformationExtract = 1.0
+
+	novelAIEncodeVibePath = "/ai/encode-vibe"
+)
+
+// ReferenceImage 风格参考图像
+type ReferenceImage struct {
+	Image                []byte  `json:"image"`                   // 参考图像（PNG）
+	GenerationID         *uint   `json:"generation_id,omitempty"` // 来自历史生成时的记录 ID
+	Strength             float64 `json:"strength"`
+	InformationExtracted float64 `json:"information_extracted"`
+}
+
+// Hash 返回参考图像的 SHA-256
+func (r *ReferenceImage) Hash() string {
+	sum := sha256.Sum256(r.Image)
+	return hex.EncodeToString(sum[:])
+}
+
+// validateReferences 校验风格参考参数
+func validateReferences(references []ReferenceImage) error {
+	if len(references) > MaxReferences {
+		return fmt.Errorf("too many reference images, maximum %d", MaxReferences)
+	}
+	for i, ref := range references {
+		if len(ref.Image) == 0 {
+			return fmt.Errorf("reference %d image is required", i+1)
+		}
+		if ref.Strength < 0 || ref.Strength > 1 {
+			return fmt.Errorf("reference %d strength must be between 0 and 1", i+1)
+		}
+		if ref.InformationExtracted <= 0 || ref.InformationExtracted > 1 {
+			return fmt.Errorf("reference %d information_extracted must be between 0 and 1", i+1)
+		}
+	}
+	return nil
+}
+
+// applyReferenceParameters 填充风格参考参数：V3 直接发送图像，V4+ 发送 encode-vibe 的编码结果
+func applyReferenceParameters(params *NovelAIParameters, req *GenerationRequest) error {
+	encoded := ModelUsesEncodedVibes(req.Model)
+	if encoded && len(req.encodedReferences) != len(req.References) {
+		return fmt.Errorf("reference images for model %s must be encoded first", req.Model)
+	}
+
+	params.ReferenceImageMultiple = make([]any, 0, len(req.References))
+	params.ReferenceInformationExtractedMultiple = make([]any, 0, len(req.References))
+	params.ReferenceStrengthMultiple = make([]any, 0, len(req.References))
+	for i, ref := range req.References {
+		if encoded {
+			params.ReferenceImageMultiple = append(params.ReferenceImageMultiple, req.encodedReferences[i])
+		} else {
+			params.ReferenceImageMultiple = append(params.ReferenceImageMultiple, base64.StdEncoding.EncodeToString(ref.Image))
+		}
+		params.ReferenceInformationExtractedMultiple = append(params.ReferenceInformationExtractedMultiple, roundInformationExtracted(ref.InformationExtracted))
+		params.ReferenceStrengthMultiple = append(params.ReferenceStrengthMultiple, ref.Strength)
+	}
+	params.NormalizeReferenceStrengthMultiple = encoded
+	return nil
+}
+
+// EncodeVibe 调用 NovelAI encode-vibe 接口，返回编码后的二进制数据
+func (s *NovelAIService) EncodeVibe(image []byte, model string, informationExtracted float64) ([]byte, error) {
+	payload, err := json.Marshal(map[string]any{
+		"image":                 base64.StdEncoding.EncodeToString(image),
+		"information_extracted": informationExtracted,
+		"model":                 model,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", s.baseURL+novelAIEncodeVibePath, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+	}
+
+	return body, nil
+}
+
+// VibeService 风格参考编码服务，编码结果缓存在数据库中以避免重复消耗 Anlas
+type VibeService struct {
+	db             *gorm.DB
+	novelaiService *NovelAIService
+}
+
+// NewVibeService 创建风格参考编码服务实例
+func NewVibeService(db *gorm.DB, novelaiService *NovelAIService) *VibeService {
+	return &VibeService{
+		db:             db,
+		novelaiService: novelaiService,
+	}
+}
+
+// Encode 返回参考图像在指定模型下的编码（base64），优先使用缓存
+func (s *VibeService) Encode(ref *ReferenceImage, modelName string) (string, error) {
+	imageHash := ref.Hash()
+	informationExtracted := roundInformationExtracted(ref.InformationExtracted)
+
+	var cached model.VibeEncoding
+	err := s.db.Where("image_hash = ? AND model = ? AND information_extracted = ?",
+		imageHash, modelName, informationExtracted).First(&cached).Error
+	if err == nil {
+		s.db.Model(&cached).UpdateColumn("hit_count", gorm.Expr("hit_count + 1"))
+		return cached.Encoding, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", fmt.Errorf("failed to query vibe cache: %w", err)
+	}
+
+	data, err := s.novelaiService.EncodeVibe(ref.Image, modelName, informationExtracted)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode vibe: %w", err)
+	}
+
+	encoding := &model.VibeEncoding{
+		ImageHash:            imageHash,
+		Model:                modelName,
+		InformationExtracted: informationExtracted,
+		Encoding:             base64.StdEncoding.EncodeToString(data),
+	}
+	// 并发编码同一图像时保留先写入的结果
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(encoding).Error; err != nil {
+		return "", fmt.Errorf("failed to save vibe cache: %w", err)
+	}
+
+	return encoding.Encoding, nil
+}
+
+// EncodeReferences 为 V4+ 模型的风格参考填充编码结果，V3 模型无需编码
+func (s *VibeService) EncodeReferences(req *GenerationRequest) error {
+	if len(req.References) == 0 || !ModelUsesEncodedVibes(req.Model) {
+		return nil
+	}
+	encodings := make([]string, 0, len(req.References))
+	for i := range req.References {
+		encoding, err := s.Encode(&req.References[i], req.Model)
+		if err != nil {
+			return err
+		}
+		encodings = append(encodings, encoding)
+	}
+	req.encodedReferences = encodings
+	return nil
+}
+
+// roundInformationExtracted 信息提取度保留两位小数，作为缓存键的一部分
+func roundInformationExtracted(value float64) float64 {
+	return math.Round(value*100) / 100
+}
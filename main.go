@@ -1,14 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
 	"novelai-backend/internal/config"
 	"novelai-backend/internal/database"
-	"novelai-backend/internal/handler"
-	"novelai-backend/internal/middleware"
-	"novelai-backend/internal/service"
+	"novelai-backend/internal/server"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -23,62 +22,42 @@ func main() {
 	// 初始化配置
 	cfg := config.New()
 
+	// 命令行子命令，如 export-presets / import-presets / create-api-key
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// 初始化数据库
 	db, err := database.Initialize(cfg.DatabasePath)
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
 
-	// 初始化服务
-	novelaiService := service.NewNovelAIService(cfg.NovelAIAPIKey)
-	imageService := service.NewImageService(db, cfg.ImagesDir)
-	rateLimitService := service.NewRateLimitService(cfg.PrivilegeKey)
-	stylePresetService := service.NewStylePresetService(db)
-
-	// 初始化处理器
-	imageHandler := handler.NewImageHandler(novelaiService, imageService, stylePresetService)
-	stylePresetHandler := handler.NewStylePresetHandler(stylePresetService)
-
 	// 设置 Gin 模式
 	if cfg.Environment == "production" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	// 创建路由
-	r := gin.Default()
-
-	// 添加 CORS 中间件
-	r.Use(func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-
-		c.Next()
-	})
-
-	// API 路由
-	api := r.Group("/api")
-	{
-		// 应用限流中间件到生成图像接口
-		api.POST("/generate",
-			middleware.RateLimitMiddleware(rateLimitService, cfg.TurnstileSecret),
-			imageHandler.GenerateImage)
-
-		// 其他接口不需要严格限流
-		api.GET("/images/:id", imageHandler.GetImage)
-		api.POST("/images/batch", imageHandler.GetImagesByIDs)
+	// 旧的共享特权密钥已被 API 密钥取代
+	if os.Getenv("PRIVILEGE_KEY") != "" {
+		log.Println("Warning: PRIVILEGE_KEY is no longer supported and is ignored; create per-user API keys with `create-api-key` and send them as `Authorization: Bearer <key>`")
+	}
 
-		// 画风预设接口
-		api.GET("/style-presets", stylePresetHandler.GetStylePresets)
+	// 初始化服务和路由
+	srv, err := server.New(cfg, db)
+	if err != nil {
+		log.Fatal("Failed to initialize server:", err)
 	}
 
-	// 静态文件服务
-	r.Static("/files", cfg.ImagesDir)
+	// 启动异步生成任务 worker（恢复未完成的任务）和过期限流记录的清理
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := srv.Start(ctx); err != nil {
+		log.Fatal("Failed to start background services:", err)
+	}
 
 	// 启动服务器
 	port := os.Getenv("PORT")
@@ -87,7 +66,7 @@ func main() {
 	}
 
 	log.Printf("Server starting on port %s", port)
-	if err := r.Run(":" + port); err != nil {
+	if err := srv.Engine.Run(":" + port); err != nil {
 		log.Fatal("Failed to start server:", err)
 	}
 }
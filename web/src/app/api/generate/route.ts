@@ -1,7 +1,13 @@
+import { isIP } from "node:net";
 import { NextRequest, NextResponse } from "next/server";
 
 const BACKEND_URL = process.env.BACKEND_URL || "http://localhost:8080";
 
+// 前端之前的反向代理或平台写入客户端连接地址的请求头，如 X-Real-IP、CF-Connecting-IP。
+// Next.js 路由无法读取 TCP 连接地址，未配置时不转发客户端 IP，后端只能看到前端的地址
+const CLIENT_IP_HEADER = process.env.CLIENT_IP_HEADER || "";
+let clientIPHeaderWarned = false;
+
 export async function POST(request: NextRequest) {
   try {
     const body = await request.json();
@@ -11,10 +17,10 @@ export async function POST(request: NextRequest) {
       "Content-Type": "application/json",
     };
 
-    // 转发特权密钥
-    const privilegeKey = request.headers.get("X-Privilege-Key");
-    if (privilegeKey) {
-      forwardHeaders["X-Privilege-Key"] = privilegeKey;
+    // 转发 API 密钥
+    const authorization = request.headers.get("Authorization");
+    if (authorization) {
+      forwardHeaders["Authorization"] = authorization;
     }
 
     // 转发 Turnstile token
@@ -23,11 +29,14 @@ export async function POST(request: NextRequest) {
       forwardHeaders["X-Turnstile-Token"] = turnstileToken;
     }
 
-    // 转发客户端 IP
-    const clientIP =
-      request.headers.get("X-Forwarded-For") ||
-      request.headers.get("X-Real-IP") ||
-      "127.0.0.1"; // NextRequest 没有 ip 属性，使用默认值
+    // 转发人机验证会话 cookie
+    const cookie = request.headers.get("Cookie");
+    if (cookie) {
+      forwardHeaders["Cookie"] = cookie;
+    }
+
+    // 转发客户端 IP，客户端自行发送的转发头不可信，不转发
+    const clientIP = getClientIP(request);
     if (clientIP) {
       forwardHeaders["X-Forwarded-For"] = clientIP;
     }
@@ -41,11 +50,14 @@ export async function POST(request: NextRequest) {
 
     if (!response.ok) {
       const errorData = await response.json();
-      return NextResponse.json(errorData, { status: response.status });
+      return relayHeaders(
+        response,
+        NextResponse.json(errorData, { status: response.status })
+      );
     }
 
     const result = await response.json();
-    return NextResponse.json(result);
+    return relayHeaders(response, NextResponse.json(result));
   } catch (error) {
     console.error("API proxy error:", error);
     return NextResponse.json(
@@ -54,3 +66,31 @@ export async function POST(request: NextRequest) {
     );
   }
 }
+
+// relayHeaders 将后端设置的 cookie（人机验证会话）和限流响应头（RateLimit-*、Retry-After）转交给浏览器
+function relayHeaders(from: Response, to: NextResponse): NextResponse {
+  for (const cookie of from.headers.getSetCookie()) {
+    to.headers.append("Set-Cookie", cookie);
+  }
+  from.headers.forEach((value, name) => {
+    if (name.startsWith("ratelimit-") || name === "retry-after") {
+      to.headers.set(name, value);
+    }
+  });
+  return to;
+}
+
+// getClientIP 从 CLIENT_IP_HEADER 读取客户端连接地址，未配置或不是合法 IP 时返回 null
+function getClientIP(request: NextRequest): string | null {
+  if (!CLIENT_IP_HEADER) {
+    if (!clientIPHeaderWarned) {
+      clientIPHeaderWarned = true;
+      console.warn(
+        "CLIENT_IP_HEADER is not set; all users of the frontend share one rate limit and captcha identity"
+      );
+    }
+    return null;
+  }
+  const value = request.headers.get(CLIENT_IP_HEADER)?.trim() ?? "";
+  return isIP(value) ? value : null;
+}
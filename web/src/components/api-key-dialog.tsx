@@ -0,0 +1,103 @@
+"use client";
+
+import { useState, useEffect } from "react";
+import { Button } from "@/components/ui/button";
+import { Input } from "@/components/ui/input";
+import { Label } from "@/components/ui/label";
+import {
+  Dialog,
+  DialogContent,
+  DialogDescription,
+  DialogFooter,
+  DialogHeader,
+  DialogTitle,
+} from "@/components/ui/dialog";
+import { KeyRound } from "lucide-react";
+import { toast } from "sonner";
+import { apiClient } from "@/lib/api-client";
+
+interface ApiKeyDialogProps {
+  open: boolean;
+  onOpenChange: (open: boolean) => void;
+  onChange: (hasKey: boolean) => void;
+}
+
+export function ApiKeyDialog({
+  open,
+  onOpenChange,
+  onChange,
+}: ApiKeyDialogProps) {
+  const [key, setKey] = useState("");
+
+  // 当对话框打开时清空输入，已保存的密钥不回显
+  useEffect(() => {
+    if (open) {
+      setKey("");
+    }
+  }, [open]);
+
+  const handleSave = () => {
+    const trimmed = key.trim();
+    if (!trimmed.startsWith("nai_")) {
+      toast.error("API 密钥格式不正确");
+      return;
+    }
+    apiClient.setApiKey(trimmed);
+    onChange(true);
+    toast.success("已设置 API 密钥");
+    onOpenChange(false);
+  };
+
+  const handleClear = () => {
+    apiClient.clearApiKey();
+    onChange(false);
+    toast.success("已清除 API 密钥");
+    onOpenChange(false);
+  };
+
+  return (
+    <Dialog open={open} onOpenChange={onOpenChange}>
+      <DialogContent className="sm:max-w-[425px]">
+        <DialogHeader>
+          <DialogTitle className="flex items-center gap-2">
+            <KeyRound className="w-5 h-5" />
+            API 密钥
+          </DialogTitle>
+          <DialogDescription>
+            携带 API 密钥的请求不受限流和安全验证限制。密钥只保存在当前页面的内存中，刷新或关闭页面后需要重新输入。
+          </DialogDescription>
+        </DialogHeader>
+
+        <div className="grid gap-2 py-4">
+          <Label htmlFor="api-key">密钥</Label>
+          <Input
+            id="api-key"
+            type="password"
+            autoComplete="off"
+            placeholder={
+              apiClient.getApiKey() ? "已设置，输入新密钥以替换" : "nai_..."
+            }
+            value={key}
+            onChange={(e) => setKey(e.target.value)}
+            onKeyDown={(e) => {
+              if (e.key === "Enter") {
+                handleSave();
+              }
+            }}
+          />
+        </div>
+
+        <DialogFooter>
+          {apiClient.getApiKey() && (
+            <Button variant="outline" onClick={handleClear}>
+              清除
+            </Button>
+          )}
+          <Button onClick={handleSave} disabled={!key.trim()}>
+            保存
+          </Button>
+        </DialogFooter>
+      </DialogContent>
+    </Dialog>
+  );
+}
@@ -24,16 +24,19 @@ import {
   Settings,
   Eye,
   EyeOff,
+  KeyRound,
   X,
 } from "lucide-react";
 import { toast } from "sonner";
 import { ImageHistory } from "./image-history";
 import { TurnstileDialog } from "./turnstile-dialog";
+import { ApiKeyDialog } from "./api-key-dialog";
 import {
   apiClient,
   RateLimitError,
   TurnstileRequiredError,
   InvalidTurnstileError,
+  InvalidApiKeyError,
 } from "@/lib/api-client";
 
 // API 响应类型
@@ -105,6 +108,8 @@ export function ImageGenerator() {
   );
   const [showTurnstileDialog, setShowTurnstileDialog] = useState(false);
   const [pendingGeneration, setPendingGeneration] = useState(false);
+  const [showApiKeyDialog, setShowApiKeyDialog] = useState(false);
+  const [hasApiKey, setHasApiKey] = useState(false);
 
   // 画风预设相关状态
   const [stylePresets, setStylePresets] = useState<StylePreset[]>([]);
@@ -304,6 +309,11 @@ export function ImageGenerator() {
         setShowTurnstileDialog(true);
         toast.error("验证已过期，请重新验证");
         return; // 不要在 finally 中重置状态
+      } else if (error instanceof InvalidApiKeyError) {
+        // API 密钥无效、过期或已撤销 - 已清除密钥，提示重新输入
+        setHasApiKey(false);
+        setShowApiKeyDialog(true);
+        toast.error("API 密钥无效，请重新输入");
       } else if (error instanceof RateLimitError) {
         // 限流错误
         if (error.type === "global") {
@@ -425,6 +435,16 @@ export function ImageGenerator() {
         <div className="flex items-center justify-between">
           <h1 className="text-2xl font-bold">图像生成参数</h1>
           <div className="flex items-center gap-2">
+            {/* API 密钥 */}
+            <Button
+              variant="outline"
+              size="sm"
+              onClick={() => setShowApiKeyDialog(true)}
+              className="flex items-center gap-2"
+            >
+              <KeyRound className="w-4 h-4" />
+              {hasApiKey ? "已设置密钥" : "API 密钥"}
+            </Button>
             {/* 高斯模糊开关 */}
             <Button
               variant="outline"
@@ -790,6 +810,13 @@ export function ImageGenerator() {
       {/* History Modal */}
       {showHistory && <ImageHistory onClose={() => setShowHistory(false)} />}
 
+      {/* API Key Dialog */}
+      <ApiKeyDialog
+        open={showApiKeyDialog}
+        onOpenChange={setShowApiKeyDialog}
+        onChange={setHasApiKey}
+      />
+
       {/* Turnstile Dialog */}
       <TurnstileDialog
         open={showTurnstileDialog}
@@ -6,15 +6,37 @@ interface ApiErrorResponse {
 }
 
 interface ApiClientOptions {
-  privilegeKey?: string;
+  apiKey?: string;
   turnstileToken?: string;
 }
 
+// 旧版本保存在 localStorage 中的密钥，启动时删除
+const LEGACY_KEY_STORAGE = ["X-Privilege-Key", "api_key"];
+
 class ApiClient {
   private turnstileToken: string | null = null;
+  // API 密钥只保存在内存中，刷新页面后需要重新输入，避免被页面脚本从浏览器存储中读取
+  private apiKey: string | null = null;
 
   constructor() {
-    // 不再在构造函数中加载密钥，而是在每次请求时动态获取
+    if (typeof window !== "undefined") {
+      LEGACY_KEY_STORAGE.forEach((name) => localStorage.removeItem(name));
+    }
+  }
+
+  // 设置 API 密钥
+  setApiKey(key: string) {
+    this.apiKey = key;
+  }
+
+  // 清除 API 密钥
+  clearApiKey() {
+    this.apiKey = null;
+  }
+
+  // 获取 API 密钥
+  getApiKey() {
+    return this.apiKey;
   }
 
   // 设置 Turnstile token
@@ -38,13 +60,10 @@ class ApiClient {
       "Content-Type": "application/json",
     };
 
-    // 动态从 localStorage 获取特权密钥
-    let privilegeKey = options?.privilegeKey;
-    if (!privilegeKey && typeof window !== "undefined") {
-      privilegeKey = localStorage.getItem("X-Privilege-Key") || undefined;
-    }
-    if (privilegeKey) {
-      headers["X-Privilege-Key"] = privilegeKey;
+    // 添加 API 密钥
+    const apiKey = options?.apiKey || this.apiKey;
+    if (apiKey) {
+      headers["Authorization"] = `Bearer ${apiKey}`;
     }
 
     // 添加 Turnstile token
@@ -61,10 +80,10 @@ class ApiClient {
     url: string,
     options: RequestInit & ApiClientOptions = {}
   ): Promise<T> {
-    const { privilegeKey, turnstileToken, ...fetchOptions } = options;
+    const { apiKey, turnstileToken, ...fetchOptions } = options;
 
     const headers = {
-      ...this.buildHeaders({ privilegeKey, turnstileToken }),
+      ...this.buildHeaders({ apiKey, turnstileToken }),
       ...fetchOptions.headers,
     };
 
@@ -86,9 +105,16 @@ class ApiClient {
         throw new RateLimitError(errorData.error, "global");
       } else if (errorData.code === "IP_RATE_LIMIT") {
         throw new RateLimitError(errorData.error, "ip");
-      } else if (errorData.code === "INVALID_TURNSTILE") {
+      } else if (
+        errorData.code === "INVALID_TURNSTILE" ||
+        errorData.code === "TURNSTILE_REPLAYED"
+      ) {
+        // token 无效或已使用过，需要重新验证
         this.clearTurnstileToken();
         throw new InvalidTurnstileError(errorData.error);
+      } else if (errorData.code === "INVALID_API_KEY") {
+        this.clearApiKey();
+        throw new InvalidApiKeyError(errorData.error);
       }
 
       throw new ApiError(
@@ -178,6 +204,13 @@ class InvalidTurnstileError extends Error {
   }
 }
 
+class InvalidApiKeyError extends Error {
+  constructor(message: string) {
+    super(message);
+    this.name = "InvalidApiKeyError";
+  }
+}
+
 // 导出单例实例
 const apiClient = new ApiClient();
 
@@ -188,5 +221,6 @@ export {
   RateLimitError,
   TurnstileRequiredError,
   InvalidTurnstileError,
+  InvalidApiKeyError,
 };
 export type { ApiClientOptions };